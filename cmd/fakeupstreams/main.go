@@ -0,0 +1,71 @@
+// Command fakeupstreams runs fakes of the book and user services, seeded from a JSON fixture,
+// so that loan-service can be run locally without the real ones:
+//
+//	go run ./cmd/fakeupstreams -fixture configs/fakeupstreams.json
+//
+// The default addresses match book_service_url and user_service_url of configs/config.json
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/fakeupstreams"
+	"golang.org/x/sync/errgroup"
+)
+
+func main() {
+	fixturePath := flag.String("fixture", "configs/fakeupstreams.json", "JSON file with the books and the users")
+	booksAddress := flag.String("books", "localhost:8082", "host:port of the book service")
+	usersAddress := flag.String("users", "localhost:8083", "host:port of the user service")
+	flag.Parse()
+
+	fixture, err := fakeupstreams.LoadFixture(*fixturePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	servers := []*http.Server{
+		{Addr: *booksAddress, Handler: fakeupstreams.NewBookService(fixture), ReadHeaderTimeout: 10 * time.Second},
+		{Addr: *usersAddress, Handler: fakeupstreams.NewUserService(fixture), ReadHeaderTimeout: 10 * time.Second},
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	errs, ctx := errgroup.WithContext(ctx)
+
+	log.Printf(
+		"serving %d books on %s and %d users on %s\n",
+		len(fixture.Books), *booksAddress, len(fixture.Users), *usersAddress,
+	)
+	for _, server := range servers {
+		errs.Go(func() error {
+			if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				return err
+			}
+			return nil
+		})
+	}
+
+	errs.Go(func() error {
+		<-ctx.Done()
+		stop()
+
+		timeoutCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		for _, server := range servers {
+			_ = server.Shutdown(timeoutCtx)
+		}
+		return nil
+	})
+
+	if err := errs.Wait(); err != nil {
+		log.Fatal(err)
+	}
+}
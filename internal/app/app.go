@@ -2,17 +2,21 @@ package app
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
-	"os"
-	"os/signal"
 	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
 	"github.com/mipt-kp-2024-go-beer/loan-service/internal/books"
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/clock"
 	"github.com/mipt-kp-2024-go-beer/loan-service/internal/fail"
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/httpclient"
 	"github.com/mipt-kp-2024-go-beer/loan-service/internal/loans"
 	"github.com/mipt-kp-2024-go-beer/loan-service/internal/loans/repo"
 	"github.com/mipt-kp-2024-go-beer/loan-service/internal/users"
@@ -25,6 +29,11 @@ type App struct {
 	http           *http.Server
 	routerInternal *chi.Mux
 	httpInternal   *http.Server
+	store          loans.Repo
+
+	// The listeners are bound by Listen, or by Start if Listen hasn't been called
+	listener         net.Listener
+	listenerInternal net.Listener
 }
 
 func New(ctx context.Context, config *Config) (*App, error) {
@@ -42,6 +51,7 @@ func New(ctx context.Context, config *Config) (*App, error) {
 
 func makeServer(address string) (*chi.Mux, *http.Server) {
 	router := chi.NewRouter()
+	router.Use(middleware.RequestID, exposeRequestID)
 	server := &http.Server{
 		Addr:              address,
 		Handler:           router,
@@ -54,16 +64,44 @@ func makeServer(address string) (*chi.Mux, *http.Server) {
 	return router, server
 }
 
+// exposeRequestID sends the ID of the request back to the client, to be quoted in bug reports
+func exposeRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(middleware.RequestIDHeader, middleware.GetReqID(r.Context()))
+		next.ServeHTTP(w, r)
+	})
+}
+
 // Setup configures the application
 func (a *App) Setup(ctx context.Context) error {
-	userSvc := users.NewConn(a.config.UserServiceURL)
-	bookSvc := books.NewConn(a.config.BookServiceURL)
+	userSvc := users.NewConn(a.config.UserServiceURL, a.clientOptions(a.config.UserServiceTimeout))
+	if a.config.TokenCacheTTL > 0 {
+		userSvc = users.NewCachedConn(userSvc, users.CacheOptions{
+			TTL:        a.config.TokenCacheTTL,
+			MaxEntries: a.config.TokenCacheSize,
+		}, clock.NewSystem())
+	}
+	bookSvc := books.NewConn(a.config.BookServiceURL, a.clientOptions(a.config.BookServiceTimeout))
+	if a.config.BookCacheTTL > 0 {
+		// The cache follows the real time, even if the service clock travels
+		bookSvc = books.NewCachedConn(bookSvc, books.CacheOptions{
+			TTL:         a.config.BookCacheTTL,
+			NegativeTTL: a.config.BookCacheNegativeTTL,
+			MaxEntries:  a.config.BookCacheSize,
+		}, clock.NewSystem())
+	}
 
 	dsn := a.config.DSN
 	var store loans.Repo
 	switch {
 	case strings.HasPrefix(dsn, "memory://"):
 		store = repo.NewMemoryRepo(dsn)
+	case strings.HasPrefix(dsn, "file://"):
+		var err error
+		store, err = repo.NewFileRepo(dsn)
+		if err != nil {
+			return err
+		}
 	case strings.HasPrefix(dsn, "sqlite://"):
 		var err error
 		store, err = repo.NewSqliteRepo(dsn)
@@ -74,30 +112,107 @@ func (a *App) Setup(ctx context.Context) error {
 		return fail.ErrInvalidDSN
 	}
 
-	service := loans.NewService(store, userSvc, bookSvc, a.config.BookReturnDeadline)
-	handler := loans.NewHandler(a.router, a.routerInternal, service)
+	policy := loans.Policy{
+		ReturnDeadline:   a.config.BookReturnDeadline,
+		MaxRenewals:      a.config.MaxRenewals,
+		HoldPickupWindow: a.config.HoldPickupWindow,
+		Limits: loans.LoanLimits{
+			PerUser:        a.config.MaxLoansPerUser,
+			PerBookPerUser: a.config.MaxLoansPerBookPerUser,
+		},
+		OverdueGracePeriod: a.config.OverdueGracePeriod,
+		Fines: loans.FineRates{
+			PerDay:      a.config.FinePerDay,
+			Cap:         a.config.FineCap,
+			Replacement: a.config.ReplacementFee,
+		},
+		IdempotencyKeyTTL: a.config.IdempotencyKeyTTL,
+	}
+
+	serviceClock := clock.NewSystem()
+	if a.config.TimeTravel {
+		log.Println("time travel is enabled, this must not be a production environment")
+		serviceClock = clock.NewTraveler(serviceClock)
+	}
+
+	a.store = store
+	service := loans.NewService(store, userSvc, bookSvc, policy, serviceClock)
+	handler := loans.NewHandler(a.router, a.routerInternal, service, serviceClock)
 	handler.Register()
 
 	return nil
 }
 
-func (a *App) Start() error {
-	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
-	defer stop()
+// clientOptions returns the options of the clients of the other microservices
+func (a *App) clientOptions(timeout time.Duration) httpclient.Options {
+	return httpclient.Options{
+		Timeout:          timeout,
+		MaxRetries:       a.config.ServiceMaxRetries,
+		RetryBackoff:     a.config.ServiceRetryBackoff,
+		MaxRetryBackoff:  a.config.ServiceMaxRetryBackoff,
+		BreakerThreshold: a.config.CircuitBreakerThreshold,
+		BreakerCooldown:  a.config.CircuitBreakerCooldown,
+	}
+}
+
+// Listen binds the public and the private servers to their addresses, so that the clients
+// may connect before Start is called. A port of 0 in the config picks a free one,
+// see PublicAddr and PrivateAddr
+func (a *App) Listen() error {
+	if a.listener != nil {
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", a.config.PublicURL)
+	if err != nil {
+		return fmt.Errorf("listen error (public api server): %w", err)
+	}
+	listenerInternal, err := net.Listen("tcp", a.config.PrivateURL)
+	if err != nil {
+		listener.Close()
+		return fmt.Errorf("listen error (internal api server): %w", err)
+	}
+
+	a.listener, a.listenerInternal = listener, listenerInternal
+	return nil
+}
+
+// PublicAddr returns the address the public server listens on, or nil before Listen
+func (a *App) PublicAddr() net.Addr {
+	if a.listener == nil {
+		return nil
+	}
+	return a.listener.Addr()
+}
+
+// PrivateAddr returns the address the private server listens on, or nil before Listen
+func (a *App) PrivateAddr() net.Addr {
+	if a.listenerInternal == nil {
+		return nil
+	}
+	return a.listenerInternal.Addr()
+}
+
+// Start serves the public and the private APIs until ctx is done or one of the servers fails,
+// then shuts both down gracefully, letting the requests in progress finish, and closes the storage
+func (a *App) Start(ctx context.Context) error {
+	if err := a.Listen(); err != nil {
+		return err
+	}
 
 	errs, ctx := errgroup.WithContext(ctx)
 
-	log.Printf("starting web servers: public on %s, private on %s\n", a.config.PublicURL, a.config.PrivateURL)
+	log.Printf("starting web servers: public on %s, private on %s\n", a.PublicAddr(), a.PrivateAddr())
 
 	errs.Go(func() error {
-		if err := a.http.ListenAndServe(); err != nil {
+		if err := a.http.Serve(a.listener); !errors.Is(err, http.ErrServerClosed) {
 			return fmt.Errorf("listen and serve error (public api server): %w", err)
 		}
 		return nil
 	})
 
 	errs.Go(func() error {
-		if err := a.httpInternal.ListenAndServe(); err != nil {
+		if err := a.httpInternal.Serve(a.listenerInternal); !errors.Is(err, http.ErrServerClosed) {
 			return fmt.Errorf("listen and serve error (internal api server): %w", err)
 		}
 		return nil
@@ -105,8 +220,6 @@ func (a *App) Start() error {
 
 	<-ctx.Done()
 
-	// Restore default behavior on the interrupt signal and notify user of shutdown.
-	stop()
 	log.Println("shutting down gracefully")
 
 	// Perform application shutdown with a maximum timeout of 5 seconds.
@@ -116,6 +229,16 @@ func (a *App) Start() error {
 	if err := a.http.Shutdown(timeoutCtx); err != nil {
 		log.Println(err.Error())
 	}
+	if err := a.httpInternal.Shutdown(timeoutCtx); err != nil {
+		log.Println(err.Error())
+	}
 
-	return nil
+	err := errs.Wait()
+	if closer, ok := a.store.(io.Closer); ok {
+		if closeErr := closer.Close(); closeErr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to close storage: %w", closeErr))
+		}
+	}
+
+	return err
 }
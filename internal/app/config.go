@@ -16,10 +16,60 @@ type Config struct {
 	BookServiceURL string `json:"book_service_url"`
 	// UserServiceURL is the host:port of the users microservice
 	UserServiceURL string `json:"user_service_url"`
-	// DSN is the database connection string
+	// BookServiceTimeout limits every single call to the book microservice, or 0 for no limit
+	BookServiceTimeout time.Duration `json:"book_service_timeout"`
+	// UserServiceTimeout limits every single call to the users microservice, or 0 for no limit
+	UserServiceTimeout time.Duration `json:"user_service_timeout"`
+	// ServiceMaxRetries is the number of times an idempotent call to the other microservices
+	// is repeated after a network error, a timeout or an "unavailable" response
+	ServiceMaxRetries int `json:"service_max_retries"`
+	// ServiceRetryBackoff is the delay before the first retry, doubled for every next one
+	ServiceRetryBackoff time.Duration `json:"service_retry_backoff"`
+	// ServiceMaxRetryBackoff caps the delay between the retries, or 0 for no cap
+	ServiceMaxRetryBackoff time.Duration `json:"service_max_retry_backoff"`
+	// CircuitBreakerThreshold is the number of failed calls in a row after which the calls
+	// to a microservice fail fast, or 0 to never fail fast
+	CircuitBreakerThreshold int `json:"circuit_breaker_threshold"`
+	// CircuitBreakerCooldown is the time span that the calls fail fast for, before a trial call is made
+	CircuitBreakerCooldown time.Duration `json:"circuit_breaker_cooldown"`
+	// TokenCacheTTL is the time span that the users of the auth tokens verified by the users microservice
+	// are cached for, or 0 to not cache them
+	TokenCacheTTL time.Duration `json:"token_cache_ttl"`
+	// TokenCacheSize is the maximum number of cached tokens, or 0 for no limit
+	TokenCacheSize int `json:"token_cache_size"`
+	// BookCacheTTL is the time span that the books looked up in the book microservice are cached for,
+	// or 0 to not cache them
+	BookCacheTTL time.Duration `json:"book_cache_ttl"`
+	// BookCacheNegativeTTL is the time span that the books missing from the book microservice
+	// are remembered for, or 0 to not remember them
+	BookCacheNegativeTTL time.Duration `json:"book_cache_negative_ttl"`
+	// BookCacheSize is the maximum number of cached books, or 0 for no limit
+	BookCacheSize int `json:"book_cache_size"`
+	// DSN is the database connection string: "memory://", "file://<directory>" or "sqlite://<file>"
 	DSN string `json:"dsn"`
 	// BookReturnDeadline is the time span that a user has to return a book after it has been taken
 	BookReturnDeadline time.Duration `json:"book_return_deadline"`
+	// MaxRenewals is the number of times a single loan's return deadline may be extended
+	MaxRenewals uint `json:"max_renewals"`
+	// HoldPickupWindow is the time span that a returned copy stays reserved for the next user in the queue
+	HoldPickupWindow time.Duration `json:"hold_pickup_window"`
+	// MaxLoansPerUser is the maximum number of unreturned books a user may have, or 0 for no limit
+	MaxLoansPerUser uint `json:"max_loans_per_user"`
+	// MaxLoansPerBookPerUser is the maximum number of unreturned copies of a single book a user may have, or 0 for no limit
+	MaxLoansPerBookPerUser uint `json:"max_loans_per_book_per_user"`
+	// OverdueGracePeriod is the time span after the return deadline before an overdue book blocks further loans
+	OverdueGracePeriod time.Duration `json:"overdue_grace_period"`
+	// FinePerDay is the late fee for each started day past the return deadline, in minor currency units
+	FinePerDay uint64 `json:"fine_per_day"`
+	// FineCap is the maximum late fee for a single loan, in minor currency units, or 0 for no cap
+	FineCap uint64 `json:"fine_cap"`
+	// ReplacementFee is the fee for a lost or damaged book, in minor currency units, or 0 to not charge it
+	ReplacementFee uint64 `json:"replacement_fee"`
+	// IdempotencyKeyTTL is the time span that the response to a request with an "Idempotency-Key"
+	// header is replayed to its retries, or 0 to not replay the responses
+	IdempotencyKeyTTL time.Duration `json:"idempotency_key_ttl"`
+	// TimeTravel lets administrators shift the service clock. Only meant for staging environments
+	TimeTravel bool `json:"time_travel"`
 }
 
 func NewConfig(path string) (*Config, error) {
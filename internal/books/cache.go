@@ -0,0 +1,72 @@
+package books
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/cache"
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/clock"
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/fail"
+)
+
+// Invalidator is implemented by the connections that cache the books
+type Invalidator interface {
+	// InvalidateBook drops the cached book, so that the next lookup asks the book service
+	InvalidateBook(bookID string)
+
+	// InvalidateAll drops all cached books
+	InvalidateAll()
+}
+
+// CacheOptions configures the caching connection
+type CacheOptions struct {
+	// TTL is the time span that a looked up book is cached for
+	TTL time.Duration
+	// NegativeTTL is the time span that a missing book is remembered for, or 0 to not remember
+	NegativeTTL time.Duration
+	// MaxEntries is the maximum number of cached books, or 0 for no limit.
+	// The least recently used ones are dropped first
+	MaxEntries int
+}
+
+// NewCachedConn returns a connection that caches the books looked up through conn.
+// Concurrent lookups of the same book share a single request to the book service
+func NewCachedConn(conn Connection, options CacheOptions, clock clock.Clock) *CachedConn {
+	return &CachedConn{
+		conn: conn,
+		books: cache.NewLoader[Book](cache.LoaderOptions{
+			TTL:      options.TTL,
+			ErrorTTL: options.NegativeTTL,
+			CacheError: func(err error) bool {
+				return errors.Is(err, fail.ErrNotFound)
+			},
+			MaxEntries: options.MaxEntries,
+		}, clock),
+	}
+}
+
+// CachedConn is a caching decorator of Connection
+type CachedConn struct {
+	conn  Connection
+	books *cache.Loader[Book]
+}
+
+func (c *CachedConn) LookupBook(ctx context.Context, bookID string) (*Book, error) {
+	return c.books.Get(ctx, bookID, func(ctx context.Context) (*Book, error) {
+		return c.conn.LookupBook(ctx, bookID)
+	})
+}
+
+func (c *CachedConn) InvalidateBook(bookID string) {
+	c.books.Invalidate(bookID)
+}
+
+func (c *CachedConn) InvalidateAll() {
+	c.books.InvalidateAll()
+}
+
+// Len returns the number of cached entries, including the expired ones not dropped yet
+func (c *CachedConn) Len() int {
+	return c.books.Len()
+}
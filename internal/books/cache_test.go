@@ -0,0 +1,237 @@
+package books_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/books"
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/clock"
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/fail"
+)
+
+// countingConn pretends to be the book service, counting the lookups of every book
+type countingConn struct {
+	mutex   sync.Mutex
+	lookups map[string]int
+	stock   uint
+	// release, if set, holds the lookups until it is closed
+	release chan struct{}
+}
+
+func newCountingConn() *countingConn {
+	return &countingConn{
+		lookups: make(map[string]int),
+		stock:   1,
+	}
+}
+
+func (c *countingConn) LookupBook(ctx context.Context, bookID string) (*books.Book, error) {
+	c.mutex.Lock()
+	c.lookups[bookID] += 1
+	stock, release := c.stock, c.release
+	c.mutex.Unlock()
+
+	if release != nil {
+		<-release
+	}
+
+	switch bookID {
+	case "missing-book":
+		return nil, fmt.Errorf("%w: %w: book %q", fail.ErrBookService, fail.ErrNotFound, bookID)
+	case "broken-book":
+		return nil, fmt.Errorf("%w: 500 Internal Server Error", fail.ErrBookService)
+	}
+	return &books.Book{ID: bookID, Title: "Title of " + bookID, TotalStock: stock}, nil
+}
+
+func (c *countingConn) count(bookID string) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.lookups[bookID]
+}
+
+func lookup(t *testing.T, conn books.Connection, bookID string, wantStock uint) {
+	t.Helper()
+
+	book, err := conn.LookupBook(context.Background(), bookID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := &books.Book{ID: bookID, Title: "Title of " + bookID, TotalStock: wantStock}
+	if diff := cmp.Diff(want, book); diff != "" {
+		t.Errorf("book mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func expectLookups(t *testing.T, conn *countingConn, bookID string, want int) {
+	t.Helper()
+
+	if got := conn.count(bookID); got != want {
+		t.Errorf("wrong number of lookups of %q: want %d, got %d", bookID, want, got)
+	}
+}
+
+func TestCachedConn(t *testing.T) {
+	options := books.CacheOptions{
+		TTL:         time.Minute,
+		NegativeTTL: 10 * time.Second,
+		MaxEntries:  2,
+	}
+
+	t.Run("ttl", func(t *testing.T) {
+		conn := newCountingConn()
+		fakeClock := clock.NewFake(time.Unix(1_000_000, 0))
+		cache := books.NewCachedConn(conn, options, fakeClock)
+
+		lookup(t, cache, "book-1", 1)
+		conn.stock = 2
+		fakeClock.Advance(time.Minute - time.Second)
+		lookup(t, cache, "book-1", 1)
+		expectLookups(t, conn, "book-1", 1)
+
+		fakeClock.Advance(time.Second)
+		lookup(t, cache, "book-1", 2)
+		expectLookups(t, conn, "book-1", 2)
+	})
+
+	t.Run("copies", func(t *testing.T) {
+		conn := newCountingConn()
+		cache := books.NewCachedConn(conn, options, clock.NewFake(time.Unix(1_000_000, 0)))
+
+		book, err := cache.LookupBook(context.Background(), "book-1")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		book.TotalStock = 100
+		lookup(t, cache, "book-1", 1)
+	})
+
+	t.Run("negative", func(t *testing.T) {
+		conn := newCountingConn()
+		fakeClock := clock.NewFake(time.Unix(1_000_000, 0))
+		cache := books.NewCachedConn(conn, options, fakeClock)
+
+		for range 2 {
+			_, err := cache.LookupBook(context.Background(), "missing-book")
+			if !errors.Is(err, fail.ErrNotFound) {
+				t.Errorf("wrong error: want %v, got %v", fail.ErrNotFound, err)
+			}
+			_, err = cache.LookupBook(context.Background(), "broken-book")
+			if !errors.Is(err, fail.ErrBookService) {
+				t.Errorf("wrong error: want %v, got %v", fail.ErrBookService, err)
+			}
+		}
+		expectLookups(t, conn, "missing-book", 1)
+		expectLookups(t, conn, "broken-book", 2)
+
+		fakeClock.Advance(10 * time.Second)
+		_, _ = cache.LookupBook(context.Background(), "missing-book")
+		expectLookups(t, conn, "missing-book", 2)
+	})
+
+	t.Run("size", func(t *testing.T) {
+		conn := newCountingConn()
+		cache := books.NewCachedConn(conn, options, clock.NewFake(time.Unix(1_000_000, 0)))
+
+		lookup(t, cache, "book-1", 1)
+		lookup(t, cache, "book-2", 1)
+		lookup(t, cache, "book-1", 1)
+		// book-2 is the least recently used one
+		lookup(t, cache, "book-3", 1)
+		if cache.Len() != 2 {
+			t.Errorf("wrong cache size: want %d, got %d", 2, cache.Len())
+		}
+
+		lookup(t, cache, "book-1", 1)
+		lookup(t, cache, "book-2", 1)
+		expectLookups(t, conn, "book-1", 1)
+		expectLookups(t, conn, "book-2", 2)
+	})
+
+	t.Run("invalidate", func(t *testing.T) {
+		conn := newCountingConn()
+		cache := books.NewCachedConn(conn, options, clock.NewFake(time.Unix(1_000_000, 0)))
+
+		lookup(t, cache, "book-1", 1)
+		lookup(t, cache, "book-2", 1)
+		conn.stock = 2
+		cache.InvalidateBook("book-1")
+		lookup(t, cache, "book-1", 2)
+		lookup(t, cache, "book-2", 1)
+
+		conn.stock = 3
+		cache.InvalidateAll()
+		lookup(t, cache, "book-1", 3)
+		lookup(t, cache, "book-2", 3)
+	})
+
+	t.Run("coalescing", func(t *testing.T) {
+		conn := newCountingConn()
+		conn.release = make(chan struct{})
+		cache := books.NewCachedConn(conn, options, clock.NewFake(time.Unix(1_000_000, 0)))
+
+		var wg sync.WaitGroup
+		for range 10 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				lookup(t, cache, "book-1", 1)
+			}()
+		}
+		// Let the lookups pile up behind the first one
+		time.Sleep(50 * time.Millisecond)
+		close(conn.release)
+		wg.Wait()
+
+		expectLookups(t, conn, "book-1", 1)
+	})
+
+	t.Run("invalidated while looking up", func(t *testing.T) {
+		conn := newCountingConn()
+		conn.release = make(chan struct{})
+		cache := books.NewCachedConn(conn, options, clock.NewFake(time.Unix(1_000_000, 0)))
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			lookup(t, cache, "book-1", 1)
+		}()
+		for conn.count("book-1") == 0 {
+			time.Sleep(time.Millisecond)
+		}
+
+		cache.InvalidateBook("book-1")
+		conn.mutex.Lock()
+		release := conn.release
+		conn.stock, conn.release = 2, nil
+		conn.mutex.Unlock()
+
+		// The lookup started after the invalidation doesn't wait for the stale one
+		lookup(t, cache, "book-1", 2)
+		close(release)
+		<-done
+
+		lookup(t, cache, "book-1", 2)
+		expectLookups(t, conn, "book-1", 2)
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		conn := newCountingConn()
+		conn.release = make(chan struct{})
+		defer close(conn.release)
+		cache := books.NewCachedConn(conn, options, clock.NewFake(time.Unix(1_000_000, 0)))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		_, err := cache.LookupBook(ctx, "book-1")
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("wrong error: want %v, got %v", context.DeadlineExceeded, err)
+		}
+	})
+}
@@ -8,23 +8,22 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
-	"time"
 
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/clock"
 	"github.com/mipt-kp-2024-go-beer/loan-service/internal/fail"
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/httpclient"
 )
 
-func NewConn(url string) Connection {
+func NewConn(url string, options httpclient.Options) Connection {
 	return &implConn{
-		url: url,
-		client: http.Client{
-			Timeout: 10 * time.Second,
-		},
+		url:    url,
+		client: httpclient.New(fail.ErrBookService, options, clock.NewSystem()),
 	}
 }
 
 type implConn struct {
 	url    string
-	client http.Client
+	client *httpclient.Client
 }
 
 func (c *implConn) LookupBook(ctx context.Context, ID string) (*Book, error) {
@@ -44,11 +43,14 @@ func (c *implConn) LookupBook(ctx context.Context, ID string) (*Book, error) {
 	}
 	defer response.Body.Close()
 
+	if response.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%w: %w: book %q", fail.ErrBookService, fail.ErrNotFound, ID)
+	}
 	if response.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(response.Body)
 		return nil, fmt.Errorf(
 			"%w: %d %s %q",
-			fail.ErrBookService,
+			fail.UpstreamStatusError(fail.ErrBookService, response.StatusCode),
 			response.StatusCode,
 			response.Status,
 			string(body),
@@ -64,7 +66,7 @@ func (c *implConn) LookupBook(ctx context.Context, ID string) (*Book, error) {
 	}
 	err = json.NewDecoder(response.Body).Decode(&result)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: failed to parse book: %w", fail.ErrBookService, err)
 	}
 
 	stock, err := strconv.ParseUint(result.Stock, 10, 64)
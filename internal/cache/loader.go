@@ -0,0 +1,139 @@
+package cache
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/clock"
+	"golang.org/x/sync/singleflight"
+)
+
+// LoaderOptions configures the loader
+type LoaderOptions struct {
+	// TTL is the time span that a loaded value is cached for, or 0 to not cache the values
+	TTL time.Duration
+	// ErrorTTL is the time span that an error accepted by CacheError is cached for,
+	// or 0 to not cache the errors
+	ErrorTTL time.Duration
+	// CacheError tells if the error is final and worth caching, like "not found",
+	// as opposed to a failure that is likely gone on the next attempt. Nil caches no errors
+	CacheError func(err error) bool
+	// MaxEntries is the maximum number of cached keys, or 0 for no limit.
+	// The least recently used ones are dropped first
+	MaxEntries int
+}
+
+// NewLoader returns an empty loader
+func NewLoader[T any](options LoaderOptions, clock clock.Clock) *Loader[T] {
+	return &Loader[T]{
+		options: options,
+		entries: NewLRU[string, loaded[T]](options.MaxEntries, clock),
+	}
+}
+
+// Loader caches the values loaded by a slow call, like a request to another service.
+// Concurrent loads of the same key share a single call. The callers get shallow copies
+// of the values, so that they can't modify the cached ones
+type Loader[T any] struct {
+	options LoaderOptions
+	group   singleflight.Group
+	entries *LRU[string, loaded[T]]
+
+	// mutex guards the generation, which changes on every invalidation,
+	// so that loads started before it don't put stale values into the cache
+	mutex      sync.Mutex
+	generation uint64
+}
+
+// loaded is a cached outcome of a load: either a value or an error
+type loaded[T any] struct {
+	value *T
+	err   error
+}
+
+// Get returns the cached value of the key, or loads it with load
+func (l *Loader[T]) Get(ctx context.Context, key string, load func(ctx context.Context) (*T, error)) (*T, error) {
+	if entry, ok := l.entries.Get(key); ok {
+		if entry.err != nil {
+			return nil, entry.err
+		}
+		return clone(entry.value), nil
+	}
+
+	l.mutex.Lock()
+	generation := l.generation
+	l.mutex.Unlock()
+
+	// The shared load isn't cancelled along with the request that has started it,
+	// since others may be waiting for it, so load has to time out on its own.
+	// Loads started after an invalidation don't join the ones started before it
+	result := l.group.DoChan(strconv.FormatUint(generation, 10)+":"+key, func() (any, error) {
+		value, err := load(context.WithoutCancel(ctx))
+		l.put(key, value, err, generation)
+		return value, err
+	})
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case shared := <-result:
+		if shared.Err != nil {
+			return nil, shared.Err
+		}
+		return clone(shared.Val.(*T)), nil
+	}
+}
+
+// Invalidate drops the cached value of the key, so that the next Get loads it again
+func (l *Loader[T]) Invalidate(key string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.entries.Remove(key)
+	l.generation += 1
+}
+
+// InvalidateAll drops all cached values
+func (l *Loader[T]) InvalidateAll() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.entries.Clear()
+	l.generation += 1
+}
+
+// Len returns the number of cached keys, including the expired ones not dropped yet
+func (l *Loader[T]) Len() int {
+	return l.entries.Len()
+}
+
+// put caches the outcome of the load started at the given generation
+func (l *Loader[T]) put(key string, value *T, err error, generation uint64) {
+	ttl := l.options.TTL
+	if err != nil {
+		if l.options.CacheError == nil || !l.options.CacheError(err) {
+			return
+		}
+		ttl = l.options.ErrorTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.generation == generation {
+		l.entries.Put(key, loaded[T]{value: clone(value), err: err}, ttl)
+	}
+}
+
+func clone[T any](value *T) *T {
+	if value == nil {
+		return nil
+	}
+	result := *value
+	return &result
+}
@@ -0,0 +1,206 @@
+package cache_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/cache"
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/clock"
+)
+
+var errFinal = errors.New("final error")
+
+// counter loads its current value, counting the loads
+type counter struct {
+	mutex sync.Mutex
+	value int
+	err   error
+	loads int
+	// release, if set, holds the loads until it is closed
+	release chan struct{}
+}
+
+func (c *counter) load(ctx context.Context) (*int, error) {
+	c.mutex.Lock()
+	c.loads += 1
+	value, err, release := c.value, c.err, c.release
+	c.mutex.Unlock()
+
+	if release != nil {
+		<-release
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &value, nil
+}
+
+func (c *counter) loadCount() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.loads
+}
+
+func (c *counter) set(value int, err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.value, c.err = value, err
+}
+
+func expectLoaded(t *testing.T, loader *cache.Loader[int], c *counter, want int, wantErr error) {
+	t.Helper()
+
+	value, err := loader.Get(context.Background(), "key", c.load)
+	if !errors.Is(err, wantErr) {
+		t.Fatalf("wrong error: want %v, got %v", wantErr, err)
+	}
+	if err == nil && *value != want {
+		t.Errorf("wrong value: want %d, got %d", want, *value)
+	}
+}
+
+func expectLoads(t *testing.T, c *counter, want int) {
+	t.Helper()
+
+	if got := c.loadCount(); got != want {
+		t.Errorf("wrong number of loads: want %d, got %d", want, got)
+	}
+}
+
+func TestLoader(t *testing.T) {
+	options := cache.LoaderOptions{
+		TTL:        time.Minute,
+		ErrorTTL:   time.Second,
+		CacheError: func(err error) bool { return errors.Is(err, errFinal) },
+	}
+
+	t.Run("ttl", func(t *testing.T) {
+		fakeClock := clock.NewFake(time.Unix(1_000_000, 0))
+		loader := cache.NewLoader[int](options, fakeClock)
+		c := &counter{value: 1}
+
+		expectLoaded(t, loader, c, 1, nil)
+		c.set(2, nil)
+		expectLoaded(t, loader, c, 1, nil)
+		fakeClock.Advance(time.Minute)
+		expectLoaded(t, loader, c, 2, nil)
+		expectLoads(t, c, 2)
+	})
+
+	t.Run("copies", func(t *testing.T) {
+		loader := cache.NewLoader[int](options, clock.NewFake(time.Unix(1_000_000, 0)))
+		c := &counter{value: 1}
+
+		value, err := loader.Get(context.Background(), "key", c.load)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		*value = 100
+		expectLoaded(t, loader, c, 1, nil)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		fakeClock := clock.NewFake(time.Unix(1_000_000, 0))
+		loader := cache.NewLoader[int](options, fakeClock)
+		c := &counter{err: errors.New("transient error")}
+
+		// Only the errors accepted by CacheError are cached, for ErrorTTL
+		expectLoaded(t, loader, c, 0, c.err)
+		c.set(0, errFinal)
+		expectLoaded(t, loader, c, 0, errFinal)
+		c.set(1, nil)
+		expectLoaded(t, loader, c, 0, errFinal)
+		expectLoads(t, c, 2)
+
+		fakeClock.Advance(time.Second)
+		expectLoaded(t, loader, c, 1, nil)
+	})
+
+	t.Run("invalidate", func(t *testing.T) {
+		loader := cache.NewLoader[int](options, clock.NewFake(time.Unix(1_000_000, 0)))
+		c := &counter{value: 1}
+
+		expectLoaded(t, loader, c, 1, nil)
+		c.set(2, nil)
+		loader.Invalidate("key")
+		expectLoaded(t, loader, c, 2, nil)
+		c.set(3, nil)
+		loader.InvalidateAll()
+		expectLoaded(t, loader, c, 3, nil)
+		expectLoads(t, c, 3)
+	})
+
+	t.Run("coalescing", func(t *testing.T) {
+		loader := cache.NewLoader[int](options, clock.NewFake(time.Unix(1_000_000, 0)))
+		c := &counter{value: 1, release: make(chan struct{})}
+
+		var wg sync.WaitGroup
+		for range 10 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				value, err := loader.Get(context.Background(), "key", c.load)
+				if err != nil || *value != 1 {
+					t.Errorf("wrong load: want 1, got %v, %v", value, err)
+				}
+			}()
+		}
+		// Let the loads pile up behind the first one
+		time.Sleep(50 * time.Millisecond)
+		close(c.release)
+		wg.Wait()
+
+		expectLoads(t, c, 1)
+	})
+
+	t.Run("invalidated while loading", func(t *testing.T) {
+		loader := cache.NewLoader[int](options, clock.NewFake(time.Unix(1_000_000, 0)))
+		c := &counter{value: 1, release: make(chan struct{})}
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			expectLoaded(t, loader, c, 1, nil)
+		}()
+		for c.loadCount() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+
+		loader.Invalidate("key")
+		c.mutex.Lock()
+		release := c.release
+		c.value, c.release = 2, nil
+		c.mutex.Unlock()
+
+		// The load started after the invalidation doesn't wait for the stale one,
+		// which doesn't overwrite it once finished
+		expectLoaded(t, loader, c, 2, nil)
+		close(release)
+		<-done
+
+		expectLoaded(t, loader, c, 2, nil)
+		expectLoads(t, c, 2)
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		loader := cache.NewLoader[int](options, clock.NewFake(time.Unix(1_000_000, 0)))
+		c := &counter{value: 1, release: make(chan struct{})}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		_, err := loader.Get(ctx, "key", c.load)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("wrong error: want %v, got %v", context.DeadlineExceeded, err)
+		}
+
+		// The load goes on for the others
+		close(c.release)
+		expectLoaded(t, loader, c, 1, nil)
+		expectLoads(t, c, 1)
+	})
+}
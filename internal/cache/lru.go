@@ -0,0 +1,115 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/clock"
+)
+
+// LRU is a size-bounded map with expiring entries, which drops the least recently used entries
+// once it is full. It is safe for concurrent use
+type LRU[K comparable, V any] struct {
+	clock      clock.Clock
+	maxEntries int
+
+	mutex   sync.Mutex
+	entries map[K]*list.Element
+	// order holds the entries, the most recently used first
+	order *list.List
+}
+
+type lruEntry[K comparable, V any] struct {
+	key       K
+	value     V
+	expiresAt time.Time
+}
+
+// NewLRU returns an empty cache of at most maxEntries entries, or unbounded if maxEntries is 0
+func NewLRU[K comparable, V any](maxEntries int, clock clock.Clock) *LRU[K, V] {
+	return &LRU[K, V]{
+		clock:      clock,
+		maxEntries: maxEntries,
+		entries:    make(map[K]*list.Element),
+		order:      list.New(),
+	}
+}
+
+// Get returns the value of the key, unless it is missing or expired
+func (c *LRU[K, V]) Get(key K) (V, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+
+	entry := element.Value.(*lruEntry[K, V])
+	if !c.clock.Now().Before(entry.expiresAt) {
+		c.order.Remove(element)
+		delete(c.entries, key)
+		var zero V
+		return zero, false
+	}
+
+	c.order.MoveToFront(element)
+	return entry.value, true
+}
+
+// Put sets the value of the key for the given time span
+func (c *LRU[K, V]) Put(key K, value V, ttl time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry := &lruEntry[K, V]{
+		key:       key,
+		value:     value,
+		expiresAt: c.clock.Now().Add(ttl),
+	}
+	if element, ok := c.entries[key]; ok {
+		element.Value = entry
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.order.PushFront(entry)
+
+	if c.maxEntries > 0 && c.order.Len() > c.maxEntries {
+		c.remove(c.order.Back())
+	}
+}
+
+// Remove drops the key, if it is there
+func (c *LRU[K, V]) Remove(key K) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+}
+
+// Clear drops all entries
+func (c *LRU[K, V]) Clear() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	clear(c.entries)
+	c.order.Init()
+}
+
+// Len returns the number of entries, including the expired ones not dropped yet
+func (c *LRU[K, V]) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.order.Len()
+}
+
+func (c *LRU[K, V]) remove(element *list.Element) {
+	entry := element.Value.(*lruEntry[K, V])
+	c.order.Remove(element)
+	delete(c.entries, entry.key)
+}
@@ -0,0 +1,72 @@
+package cache_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/cache"
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/clock"
+)
+
+func expectEntry(t *testing.T, lru *cache.LRU[string, int], key string, want int, wantOK bool) {
+	t.Helper()
+
+	value, ok := lru.Get(key)
+	if ok != wantOK || value != want {
+		t.Errorf("wrong entry %q: want (%d, %t), got (%d, %t)", key, want, wantOK, value, ok)
+	}
+}
+
+func TestLRU(t *testing.T) {
+	t.Run("expiry", func(t *testing.T) {
+		fakeClock := clock.NewFake(time.Unix(1_000_000, 0))
+		lru := cache.NewLRU[string, int](0, fakeClock)
+
+		lru.Put("a", 1, time.Minute)
+		lru.Put("b", 2, time.Hour)
+		fakeClock.Advance(time.Minute - time.Second)
+		expectEntry(t, lru, "a", 1, true)
+
+		fakeClock.Advance(time.Second)
+		expectEntry(t, lru, "a", 0, false)
+		expectEntry(t, lru, "b", 2, true)
+		if lru.Len() != 1 {
+			t.Errorf("wrong length: want %d, got %d", 1, lru.Len())
+		}
+	})
+
+	t.Run("size", func(t *testing.T) {
+		lru := cache.NewLRU[string, int](2, clock.NewFake(time.Unix(1_000_000, 0)))
+
+		lru.Put("a", 1, time.Minute)
+		lru.Put("b", 2, time.Minute)
+		expectEntry(t, lru, "a", 1, true)
+		lru.Put("c", 3, time.Minute)
+
+		expectEntry(t, lru, "a", 1, true)
+		expectEntry(t, lru, "b", 0, false)
+		expectEntry(t, lru, "c", 3, true)
+
+		// Overwriting doesn't take more room
+		lru.Put("c", 4, time.Minute)
+		expectEntry(t, lru, "a", 1, true)
+		expectEntry(t, lru, "c", 4, true)
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		lru := cache.NewLRU[string, int](0, clock.NewFake(time.Unix(1_000_000, 0)))
+
+		lru.Put("a", 1, time.Minute)
+		lru.Put("b", 2, time.Minute)
+		lru.Remove("a")
+		lru.Remove("c")
+		expectEntry(t, lru, "a", 0, false)
+		expectEntry(t, lru, "b", 2, true)
+
+		lru.Clear()
+		expectEntry(t, lru, "b", 0, false)
+		if lru.Len() != 0 {
+			t.Errorf("wrong length: want %d, got %d", 0, lru.Len())
+		}
+	})
+}
@@ -0,0 +1,100 @@
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the current time
+type Clock interface {
+	Now() time.Time
+}
+
+// NewSystem returns the clock that follows the system time
+func NewSystem() Clock {
+	return systemClock{}
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// Traveler is a clock that can be moved away from the clock it is based on
+type Traveler interface {
+	Clock
+
+	// Offset returns how far the clock is ahead of its base (negative if behind)
+	Offset() time.Duration
+
+	// SetOffset moves the clock to be the given duration ahead of its base
+	SetOffset(offset time.Duration)
+}
+
+// NewTraveler returns a clock that runs along with base, shifted by an adjustable offset
+func NewTraveler(base Clock) Traveler {
+	return &travelerClock{
+		base: base,
+	}
+}
+
+type travelerClock struct {
+	base   Clock
+	mutex  sync.RWMutex
+	offset time.Duration
+}
+
+func (c *travelerClock) Now() time.Time {
+	return c.base.Now().Add(c.Offset())
+}
+
+func (c *travelerClock) Offset() time.Duration {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.offset
+}
+
+func (c *travelerClock) SetOffset(offset time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.offset = offset
+}
+
+// Fake is a clock that only moves when told to, for tests
+type Fake struct {
+	mutex sync.RWMutex
+	now   time.Time
+}
+
+// NewFake returns a fake clock stopped at the given time
+func NewFake(now time.Time) *Fake {
+	return &Fake{
+		now: now,
+	}
+}
+
+func (f *Fake) Now() time.Time {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	return f.now
+}
+
+// Set moves the clock to the given time
+func (f *Fake) Set(now time.Time) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.now = now
+}
+
+// Advance moves the clock forward by the given duration
+func (f *Fake) Advance(d time.Duration) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.now = f.now.Add(d)
+}
@@ -2,44 +2,93 @@ package fail
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
 )
 
 var (
-	ErrNotFound         = new("object not found")
-	ErrCollision        = new("object already exists")
-	ErrForbidden        = new("insufficient permissions")
-	ErrNoStock          = new("insufficient stock")
-	ErrMissingParams    = new("missing required parameters")
-	ErrInvalidDSN       = new("unrecognized data source name")
-	ErrMalformedStorage = new("malformed storage")
-	ErrUserService      = new("user service error")
-	ErrBookService      = new("book service error")
+	ErrNotFound            = new("object not found")
+	ErrCollision           = new("object already exists")
+	ErrForbidden           = new("insufficient permissions")
+	ErrNoStock             = new("insufficient stock")
+	ErrMissingParams       = new("missing required parameters")
+	ErrInvalidDSN          = new("unrecognized data source name")
+	ErrMalformedStorage    = new("malformed storage")
+	ErrUserService         = new("user service error")
+	ErrBookService         = new("book service error")
+	ErrUnavailable         = new("service unavailable")
+	ErrRenewalLimit        = new("renewal limit reached")
+	ErrLimitExceeded       = new("loan limit exceeded")
+	ErrHasOverdue          = new("user has overdue books")
+	ErrUnauthorized        = new("missing or malformed credentials")
+	ErrIdempotencyMismatch = new("idempotency key reused with different parameters")
 )
 
 func new(desc string) error {
 	return errors.New(desc)
 }
 
+// kind describes how errors wrapping a sentinel are reported
+type kind struct {
+	sentinel error
+	status   int
+	code     string
+}
+
+// kinds lists the sentinels in the order of precedence, should an error wrap several of them.
+// The codes are part of the API and must not change
+var kinds = []kind{
+	{ErrUnavailable, http.StatusServiceUnavailable, "unavailable"},
+	{ErrUserService, http.StatusBadGateway, "user_service"},
+	{ErrBookService, http.StatusBadGateway, "book_service"},
+	{ErrNotFound, http.StatusNotFound, "not_found"},
+	{ErrCollision, http.StatusConflict, "collision"},
+	{ErrForbidden, http.StatusForbidden, "forbidden"},
+	{ErrNoStock, http.StatusNotFound, "no_stock"},
+	{ErrMissingParams, http.StatusBadRequest, "missing_params"},
+	{ErrRenewalLimit, http.StatusConflict, "renewal_limit"},
+	{ErrLimitExceeded, http.StatusConflict, "limit_exceeded"},
+	{ErrHasOverdue, http.StatusForbidden, "has_overdue"},
+	{ErrUnauthorized, http.StatusUnauthorized, "unauthorized"},
+	{ErrIdempotencyMismatch, http.StatusUnprocessableEntity, "idempotency_mismatch"},
+	{ErrInvalidDSN, http.StatusInternalServerError, "invalid_dsn"},
+	{ErrMalformedStorage, http.StatusInternalServerError, "malformed_storage"},
+}
+
+// internalKind is the kind of errors not wrapping any sentinel
+var internalKind = kind{
+	sentinel: errors.New("internal error"),
+	status:   http.StatusInternalServerError,
+	code:     "internal",
+}
+
+func kindOf(err error) kind {
+	for _, k := range kinds {
+		if errors.Is(err, k.sentinel) {
+			return k
+		}
+	}
+	return internalKind
+}
+
 // HTTPErrorCode returns the HTTP error code for the given error.
 func HTTPErrorCode(err error) int {
-	switch {
-	case errors.Is(err, ErrNotFound):
-		return http.StatusNotFound
-	case errors.Is(err, ErrCollision):
-		return http.StatusConflict
-	case errors.Is(err, ErrForbidden):
-		return http.StatusForbidden
-	case errors.Is(err, ErrNoStock):
-		return http.StatusNotFound
-	case errors.Is(err, ErrMissingParams):
-		return http.StatusBadRequest
-	default:
-		return http.StatusInternalServerError
-	}
+	return kindOf(err).status
 }
 
-// WriteError writes the right error code and the error message to the given writer.
-func WriteError(w http.ResponseWriter, err error) {
-	http.Error(w, err.Error(), HTTPErrorCode(err))
+// ErrorCode returns the machine-readable code of the given error, stable across messages.
+func ErrorCode(err error) string {
+	return kindOf(err).code
+}
+
+// UpstreamStatusError returns the error to wrap when another service (named by sentinel)
+// responds with the given status code: the service is unavailable if it says so or times out,
+// and is at fault otherwise
+func UpstreamStatusError(sentinel error, status int) error {
+	switch status {
+	case http.StatusServiceUnavailable, http.StatusGatewayTimeout, http.StatusTooManyRequests:
+		return fmt.Errorf("%w: %w", sentinel, ErrUnavailable)
+	default:
+		return sentinel
+	}
 }
@@ -0,0 +1,87 @@
+package fail
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// Problem is the body of error responses, following RFC 7807 (problem details for HTTP APIs)
+type Problem struct {
+	// Type identifies the kind of the problem, one per error code
+	Type string `json:"type"`
+	// Title is the summary of the kind of the problem, the same for all problems of a type
+	Title string `json:"title"`
+	// Status is the HTTP status code of the response
+	Status int `json:"status"`
+	// Detail explains this occurrence of the problem, if there is more to say than the title
+	Detail string `json:"detail,omitempty"`
+	// Code is the machine-readable error code, see ErrorCode
+	Code string `json:"code"`
+	// RequestID identifies the request in the logs of the service
+	RequestID string `json:"request_id,omitempty"`
+	// Details are extra data specific to the type, see WithDetails
+	Details any `json:"details,omitempty"`
+}
+
+// problemTypePrefix prefixes the error code in the problem type URI
+const problemTypePrefix = "urn:loan-service:problem:"
+
+// detailedError attaches structured details to an error
+type detailedError struct {
+	err     error
+	details any
+}
+
+func (e *detailedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *detailedError) Unwrap() error {
+	return e.err
+}
+
+// WithDetails returns the error with the given details attached, to be reported in Problem.Details.
+// The details must be marshallable to JSON
+func WithDetails(err error, details any) error {
+	return &detailedError{err: err, details: details}
+}
+
+// NewProblem describes the error occurred while handling the request.
+// The messages of internal errors are only logged, as they may reveal the inner workings
+func NewProblem(r *http.Request, err error) Problem {
+	k := kindOf(err)
+	problem := Problem{
+		Type:      problemTypePrefix + k.code,
+		Title:     k.sentinel.Error(),
+		Status:    k.status,
+		Code:      k.code,
+		RequestID: middleware.GetReqID(r.Context()),
+	}
+
+	if k == internalKind {
+		log.Printf("request %q failed: %v", problem.RequestID, err)
+	} else if message := err.Error(); message != problem.Title {
+		problem.Detail = message
+	}
+
+	var detailed *detailedError
+	if errors.As(err, &detailed) {
+		problem.Details = detailed.details
+	}
+
+	return problem
+}
+
+// WriteError writes the right error code and the problem description to the given writer.
+func WriteError(w http.ResponseWriter, r *http.Request, err error) {
+	problem := NewProblem(r, err)
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(problem.Status)
+	_ = json.NewEncoder(w).Encode(problem)
+}
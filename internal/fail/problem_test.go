@@ -0,0 +1,114 @@
+package fail_test
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/google/go-cmp/cmp"
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/fail"
+)
+
+func TestHTTPErrorCode(t *testing.T) {
+	cases := []struct {
+		err  error
+		code int
+	}{
+		{fmt.Errorf("%w: loan-1", fail.ErrNotFound), http.StatusNotFound},
+		{fmt.Errorf("%w: 404 Not Found", fail.ErrBookService), http.StatusBadGateway},
+		{fmt.Errorf("%w: 500", fail.UpstreamStatusError(fail.ErrUserService, http.StatusInternalServerError)), http.StatusBadGateway},
+		{fmt.Errorf("%w: 503", fail.UpstreamStatusError(fail.ErrUserService, http.StatusServiceUnavailable)), http.StatusServiceUnavailable},
+		{fmt.Errorf("%w: %w: connection refused", fail.ErrBookService, fail.ErrUnavailable), http.StatusServiceUnavailable},
+		{fail.WithDetails(fail.ErrHasOverdue, nil), http.StatusForbidden},
+		{errors.New("disk on fire"), http.StatusInternalServerError},
+	}
+	for _, c := range cases {
+		if code := fail.HTTPErrorCode(c.err); code != c.code {
+			t.Errorf("wrong code of %q: want %d, got %d", c.err, c.code, code)
+		}
+	}
+}
+
+func TestNewProblem(t *testing.T) {
+	request := func(t *testing.T) *http.Request {
+		t.Helper()
+
+		var result *http.Request
+		r := httptest.NewRequest("GET", "/api/v1/loans/loan-1", nil)
+		r.Header.Set(middleware.RequestIDHeader, "request-1")
+		middleware.RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			result = r
+		})).ServeHTTP(httptest.NewRecorder(), r)
+
+		return result
+	}
+
+	cases := []struct {
+		name string
+		err  error
+		want fail.Problem
+	}{
+		{
+			name: "sentinel",
+			err:  fail.ErrNotFound,
+			want: fail.Problem{
+				Type:      "urn:loan-service:problem:not_found",
+				Title:     "object not found",
+				Status:    http.StatusNotFound,
+				Code:      "not_found",
+				RequestID: "request-1",
+			},
+		},
+		{
+			name: "detailed",
+			err:  fail.WithDetails(fmt.Errorf("%w: 2 overdue", fail.ErrHasOverdue), map[string]int{"overdue": 2}),
+			want: fail.Problem{
+				Type:      "urn:loan-service:problem:has_overdue",
+				Title:     "user has overdue books",
+				Status:    http.StatusForbidden,
+				Detail:    "user has overdue books: 2 overdue",
+				Code:      "has_overdue",
+				RequestID: "request-1",
+				Details:   map[string]int{"overdue": 2},
+			},
+		},
+		{
+			name: "internal",
+			err:  errors.New("database is locked"),
+			want: fail.Problem{
+				Type:      "urn:loan-service:problem:internal",
+				Title:     "internal error",
+				Status:    http.StatusInternalServerError,
+				Code:      "internal",
+				RequestID: "request-1",
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if diff := cmp.Diff(c.want, fail.NewProblem(request(t), c.err)); diff != "" {
+				t.Errorf("problem mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	rr := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/api/v1/book/book-1/take", nil)
+	fail.WriteError(rr, r, fmt.Errorf("%w: 2 overdue", fail.ErrHasOverdue))
+
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("unexpected status code: want %d, got %d", http.StatusForbidden, rr.Code)
+	}
+	if got := rr.Header().Get("Content-Type"); got != "application/problem+json" {
+		t.Errorf("unexpected content type: want %q, got %q", "application/problem+json", got)
+	}
+	want := `{"type":"urn:loan-service:problem:has_overdue","title":"user has overdue books","status":403,"detail":"user has overdue books: 2 overdue","code":"has_overdue"}` + "\n"
+	if diff := cmp.Diff(want, rr.Body.String()); diff != "" {
+		t.Errorf("response body mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,45 @@
+package fakeupstreams
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// NewBookService returns a fake of the book service, serving the books of the fixture
+// the way books.NewConn expects
+func NewBookService(fixture *Fixture) http.Handler {
+	books := make(map[string]FixtureBook, len(fixture.Books))
+	for _, book := range fixture.Books {
+		books[book.ID] = book
+	}
+
+	router := chi.NewRouter()
+	router.Get("/api/v1/books/{bookID}", func(w http.ResponseWriter, r *http.Request) {
+		book, ok := books[chi.URLParam(r, "bookID")]
+		if !ok {
+			http.Error(w, "book not found", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(struct {
+			ID          string `json:"id"`
+			Title       string `json:"title"`
+			Author      string `json:"author"`
+			Description string `json:"description"`
+			// The real service gives the stock as a string
+			Stock string `json:"stock"`
+		}{
+			ID:          book.ID,
+			Title:       book.Title,
+			Author:      book.Author,
+			Description: book.Description,
+			Stock:       strconv.FormatUint(uint64(book.Stock), 10),
+		})
+	})
+
+	return router
+}
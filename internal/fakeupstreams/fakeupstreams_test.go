@@ -0,0 +1,79 @@
+package fakeupstreams_test
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/books"
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/fail"
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/fakeupstreams"
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/httpclient"
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/users"
+)
+
+// The fakes are checked against the real connections, which are what they have to satisfy
+
+func TestFixture(t *testing.T) {
+	fixture, err := fakeupstreams.LoadFixture("../../configs/fakeupstreams.json")
+	if err != nil {
+		t.Fatalf("failed to load fixture: %v", err)
+	}
+	if len(fixture.Books) == 0 || len(fixture.Users) == 0 {
+		t.Errorf("empty fixture: %d books, %d users", len(fixture.Books), len(fixture.Users))
+	}
+}
+
+func TestBookService(t *testing.T) {
+	fixture := &fakeupstreams.Fixture{
+		Books: []fakeupstreams.FixtureBook{
+			{ID: "book-1", Title: "Title", Author: "Author", Description: "Description", Stock: 3},
+		},
+	}
+	server := httptest.NewServer(fakeupstreams.NewBookService(fixture))
+	defer server.Close()
+	conn := books.NewConn(strings.TrimPrefix(server.URL, "http://"), httpclient.Options{Timeout: 10 * time.Second})
+
+	book, err := conn.LookupBook(context.Background(), "book-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := &books.Book{ID: "book-1", Title: "Title", Author: "Author", Description: "Description", TotalStock: 3}
+	if diff := cmp.Diff(want, book); diff != "" {
+		t.Errorf("book mismatch (-want +got):\n%s", diff)
+	}
+
+	_, err = conn.LookupBook(context.Background(), "book-2")
+	if !errors.Is(err, fail.ErrNotFound) {
+		t.Errorf("wrong error: want %v, got %v", fail.ErrNotFound, err)
+	}
+}
+
+func TestUserService(t *testing.T) {
+	fixture := &fakeupstreams.Fixture{
+		Users: []fakeupstreams.FixtureUser{
+			{Token: "token-1", ID: "user-1", Permissions: uint64(users.PermLoanBooks | users.PermQueryUsers)},
+		},
+	}
+	server := httptest.NewServer(fakeupstreams.NewUserService(fixture))
+	defer server.Close()
+	conn := users.NewConn(strings.TrimPrefix(server.URL, "http://"), httpclient.Options{Timeout: 10 * time.Second})
+
+	user, err := conn.VerifyToken(context.Background(), "token-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := &users.User{ID: "user-1", Permissions: users.PermLoanBooks | users.PermQueryUsers}
+	if diff := cmp.Diff(want, user); diff != "" {
+		t.Errorf("user mismatch (-want +got):\n%s", diff)
+	}
+
+	_, err = conn.VerifyToken(context.Background(), "token-2")
+	if !errors.Is(err, fail.ErrUnauthorized) {
+		t.Errorf("wrong error: want %v, got %v", fail.ErrUnauthorized, err)
+	}
+}
@@ -0,0 +1,45 @@
+package fakeupstreams
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Fixture is the data the fake services are seeded with
+type Fixture struct {
+	Books []FixtureBook `json:"books"`
+	Users []FixtureUser `json:"users"`
+}
+
+// FixtureBook is a book known to the fake book service
+type FixtureBook struct {
+	ID          string `json:"id"`
+	Title       string `json:"title"`
+	Author      string `json:"author"`
+	Description string `json:"description"`
+	Stock       uint   `json:"stock"`
+}
+
+// FixtureUser is a user known to the fake user service, logged in with the token
+type FixtureUser struct {
+	Token string `json:"token"`
+	ID    string `json:"id"`
+	// Permissions is the bitmask of users.Permission
+	Permissions uint64 `json:"permissions"`
+}
+
+// LoadFixture reads the fixture from the JSON file
+func LoadFixture(path string) (*Fixture, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Fixture{}
+	err = json.Unmarshal(data, result)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse fixture %q: %w", path, err)
+	}
+	return result, nil
+}
@@ -0,0 +1,60 @@
+package fakeupstreams
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// NewUserService returns a fake of the user service, verifying the tokens of the fixture users
+// the way users.NewConn expects
+func NewUserService(fixture *Fixture) http.Handler {
+	users := make(map[string]FixtureUser, len(fixture.Users))
+	for _, user := range fixture.Users {
+		users[user.Token] = user
+	}
+
+	// withUser passes the user of the token in the request body to the handler
+	withUser := func(handler func(w http.ResponseWriter, user FixtureUser)) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			var request struct {
+				Token string `json:"token"`
+			}
+			err := json.NewDecoder(r.Body).Decode(&request)
+			if err != nil {
+				http.Error(w, "malformed request", http.StatusBadRequest)
+				return
+			}
+
+			user, ok := users[request.Token]
+			if !ok {
+				http.Error(w, "invalid token", http.StatusUnauthorized)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			handler(w, user)
+		}
+	}
+
+	router := chi.NewRouter()
+	router.Post("/user/id", withUser(func(w http.ResponseWriter, user FixtureUser) {
+		_ = json.NewEncoder(w).Encode(struct {
+			ID string `json:"ID"`
+		}{
+			ID: user.ID,
+		})
+	}))
+	router.Post("/user/permissions", withUser(func(w http.ResponseWriter, user FixtureUser) {
+		_ = json.NewEncoder(w).Encode(struct {
+			// The typo and the string are those of the real service
+			Permissions string `json:"permissios"`
+		}{
+			Permissions: strconv.FormatUint(user.Permissions, 10),
+		})
+	}))
+
+	return router
+}
@@ -0,0 +1,72 @@
+package httpclient
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/clock"
+)
+
+// breaker is a circuit breaker: after threshold failed calls in a row it opens, failing
+// the calls fast for the cooldown. Then it lets a single trial call through (half-open),
+// which either closes it again or opens it for another cooldown
+type breaker struct {
+	clock     clock.Clock
+	threshold int
+	cooldown  time.Duration
+
+	mutex    sync.Mutex
+	failures int
+	// openUntil is when the open breaker lets the trial call through
+	openUntil time.Time
+	// trial is true while the trial call is being made
+	trial bool
+}
+
+// allow tells if a call may be made now
+func (b *breaker) allow() bool {
+	if b.threshold <= 0 {
+		return true
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.failures < b.threshold {
+		return true
+	}
+	if b.trial || b.clock.Now().Before(b.openUntil) {
+		return false
+	}
+	b.trial = true
+	return true
+}
+
+// record counts the outcome of an allowed call
+func (b *breaker) record(success bool) {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.trial = false
+	if success {
+		b.failures = 0
+		return
+	}
+
+	b.failures += 1
+	if b.failures >= b.threshold {
+		b.openUntil = b.clock.Now().Add(b.cooldown)
+	}
+}
+
+// forget drops an allowed call that has told nothing about the service
+func (b *breaker) forget() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.trial = false
+}
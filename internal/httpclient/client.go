@@ -0,0 +1,191 @@
+package httpclient
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"time"
+
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/clock"
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/fail"
+)
+
+// Options configures the client
+type Options struct {
+	// Timeout limits every single attempt of a call, or 0 for no limit
+	Timeout time.Duration
+	// MaxRetries is the number of times an idempotent call is repeated after a failed attempt
+	MaxRetries int
+	// RetryBackoff is the delay before the first retry, doubled for every next one
+	RetryBackoff time.Duration
+	// MaxRetryBackoff caps the delay between the retries, or 0 for no cap
+	MaxRetryBackoff time.Duration
+	// BreakerThreshold is the number of failed attempts in a row after which the calls fail fast,
+	// or 0 to never fail fast. Network errors, timeouts, 5xx and 429 responses count as failed
+	BreakerThreshold int
+	// BreakerCooldown is the time span that the calls fail fast for, after which a single trial
+	// call is let through. Its success lets all calls through again
+	BreakerCooldown time.Duration
+}
+
+// New returns a client with the given options. The errors it reports wrap sentinel,
+// which tells what service has failed (e.g. fail.ErrBookService)
+func New(sentinel error, options Options, clock clock.Clock) *Client {
+	return &Client{
+		sentinel: sentinel,
+		options:  options,
+		client:   http.Client{},
+		breaker:  breaker{clock: clock, threshold: options.BreakerThreshold, cooldown: options.BreakerCooldown},
+	}
+}
+
+// Client is an HTTP client for the other services, which retries the failed idempotent calls
+// and stops calling a failing service for a while, so that the callers don't wait for it in vain
+type Client struct {
+	sentinel error
+	options  Options
+	client   http.Client
+	breaker  breaker
+}
+
+// Do sends the request, retrying it if its method is idempotent (see DoIdempotent).
+// Error responses are returned as is, after the retries if they are worth retrying
+func (c *Client) Do(request *http.Request) (*http.Response, error) {
+	return c.do(request, isIdempotent(request.Method))
+}
+
+// DoIdempotent sends the request, retrying it on network errors, timeouts and responses
+// saying that the service is unavailable. It is for the requests the caller knows to be
+// safe to repeat regardless of their method, like the POSTs that only query data
+func (c *Client) DoIdempotent(request *http.Request) (*http.Response, error) {
+	return c.do(request, true)
+}
+
+func (c *Client) do(request *http.Request, retry bool) (*http.Response, error) {
+	ctx := request.Context()
+	if request.Body != nil && request.GetBody == nil {
+		// The body can't be sent twice
+		retry = false
+	}
+
+	for attempt := 0; ; attempt += 1 {
+		if !c.breaker.allow() {
+			return nil, fmt.Errorf("%w: %w: too many failures, not calling for a while", c.sentinel, fail.ErrUnavailable)
+		}
+
+		response, err := c.attempt(request, attempt)
+		if ctx.Err() != nil {
+			// The caller has given up, which says nothing about the service
+			c.breaker.forget()
+		} else {
+			c.breaker.record(err == nil && !isFailing(response.StatusCode))
+		}
+
+		failed := err != nil || isUnavailable(response.StatusCode)
+		if !failed || !retry || attempt >= c.options.MaxRetries || ctx.Err() != nil {
+			if err != nil {
+				return nil, fmt.Errorf("%w: %w: %w", c.sentinel, fail.ErrUnavailable, err)
+			}
+			return response, nil
+		}
+
+		if response != nil {
+			_, _ = io.Copy(io.Discard, response.Body)
+			response.Body.Close()
+		}
+
+		timer := time.NewTimer(c.backoff(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, fmt.Errorf("%w: %w: %w", c.sentinel, fail.ErrUnavailable, ctx.Err())
+		case <-timer.C:
+		}
+	}
+}
+
+// attempt sends the request once, within the per-attempt timeout
+func (c *Client) attempt(request *http.Request, attempt int) (*http.Response, error) {
+	ctx, cancel := request.Context(), context.CancelFunc(func() {})
+	if c.options.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, c.options.Timeout)
+	}
+
+	request = request.Clone(ctx)
+	if attempt > 0 && request.GetBody != nil {
+		body, err := request.GetBody()
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		request.Body = body
+	}
+
+	response, err := c.client.Do(request)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	// The timeout covers reading the body as well
+	response.Body = &cancelOnClose{ReadCloser: response.Body, cancel: cancel}
+	return response, nil
+}
+
+// backoff returns the delay before the retry after the given attempt, with jitter,
+// so that the clients don't retry in lockstep
+func (c *Client) backoff(attempt int) time.Duration {
+	backoff := c.options.RetryBackoff
+	for range attempt {
+		if c.options.MaxRetryBackoff > 0 && backoff >= c.options.MaxRetryBackoff {
+			break
+		}
+		backoff *= 2
+	}
+	if c.options.MaxRetryBackoff > 0 {
+		backoff = min(backoff, c.options.MaxRetryBackoff)
+	}
+	if backoff <= 0 {
+		return 0
+	}
+	return backoff/2 + rand.N(backoff/2+1)
+}
+
+// isIdempotent tells if the requests with the method may be repeated safely (RFC 9110)
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// isFailing tells if the response status counts as a failure of the service for the breaker:
+// any server error, or being told to back off
+func isFailing(status int) bool {
+	return status >= http.StatusInternalServerError || status == http.StatusTooManyRequests
+}
+
+// isUnavailable tells if the response status means that the service is temporarily unavailable
+// or overloaded, so that the request is worth retrying
+func isUnavailable(status int) bool {
+	switch status {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout, http.StatusTooManyRequests:
+		return true
+	}
+	return false
+}
+
+// cancelOnClose releases the context of the request when the response body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
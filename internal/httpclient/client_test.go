@@ -0,0 +1,266 @@
+package httpclient_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/clock"
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/fail"
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/httpclient"
+)
+
+// flakyServer fails the given number of calls with the given status, then succeeds
+type flakyServer struct {
+	*httptest.Server
+
+	mutex    sync.Mutex
+	failures int
+	status   int
+	delay    time.Duration
+	calls    int
+	bodies   []string
+}
+
+func newFlakyServer(t *testing.T, failures int, status int) *flakyServer {
+	t.Helper()
+
+	s := &flakyServer{failures: failures, status: status}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		s.mutex.Lock()
+		s.calls += 1
+		s.bodies = append(s.bodies, string(body))
+		fails := s.calls <= s.failures
+		status, delay := s.status, s.delay
+		s.mutex.Unlock()
+
+		if fails && delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+			}
+			return
+		}
+		if fails {
+			w.WriteHeader(status)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+func (s *flakyServer) callCount() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.calls
+}
+
+func newRequest(t *testing.T, method string, url string, body string) *http.Request {
+	t.Helper()
+
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	request, err := http.NewRequestWithContext(context.Background(), method, url, reader)
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	return request
+}
+
+func expectStatus(t *testing.T, response *http.Response, err error, want int) {
+	t.Helper()
+
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != want {
+		t.Errorf("unexpected status code: want %d, got %d", want, response.StatusCode)
+	}
+}
+
+func expectCalls(t *testing.T, server *flakyServer, want int) {
+	t.Helper()
+
+	if got := server.callCount(); got != want {
+		t.Errorf("wrong number of calls: want %d, got %d", want, got)
+	}
+}
+
+func TestClient(t *testing.T) {
+	options := httpclient.Options{
+		Timeout:         time.Second,
+		MaxRetries:      2,
+		RetryBackoff:    time.Millisecond,
+		MaxRetryBackoff: 5 * time.Millisecond,
+	}
+	newClient := func(options httpclient.Options) *httpclient.Client {
+		return httpclient.New(fail.ErrBookService, options, clock.NewFake(time.Unix(1_000_000, 0)))
+	}
+
+	t.Run("retry", func(t *testing.T) {
+		server := newFlakyServer(t, 2, http.StatusServiceUnavailable)
+		response, err := newClient(options).Do(newRequest(t, "GET", server.URL, ""))
+
+		expectStatus(t, response, err, http.StatusOK)
+		expectCalls(t, server, 3)
+	})
+
+	t.Run("retries exhausted", func(t *testing.T) {
+		server := newFlakyServer(t, 3, http.StatusBadGateway)
+		response, err := newClient(options).Do(newRequest(t, "GET", server.URL, ""))
+
+		expectStatus(t, response, err, http.StatusBadGateway)
+		expectCalls(t, server, 3)
+	})
+
+	t.Run("not worth retrying", func(t *testing.T) {
+		server := newFlakyServer(t, 1, http.StatusNotFound)
+		response, err := newClient(options).Do(newRequest(t, "GET", server.URL, ""))
+
+		expectStatus(t, response, err, http.StatusNotFound)
+		expectCalls(t, server, 1)
+	})
+
+	t.Run("server error", func(t *testing.T) {
+		server := newFlakyServer(t, 1, http.StatusInternalServerError)
+		response, err := newClient(options).Do(newRequest(t, "GET", server.URL, ""))
+
+		expectStatus(t, response, err, http.StatusInternalServerError)
+		expectCalls(t, server, 1)
+	})
+
+	t.Run("not idempotent", func(t *testing.T) {
+		server := newFlakyServer(t, 1, http.StatusServiceUnavailable)
+		response, err := newClient(options).Do(newRequest(t, "POST", server.URL, "body"))
+
+		expectStatus(t, response, err, http.StatusServiceUnavailable)
+		expectCalls(t, server, 1)
+	})
+
+	t.Run("idempotent body", func(t *testing.T) {
+		server := newFlakyServer(t, 1, http.StatusServiceUnavailable)
+		response, err := newClient(options).DoIdempotent(newRequest(t, "POST", server.URL, "body"))
+
+		expectStatus(t, response, err, http.StatusOK)
+		expectCalls(t, server, 2)
+		for i, body := range server.bodies {
+			if body != "body" {
+				t.Errorf("wrong body of call %d: %q", i, body)
+			}
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		server := newFlakyServer(t, 1, 0)
+		server.delay = time.Second
+		timeoutOptions := options
+		timeoutOptions.Timeout = 20 * time.Millisecond
+		response, err := newClient(timeoutOptions).Do(newRequest(t, "GET", server.URL, ""))
+
+		expectStatus(t, response, err, http.StatusOK)
+		expectCalls(t, server, 2)
+	})
+
+	t.Run("network error", func(t *testing.T) {
+		server := newFlakyServer(t, 0, 0)
+		server.Close()
+		_, err := newClient(options).Do(newRequest(t, "GET", server.URL, ""))
+
+		if !errors.Is(err, fail.ErrBookService) || !errors.Is(err, fail.ErrUnavailable) {
+			t.Errorf("wrong error: want %v and %v, got %v", fail.ErrBookService, fail.ErrUnavailable, err)
+		}
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		server := newFlakyServer(t, 10, http.StatusServiceUnavailable)
+		backoffOptions := options
+		backoffOptions.RetryBackoff, backoffOptions.MaxRetryBackoff = time.Hour, time.Hour
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		_, err := newClient(backoffOptions).Do(newRequest(t, "GET", server.URL, "").WithContext(ctx))
+
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("wrong error: want %v, got %v", context.DeadlineExceeded, err)
+		}
+		expectCalls(t, server, 1)
+	})
+}
+
+func TestClientBreaker(t *testing.T) {
+	options := httpclient.Options{
+		Timeout:          time.Second,
+		BreakerThreshold: 3,
+		BreakerCooldown:  10 * time.Second,
+	}
+	fakeClock := clock.NewFake(time.Unix(1_000_000, 0))
+	client := httpclient.New(fail.ErrUserService, options, fakeClock)
+	server := newFlakyServer(t, 4, http.StatusServiceUnavailable)
+
+	for range 3 {
+		response, err := client.Do(newRequest(t, "GET", server.URL, ""))
+		expectStatus(t, response, err, http.StatusServiceUnavailable)
+	}
+
+	// The breaker is open, the service isn't called
+	_, err := client.Do(newRequest(t, "GET", server.URL, ""))
+	if !errors.Is(err, fail.ErrUserService) || !errors.Is(err, fail.ErrUnavailable) {
+		t.Errorf("wrong error: want %v and %v, got %v", fail.ErrUserService, fail.ErrUnavailable, err)
+	}
+	expectCalls(t, server, 3)
+
+	// The failed trial call opens it for another cooldown
+	fakeClock.Advance(10 * time.Second)
+	response, err := client.Do(newRequest(t, "GET", server.URL, ""))
+	expectStatus(t, response, err, http.StatusServiceUnavailable)
+	_, err = client.Do(newRequest(t, "GET", server.URL, ""))
+	if !errors.Is(err, fail.ErrUnavailable) {
+		t.Errorf("wrong error: want %v, got %v", fail.ErrUnavailable, err)
+	}
+	expectCalls(t, server, 4)
+
+	// The successful one closes it
+	fakeClock.Advance(10 * time.Second)
+	for range 2 {
+		response, err = client.Do(newRequest(t, "GET", server.URL, ""))
+		expectStatus(t, response, err, http.StatusOK)
+	}
+	expectCalls(t, server, 6)
+}
+
+func TestClientBreakerServerErrors(t *testing.T) {
+	options := httpclient.Options{
+		Timeout:          time.Second,
+		MaxRetries:       2,
+		BreakerThreshold: 3,
+		BreakerCooldown:  10 * time.Second,
+	}
+	client := httpclient.New(fail.ErrBookService, options, clock.NewFake(time.Unix(1_000_000, 0)))
+	server := newFlakyServer(t, 1000, http.StatusInternalServerError)
+
+	// Server errors aren't retried, but they do count against the service
+	for range 3 {
+		response, err := client.Do(newRequest(t, "GET", server.URL, ""))
+		expectStatus(t, response, err, http.StatusInternalServerError)
+	}
+
+	_, err := client.Do(newRequest(t, "GET", server.URL, ""))
+	if !errors.Is(err, fail.ErrBookService) || !errors.Is(err, fail.ErrUnavailable) {
+		t.Errorf("wrong error: want %v and %v, got %v", fail.ErrBookService, fail.ErrUnavailable, err)
+	}
+	expectCalls(t, server, 3)
+}
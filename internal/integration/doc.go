@@ -0,0 +1,3 @@
+// Package integration holds the end-to-end tests of the service, which boot the whole App
+// from the shipped config against the fakes of the other microservices and drive it over HTTP
+package integration
@@ -0,0 +1,401 @@
+package integration_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/app"
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/fakeupstreams"
+)
+
+const (
+	// The books and the users of configs/fakeupstreams.json
+	bookPlenty     = "6c4e2a4e-0b7a-4d55-9a3b-3f1f6f3c1a01"
+	bookOutOfStock = "d3f7c9e1-8a2b-4f6d-b1e4-5c8a9d0e3f03"
+	readerID       = "0f8e7d6c-5b4a-4392-8170-6e5d4c3b2a11"
+	librarianID    = "1a2b3c4d-5e6f-4708-9a1b-2c3d4e5f6a12"
+)
+
+// backends are the storages the App is run on, each returning a new DSN on every call
+var backends = []struct {
+	name   string
+	newDSN func(t *testing.T) string
+}{
+	{name: "memory", newDSN: func(t *testing.T) string { return "memory://" }},
+	{name: "sqlite", newDSN: func(t *testing.T) string { return "sqlite://" + filepath.Join(t.TempDir(), "loans.sqlite") }},
+	{name: "file", newDSN: func(t *testing.T) string { return "file://" + t.TempDir() }},
+}
+
+// upstreams are the fakes of the book and the user services
+type upstreams struct {
+	books *httptest.Server
+	users *httptest.Server
+
+	// The user service holds the requests while hold is set, until it is closed
+	mutex   sync.Mutex
+	hold    chan struct{}
+	arrived chan struct{}
+}
+
+func newUpstreams(t *testing.T) *upstreams {
+	t.Helper()
+
+	fixture, err := fakeupstreams.LoadFixture("../../configs/fakeupstreams.json")
+	if err != nil {
+		t.Fatalf("failed to load fixture: %v", err)
+	}
+
+	u := &upstreams{}
+	userService := fakeupstreams.NewUserService(fixture)
+	u.books = httptest.NewServer(fakeupstreams.NewBookService(fixture))
+	u.users = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u.mutex.Lock()
+		hold, arrived := u.hold, u.arrived
+		u.hold, u.arrived = nil, nil
+		u.mutex.Unlock()
+
+		if hold != nil {
+			close(arrived)
+			<-hold
+		}
+		userService.ServeHTTP(w, r)
+	}))
+	t.Cleanup(u.books.Close)
+	t.Cleanup(u.users.Close)
+
+	return u
+}
+
+// holdNext makes the user service hold the next request until release is closed,
+// and returns the channel closed when the request arrives
+func (u *upstreams) holdNext(release chan struct{}) <-chan struct{} {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	u.hold, u.arrived = release, make(chan struct{})
+	return u.arrived
+}
+
+// runningApp is the App started on ephemeral ports
+type runningApp struct {
+	public  string
+	private string
+	cancel  context.CancelFunc
+	done    chan error
+}
+
+func startApp(t *testing.T, upstreams *upstreams, dsn string) *runningApp {
+	t.Helper()
+
+	config, err := app.NewConfig("../../configs/config.json")
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+	config.PublicURL = "127.0.0.1:0"
+	config.PrivateURL = "127.0.0.1:0"
+	config.BookServiceURL = strings.TrimPrefix(upstreams.books.URL, "http://")
+	config.UserServiceURL = strings.TrimPrefix(upstreams.users.URL, "http://")
+	config.DSN = dsn
+
+	ctx, cancel := context.WithCancel(context.Background())
+	application, err := app.New(ctx, config)
+	if err != nil {
+		t.Fatalf("failed to create app: %v", err)
+	}
+	if err = application.Setup(ctx); err != nil {
+		t.Fatalf("failed to set up app: %v", err)
+	}
+	if err = application.Listen(); err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	a := &runningApp{
+		public:  "http://" + application.PublicAddr().String(),
+		private: "http://" + application.PrivateAddr().String(),
+		cancel:  cancel,
+		done:    make(chan error, 1),
+	}
+	go func() {
+		a.done <- application.Start(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-a.done
+	})
+
+	return a
+}
+
+// stop shuts the App down and waits for Start to return
+func (a *runningApp) stop(t *testing.T) {
+	t.Helper()
+
+	a.cancel()
+	select {
+	case err := <-a.done:
+		if err != nil {
+			t.Errorf("app failed: %v", err)
+		}
+		// For the cleanup
+		a.done <- nil
+	case <-time.After(10 * time.Second):
+		t.Fatalf("app hasn't shut down")
+	}
+}
+
+// call makes a request, with a form body for the v1 POSTs and a JSON body for the v2 ones,
+// and decodes the JSON response into result unless it is nil
+func call(t *testing.T, method string, address string, token string, body any, result any) int {
+	t.Helper()
+
+	var reader *bytes.Reader
+	contentType := ""
+	switch body := body.(type) {
+	case nil:
+		reader = bytes.NewReader(nil)
+	case url.Values:
+		reader = bytes.NewReader([]byte(body.Encode()))
+		contentType = "application/x-www-form-urlencoded"
+	default:
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatalf("failed to encode body: %v", err)
+		}
+		reader = bytes.NewReader(data)
+		contentType = "application/json"
+	}
+
+	request, err := http.NewRequest(method, address, reader)
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("%s %s failed: %v", method, address, err)
+	}
+	defer response.Body.Close()
+
+	if result != nil {
+		if err = json.NewDecoder(response.Body).Decode(result); err != nil {
+			t.Fatalf("failed to decode response of %s %s: %v", method, address, err)
+		}
+	}
+	return response.StatusCode
+}
+
+func expectStatus(t *testing.T, what string, want int, got int) {
+	t.Helper()
+
+	if got != want {
+		t.Errorf("%s: unexpected status code: want %d, got %d", what, want, got)
+	}
+}
+
+func (a *runningApp) available(t *testing.T, bookID string) uint {
+	t.Helper()
+
+	var result struct {
+		Available uint `json:"available"`
+	}
+	status := call(t, "GET", a.public+"/api/v1/book/"+bookID+"/avail?auth=token-librarian", "", nil, &result)
+	expectStatus(t, "avail", http.StatusOK, status)
+	return result.Available
+}
+
+// loanList is the page of the reservations or the overdue loans
+type loanList struct {
+	Reserved []loanView `json:"reserved"`
+	Overdue  []loanView `json:"overdue"`
+	Total    uint       `json:"total"`
+}
+
+type loanView struct {
+	UserID string `json:"user_id"`
+	BookID string `json:"book_id"`
+}
+
+func (a *runningApp) userLoans(t *testing.T, userID string) map[string]any {
+	t.Helper()
+
+	var result map[string]any
+	status := call(t, "GET", a.private+"/api/v1/userloans/"+userID, "", nil, &result)
+	expectStatus(t, "userloans", http.StatusOK, status)
+	return result
+}
+
+func TestLoanFlow(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			a := startApp(t, newUpstreams(t), backend.newDSN(t))
+
+			if got := a.available(t, bookPlenty); got != 3 {
+				t.Errorf("wrong availability: want %d, got %d", 3, got)
+			}
+
+			// The librarian lends a book to the reader over v1, and takes one for self over v2
+			status := call(t, "POST", a.public+"/api/v1/book/"+bookPlenty+"/take", "",
+				url.Values{"auth": {"token-librarian"}, "user": {readerID}}, nil)
+			expectStatus(t, "v1 take", http.StatusOK, status)
+			status = call(t, "POST", a.public+"/api/v2/loans", "token-librarian",
+				map[string]any{"book_id": bookPlenty}, nil)
+			expectStatus(t, "v2 take", http.StatusOK, status)
+
+			// The reader may only take books for self
+			var problem struct {
+				Code string `json:"code"`
+			}
+			status = call(t, "POST", a.public+"/api/v2/loans", "token-reader",
+				map[string]any{"book_id": bookPlenty, "user_id": librarianID}, &problem)
+			expectStatus(t, "take without permission", http.StatusForbidden, status)
+			if problem.Code != "forbidden" {
+				t.Errorf("wrong problem code: want %q, got %q", "forbidden", problem.Code)
+			}
+			status = call(t, "POST", a.public+"/api/v2/loans", "token-unknown",
+				map[string]any{"book_id": bookPlenty}, &problem)
+			expectStatus(t, "take with unknown token", http.StatusUnauthorized, status)
+			if problem.Code != "unauthorized" {
+				t.Errorf("wrong problem code: want %q, got %q", "unauthorized", problem.Code)
+			}
+			status = call(t, "POST", a.public+"/api/v2/loans", "token-librarian",
+				map[string]any{"book_id": bookOutOfStock}, &problem)
+			expectStatus(t, "take out of stock", http.StatusNotFound, status)
+			if problem.Code != "no_stock" {
+				t.Errorf("wrong problem code: want %q, got %q", "no_stock", problem.Code)
+			}
+
+			if got := a.available(t, bookPlenty); got != 1 {
+				t.Errorf("wrong availability: want %d, got %d", 1, got)
+			}
+
+			var reserved loanList
+			status = call(t, "GET", a.public+"/api/v2/reserved", "token-librarian", nil, &reserved)
+			expectStatus(t, "reserved", http.StatusOK, status)
+			// The loans may be taken within the same millisecond, so their order isn't checked
+			want := []loanView{{UserID: readerID, BookID: bookPlenty}, {UserID: librarianID, BookID: bookPlenty}}
+			byUser := cmpopts.SortSlices(func(a, b loanView) bool { return a.UserID < b.UserID })
+			if diff := cmp.Diff(want, reserved.Reserved, byUser); diff != "" {
+				t.Errorf("reserved mismatch (-want +got):\n%s", diff)
+			}
+
+			// Nothing is overdue yet, but everything is after the return deadline of two weeks
+			var overdue loanList
+			status = call(t, "GET", a.public+"/api/v2/overdue", "token-librarian", nil, &overdue)
+			expectStatus(t, "overdue", http.StatusOK, status)
+			if overdue.Total != 0 {
+				t.Errorf("wrong number of overdue loans: want %d, got %d", 0, overdue.Total)
+			}
+			later := time.Now().Add(15 * 24 * time.Hour).Unix()
+			status = call(t, "GET", fmt.Sprintf("%s/api/v2/overdue?atTime=%d", a.public, later), "token-librarian", nil, &overdue)
+			expectStatus(t, "overdue later", http.StatusOK, status)
+			if overdue.Total != 2 {
+				t.Errorf("wrong number of overdue loans: want %d, got %d", 2, overdue.Total)
+			}
+
+			wantLoans := map[string]any{"unreturned": 1.0, "outstanding_fines": 0.0}
+			if diff := cmp.Diff(wantLoans, a.userLoans(t, readerID)); diff != "" {
+				t.Errorf("userloans mismatch (-want +got):\n%s", diff)
+			}
+
+			status = call(t, "POST", a.public+"/api/v1/book/"+bookPlenty+"/return", "",
+				url.Values{"auth": {"token-librarian"}, "user": {readerID}}, nil)
+			expectStatus(t, "v1 return", http.StatusOK, status)
+			status = call(t, "POST", a.public+"/api/v2/returns", "token-librarian",
+				map[string]any{"book_id": bookPlenty}, nil)
+			expectStatus(t, "v2 return", http.StatusOK, status)
+
+			if got := a.available(t, bookPlenty); got != 3 {
+				t.Errorf("wrong availability: want %d, got %d", 3, got)
+			}
+			status = call(t, "GET", a.public+"/api/v2/reserved", "token-librarian", nil, &reserved)
+			expectStatus(t, "reserved", http.StatusOK, status)
+			if reserved.Total != 0 {
+				t.Errorf("wrong number of reservations: want %d, got %d", 0, reserved.Total)
+			}
+			wantLoans = map[string]any{"unreturned": 0.0, "outstanding_fines": 0.0}
+			if diff := cmp.Diff(wantLoans, a.userLoans(t, readerID)); diff != "" {
+				t.Errorf("userloans mismatch (-want +got):\n%s", diff)
+			}
+
+			a.stop(t)
+		})
+	}
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			upstreams := newUpstreams(t)
+			dsn := backend.newDSN(t)
+			a := startApp(t, upstreams, dsn)
+
+			// The take is in progress, waiting for the user service, when the shutdown begins
+			release := make(chan struct{})
+			arrived := upstreams.holdNext(release)
+			taken := make(chan error, 1)
+			go func() {
+				request, _ := http.NewRequest("POST", a.public+"/api/v2/loans", strings.NewReader(`{"book_id":"`+bookPlenty+`"}`))
+				request.Header.Set("Content-Type", "application/json")
+				request.Header.Set("Authorization", "Bearer token-librarian")
+				response, err := http.DefaultClient.Do(request)
+				if err == nil {
+					response.Body.Close()
+					if response.StatusCode != http.StatusOK {
+						err = fmt.Errorf("unexpected status code: want %d, got %d", http.StatusOK, response.StatusCode)
+					}
+				}
+				taken <- err
+			}()
+			<-arrived
+			a.cancel()
+
+			select {
+			case <-a.done:
+				t.Fatalf("app has shut down before the request in progress has finished")
+			case <-time.After(100 * time.Millisecond):
+			}
+
+			close(release)
+			if err := <-taken; err != nil {
+				t.Errorf("take in progress failed: %v", err)
+			}
+			a.stop(t)
+
+			// No more connections are accepted
+			if _, err := http.Get(a.public + "/openapi.json"); err == nil {
+				t.Errorf("public server still serves after shutdown")
+			}
+			if _, err := http.Get(a.private + "/openapi.json"); err == nil {
+				t.Errorf("private server still serves after shutdown")
+			}
+
+			// The durable storages reopen with the loan taken before the shutdown
+			if backend.name == "memory" {
+				return
+			}
+			a = startApp(t, upstreams, dsn)
+			if got := a.available(t, bookPlenty); got != 2 {
+				t.Errorf("wrong availability after restart: want %d, got %d", 2, got)
+			}
+			a.stop(t)
+		})
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/clock"
 	"github.com/mipt-kp-2024-go-beer/loan-service/internal/fail"
 )
 
@@ -15,29 +16,73 @@ type Handler struct {
 	router         *chi.Mux
 	routerInternal *chi.Mux
 	service        Service
+	clock          clock.Clock
 }
 
-func NewHandler(router *chi.Mux, routerInternal *chi.Mux, service Service) Handler {
+func NewHandler(router *chi.Mux, routerInternal *chi.Mux, service Service, clock clock.Clock) Handler {
 	return Handler{
 		router:         router,
 		routerInternal: routerInternal,
 		service:        service,
+		clock:          clock,
 	}
 }
 
 func (h *Handler) Register() {
-	h.router.Group(func(r chi.Router) {
-		r.Post("/api/v1/book/{bookID}/take", h.postBookTake)
-		r.Post("/api/v1/book/{bookID}/return", h.postBookReturn)
-		r.Get("/api/v1/book/{bookID}/avail", h.getBookAvailable)
+	h.router.Route("/api/v1", func(r chi.Router) {
+		r.Use(h.useIdempotencyKeys)
+		r.Post("/book/{bookID}/take", h.postBookTake)
+		r.Post("/book/{bookID}/return", h.postBookReturn)
+		h.registerPublic(r)
+	})
 
-		r.Get("/api/v1/reserved", h.getReserved)
-		r.Get("/api/v1/overdue", h.getOverdue)
+	h.router.Route("/api/v2", func(r chi.Router) {
+		r.Use(useAPIv2)
+		r.Use(h.useIdempotencyKeys)
+		r.Post("/loans", h.postLoansV2)
+		r.Post("/returns", h.postReturnsV2)
+		h.registerPublic(r)
 	})
 
 	h.routerInternal.Group(func(r chi.Router) {
 		r.Get("/api/v1/userloans/{userID}", h.getUserLoans)
+		r.Post("/api/v1/books/{bookID}/invalidate", h.postBookInvalidate)
+		r.Post("/api/v1/tokens/revoke", h.postTokenRevoke)
 	})
+
+	h.router.Get("/openapi.json", getOpenAPISpec)
+	h.routerInternal.Get("/openapi.json", getOpenAPISpec)
+}
+
+// registerPublic registers the public routes shared by all API versions
+func (h *Handler) registerPublic(r chi.Router) {
+	r.Post("/book/{bookID}/close", h.postBookClose)
+	r.Post("/book/{bookID}/renew", h.postBookRenew)
+	r.Get("/book/{bookID}/avail", h.getBookAvailable)
+	r.Post("/book/{bookID}/hold", h.postBookHold)
+	r.Post("/book/{bookID}/hold/cancel", h.postBookHoldCancel)
+
+	r.Get("/book/{bookID}/copies", h.getBookCopies)
+	r.Post("/book/{bookID}/copies", h.postBookCopies)
+	r.Post("/copies/{barcode}/update", h.postCopyUpdate)
+	r.Post("/copies/{barcode}/return", h.postCopyReturn)
+
+	r.Get("/loans/{loanID}", h.getLoan)
+	r.Post("/loans/{loanID}/return", h.postLoanReturn)
+
+	r.Get("/users/{userID}/loans", h.getUserLoanHistory)
+
+	r.Get("/holds", h.getHolds)
+
+	r.Get("/fines", h.getFines)
+	r.Post("/fines/{fineID}/pay", h.postFinePay)
+	r.Post("/fines/{fineID}/waive", h.postFineWaive)
+
+	r.Get("/reserved", h.getReserved)
+	r.Get("/overdue", h.getOverdue)
+
+	r.Get("/admin/clock", h.getAdminClock)
+	r.Post("/admin/clock", h.postAdminClock)
 }
 
 func writeJSONSuccess(w http.ResponseWriter) {
@@ -45,25 +90,65 @@ func writeJSONSuccess(w http.ResponseWriter) {
 	_ = json.NewEncoder(w).Encode(struct{}{})
 }
 
+// parseOptionalBool parses a boolean form value, which is false if omitted
+func parseOptionalBool(value string) (bool, error) {
+	if value == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(value)
+}
+
+// parseOptionalUint parses an unsigned integer form value, which is 0 if omitted
+func parseOptionalUint(value string) (uint64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	return strconv.ParseUint(value, 10, 64)
+}
+
+// parsePage parses the pagination parameters of an already parsed form
+func parsePage(r *http.Request) (Page, error) {
+	limit, err := parseOptionalUint(r.Form.Get("limit"))
+	if err != nil {
+		return Page{}, fmt.Errorf("%w: failed to parse limit: %w", fail.ErrMissingParams, err)
+	}
+
+	return Page{
+		Limit:  uint(limit),
+		Cursor: r.Form.Get("cursor"),
+	}, nil
+}
+
 // Public API
 
 func (h *Handler) postBookTake(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
-		fail.WriteError(w, fmt.Errorf("%w: %w", fail.ErrMissingParams, err))
+		fail.WriteError(w, r, fmt.Errorf("%w: %w", fail.ErrMissingParams, err))
 		return
 	}
-	authToken := r.Form.Get("auth")
+	authToken := requestToken(r)
 	userID := r.Form.Get("user")
 	bookID := chi.URLParam(r, "bookID")
 	if authToken == "" || bookID == "" {
-		fail.WriteError(w, fmt.Errorf("%w: %q", fail.ErrMissingParams, "auth, bookID"))
+		fail.WriteError(w, r, fmt.Errorf("%w: %q", fail.ErrMissingParams, "auth, bookID"))
+		return
+	}
+	var overrides TakeOverrides
+	overrides.Limits, err = parseOptionalBool(r.Form.Get("overrideLimits"))
+	if err != nil {
+		fail.WriteError(w, r, fmt.Errorf("%w: failed to parse overrideLimits: %w", fail.ErrMissingParams, err))
+		return
+	}
+	overrides.Overdue, err = parseOptionalBool(r.Form.Get("overrideOverdue"))
+	if err != nil {
+		fail.WriteError(w, r, fmt.Errorf("%w: failed to parse overrideOverdue: %w", fail.ErrMissingParams, err))
 		return
 	}
 
-	err = h.service.TakeBook(r.Context(), authToken, userID, bookID)
+	err = h.service.TakeBook(r.Context(), authToken, userID, bookID, r.Form.Get("barcode"), r.Form.Get("notes"), overrides)
 	if err != nil {
-		fail.WriteError(w, err)
+		fail.WriteError(w, r, err)
 		return
 	}
 
@@ -73,20 +158,67 @@ func (h *Handler) postBookTake(w http.ResponseWriter, r *http.Request) {
 func (h *Handler) postBookReturn(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
-		fail.WriteError(w, fmt.Errorf("%w: %w", fail.ErrMissingParams, err))
+		fail.WriteError(w, r, fmt.Errorf("%w: %w", fail.ErrMissingParams, err))
 		return
 	}
-	authToken := r.Form.Get("auth")
+	authToken := requestToken(r)
 	userID := r.Form.Get("user")
 	bookID := chi.URLParam(r, "bookID")
 	if authToken == "" || bookID == "" {
-		fail.WriteError(w, fmt.Errorf("%w: %q", fail.ErrMissingParams, "auth, bookID"))
+		fail.WriteError(w, r, fmt.Errorf("%w: %q", fail.ErrMissingParams, "auth, bookID"))
 		return
 	}
 
 	err = h.service.ReturnBook(r.Context(), authToken, userID, bookID)
 	if err != nil {
-		fail.WriteError(w, err)
+		fail.WriteError(w, r, err)
+		return
+	}
+
+	writeJSONSuccess(w)
+}
+
+func (h *Handler) postBookClose(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		fail.WriteError(w, r, fmt.Errorf("%w: %w", fail.ErrMissingParams, err))
+		return
+	}
+	authToken := requestToken(r)
+	userID := r.Form.Get("user")
+	bookID := chi.URLParam(r, "bookID")
+	status := LoanStatus(r.Form.Get("status"))
+	if authToken == "" || bookID == "" || status == "" {
+		fail.WriteError(w, r, fmt.Errorf("%w: %q", fail.ErrMissingParams, "auth, bookID, status"))
+		return
+	}
+
+	err = h.service.CloseLoan(r.Context(), authToken, userID, bookID, status)
+	if err != nil {
+		fail.WriteError(w, r, err)
+		return
+	}
+
+	writeJSONSuccess(w)
+}
+
+func (h *Handler) postBookRenew(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		fail.WriteError(w, r, fmt.Errorf("%w: %w", fail.ErrMissingParams, err))
+		return
+	}
+	authToken := requestToken(r)
+	userID := r.Form.Get("user")
+	bookID := chi.URLParam(r, "bookID")
+	if authToken == "" || bookID == "" {
+		fail.WriteError(w, r, fmt.Errorf("%w: %q", fail.ErrMissingParams, "auth, bookID"))
+		return
+	}
+
+	err = h.service.RenewLoan(r.Context(), authToken, userID, bookID)
+	if err != nil {
+		fail.WriteError(w, r, err)
 		return
 	}
 
@@ -96,19 +228,19 @@ func (h *Handler) postBookReturn(w http.ResponseWriter, r *http.Request) {
 func (h *Handler) getBookAvailable(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
-		fail.WriteError(w, fmt.Errorf("%w: %w", fail.ErrMissingParams, err))
+		fail.WriteError(w, r, fmt.Errorf("%w: %w", fail.ErrMissingParams, err))
 		return
 	}
-	authToken := r.Form.Get("auth")
+	authToken := requestToken(r)
 	bookID := chi.URLParam(r, "bookID")
 	if authToken == "" || bookID == "" {
-		fail.WriteError(w, fmt.Errorf("%w: %q", fail.ErrMissingParams, "auth, bookID"))
+		fail.WriteError(w, r, fmt.Errorf("%w: %q", fail.ErrMissingParams, "auth, bookID"))
 		return
 	}
 
 	available, err := h.service.CountAvailableBook(r.Context(), authToken, bookID)
 	if err != nil {
-		fail.WriteError(w, err)
+		fail.WriteError(w, r, err)
 		return
 	}
 
@@ -120,99 +252,563 @@ func (h *Handler) getBookAvailable(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+func (h *Handler) postBookHold(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		fail.WriteError(w, r, fmt.Errorf("%w: %w", fail.ErrMissingParams, err))
+		return
+	}
+	authToken := requestToken(r)
+	userID := r.Form.Get("user")
+	bookID := chi.URLParam(r, "bookID")
+	if authToken == "" || bookID == "" {
+		fail.WriteError(w, r, fmt.Errorf("%w: %q", fail.ErrMissingParams, "auth, bookID"))
+		return
+	}
+
+	err = h.service.PlaceHold(r.Context(), authToken, userID, bookID)
+	if err != nil {
+		fail.WriteError(w, r, err)
+		return
+	}
+
+	writeJSONSuccess(w)
+}
+
+func (h *Handler) postBookHoldCancel(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		fail.WriteError(w, r, fmt.Errorf("%w: %w", fail.ErrMissingParams, err))
+		return
+	}
+	authToken := requestToken(r)
+	userID := r.Form.Get("user")
+	bookID := chi.URLParam(r, "bookID")
+	if authToken == "" || bookID == "" {
+		fail.WriteError(w, r, fmt.Errorf("%w: %q", fail.ErrMissingParams, "auth, bookID"))
+		return
+	}
+
+	err = h.service.CancelHold(r.Context(), authToken, userID, bookID)
+	if err != nil {
+		fail.WriteError(w, r, err)
+		return
+	}
+
+	writeJSONSuccess(w)
+}
+
+func (h *Handler) getBookCopies(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		fail.WriteError(w, r, fmt.Errorf("%w: %w", fail.ErrMissingParams, err))
+		return
+	}
+	authToken := requestToken(r)
+	bookID := chi.URLParam(r, "bookID")
+	if authToken == "" || bookID == "" {
+		fail.WriteError(w, r, fmt.Errorf("%w: %q", fail.ErrMissingParams, "auth, bookID"))
+		return
+	}
+
+	copies, err := h.service.ListCopies(r.Context(), authToken, bookID)
+	if err != nil {
+		fail.WriteError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(struct {
+		Copies []Copy `json:"copies"`
+	}{
+		Copies: copies,
+	})
+}
+
+func (h *Handler) postBookCopies(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		fail.WriteError(w, r, fmt.Errorf("%w: %w", fail.ErrMissingParams, err))
+		return
+	}
+	authToken := requestToken(r)
+	bookID := chi.URLParam(r, "bookID")
+	barcode := r.Form.Get("barcode")
+	condition := CopyCondition(r.Form.Get("condition"))
+	shelfLocation := r.Form.Get("shelf")
+	if authToken == "" || bookID == "" || barcode == "" {
+		fail.WriteError(w, r, fmt.Errorf("%w: %q", fail.ErrMissingParams, "auth, bookID, barcode"))
+		return
+	}
+
+	bookCopy, err := h.service.RegisterCopy(r.Context(), authToken, bookID, barcode, condition, shelfLocation)
+	if err != nil {
+		fail.WriteError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(struct {
+		Copy Copy `json:"copy"`
+	}{
+		Copy: bookCopy,
+	})
+}
+
+func (h *Handler) postCopyUpdate(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		fail.WriteError(w, r, fmt.Errorf("%w: %w", fail.ErrMissingParams, err))
+		return
+	}
+	authToken := requestToken(r)
+	barcode := chi.URLParam(r, "barcode")
+	condition := CopyCondition(r.Form.Get("condition"))
+	shelfLocation := r.Form.Get("shelf")
+	if authToken == "" || barcode == "" {
+		fail.WriteError(w, r, fmt.Errorf("%w: %q", fail.ErrMissingParams, "auth, barcode"))
+		return
+	}
+
+	bookCopy, err := h.service.UpdateCopy(r.Context(), authToken, barcode, condition, shelfLocation)
+	if err != nil {
+		fail.WriteError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(struct {
+		Copy Copy `json:"copy"`
+	}{
+		Copy: bookCopy,
+	})
+}
+
+func (h *Handler) postCopyReturn(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		fail.WriteError(w, r, fmt.Errorf("%w: %w", fail.ErrMissingParams, err))
+		return
+	}
+	authToken := requestToken(r)
+	barcode := chi.URLParam(r, "barcode")
+	if authToken == "" || barcode == "" {
+		fail.WriteError(w, r, fmt.Errorf("%w: %q", fail.ErrMissingParams, "auth, barcode"))
+		return
+	}
+
+	err = h.service.ReturnCopy(r.Context(), authToken, barcode)
+	if err != nil {
+		fail.WriteError(w, r, err)
+		return
+	}
+
+	writeJSONSuccess(w)
+}
+
+func (h *Handler) getLoan(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		fail.WriteError(w, r, fmt.Errorf("%w: %w", fail.ErrMissingParams, err))
+		return
+	}
+	authToken := requestToken(r)
+	loanID := chi.URLParam(r, "loanID")
+	if authToken == "" || loanID == "" {
+		fail.WriteError(w, r, fmt.Errorf("%w: %q", fail.ErrMissingParams, "auth, loanID"))
+		return
+	}
+
+	loan, err := h.service.GetLoan(r.Context(), authToken, loanID)
+	if err != nil {
+		fail.WriteError(w, r, err)
+		return
+	}
+
+	format := responseTimeFormat(r)
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(struct {
+		Loan lentBookView `json:"loan"`
+	}{
+		Loan: format.lentBook(&loan),
+	})
+}
+
+func (h *Handler) postLoanReturn(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		fail.WriteError(w, r, fmt.Errorf("%w: %w", fail.ErrMissingParams, err))
+		return
+	}
+	authToken := requestToken(r)
+	loanID := chi.URLParam(r, "loanID")
+	if authToken == "" || loanID == "" {
+		fail.WriteError(w, r, fmt.Errorf("%w: %q", fail.ErrMissingParams, "auth, loanID"))
+		return
+	}
+
+	err = h.service.ReturnLoan(r.Context(), authToken, loanID)
+	if err != nil {
+		fail.WriteError(w, r, err)
+		return
+	}
+
+	writeJSONSuccess(w)
+}
+
+func (h *Handler) getUserLoanHistory(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		fail.WriteError(w, r, fmt.Errorf("%w: %w", fail.ErrMissingParams, err))
+		return
+	}
+	authToken := requestToken(r)
+	userID := chi.URLParam(r, "userID")
+	if authToken == "" || userID == "" {
+		fail.WriteError(w, r, fmt.Errorf("%w: %q", fail.ErrMissingParams, "auth, userID"))
+		return
+	}
+
+	filter := LoanFilter{
+		BookID: r.Form.Get("book"),
+		State:  LoanState(r.Form.Get("state")),
+	}
+	filter.TakenFrom, err = parseOptionalTime(r.Form.Get("takenFrom"))
+	if err != nil {
+		fail.WriteError(w, r, fmt.Errorf("%w: failed to parse takenFrom: %w", fail.ErrMissingParams, err))
+		return
+	}
+	filter.TakenUntil, err = parseOptionalTime(r.Form.Get("takenUntil"))
+	if err != nil {
+		fail.WriteError(w, r, fmt.Errorf("%w: failed to parse takenUntil: %w", fail.ErrMissingParams, err))
+		return
+	}
+
+	page, err := parsePage(r)
+	if err != nil {
+		fail.WriteError(w, r, err)
+		return
+	}
+
+	result, err := h.service.ListUserLoans(r.Context(), authToken, userID, filter, LoanSort(r.Form.Get("sort")), page)
+	if err != nil {
+		fail.WriteError(w, r, err)
+		return
+	}
+
+	format := responseTimeFormat(r)
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(struct {
+		Loans      []lentBookView `json:"loans"`
+		NextCursor string         `json:"next_cursor"`
+		Total      uint           `json:"total"`
+	}{
+		Loans:      format.lentBooks(result.Loans),
+		NextCursor: result.NextCursor,
+		Total:      result.Total,
+	})
+}
+
+func (h *Handler) getHolds(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		fail.WriteError(w, r, fmt.Errorf("%w: %w", fail.ErrMissingParams, err))
+		return
+	}
+	authToken := requestToken(r)
+	userID := r.Form.Get("user")
+	bookID := r.Form.Get("book")
+	if authToken == "" {
+		fail.WriteError(w, r, fmt.Errorf("%w: %q", fail.ErrMissingParams, "auth"))
+		return
+	}
+
+	holds, err := h.service.ListHolds(r.Context(), authToken, userID, bookID)
+	if err != nil {
+		fail.WriteError(w, r, err)
+		return
+	}
+
+	format := responseTimeFormat(r)
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(struct {
+		Holds []holdView `json:"holds"`
+	}{
+		Holds: format.holds(holds),
+	})
+}
+
 func (h *Handler) getReserved(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
-		fail.WriteError(w, fmt.Errorf("%w: %w", fail.ErrMissingParams, err))
+		fail.WriteError(w, r, fmt.Errorf("%w: %w", fail.ErrMissingParams, err))
 		return
 	}
-	authToken := r.Form.Get("auth")
+	authToken := requestToken(r)
 	if authToken == "" {
-		fail.WriteError(w, fmt.Errorf("%w: %q", fail.ErrMissingParams, "auth"))
+		fail.WriteError(w, r, fmt.Errorf("%w: %q", fail.ErrMissingParams, "auth"))
 		return
 	}
-	atTimeStr := r.Form.Get("atTime")
-	var atTime int64
-	if atTimeStr == "" {
-		atTime = time.Now().Unix()
-	} else {
-		atTime, err = strconv.ParseInt(atTimeStr, 10, 64)
+	atTime := h.clock.Now()
+	if atTimeStr := r.Form.Get("atTime"); atTimeStr != "" {
+		timestamp, err := parseTime(atTimeStr)
 		if err != nil {
-			fail.WriteError(w, fmt.Errorf("%w: failed to parse atTime: %w", fail.ErrMissingParams, err))
+			fail.WriteError(w, r, fmt.Errorf("%w: failed to parse atTime: %w", fail.ErrMissingParams, err))
 			return
 		}
+		atTime = FromTimestamp(timestamp)
+	}
+
+	page, err := parsePage(r)
+	if err != nil {
+		fail.WriteError(w, r, err)
+		return
 	}
 
-	reserved, err := h.service.ListReservations(r.Context(), authToken, time.Unix(atTime, 0))
+	reserved, err := h.service.ListReservations(r.Context(), authToken, atTime, page)
 	if err != nil {
-		fail.WriteError(w, err)
+		fail.WriteError(w, r, err)
 		return
 	}
 
+	format := responseTimeFormat(r)
 	w.WriteHeader(http.StatusOK)
 	_ = json.NewEncoder(w).Encode(struct {
-		Reserved []LentBook `json:"reserved"`
+		Reserved   []lentBookView `json:"reserved"`
+		NextCursor string         `json:"next_cursor"`
+		Total      uint           `json:"total"`
 	}{
-		Reserved: reserved,
+		Reserved:   format.lentBooks(reserved.Loans),
+		NextCursor: reserved.NextCursor,
+		Total:      reserved.Total,
 	})
 }
 
 func (h *Handler) getOverdue(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
-		fail.WriteError(w, fmt.Errorf("%w: %w", fail.ErrMissingParams, err))
+		fail.WriteError(w, r, fmt.Errorf("%w: %w", fail.ErrMissingParams, err))
 		return
 	}
-	authToken := r.Form.Get("auth")
+	authToken := requestToken(r)
 	if authToken == "" {
-		fail.WriteError(w, fmt.Errorf("%w: %q", fail.ErrMissingParams, "auth"))
+		fail.WriteError(w, r, fmt.Errorf("%w: %q", fail.ErrMissingParams, "auth"))
 		return
 	}
-	atTimeStr := r.Form.Get("atTime")
-	var atTime int64
-	if atTimeStr == "" {
-		atTime = time.Now().Unix()
-	} else {
-		atTime, err = strconv.ParseInt(atTimeStr, 10, 64)
+	atTime := h.clock.Now()
+	if atTimeStr := r.Form.Get("atTime"); atTimeStr != "" {
+		timestamp, err := parseTime(atTimeStr)
 		if err != nil {
-			fail.WriteError(w, fmt.Errorf("%w: failed to parse atTime: %w", fail.ErrMissingParams, err))
+			fail.WriteError(w, r, fmt.Errorf("%w: failed to parse atTime: %w", fail.ErrMissingParams, err))
 			return
 		}
+		atTime = FromTimestamp(timestamp)
 	}
 
-	overdue, err := h.service.ListOverdue(r.Context(), authToken, time.Unix(atTime, 0))
+	page, err := parsePage(r)
 	if err != nil {
-		fail.WriteError(w, err)
+		fail.WriteError(w, r, err)
 		return
 	}
 
+	overdue, err := h.service.ListOverdue(r.Context(), authToken, atTime, page)
+	if err != nil {
+		fail.WriteError(w, r, err)
+		return
+	}
+
+	format := responseTimeFormat(r)
 	w.WriteHeader(http.StatusOK)
 	_ = json.NewEncoder(w).Encode(struct {
-		Overdue []LentBook `json:"overdue"`
+		Overdue    []lentBookView `json:"overdue"`
+		NextCursor string         `json:"next_cursor"`
+		Total      uint           `json:"total"`
 	}{
-		Overdue: overdue,
+		Overdue:    format.lentBooks(overdue.Loans),
+		NextCursor: overdue.NextCursor,
+		Total:      overdue.Total,
 	})
 }
 
+func (h *Handler) getFines(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		fail.WriteError(w, r, fmt.Errorf("%w: %w", fail.ErrMissingParams, err))
+		return
+	}
+	authToken := requestToken(r)
+	userID := r.Form.Get("user")
+	if authToken == "" {
+		fail.WriteError(w, r, fmt.Errorf("%w: %q", fail.ErrMissingParams, "auth"))
+		return
+	}
+
+	fines, err := h.service.ListFines(r.Context(), authToken, userID)
+	if err != nil {
+		fail.WriteError(w, r, err)
+		return
+	}
+
+	format := responseTimeFormat(r)
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(struct {
+		Fines []fineView `json:"fines"`
+	}{
+		Fines: format.fines(fines),
+	})
+}
+
+func (h *Handler) postFinePay(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		fail.WriteError(w, r, fmt.Errorf("%w: %w", fail.ErrMissingParams, err))
+		return
+	}
+	authToken := requestToken(r)
+	fineID := chi.URLParam(r, "fineID")
+	if authToken == "" || fineID == "" {
+		fail.WriteError(w, r, fmt.Errorf("%w: %q", fail.ErrMissingParams, "auth, fineID"))
+		return
+	}
+
+	err = h.service.PayFine(r.Context(), authToken, fineID)
+	if err != nil {
+		fail.WriteError(w, r, err)
+		return
+	}
+
+	writeJSONSuccess(w)
+}
+
+func (h *Handler) postFineWaive(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		fail.WriteError(w, r, fmt.Errorf("%w: %w", fail.ErrMissingParams, err))
+		return
+	}
+	authToken := requestToken(r)
+	fineID := chi.URLParam(r, "fineID")
+	if authToken == "" || fineID == "" {
+		fail.WriteError(w, r, fmt.Errorf("%w: %q", fail.ErrMissingParams, "auth, fineID"))
+		return
+	}
+
+	err = h.service.WaiveFine(r.Context(), authToken, fineID)
+	if err != nil {
+		fail.WriteError(w, r, err)
+		return
+	}
+
+	writeJSONSuccess(w)
+}
+
+func (h *Handler) getAdminClock(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		fail.WriteError(w, r, fmt.Errorf("%w: %w", fail.ErrMissingParams, err))
+		return
+	}
+	authToken := requestToken(r)
+	if authToken == "" {
+		fail.WriteError(w, r, fmt.Errorf("%w: %q", fail.ErrMissingParams, "auth"))
+		return
+	}
+
+	state, err := h.service.GetClock(r.Context(), authToken)
+	if err != nil {
+		fail.WriteError(w, r, err)
+		return
+	}
+
+	format := responseTimeFormat(r)
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(format.clockState(state))
+}
+
+func (h *Handler) postAdminClock(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		fail.WriteError(w, r, fmt.Errorf("%w: %w", fail.ErrMissingParams, err))
+		return
+	}
+	authToken := requestToken(r)
+	offsetStr := r.Form.Get("offset")
+	if authToken == "" || offsetStr == "" {
+		fail.WriteError(w, r, fmt.Errorf("%w: %q", fail.ErrMissingParams, "auth, offset"))
+		return
+	}
+	offset, err := time.ParseDuration(offsetStr)
+	if err != nil {
+		fail.WriteError(w, r, fmt.Errorf("%w: failed to parse offset: %w", fail.ErrMissingParams, err))
+		return
+	}
+
+	state, err := h.service.TravelInTime(r.Context(), authToken, offset)
+	if err != nil {
+		fail.WriteError(w, r, err)
+		return
+	}
+
+	format := responseTimeFormat(r)
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(format.clockState(state))
+}
+
 // Internal API
 
+func (h *Handler) postBookInvalidate(w http.ResponseWriter, r *http.Request) {
+	bookID := chi.URLParam(r, "bookID")
+	if bookID == "" {
+		fail.WriteError(w, r, fmt.Errorf("%w: %q", fail.ErrMissingParams, "bookID"))
+		return
+	}
+
+	err := h.service.InvalidateBook(r.Context(), bookID)
+	if err != nil {
+		fail.WriteError(w, r, err)
+		return
+	}
+
+	writeJSONSuccess(w)
+}
+
+func (h *Handler) postTokenRevoke(w http.ResponseWriter, r *http.Request) {
+	// The token is taken from the body, like the user service takes it, to keep it out of the URLs
+	var request struct {
+		Token string `json:"token"`
+	}
+	err := decodeJSONBody(w, r, &request)
+	if err != nil {
+		fail.WriteError(w, r, err)
+		return
+	}
+	if request.Token == "" {
+		fail.WriteError(w, r, fmt.Errorf("%w: %q", fail.ErrMissingParams, "token"))
+		return
+	}
+
+	err = h.service.RevokeToken(r.Context(), request.Token)
+	if err != nil {
+		fail.WriteError(w, r, err)
+		return
+	}
+
+	writeJSONSuccess(w)
+}
+
 func (h *Handler) getUserLoans(w http.ResponseWriter, r *http.Request) {
 	userID := chi.URLParam(r, "userID")
 	if userID == "" {
-		fail.WriteError(w, fmt.Errorf("%w: %q", fail.ErrMissingParams, "userID"))
+		fail.WriteError(w, r, fmt.Errorf("%w: %q", fail.ErrMissingParams, "userID"))
 		return
 	}
 
-	unreturned, err := h.service.GetUserLoans(r.Context(), userID)
+	userLoans, err := h.service.GetUserLoans(r.Context(), userID)
 	if err != nil {
-		fail.WriteError(w, err)
+		fail.WriteError(w, r, err)
 		return
 	}
 
 	w.WriteHeader(http.StatusOK)
-	_ = json.NewEncoder(w).Encode(struct {
-		Unreturned uint `json:"unreturned"`
-	}{
-		Unreturned: unreturned,
-	})
+	_ = json.NewEncoder(w).Encode(userLoans)
 }
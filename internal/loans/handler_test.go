@@ -5,9 +5,11 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/google/go-cmp/cmp"
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/clock"
 	"github.com/mipt-kp-2024-go-beer/loan-service/internal/loans"
 	"github.com/mipt-kp-2024-go-beer/loan-service/internal/loans/mock"
 )
@@ -20,7 +22,7 @@ func performRequest(t *testing.T, req *http.Request, useInternal bool) *httptest
 	router := chi.NewRouter()
 	routerInternal := chi.NewRouter()
 
-	h := loans.NewHandler(router, routerInternal, service)
+	h := loans.NewHandler(router, routerInternal, service, clock.NewFake(time.Unix(12345, 0)))
 	h.Register()
 
 	rr := httptest.NewRecorder()
@@ -74,7 +76,7 @@ func TestPostBookTake(t *testing.T) {
 		if rr.Code != http.StatusForbidden {
 			t.Errorf("unexpected status code: want %d, got %d", http.StatusForbidden, rr.Code)
 		}
-		if diff := cmp.Diff("insufficient permissions\n", rr.Body.String()); diff != "" {
+		if diff := cmp.Diff("{\"type\":\"urn:loan-service:problem:forbidden\",\"title\":\"insufficient permissions\",\"status\":403,\"code\":\"forbidden\"}\n", rr.Body.String()); diff != "" {
 			t.Errorf("response body mismatch (-want +got):\n%s", diff)
 		}
 	})
@@ -94,7 +96,111 @@ func TestPostBookTake(t *testing.T) {
 		if rr.Code != http.StatusNotFound {
 			t.Errorf("unexpected status code: want %d, got %d", http.StatusNotFound, rr.Code)
 		}
-		if diff := cmp.Diff("insufficient stock\n", rr.Body.String()); diff != "" {
+		if diff := cmp.Diff("{\"type\":\"urn:loan-service:problem:no_stock\",\"title\":\"insufficient stock\",\"status\":404,\"code\":\"no_stock\"}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestPostBookTake_Restrictions(t *testing.T) {
+	// POST /api/v1/book/{bookID}/take
+
+	t.Run("limit exceeded", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"POST",
+			"/api/v1/book/limited-book/take",
+			strings.NewReader("auth=good-token"),
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, false)
+
+		if rr.Code != http.StatusConflict {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusConflict, rr.Code)
+		}
+		if diff := cmp.Diff("{\"type\":\"urn:loan-service:problem:limit_exceeded\",\"title\":\"loan limit exceeded\",\"status\":409,\"code\":\"limit_exceeded\"}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("override", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"POST",
+			"/api/v1/book/limited-book/take",
+			strings.NewReader("auth=good-token&overrideLimits=true"),
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, false)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusOK, rr.Code)
+		}
+		if diff := cmp.Diff("{}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("has overdue", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"POST",
+			"/api/v1/book/good-book/take",
+			strings.NewReader("auth=good-token&user=overdue-user"),
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, false)
+
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusForbidden, rr.Code)
+		}
+		if diff := cmp.Diff("{\"type\":\"urn:loan-service:problem:has_overdue\",\"title\":\"user has overdue books\",\"status\":403,\"code\":\"has_overdue\"}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("override overdue", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"POST",
+			"/api/v1/book/good-book/take",
+			strings.NewReader("auth=good-token&user=overdue-user&overrideOverdue=1"),
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, false)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusOK, rr.Code)
+		}
+		if diff := cmp.Diff("{}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("bad override", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"POST",
+			"/api/v1/book/limited-book/take",
+			strings.NewReader("auth=good-token&overrideLimits=xxx"),
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, false)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+		if diff := cmp.Diff("{\"type\":\"urn:loan-service:problem:missing_params\",\"title\":\"missing required parameters\",\"status\":400,\"detail\":\"missing required parameters: failed to parse overrideLimits: strconv.ParseBool: parsing \\\"xxx\\\": invalid syntax\",\"code\":\"missing_params\"}\n", rr.Body.String()); diff != "" {
 			t.Errorf("response body mismatch (-want +got):\n%s", diff)
 		}
 	})
@@ -138,7 +244,7 @@ func TestPostBookReturn(t *testing.T) {
 		if rr.Code != http.StatusForbidden {
 			t.Errorf("unexpected status code: want %d, got %d", http.StatusForbidden, rr.Code)
 		}
-		if diff := cmp.Diff("insufficient permissions\n", rr.Body.String()); diff != "" {
+		if diff := cmp.Diff("{\"type\":\"urn:loan-service:problem:forbidden\",\"title\":\"insufficient permissions\",\"status\":403,\"code\":\"forbidden\"}\n", rr.Body.String()); diff != "" {
 			t.Errorf("response body mismatch (-want +got):\n%s", diff)
 		}
 	})
@@ -158,20 +264,20 @@ func TestPostBookReturn(t *testing.T) {
 		if rr.Code != http.StatusNotFound {
 			t.Errorf("unexpected status code: want %d, got %d", http.StatusNotFound, rr.Code)
 		}
-		if diff := cmp.Diff("object not found\n", rr.Body.String()); diff != "" {
+		if diff := cmp.Diff("{\"type\":\"urn:loan-service:problem:not_found\",\"title\":\"object not found\",\"status\":404,\"code\":\"not_found\"}\n", rr.Body.String()); diff != "" {
 			t.Errorf("response body mismatch (-want +got):\n%s", diff)
 		}
 	})
 }
 
-func TestGetBookAvailable(t *testing.T) {
-	// GET /api/v1/book/{bookID}/avail
+func TestPostBookClose(t *testing.T) {
+	// POST /api/v1/book/{bookID}/close
 
 	t.Run("basic", func(t *testing.T) {
 		r, err := http.NewRequest(
-			"GET",
-			"/api/v1/book/good-book/avail?auth=good-token",
-			nil,
+			"POST",
+			"/api/v1/book/good-book/close",
+			strings.NewReader("auth=good-token&status=lost"),
 		)
 		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 		if err != nil {
@@ -182,16 +288,16 @@ func TestGetBookAvailable(t *testing.T) {
 		if rr.Code != http.StatusOK {
 			t.Errorf("unexpected status code: want %d, got %d", http.StatusOK, rr.Code)
 		}
-		if diff := cmp.Diff("{\"available\":10}\n", rr.Body.String()); diff != "" {
+		if diff := cmp.Diff("{}\n", rr.Body.String()); diff != "" {
 			t.Errorf("response body mismatch (-want +got):\n%s", diff)
 		}
 	})
 
 	t.Run("bad token", func(t *testing.T) {
 		r, err := http.NewRequest(
-			"GET",
-			"/api/v1/book/good-book/avail?auth=bad-token",
-			nil,
+			"POST",
+			"/api/v1/book/good-book/close",
+			strings.NewReader("auth=bad-token&status=lost"),
 		)
 		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 		if err != nil {
@@ -202,16 +308,36 @@ func TestGetBookAvailable(t *testing.T) {
 		if rr.Code != http.StatusForbidden {
 			t.Errorf("unexpected status code: want %d, got %d", http.StatusForbidden, rr.Code)
 		}
-		if diff := cmp.Diff("insufficient permissions\n", rr.Body.String()); diff != "" {
+		if diff := cmp.Diff("{\"type\":\"urn:loan-service:problem:forbidden\",\"title\":\"insufficient permissions\",\"status\":403,\"code\":\"forbidden\"}\n", rr.Body.String()); diff != "" {
 			t.Errorf("response body mismatch (-want +got):\n%s", diff)
 		}
 	})
 
-	t.Run("bad book", func(t *testing.T) {
+	t.Run("missing status", func(t *testing.T) {
 		r, err := http.NewRequest(
-			"GET",
-			"/api/v1/book/bad-book/avail?auth=good-token",
-			nil,
+			"POST",
+			"/api/v1/book/good-book/close",
+			strings.NewReader("auth=good-token"),
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, false)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+		if diff := cmp.Diff("{\"type\":\"urn:loan-service:problem:missing_params\",\"title\":\"missing required parameters\",\"status\":400,\"detail\":\"missing required parameters: \\\"auth, bookID, status\\\"\",\"code\":\"missing_params\"}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"POST",
+			"/api/v1/book/bad-book/close",
+			strings.NewReader("auth=good-token&status=damaged"),
 		)
 		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 		if err != nil {
@@ -222,19 +348,19 @@ func TestGetBookAvailable(t *testing.T) {
 		if rr.Code != http.StatusNotFound {
 			t.Errorf("unexpected status code: want %d, got %d", http.StatusNotFound, rr.Code)
 		}
-		if diff := cmp.Diff("object not found\n", rr.Body.String()); diff != "" {
+		if diff := cmp.Diff("{\"type\":\"urn:loan-service:problem:not_found\",\"title\":\"object not found\",\"status\":404,\"code\":\"not_found\"}\n", rr.Body.String()); diff != "" {
 			t.Errorf("response body mismatch (-want +got):\n%s", diff)
 		}
 	})
 }
 
-func TestGetReserved(t *testing.T) {
-	// GET /api/v1/reserved
+func TestGetLoan(t *testing.T) {
+	// GET /api/v1/loans/{loanID}
 
 	t.Run("basic", func(t *testing.T) {
 		r, err := http.NewRequest(
 			"GET",
-			"/api/v1/reserved?auth=good-token",
+			"/api/v1/loans/loan-id?auth=good-token",
 			nil,
 		)
 		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
@@ -246,18 +372,19 @@ func TestGetReserved(t *testing.T) {
 		if rr.Code != http.StatusOK {
 			t.Errorf("unexpected status code: want %d, got %d", http.StatusOK, rr.Code)
 		}
-		if diff := cmp.Diff("{\"reserved\":[{\"id\":\"loan-id\",\"user_id\":\"user-id\",\"book_id\":\"book-id\",\"taken_at\":123,\"return_deadline\":456,\"returned\":false,\"returned_at\":0}]}\n", rr.Body.String()); diff != "" {
+		if diff := cmp.Diff("{\"loan\":{\"id\":\"loan-id\",\"user_id\":\"user-id\",\"book_id\":\"book-id\",\"copy_id\":\"\",\"taken_at\":123,\"return_deadline\":456,\"returned\":false,\"returned_at\":0,\"renewals\":0,\"status\":\"open\"}}\n", rr.Body.String()); diff != "" {
 			t.Errorf("response body mismatch (-want +got):\n%s", diff)
 		}
 	})
 
-	t.Run("time", func(t *testing.T) {
+	t.Run("rfc3339", func(t *testing.T) {
 		r, err := http.NewRequest(
 			"GET",
-			"/api/v1/reserved?auth=good-token&atTime=12345",
+			"/api/v1/loans/loan-id?auth=good-token",
 			nil,
 		)
 		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Accept", "application/json; time=rfc3339")
 		if err != nil {
 			t.Fatalf("failed to create request: %v", err)
 		}
@@ -266,7 +393,7 @@ func TestGetReserved(t *testing.T) {
 		if rr.Code != http.StatusOK {
 			t.Errorf("unexpected status code: want %d, got %d", http.StatusOK, rr.Code)
 		}
-		if diff := cmp.Diff("{\"reserved\":[{\"id\":\"loan-id\",\"user_id\":\"user-id\",\"book_id\":\"book-id\",\"taken_at\":123,\"return_deadline\":456,\"returned\":false,\"returned_at\":0}]}\n", rr.Body.String()); diff != "" {
+		if diff := cmp.Diff("{\"loan\":{\"id\":\"loan-id\",\"user_id\":\"user-id\",\"book_id\":\"book-id\",\"copy_id\":\"\",\"taken_at\":\"1970-01-01T00:02:03.000Z\",\"return_deadline\":\"1970-01-01T00:07:36.000Z\",\"returned\":false,\"returned_at\":null,\"renewals\":0,\"status\":\"open\"}}\n", rr.Body.String()); diff != "" {
 			t.Errorf("response body mismatch (-want +got):\n%s", diff)
 		}
 	})
@@ -274,7 +401,7 @@ func TestGetReserved(t *testing.T) {
 	t.Run("bad token", func(t *testing.T) {
 		r, err := http.NewRequest(
 			"GET",
-			"/api/v1/reserved?auth=bad-token",
+			"/api/v1/loans/loan-id?auth=bad-token",
 			nil,
 		)
 		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
@@ -286,15 +413,15 @@ func TestGetReserved(t *testing.T) {
 		if rr.Code != http.StatusForbidden {
 			t.Errorf("unexpected status code: want %d, got %d", http.StatusForbidden, rr.Code)
 		}
-		if diff := cmp.Diff("insufficient permissions\n", rr.Body.String()); diff != "" {
+		if diff := cmp.Diff("{\"type\":\"urn:loan-service:problem:forbidden\",\"title\":\"insufficient permissions\",\"status\":403,\"code\":\"forbidden\"}\n", rr.Body.String()); diff != "" {
 			t.Errorf("response body mismatch (-want +got):\n%s", diff)
 		}
 	})
 
-	t.Run("bad time", func(t *testing.T) {
+	t.Run("not found", func(t *testing.T) {
 		r, err := http.NewRequest(
 			"GET",
-			"/api/v1/reserved?auth=good-token&atTime=xxx",
+			"/api/v1/loans/bad-loan?auth=good-token",
 			nil,
 		)
 		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
@@ -303,23 +430,23 @@ func TestGetReserved(t *testing.T) {
 		}
 		rr := performRequest(t, r, false)
 
-		if rr.Code != http.StatusBadRequest {
-			t.Errorf("unexpected status code: want %d, got %d", http.StatusBadRequest, rr.Code)
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusNotFound, rr.Code)
 		}
-		if diff := cmp.Diff("missing required parameters: failed to parse atTime: strconv.ParseInt: parsing \"xxx\": invalid syntax\n", rr.Body.String()); diff != "" {
+		if diff := cmp.Diff("{\"type\":\"urn:loan-service:problem:not_found\",\"title\":\"object not found\",\"status\":404,\"code\":\"not_found\"}\n", rr.Body.String()); diff != "" {
 			t.Errorf("response body mismatch (-want +got):\n%s", diff)
 		}
 	})
 }
 
-func TestGetOverdue(t *testing.T) {
-	// GET /api/v1/overdue
+func TestPostLoanReturn(t *testing.T) {
+	// POST /api/v1/loans/{loanID}/return
 
 	t.Run("basic", func(t *testing.T) {
 		r, err := http.NewRequest(
-			"GET",
-			"/api/v1/overdue?auth=good-token",
-			nil,
+			"POST",
+			"/api/v1/loans/loan-id/return",
+			strings.NewReader("auth=good-token"),
 		)
 		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 		if err != nil {
@@ -330,15 +457,59 @@ func TestGetOverdue(t *testing.T) {
 		if rr.Code != http.StatusOK {
 			t.Errorf("unexpected status code: want %d, got %d", http.StatusOK, rr.Code)
 		}
-		if diff := cmp.Diff("{\"overdue\":[{\"id\":\"loan-id\",\"user_id\":\"user-id\",\"book_id\":\"book-id\",\"taken_at\":123,\"return_deadline\":456,\"returned\":false,\"returned_at\":0}]}\n", rr.Body.String()); diff != "" {
+		if diff := cmp.Diff("{}\n", rr.Body.String()); diff != "" {
 			t.Errorf("response body mismatch (-want +got):\n%s", diff)
 		}
 	})
 
-	t.Run("time", func(t *testing.T) {
+	t.Run("bad token", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"POST",
+			"/api/v1/loans/loan-id/return",
+			strings.NewReader("auth=bad-token"),
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, false)
+
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusForbidden, rr.Code)
+		}
+		if diff := cmp.Diff("{\"type\":\"urn:loan-service:problem:forbidden\",\"title\":\"insufficient permissions\",\"status\":403,\"code\":\"forbidden\"}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"POST",
+			"/api/v1/loans/bad-loan/return",
+			strings.NewReader("auth=good-token"),
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, false)
+
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusNotFound, rr.Code)
+		}
+		if diff := cmp.Diff("{\"type\":\"urn:loan-service:problem:not_found\",\"title\":\"object not found\",\"status\":404,\"code\":\"not_found\"}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestGetUserLoanHistory(t *testing.T) {
+	// GET /api/v1/users/{userID}/loans
+
+	t.Run("basic", func(t *testing.T) {
 		r, err := http.NewRequest(
 			"GET",
-			"/api/v1/overdue?auth=good-token&atTime=12345",
+			"/api/v1/users/user-id/loans?auth=good-token&state=open&sort=taken_asc&limit=10",
 			nil,
 		)
 		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
@@ -350,7 +521,7 @@ func TestGetOverdue(t *testing.T) {
 		if rr.Code != http.StatusOK {
 			t.Errorf("unexpected status code: want %d, got %d", http.StatusOK, rr.Code)
 		}
-		if diff := cmp.Diff("{\"overdue\":[{\"id\":\"loan-id\",\"user_id\":\"user-id\",\"book_id\":\"book-id\",\"taken_at\":123,\"return_deadline\":456,\"returned\":false,\"returned_at\":0}]}\n", rr.Body.String()); diff != "" {
+		if diff := cmp.Diff("{\"loans\":[{\"id\":\"loan-id\",\"user_id\":\"user-id\",\"book_id\":\"book-id\",\"copy_id\":\"\",\"taken_at\":123,\"return_deadline\":456,\"returned\":false,\"returned_at\":0,\"renewals\":0,\"status\":\"open\"}],\"next_cursor\":\"next-cursor\",\"total\":1}\n", rr.Body.String()); diff != "" {
 			t.Errorf("response body mismatch (-want +got):\n%s", diff)
 		}
 	})
@@ -358,7 +529,7 @@ func TestGetOverdue(t *testing.T) {
 	t.Run("bad token", func(t *testing.T) {
 		r, err := http.NewRequest(
 			"GET",
-			"/api/v1/overdue?auth=bad-token",
+			"/api/v1/users/user-id/loans?auth=bad-token",
 			nil,
 		)
 		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
@@ -370,15 +541,15 @@ func TestGetOverdue(t *testing.T) {
 		if rr.Code != http.StatusForbidden {
 			t.Errorf("unexpected status code: want %d, got %d", http.StatusForbidden, rr.Code)
 		}
-		if diff := cmp.Diff("insufficient permissions\n", rr.Body.String()); diff != "" {
+		if diff := cmp.Diff("{\"type\":\"urn:loan-service:problem:forbidden\",\"title\":\"insufficient permissions\",\"status\":403,\"code\":\"forbidden\"}\n", rr.Body.String()); diff != "" {
 			t.Errorf("response body mismatch (-want +got):\n%s", diff)
 		}
 	})
 
-	t.Run("bad time", func(t *testing.T) {
+	t.Run("bad limit", func(t *testing.T) {
 		r, err := http.NewRequest(
 			"GET",
-			"/api/v1/overdue?auth=good-token&atTime=xxx",
+			"/api/v1/users/user-id/loans?auth=good-token&limit=-1",
 			nil,
 		)
 		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
@@ -390,33 +561,1239 @@ func TestGetOverdue(t *testing.T) {
 		if rr.Code != http.StatusBadRequest {
 			t.Errorf("unexpected status code: want %d, got %d", http.StatusBadRequest, rr.Code)
 		}
-		if diff := cmp.Diff("missing required parameters: failed to parse atTime: strconv.ParseInt: parsing \"xxx\": invalid syntax\n", rr.Body.String()); diff != "" {
+		if diff := cmp.Diff("{\"type\":\"urn:loan-service:problem:missing_params\",\"title\":\"missing required parameters\",\"status\":400,\"detail\":\"missing required parameters: failed to parse limit: strconv.ParseUint: parsing \\\"-1\\\": invalid syntax\",\"code\":\"missing_params\"}\n", rr.Body.String()); diff != "" {
 			t.Errorf("response body mismatch (-want +got):\n%s", diff)
 		}
 	})
-}
 
-// Internal API
+	t.Run("bad cursor", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"GET",
+			"/api/v1/users/user-id/loans?auth=good-token&cursor=bad-cursor",
+			nil,
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, false)
 
-func TestGetUserLoans(t *testing.T) {
-	// GET /api/v1/userloans/{userID}
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+		if diff := cmp.Diff("{\"type\":\"urn:loan-service:problem:missing_params\",\"title\":\"missing required parameters\",\"status\":400,\"code\":\"missing_params\"}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestPostBookRenew(t *testing.T) {
+	// POST /api/v1/book/{bookID}/renew
 
 	t.Run("basic", func(t *testing.T) {
 		r, err := http.NewRequest(
-			"GET",
-			"/api/v1/userloans/good-user",
-			nil,
+			"POST",
+			"/api/v1/book/good-book/renew",
+			strings.NewReader("auth=good-token"),
 		)
 		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 		if err != nil {
 			t.Fatalf("failed to create request: %v", err)
 		}
-		rr := performRequest(t, r, true)
+		rr := performRequest(t, r, false)
 
 		if rr.Code != http.StatusOK {
 			t.Errorf("unexpected status code: want %d, got %d", http.StatusOK, rr.Code)
 		}
-		if diff := cmp.Diff("{\"unreturned\":123}\n", rr.Body.String()); diff != "" {
+		if diff := cmp.Diff("{}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("bad token", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"POST",
+			"/api/v1/book/good-book/renew",
+			strings.NewReader("auth=bad-token"),
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, false)
+
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusForbidden, rr.Code)
+		}
+		if diff := cmp.Diff("{\"type\":\"urn:loan-service:problem:forbidden\",\"title\":\"insufficient permissions\",\"status\":403,\"code\":\"forbidden\"}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("renewal limit", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"POST",
+			"/api/v1/book/bad-book/renew",
+			strings.NewReader("auth=good-token"),
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, false)
+
+		if rr.Code != http.StatusConflict {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusConflict, rr.Code)
+		}
+		if diff := cmp.Diff("{\"type\":\"urn:loan-service:problem:renewal_limit\",\"title\":\"renewal limit reached\",\"status\":409,\"code\":\"renewal_limit\"}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestGetBookAvailable(t *testing.T) {
+	// GET /api/v1/book/{bookID}/avail
+
+	t.Run("basic", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"GET",
+			"/api/v1/book/good-book/avail?auth=good-token",
+			nil,
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, false)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusOK, rr.Code)
+		}
+		if diff := cmp.Diff("{\"available\":10}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("bad token", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"GET",
+			"/api/v1/book/good-book/avail?auth=bad-token",
+			nil,
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, false)
+
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusForbidden, rr.Code)
+		}
+		if diff := cmp.Diff("{\"type\":\"urn:loan-service:problem:forbidden\",\"title\":\"insufficient permissions\",\"status\":403,\"code\":\"forbidden\"}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("bad book", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"GET",
+			"/api/v1/book/bad-book/avail?auth=good-token",
+			nil,
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, false)
+
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusNotFound, rr.Code)
+		}
+		if diff := cmp.Diff("{\"type\":\"urn:loan-service:problem:not_found\",\"title\":\"object not found\",\"status\":404,\"code\":\"not_found\"}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestGetBookCopies(t *testing.T) {
+	// GET /api/v1/book/{bookID}/copies
+
+	t.Run("basic", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"GET",
+			"/api/v1/book/good-book/copies?auth=good-token",
+			nil,
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, false)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusOK, rr.Code)
+		}
+		if diff := cmp.Diff("{\"copies\":[{\"id\":\"copy-id\",\"book_id\":\"good-book\",\"barcode\":\"0001\",\"condition\":\"good\",\"shelf_location\":\"A-1\"}]}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("bad token", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"GET",
+			"/api/v1/book/good-book/copies?auth=bad-token",
+			nil,
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, false)
+
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusForbidden, rr.Code)
+		}
+		if diff := cmp.Diff("{\"type\":\"urn:loan-service:problem:forbidden\",\"title\":\"insufficient permissions\",\"status\":403,\"code\":\"forbidden\"}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestPostBookCopies(t *testing.T) {
+	// POST /api/v1/book/{bookID}/copies
+
+	t.Run("basic", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"POST",
+			"/api/v1/book/good-book/copies",
+			strings.NewReader("auth=good-token&barcode=0001&condition=good&shelf=A-1"),
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, false)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusOK, rr.Code)
+		}
+		if diff := cmp.Diff("{\"copy\":{\"id\":\"copy-id\",\"book_id\":\"good-book\",\"barcode\":\"0001\",\"condition\":\"good\",\"shelf_location\":\"A-1\"}}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("missing barcode", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"POST",
+			"/api/v1/book/good-book/copies",
+			strings.NewReader("auth=good-token"),
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, false)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+		if diff := cmp.Diff("{\"type\":\"urn:loan-service:problem:missing_params\",\"title\":\"missing required parameters\",\"status\":400,\"detail\":\"missing required parameters: \\\"auth, bookID, barcode\\\"\",\"code\":\"missing_params\"}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("duplicate barcode", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"POST",
+			"/api/v1/book/good-book/copies",
+			strings.NewReader("auth=good-token&barcode=bad-barcode"),
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, false)
+
+		if rr.Code != http.StatusConflict {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusConflict, rr.Code)
+		}
+		if diff := cmp.Diff("{\"type\":\"urn:loan-service:problem:collision\",\"title\":\"object already exists\",\"status\":409,\"code\":\"collision\"}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestPostCopyUpdate(t *testing.T) {
+	// POST /api/v1/copies/{barcode}/update
+
+	t.Run("basic", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"POST",
+			"/api/v1/copies/0001/update",
+			strings.NewReader("auth=good-token&condition=worn"),
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, false)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusOK, rr.Code)
+		}
+		if diff := cmp.Diff("{\"copy\":{\"id\":\"copy-id\",\"book_id\":\"book-id\",\"barcode\":\"0001\",\"condition\":\"worn\",\"shelf_location\":\"\"}}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("bad token", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"POST",
+			"/api/v1/copies/0001/update",
+			strings.NewReader("auth=bad-token&condition=worn"),
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, false)
+
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusForbidden, rr.Code)
+		}
+		if diff := cmp.Diff("{\"type\":\"urn:loan-service:problem:forbidden\",\"title\":\"insufficient permissions\",\"status\":403,\"code\":\"forbidden\"}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("bad barcode", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"POST",
+			"/api/v1/copies/bad-barcode/update",
+			strings.NewReader("auth=good-token"),
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, false)
+
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusNotFound, rr.Code)
+		}
+		if diff := cmp.Diff("{\"type\":\"urn:loan-service:problem:not_found\",\"title\":\"object not found\",\"status\":404,\"code\":\"not_found\"}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestPostCopyReturn(t *testing.T) {
+	// POST /api/v1/copies/{barcode}/return
+
+	t.Run("basic", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"POST",
+			"/api/v1/copies/0001/return",
+			strings.NewReader("auth=good-token"),
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, false)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusOK, rr.Code)
+		}
+		if diff := cmp.Diff("{}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("bad token", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"POST",
+			"/api/v1/copies/0001/return",
+			strings.NewReader("auth=bad-token"),
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, false)
+
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusForbidden, rr.Code)
+		}
+		if diff := cmp.Diff("{\"type\":\"urn:loan-service:problem:forbidden\",\"title\":\"insufficient permissions\",\"status\":403,\"code\":\"forbidden\"}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("bad barcode", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"POST",
+			"/api/v1/copies/bad-barcode/return",
+			strings.NewReader("auth=good-token"),
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, false)
+
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusNotFound, rr.Code)
+		}
+		if diff := cmp.Diff("{\"type\":\"urn:loan-service:problem:not_found\",\"title\":\"object not found\",\"status\":404,\"code\":\"not_found\"}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestPostBookHold(t *testing.T) {
+	// POST /api/v1/book/{bookID}/hold
+
+	t.Run("basic", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"POST",
+			"/api/v1/book/good-book/hold",
+			strings.NewReader("auth=good-token"),
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, false)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusOK, rr.Code)
+		}
+		if diff := cmp.Diff("{}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("bad token", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"POST",
+			"/api/v1/book/good-book/hold",
+			strings.NewReader("auth=bad-token"),
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, false)
+
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusForbidden, rr.Code)
+		}
+		if diff := cmp.Diff("{\"type\":\"urn:loan-service:problem:forbidden\",\"title\":\"insufficient permissions\",\"status\":403,\"code\":\"forbidden\"}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("in stock", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"POST",
+			"/api/v1/book/bad-book/hold",
+			strings.NewReader("auth=good-token"),
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, false)
+
+		if rr.Code != http.StatusConflict {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusConflict, rr.Code)
+		}
+		if diff := cmp.Diff("{\"type\":\"urn:loan-service:problem:collision\",\"title\":\"object already exists\",\"status\":409,\"code\":\"collision\"}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestPostBookHoldCancel(t *testing.T) {
+	// POST /api/v1/book/{bookID}/hold/cancel
+
+	t.Run("basic", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"POST",
+			"/api/v1/book/good-book/hold/cancel",
+			strings.NewReader("auth=good-token"),
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, false)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusOK, rr.Code)
+		}
+		if diff := cmp.Diff("{}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("bad token", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"POST",
+			"/api/v1/book/good-book/hold/cancel",
+			strings.NewReader("auth=bad-token"),
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, false)
+
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusForbidden, rr.Code)
+		}
+		if diff := cmp.Diff("{\"type\":\"urn:loan-service:problem:forbidden\",\"title\":\"insufficient permissions\",\"status\":403,\"code\":\"forbidden\"}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("not held", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"POST",
+			"/api/v1/book/bad-book/hold/cancel",
+			strings.NewReader("auth=good-token"),
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, false)
+
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusNotFound, rr.Code)
+		}
+		if diff := cmp.Diff("{\"type\":\"urn:loan-service:problem:not_found\",\"title\":\"object not found\",\"status\":404,\"code\":\"not_found\"}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestGetHolds(t *testing.T) {
+	// GET /api/v1/holds
+
+	t.Run("basic", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"GET",
+			"/api/v1/holds?auth=good-token&book=book-id",
+			nil,
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, false)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusOK, rr.Code)
+		}
+		if diff := cmp.Diff("{\"holds\":[{\"id\":\"hold-id\",\"user_id\":\"user-id\",\"book_id\":\"book-id\",\"placed_at\":123,\"pickup_window\":100,\"reserved_until\":0}]}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("bad token", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"GET",
+			"/api/v1/holds?auth=bad-token",
+			nil,
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, false)
+
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusForbidden, rr.Code)
+		}
+		if diff := cmp.Diff("{\"type\":\"urn:loan-service:problem:forbidden\",\"title\":\"insufficient permissions\",\"status\":403,\"code\":\"forbidden\"}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestGetReserved(t *testing.T) {
+	// GET /api/v1/reserved
+
+	t.Run("basic", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"GET",
+			"/api/v1/reserved?auth=good-token",
+			nil,
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, false)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusOK, rr.Code)
+		}
+		if diff := cmp.Diff("{\"reserved\":[{\"id\":\"loan-id\",\"user_id\":\"user-id\",\"book_id\":\"book-id\",\"copy_id\":\"\",\"taken_at\":123,\"return_deadline\":456,\"returned\":false,\"returned_at\":0,\"renewals\":0,\"status\":\"open\"}],\"next_cursor\":\"next-cursor\",\"total\":1}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("time", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"GET",
+			"/api/v1/reserved?auth=good-token&atTime=12345",
+			nil,
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, false)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusOK, rr.Code)
+		}
+		if diff := cmp.Diff("{\"reserved\":[{\"id\":\"loan-id\",\"user_id\":\"user-id\",\"book_id\":\"book-id\",\"copy_id\":\"\",\"taken_at\":123,\"return_deadline\":456,\"returned\":false,\"returned_at\":0,\"renewals\":0,\"status\":\"open\"}],\"next_cursor\":\"next-cursor\",\"total\":1}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("rfc3339 time", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"GET",
+			"/api/v1/reserved?auth=good-token&atTime=2024-03-01T12:00:00.5Z",
+			nil,
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Accept", "text/html, application/json; time=rfc3339")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, false)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusOK, rr.Code)
+		}
+		if diff := cmp.Diff("{\"reserved\":[{\"id\":\"loan-id\",\"user_id\":\"user-id\",\"book_id\":\"book-id\",\"copy_id\":\"\",\"taken_at\":\"1970-01-01T00:02:03.000Z\",\"return_deadline\":\"1970-01-01T00:07:36.000Z\",\"returned\":false,\"returned_at\":null,\"renewals\":0,\"status\":\"open\"}],\"next_cursor\":\"next-cursor\",\"total\":1}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("bad token", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"GET",
+			"/api/v1/reserved?auth=bad-token",
+			nil,
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, false)
+
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusForbidden, rr.Code)
+		}
+		if diff := cmp.Diff("{\"type\":\"urn:loan-service:problem:forbidden\",\"title\":\"insufficient permissions\",\"status\":403,\"code\":\"forbidden\"}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("bad time", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"GET",
+			"/api/v1/reserved?auth=good-token&atTime=xxx",
+			nil,
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, false)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+		if diff := cmp.Diff("{\"type\":\"urn:loan-service:problem:missing_params\",\"title\":\"missing required parameters\",\"status\":400,\"detail\":\"missing required parameters: failed to parse atTime: expected Unix seconds or an RFC 3339 timestamp, got \\\"xxx\\\"\",\"code\":\"missing_params\"}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+	t.Run("bad cursor", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"GET",
+			"/api/v1/reserved?auth=good-token&limit=10&cursor=bad-cursor",
+			nil,
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, false)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+		if diff := cmp.Diff("{\"type\":\"urn:loan-service:problem:missing_params\",\"title\":\"missing required parameters\",\"status\":400,\"code\":\"missing_params\"}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestGetOverdue(t *testing.T) {
+	// GET /api/v1/overdue
+
+	t.Run("basic", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"GET",
+			"/api/v1/overdue?auth=good-token",
+			nil,
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, false)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusOK, rr.Code)
+		}
+		if diff := cmp.Diff("{\"overdue\":[{\"id\":\"loan-id\",\"user_id\":\"user-id\",\"book_id\":\"book-id\",\"copy_id\":\"\",\"taken_at\":123,\"return_deadline\":456,\"returned\":false,\"returned_at\":0,\"renewals\":0,\"status\":\"open\"}],\"next_cursor\":\"next-cursor\",\"total\":1}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("time", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"GET",
+			"/api/v1/overdue?auth=good-token&atTime=12345",
+			nil,
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, false)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusOK, rr.Code)
+		}
+		if diff := cmp.Diff("{\"overdue\":[{\"id\":\"loan-id\",\"user_id\":\"user-id\",\"book_id\":\"book-id\",\"copy_id\":\"\",\"taken_at\":123,\"return_deadline\":456,\"returned\":false,\"returned_at\":0,\"renewals\":0,\"status\":\"open\"}],\"next_cursor\":\"next-cursor\",\"total\":1}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("bad token", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"GET",
+			"/api/v1/overdue?auth=bad-token",
+			nil,
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, false)
+
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusForbidden, rr.Code)
+		}
+		if diff := cmp.Diff("{\"type\":\"urn:loan-service:problem:forbidden\",\"title\":\"insufficient permissions\",\"status\":403,\"code\":\"forbidden\"}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("bad time", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"GET",
+			"/api/v1/overdue?auth=good-token&atTime=xxx",
+			nil,
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, false)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+		if diff := cmp.Diff("{\"type\":\"urn:loan-service:problem:missing_params\",\"title\":\"missing required parameters\",\"status\":400,\"detail\":\"missing required parameters: failed to parse atTime: expected Unix seconds or an RFC 3339 timestamp, got \\\"xxx\\\"\",\"code\":\"missing_params\"}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+	t.Run("bad cursor", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"GET",
+			"/api/v1/overdue?auth=good-token&limit=10&cursor=bad-cursor",
+			nil,
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, false)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+		if diff := cmp.Diff("{\"type\":\"urn:loan-service:problem:missing_params\",\"title\":\"missing required parameters\",\"status\":400,\"code\":\"missing_params\"}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestGetFines(t *testing.T) {
+	// GET /api/v1/fines
+
+	t.Run("basic", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"GET",
+			"/api/v1/fines?auth=good-token",
+			nil,
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, false)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusOK, rr.Code)
+		}
+		if diff := cmp.Diff("{\"fines\":[{\"id\":\"fine-id\",\"user_id\":\"user-id\",\"loan_id\":\"loan-id\",\"book_id\":\"book-id\",\"reason\":\"late\",\"amount\":300,\"issued_at\":789,\"status\":\"outstanding\",\"resolved_at\":0}]}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("bad token", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"GET",
+			"/api/v1/fines?auth=bad-token",
+			nil,
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, false)
+
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusForbidden, rr.Code)
+		}
+		if diff := cmp.Diff("{\"type\":\"urn:loan-service:problem:forbidden\",\"title\":\"insufficient permissions\",\"status\":403,\"code\":\"forbidden\"}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestPostFinePay(t *testing.T) {
+	// POST /api/v1/fines/{fineID}/pay
+
+	t.Run("basic", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"POST",
+			"/api/v1/fines/good-fine/pay",
+			strings.NewReader("auth=good-token"),
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, false)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusOK, rr.Code)
+		}
+		if diff := cmp.Diff("{}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("bad token", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"POST",
+			"/api/v1/fines/good-fine/pay",
+			strings.NewReader("auth=bad-token"),
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, false)
+
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusForbidden, rr.Code)
+		}
+		if diff := cmp.Diff("{\"type\":\"urn:loan-service:problem:forbidden\",\"title\":\"insufficient permissions\",\"status\":403,\"code\":\"forbidden\"}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("bad fine", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"POST",
+			"/api/v1/fines/bad-fine/pay",
+			strings.NewReader("auth=good-token"),
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, false)
+
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusNotFound, rr.Code)
+		}
+		if diff := cmp.Diff("{\"type\":\"urn:loan-service:problem:not_found\",\"title\":\"object not found\",\"status\":404,\"code\":\"not_found\"}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestPostFineWaive(t *testing.T) {
+	// POST /api/v1/fines/{fineID}/waive
+
+	t.Run("basic", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"POST",
+			"/api/v1/fines/good-fine/waive",
+			strings.NewReader("auth=good-token"),
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, false)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusOK, rr.Code)
+		}
+		if diff := cmp.Diff("{}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("bad token", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"POST",
+			"/api/v1/fines/good-fine/waive",
+			strings.NewReader("auth=bad-token"),
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, false)
+
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusForbidden, rr.Code)
+		}
+		if diff := cmp.Diff("{\"type\":\"urn:loan-service:problem:forbidden\",\"title\":\"insufficient permissions\",\"status\":403,\"code\":\"forbidden\"}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("bad fine", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"POST",
+			"/api/v1/fines/bad-fine/waive",
+			strings.NewReader("auth=good-token"),
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, false)
+
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusNotFound, rr.Code)
+		}
+		if diff := cmp.Diff("{\"type\":\"urn:loan-service:problem:not_found\",\"title\":\"object not found\",\"status\":404,\"code\":\"not_found\"}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
+
+// Internal API
+
+func TestGetAdminClock(t *testing.T) {
+	// GET /api/v1/admin/clock
+
+	t.Run("basic", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"GET",
+			"/api/v1/admin/clock?auth=good-token",
+			nil,
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, false)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusOK, rr.Code)
+		}
+		if diff := cmp.Diff("{\"now\":1000,\"offset\":0}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("missing auth", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"GET",
+			"/api/v1/admin/clock",
+			nil,
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, false)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+		if diff := cmp.Diff("{\"type\":\"urn:loan-service:problem:missing_params\",\"title\":\"missing required parameters\",\"status\":400,\"detail\":\"missing required parameters: \\\"auth\\\"\",\"code\":\"missing_params\"}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("forbidden", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"GET",
+			"/api/v1/admin/clock?auth=bad-token",
+			nil,
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, false)
+
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusForbidden, rr.Code)
+		}
+		if diff := cmp.Diff("{\"type\":\"urn:loan-service:problem:forbidden\",\"title\":\"insufficient permissions\",\"status\":403,\"code\":\"forbidden\"}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestPostAdminClock(t *testing.T) {
+	// POST /api/v1/admin/clock
+
+	t.Run("basic", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"POST",
+			"/api/v1/admin/clock",
+			strings.NewReader("auth=good-token&offset=72h"),
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, false)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusOK, rr.Code)
+		}
+		if diff := cmp.Diff("{\"now\":260200,\"offset\":259200}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("back in time", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"POST",
+			"/api/v1/admin/clock",
+			strings.NewReader("auth=good-token&offset=-10s"),
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, false)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusOK, rr.Code)
+		}
+		if diff := cmp.Diff("{\"now\":990,\"offset\":-10}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("missing offset", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"POST",
+			"/api/v1/admin/clock",
+			strings.NewReader("auth=good-token"),
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, false)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+		if diff := cmp.Diff("{\"type\":\"urn:loan-service:problem:missing_params\",\"title\":\"missing required parameters\",\"status\":400,\"detail\":\"missing required parameters: \\\"auth, offset\\\"\",\"code\":\"missing_params\"}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("bad offset", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"POST",
+			"/api/v1/admin/clock",
+			strings.NewReader("auth=good-token&offset=xxx"),
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, false)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+		if diff := cmp.Diff("{\"type\":\"urn:loan-service:problem:missing_params\",\"title\":\"missing required parameters\",\"status\":400,\"detail\":\"missing required parameters: failed to parse offset: time: invalid duration \\\"xxx\\\"\",\"code\":\"missing_params\"}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("forbidden", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"POST",
+			"/api/v1/admin/clock",
+			strings.NewReader("auth=bad-token&offset=1h"),
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, false)
+
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusForbidden, rr.Code)
+		}
+		if diff := cmp.Diff("{\"type\":\"urn:loan-service:problem:forbidden\",\"title\":\"insufficient permissions\",\"status\":403,\"code\":\"forbidden\"}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestGetUserLoans(t *testing.T) {
+	// GET /api/v1/userloans/{userID}
+
+	t.Run("basic", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"GET",
+			"/api/v1/userloans/good-user",
+			nil,
+		)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, true)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusOK, rr.Code)
+		}
+		if diff := cmp.Diff("{\"unreturned\":123,\"outstanding_fines\":456}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestPostBookInvalidate(t *testing.T) {
+	// POST /api/v1/books/{bookID}/invalidate
+
+	t.Run("basic", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"POST",
+			"/api/v1/books/good-book/invalidate",
+			nil,
+		)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, true)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusOK, rr.Code)
+		}
+		if diff := cmp.Diff("{}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("not public", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"POST",
+			"/api/v1/books/good-book/invalidate",
+			nil,
+		)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, false)
+
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusNotFound, rr.Code)
+		}
+	})
+}
+
+func TestPostTokenRevoke(t *testing.T) {
+	// POST /api/v1/tokens/revoke
+
+	t.Run("basic", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"POST",
+			"/api/v1/tokens/revoke",
+			strings.NewReader(`{"token":"good-token"}`),
+		)
+		r.Header.Set("Content-Type", "application/json")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, true)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusOK, rr.Code)
+		}
+		if diff := cmp.Diff("{}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("no token", func(t *testing.T) {
+		r, err := http.NewRequest(
+			"POST",
+			"/api/v1/tokens/revoke",
+			strings.NewReader(`{}`),
+		)
+		r.Header.Set("Content-Type", "application/json")
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		rr := performRequest(t, r, true)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+		if diff := cmp.Diff("{\"type\":\"urn:loan-service:problem:missing_params\",\"title\":\"missing required parameters\",\"status\":400,\"detail\":\"missing required parameters: \\\"token\\\"\",\"code\":\"missing_params\"}\n", rr.Body.String()); diff != "" {
 			t.Errorf("response body mismatch (-want +got):\n%s", diff)
 		}
 	})
@@ -0,0 +1,164 @@
+package loans
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/fail"
+)
+
+// Version 2 of the public API takes the auth token from the "Authorization: Bearer" header
+// instead of the form, so that tokens stay out of URLs and access logs, takes JSON bodies
+// for taking and returning books and gives times in RFC 3339 unless asked otherwise
+// (see negotiateTimeFormat)
+
+// maxBodySize limits the size of JSON request bodies
+const maxBodySize = 1 << 20
+
+type apiV2Key struct{}
+
+// apiV2Request is what the API v2 middleware records about a request
+type apiV2Request struct {
+	token string
+}
+
+// useAPIv2 marks the requests as API v2 ones, rejecting those without a bearer token
+func useAPIv2(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+		token = strings.TrimSpace(token)
+		if !strings.EqualFold(scheme, "Bearer") || token == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="loan-service"`)
+			fail.WriteError(w, r, fmt.Errorf("%w: expected an %q header", fail.ErrUnauthorized, "Authorization: Bearer <token>"))
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), apiV2Key{}, apiV2Request{token: token})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// getAPIv2 returns what is known about an API v2 request, or false for other requests
+func getAPIv2(r *http.Request) (apiV2Request, bool) {
+	request, ok := r.Context().Value(apiV2Key{}).(apiV2Request)
+	return request, ok
+}
+
+// requestToken returns the auth token of an already parsed request
+func requestToken(r *http.Request) string {
+	if request, ok := getAPIv2(r); ok {
+		return request.token
+	}
+	return r.Form.Get("auth")
+}
+
+// responseTimeFormat returns the format of timestamps in the response to the request
+func responseTimeFormat(r *http.Request) TimeFormat {
+	if _, ok := getAPIv2(r); ok {
+		return negotiateTimeFormat(r, TimeRFC3339)
+	}
+	return negotiateTimeFormat(r, TimeUnix)
+}
+
+// decodeJSONBody decodes the JSON request body into dst, rejecting unknown fields
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, dst any) error {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		return fmt.Errorf("%w: expected a body of type application/json", fail.ErrMissingParams)
+	}
+
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(dst)
+	if err != nil {
+		return fmt.Errorf("%w: malformed request body: %w", fail.ErrMissingParams, err)
+	}
+	if decoder.More() {
+		return fmt.Errorf("%w: malformed request body: unexpected data after the object", fail.ErrMissingParams)
+	}
+
+	return nil
+}
+
+// takeRequest is the body of POST /api/v2/loans
+type takeRequest struct {
+	// UserID is the user to take the book on behalf of, the caller by default
+	UserID string `json:"user_id"`
+	BookID string `json:"book_id"`
+	// Barcode picks a particular copy to lend out, otherwise a free copy is picked
+	Barcode         string `json:"barcode"`
+	Notes           string `json:"notes"`
+	OverrideLimits  bool   `json:"override_limits"`
+	OverrideOverdue bool   `json:"override_overdue"`
+}
+
+// returnRequest is the body of POST /api/v2/returns.
+// Either the book (taken by the user, the caller by default) or the copy is given
+type returnRequest struct {
+	UserID  string `json:"user_id"`
+	BookID  string `json:"book_id"`
+	Barcode string `json:"barcode"`
+}
+
+func (h *Handler) postLoansV2(w http.ResponseWriter, r *http.Request) {
+	var request takeRequest
+	err := decodeJSONBody(w, r, &request)
+	if err != nil {
+		fail.WriteError(w, r, err)
+		return
+	}
+	if request.BookID == "" {
+		fail.WriteError(w, r, fmt.Errorf("%w: %q", fail.ErrMissingParams, "book_id"))
+		return
+	}
+
+	overrides := TakeOverrides{
+		Limits:  request.OverrideLimits,
+		Overdue: request.OverrideOverdue,
+	}
+	err = h.service.TakeBook(
+		r.Context(),
+		requestToken(r),
+		request.UserID,
+		request.BookID,
+		request.Barcode,
+		request.Notes,
+		overrides,
+	)
+	if err != nil {
+		fail.WriteError(w, r, err)
+		return
+	}
+
+	writeJSONSuccess(w)
+}
+
+func (h *Handler) postReturnsV2(w http.ResponseWriter, r *http.Request) {
+	var request returnRequest
+	err := decodeJSONBody(w, r, &request)
+	if err != nil {
+		fail.WriteError(w, r, err)
+		return
+	}
+
+	switch {
+	case request.Barcode != "" && request.BookID == "" && request.UserID == "":
+		err = h.service.ReturnCopy(r.Context(), requestToken(r), request.Barcode)
+	case request.Barcode == "" && request.BookID != "":
+		err = h.service.ReturnBook(r.Context(), requestToken(r), request.UserID, request.BookID)
+	default:
+		err = fmt.Errorf("%w: either %q or %q", fail.ErrMissingParams, "book_id", "barcode")
+	}
+	if err != nil {
+		fail.WriteError(w, r, err)
+		return
+	}
+
+	writeJSONSuccess(w)
+}
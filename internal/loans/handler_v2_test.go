@@ -0,0 +1,302 @@
+package loans_test
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// API v2
+
+type v2Case struct {
+	name        string
+	method      string
+	path        string
+	token       string
+	contentType string
+	body        string
+	code        int
+	want        string
+}
+
+func testV2(t *testing.T, cases []v2Case) {
+	t.Helper()
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r, err := http.NewRequest(c.method, c.path, strings.NewReader(c.body))
+			if err != nil {
+				t.Fatalf("failed to create request: %v", err)
+			}
+			if c.token != "" {
+				r.Header.Set("Authorization", c.token)
+			}
+			if c.contentType != "" {
+				r.Header.Set("Content-Type", c.contentType)
+			}
+			rr := performRequest(t, r, false)
+
+			if rr.Code != c.code {
+				t.Errorf("unexpected status code: want %d, got %d", c.code, rr.Code)
+			}
+			if diff := cmp.Diff(c.want, rr.Body.String()); diff != "" {
+				t.Errorf("response body mismatch (-want +got):\n%s", diff)
+			}
+			wantType := "application/json"
+			if c.code >= 400 {
+				wantType = "application/problem+json"
+			}
+			if got := rr.Header().Get("Content-Type"); got != wantType {
+				t.Errorf("unexpected content type: want %q, got %q", wantType, got)
+			}
+		})
+	}
+}
+
+func TestV2Auth(t *testing.T) {
+	testV2(t, []v2Case{
+		{
+			name:   "bearer token",
+			method: "GET",
+			path:   "/api/v2/book/good-book/avail",
+			token:  "Bearer good-token",
+			code:   http.StatusOK,
+			want:   "{\"available\":10}\n",
+		},
+		{
+			name:   "lowercase scheme",
+			method: "GET",
+			path:   "/api/v2/book/good-book/avail",
+			token:  "bearer good-token",
+			code:   http.StatusOK,
+			want:   "{\"available\":10}\n",
+		},
+		{
+			name:   "token in query",
+			method: "GET",
+			path:   "/api/v2/book/good-book/avail?auth=good-token",
+			code:   http.StatusUnauthorized,
+			want:   "{\"type\":\"urn:loan-service:problem:unauthorized\",\"title\":\"missing or malformed credentials\",\"status\":401,\"detail\":\"missing or malformed credentials: expected an \\\"Authorization: Bearer \\u003ctoken\\u003e\\\" header\",\"code\":\"unauthorized\"}\n",
+		},
+		{
+			name:   "wrong scheme",
+			method: "GET",
+			path:   "/api/v2/book/good-book/avail",
+			token:  "Basic Z29vZDp0b2tlbg==",
+			code:   http.StatusUnauthorized,
+			want:   "{\"type\":\"urn:loan-service:problem:unauthorized\",\"title\":\"missing or malformed credentials\",\"status\":401,\"detail\":\"missing or malformed credentials: expected an \\\"Authorization: Bearer \\u003ctoken\\u003e\\\" header\",\"code\":\"unauthorized\"}\n",
+		},
+		{
+			name:   "bad token",
+			method: "GET",
+			path:   "/api/v2/book/good-book/avail",
+			token:  "Bearer bad-token",
+			code:   http.StatusForbidden,
+			want:   "{\"type\":\"urn:loan-service:problem:forbidden\",\"title\":\"insufficient permissions\",\"status\":403,\"code\":\"forbidden\"}\n",
+		},
+	})
+}
+
+func TestV2Times(t *testing.T) {
+	testV2(t, []v2Case{
+		{
+			name:   "rfc3339 by default",
+			method: "GET",
+			path:   "/api/v2/loans/loan-id",
+			token:  "Bearer good-token",
+			code:   http.StatusOK,
+			want:   "{\"loan\":{\"id\":\"loan-id\",\"user_id\":\"user-id\",\"book_id\":\"book-id\",\"copy_id\":\"\",\"taken_at\":\"1970-01-01T00:02:03.000Z\",\"return_deadline\":\"1970-01-01T00:07:36.000Z\",\"returned\":false,\"returned_at\":null,\"renewals\":0,\"status\":\"open\"}}\n",
+		},
+		{
+			name:   "bad loan",
+			method: "GET",
+			path:   "/api/v2/loans/bad-loan",
+			token:  "Bearer good-token",
+			code:   http.StatusNotFound,
+			want:   "{\"type\":\"urn:loan-service:problem:not_found\",\"title\":\"object not found\",\"status\":404,\"code\":\"not_found\"}\n",
+		},
+	})
+
+	t.Run("unix on request", func(t *testing.T) {
+		r, err := http.NewRequest("GET", "/api/v2/loans/loan-id", nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		r.Header.Set("Authorization", "Bearer good-token")
+		r.Header.Set("Accept", "application/json; time=unix")
+		rr := performRequest(t, r, false)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("unexpected status code: want %d, got %d", http.StatusOK, rr.Code)
+		}
+		if diff := cmp.Diff("{\"loan\":{\"id\":\"loan-id\",\"user_id\":\"user-id\",\"book_id\":\"book-id\",\"copy_id\":\"\",\"taken_at\":123,\"return_deadline\":456,\"returned\":false,\"returned_at\":0,\"renewals\":0,\"status\":\"open\"}}\n", rr.Body.String()); diff != "" {
+			t.Errorf("response body mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestPostLoansV2(t *testing.T) {
+	// POST /api/v2/loans
+
+	testV2(t, []v2Case{
+		{
+			name:        "basic",
+			method:      "POST",
+			path:        "/api/v2/loans",
+			token:       "Bearer good-token",
+			contentType: "application/json",
+			body:        `{"book_id": "good-book", "notes": "a coffee stain on page 12"}`,
+			code:        http.StatusOK,
+			want:        "{}\n",
+		},
+		{
+			name:        "copy and user",
+			method:      "POST",
+			path:        "/api/v2/loans",
+			token:       "Bearer good-token",
+			contentType: "application/json; charset=utf-8",
+			body:        `{"user_id": "good-user", "book_id": "good-book", "barcode": "0001"}`,
+			code:        http.StatusOK,
+			want:        "{}\n",
+		},
+		{
+			name:        "override",
+			method:      "POST",
+			path:        "/api/v2/loans",
+			token:       "Bearer good-token",
+			contentType: "application/json",
+			body:        `{"user_id": "overdue-user", "book_id": "limited-book", "override_limits": true, "override_overdue": true}`,
+			code:        http.StatusOK,
+			want:        "{}\n",
+		},
+		{
+			name:        "limits",
+			method:      "POST",
+			path:        "/api/v2/loans",
+			token:       "Bearer good-token",
+			contentType: "application/json",
+			body:        `{"book_id": "limited-book"}`,
+			code:        http.StatusConflict,
+			want:        "{\"type\":\"urn:loan-service:problem:limit_exceeded\",\"title\":\"loan limit exceeded\",\"status\":409,\"code\":\"limit_exceeded\"}\n",
+		},
+		{
+			name:        "no stock",
+			method:      "POST",
+			path:        "/api/v2/loans",
+			token:       "Bearer good-token",
+			contentType: "application/json",
+			body:        `{"book_id": "bad-book"}`,
+			code:        http.StatusNotFound,
+			want:        "{\"type\":\"urn:loan-service:problem:no_stock\",\"title\":\"insufficient stock\",\"status\":404,\"code\":\"no_stock\"}\n",
+		},
+		{
+			name:        "no book",
+			method:      "POST",
+			path:        "/api/v2/loans",
+			token:       "Bearer good-token",
+			contentType: "application/json",
+			body:        `{"user_id": "good-user"}`,
+			code:        http.StatusBadRequest,
+			want:        "{\"type\":\"urn:loan-service:problem:missing_params\",\"title\":\"missing required parameters\",\"status\":400,\"detail\":\"missing required parameters: \\\"book_id\\\"\",\"code\":\"missing_params\"}\n",
+		},
+		{
+			name:        "unknown field",
+			method:      "POST",
+			path:        "/api/v2/loans",
+			token:       "Bearer good-token",
+			contentType: "application/json",
+			body:        `{"book_id": "good-book", "auth": "good-token"}`,
+			code:        http.StatusBadRequest,
+			want:        "{\"type\":\"urn:loan-service:problem:missing_params\",\"title\":\"missing required parameters\",\"status\":400,\"detail\":\"missing required parameters: malformed request body: json: unknown field \\\"auth\\\"\",\"code\":\"missing_params\"}\n",
+		},
+		{
+			name:        "form body",
+			method:      "POST",
+			path:        "/api/v2/loans",
+			token:       "Bearer good-token",
+			contentType: "application/x-www-form-urlencoded",
+			body:        "book_id=good-book",
+			code:        http.StatusBadRequest,
+			want:        "{\"type\":\"urn:loan-service:problem:missing_params\",\"title\":\"missing required parameters\",\"status\":400,\"detail\":\"missing required parameters: expected a body of type application/json\",\"code\":\"missing_params\"}\n",
+		},
+		{
+			name:        "bad token",
+			method:      "POST",
+			path:        "/api/v2/loans",
+			token:       "Bearer bad-token",
+			contentType: "application/json",
+			body:        `{"book_id": "good-book"}`,
+			code:        http.StatusForbidden,
+			want:        "{\"type\":\"urn:loan-service:problem:forbidden\",\"title\":\"insufficient permissions\",\"status\":403,\"code\":\"forbidden\"}\n",
+		},
+	})
+}
+
+func TestPostReturnsV2(t *testing.T) {
+	// POST /api/v2/returns
+
+	testV2(t, []v2Case{
+		{
+			name:        "book",
+			method:      "POST",
+			path:        "/api/v2/returns",
+			token:       "Bearer good-token",
+			contentType: "application/json",
+			body:        `{"user_id": "good-user", "book_id": "good-book"}`,
+			code:        http.StatusOK,
+			want:        "{}\n",
+		},
+		{
+			name:        "copy",
+			method:      "POST",
+			path:        "/api/v2/returns",
+			token:       "Bearer good-token",
+			contentType: "application/json",
+			body:        `{"barcode": "0001"}`,
+			code:        http.StatusOK,
+			want:        "{}\n",
+		},
+		{
+			name:        "bad book",
+			method:      "POST",
+			path:        "/api/v2/returns",
+			token:       "Bearer good-token",
+			contentType: "application/json",
+			body:        `{"book_id": "bad-book"}`,
+			code:        http.StatusNotFound,
+			want:        "{\"type\":\"urn:loan-service:problem:not_found\",\"title\":\"object not found\",\"status\":404,\"code\":\"not_found\"}\n",
+		},
+		{
+			name:        "bad copy",
+			method:      "POST",
+			path:        "/api/v2/returns",
+			token:       "Bearer good-token",
+			contentType: "application/json",
+			body:        `{"barcode": "bad-barcode"}`,
+			code:        http.StatusNotFound,
+			want:        "{\"type\":\"urn:loan-service:problem:not_found\",\"title\":\"object not found\",\"status\":404,\"code\":\"not_found\"}\n",
+		},
+		{
+			name:        "both book and copy",
+			method:      "POST",
+			path:        "/api/v2/returns",
+			token:       "Bearer good-token",
+			contentType: "application/json",
+			body:        `{"book_id": "good-book", "barcode": "0001"}`,
+			code:        http.StatusBadRequest,
+			want:        "{\"type\":\"urn:loan-service:problem:missing_params\",\"title\":\"missing required parameters\",\"status\":400,\"detail\":\"missing required parameters: either \\\"book_id\\\" or \\\"barcode\\\"\",\"code\":\"missing_params\"}\n",
+		},
+		{
+			name:        "malformed body",
+			method:      "POST",
+			path:        "/api/v2/returns",
+			token:       "Bearer good-token",
+			contentType: "application/json",
+			body:        `{"book_id": "good-book"} {}`,
+			code:        http.StatusBadRequest,
+			want:        "{\"type\":\"urn:loan-service:problem:missing_params\",\"title\":\"missing required parameters\",\"status\":400,\"detail\":\"missing required parameters: malformed request body: unexpected data after the object\",\"code\":\"missing_params\"}\n",
+		},
+	})
+}
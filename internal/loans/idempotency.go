@@ -0,0 +1,157 @@
+package loans
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/fail"
+)
+
+// Clients may retry mutating requests safely by sending the same "Idempotency-Key" header:
+// the response to the first request is saved and replayed on retries, instead of repeating
+// the request (see Service.BeginIdempotentRequest)
+
+const (
+	idempotencyKeyHeader      = "Idempotency-Key"
+	idempotencyReplayedHeader = "Idempotent-Replayed"
+
+	// maxIdempotencyKeyLength limits the length of the idempotency keys
+	maxIdempotencyKeyLength = 255
+)
+
+// useIdempotencyKeys replays the saved responses to POST requests with a used idempotency key
+func (h *Handler) useIdempotencyKeys(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if r.Method != http.MethodPost || key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			fail.WriteError(w, r, fmt.Errorf(
+				"%w: %q must be at most %d characters long",
+				fail.ErrMissingParams, idempotencyKeyHeader, maxIdempotencyKeyLength,
+			))
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+		if err != nil {
+			fail.WriteError(w, r, fmt.Errorf("%w: failed to read request body: %w", fail.ErrMissingParams, err))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		err = r.ParseForm()
+		if err != nil {
+			fail.WriteError(w, r, fmt.Errorf("%w: %w", fail.ErrMissingParams, err))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		// Keys are scoped to the client, so that clients can't replay the responses to each other
+		key = hashHex([]byte(requestToken(r))) + ":" + key
+		fingerprint := requestFingerprint(r, body)
+
+		record, err := h.service.BeginIdempotentRequest(r.Context(), key, fingerprint)
+		if err != nil {
+			fail.WriteError(w, r, err)
+			return
+		}
+		if record != nil {
+			if !record.Done {
+				fail.WriteError(w, r, fmt.Errorf("%w: a request with this idempotency key is in progress", fail.ErrCollision))
+				return
+			}
+
+			w.Header().Set("Content-Type", record.ContentType)
+			w.Header().Set(idempotencyReplayedHeader, "true")
+			w.WriteHeader(record.Status)
+			w.Write(record.Body)
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		// The outcome is saved even if the client has gone away, since it's the one to retry
+		ctx := context.WithoutCancel(r.Context())
+		if !savedStatus(recorder.status) {
+			// The request may succeed if retried
+			err = h.service.AbandonIdempotentRequest(ctx, key)
+		} else {
+			err = h.service.FinishIdempotentRequest(ctx, &IdempotencyRecord{
+				Key:         key,
+				Fingerprint: fingerprint,
+				Status:      recorder.status,
+				ContentType: recorder.Header().Get("Content-Type"),
+				Body:        recorder.body.Bytes(),
+			})
+			if err != nil {
+				err = errors.Join(err, h.service.AbandonIdempotentRequest(ctx, key))
+			}
+		}
+		if err != nil {
+			log.Printf("failed to save the outcome of the request with idempotency key %q: %v", key, err)
+		}
+	})
+}
+
+// savedStatus tells if the response with the status is to be replayed on retries.
+// Server failures may be gone on retry, and so may rejected tokens or permissions:
+// the keys are reserved before the token is verified, so these are never saved
+func savedStatus(status int) bool {
+	switch {
+	case status >= http.StatusInternalServerError:
+		return false
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return false
+	default:
+		return true
+	}
+}
+
+// requestFingerprint identifies the parameters of the request, to tell retries from key reuse
+func requestFingerprint(r *http.Request, body []byte) string {
+	hash := sha256.New()
+	for _, part := range []string{r.Method, r.URL.RequestURI(), r.Header.Get("Content-Type")} {
+		hash.Write([]byte(part))
+		hash.Write([]byte{0})
+	}
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// hashHex returns the hex-encoded SHA-256 hash of the data
+func hashHex(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+// responseRecorder passes the response through, keeping a copy of it
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(data []byte) (int, error) {
+	r.wroteHeader = true
+	r.body.Write(data)
+	return r.ResponseWriter.Write(data)
+}
@@ -0,0 +1,169 @@
+package loans_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/go-cmp/cmp"
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/clock"
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/loans"
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/loans/mock"
+)
+
+func TestIdempotencyKeys(t *testing.T) {
+	// The requests share the router, so that the retries see the saved responses
+	router := chi.NewRouter()
+	h := loans.NewHandler(router, chi.NewRouter(), mock.NewService(), clock.NewFake(time.Unix(12345, 0)))
+	h.Register()
+
+	cases := []struct {
+		name     string
+		path     string
+		token    string
+		key      string
+		body     string
+		code     int
+		replayed bool
+		want     string
+	}{
+		{
+			name: "first take",
+			path: "/api/v2/loans",
+			key:  "key-1",
+			body: `{"book_id":"good-book"}`,
+			code: http.StatusOK,
+			want: "{}\n",
+		},
+		{
+			name:     "retried take",
+			path:     "/api/v2/loans",
+			key:      "key-1",
+			body:     `{"book_id":"good-book"}`,
+			code:     http.StatusOK,
+			replayed: true,
+			want:     "{}\n",
+		},
+		{
+			name: "reused key",
+			path: "/api/v2/loans",
+			key:  "key-1",
+			body: `{"book_id":"other-book"}`,
+			code: http.StatusUnprocessableEntity,
+			want: "{\"type\":\"urn:loan-service:problem:idempotency_mismatch\",\"title\":\"idempotency key reused with different parameters\",\"status\":422,\"code\":\"idempotency_mismatch\"}\n",
+		},
+		{
+			name:  "key of another client",
+			path:  "/api/v2/loans",
+			token: "other-token",
+			key:   "key-1",
+			body:  `{"book_id":"other-book"}`,
+			code:  http.StatusOK,
+			want:  "{}\n",
+		},
+		{
+			name: "first failure",
+			path: "/api/v2/loans",
+			key:  "key-2",
+			body: `{"book_id":"bad-book"}`,
+			code: http.StatusNotFound,
+			want: "{\"type\":\"urn:loan-service:problem:no_stock\",\"title\":\"insufficient stock\",\"status\":404,\"code\":\"no_stock\"}\n",
+		},
+		{
+			name:     "retried failure",
+			path:     "/api/v2/loans",
+			key:      "key-2",
+			body:     `{"book_id":"bad-book"}`,
+			code:     http.StatusNotFound,
+			replayed: true,
+			want:     "{\"type\":\"urn:loan-service:problem:no_stock\",\"title\":\"insufficient stock\",\"status\":404,\"code\":\"no_stock\"}\n",
+		},
+		{
+			name:  "first forbidden",
+			path:  "/api/v2/loans",
+			token: "bad-token",
+			key:   "key-4",
+			body:  `{"book_id":"good-book"}`,
+			code:  http.StatusForbidden,
+			want:  "{\"type\":\"urn:loan-service:problem:forbidden\",\"title\":\"insufficient permissions\",\"status\":403,\"code\":\"forbidden\"}\n",
+		},
+		{
+			name:  "retried forbidden",
+			path:  "/api/v2/loans",
+			token: "bad-token",
+			key:   "key-4",
+			body:  `{"book_id":"good-book"}`,
+			code:  http.StatusForbidden,
+			want:  "{\"type\":\"urn:loan-service:problem:forbidden\",\"title\":\"insufficient permissions\",\"status\":403,\"code\":\"forbidden\"}\n",
+		},
+		{
+			name: "in progress",
+			path: "/api/v2/returns",
+			key:  "busy-key",
+			body: `{"book_id":"good-book"}`,
+			code: http.StatusConflict,
+			want: "{\"type\":\"urn:loan-service:problem:collision\",\"title\":\"object already exists\",\"status\":409,\"detail\":\"object already exists: a request with this idempotency key is in progress\",\"code\":\"collision\"}\n",
+		},
+		{
+			name: "without key",
+			path: "/api/v2/returns",
+			body: `{"book_id":"good-book"}`,
+			code: http.StatusOK,
+			want: "{}\n",
+		},
+		{
+			name: "long key",
+			path: "/api/v2/returns",
+			key:  strings.Repeat("k", 256),
+			body: `{"book_id":"good-book"}`,
+			code: http.StatusBadRequest,
+			want: "{\"type\":\"urn:loan-service:problem:missing_params\",\"title\":\"missing required parameters\",\"status\":400,\"detail\":\"missing required parameters: \\\"Idempotency-Key\\\" must be at most 255 characters long\",\"code\":\"missing_params\"}\n",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", c.path, strings.NewReader(c.body))
+			token := c.token
+			if token == "" {
+				token = "good-token"
+			}
+			r.Header.Set("Authorization", "Bearer "+token)
+			r.Header.Set("Content-Type", "application/json")
+			if c.key != "" {
+				r.Header.Set("Idempotency-Key", c.key)
+			}
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, r)
+
+			if rr.Code != c.code {
+				t.Errorf("unexpected status code: want %d, got %d", c.code, rr.Code)
+			}
+			if diff := cmp.Diff(c.want, rr.Body.String()); diff != "" {
+				t.Errorf("response body mismatch (-want +got):\n%s", diff)
+			}
+			if replayed := rr.Header().Get("Idempotent-Replayed") == "true"; replayed != c.replayed {
+				t.Errorf("unexpected replay: want %t, got %t", c.replayed, replayed)
+			}
+		})
+	}
+
+	t.Run("form", func(t *testing.T) {
+		for i, replayed := range []bool{false, true} {
+			r := httptest.NewRequest("POST", "/api/v1/book/good-book/take", strings.NewReader("auth=good-token"))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.Header.Set("Idempotency-Key", "key-3")
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, r)
+
+			if rr.Code != http.StatusOK {
+				t.Errorf("request %d: unexpected status code: want %d, got %d", i, http.StatusOK, rr.Code)
+			}
+			if got := rr.Header().Get("Idempotent-Replayed") == "true"; got != replayed {
+				t.Errorf("request %d: unexpected replay: want %t, got %t", i, replayed, got)
+			}
+		}
+	})
+}
@@ -5,7 +5,8 @@ import (
 	"time"
 )
 
-// LentBook stores the information about a book being lent to a user
+// LentBook stores the information about a book being lent to a user.
+// Here and elsewhere, timestamps are in milliseconds, see ToTimestamp
 type LentBook struct {
 	// ID is the UUID of the operation
 	ID string `json:"id"`
@@ -13,63 +14,415 @@ type LentBook struct {
 	UserID string `json:"user_id"`
 	// BookID is the UUID of the book being lent
 	BookID string `json:"book_id"`
+	// CopyID is the UUID of the physical copy being lent,
+	// or empty if the book had no registered copies
+	CopyID string `json:"copy_id"`
 	// TakenAt is the timestamp (UTC) when the book was taken
 	TakenAt uint64 `json:"taken_at"`
 	// ReturnDeadline is the timestamp (UTC) when the book should be returned
 	ReturnDeadline uint64 `json:"return_deadline"`
-	// Returned is true if the book is already returned
+	// Returned is true if the loan is already closed (see Status for how)
 	Returned bool `json:"returned"`
-	// ReturnedAt is the timestamp (UTC) when the book was returned, if it was already
+	// ReturnedAt is the timestamp (UTC) when the loan was closed, if it was already
 	ReturnedAt uint64 `json:"returned_at"`
+	// Renewals is the number of times the return deadline has been extended
+	Renewals uint `json:"renewals"`
+	// Status tells whether the loan is still open and how it was closed otherwise
+	Status LoanStatus `json:"status"`
+	// Notes is a free-form remark left by whoever registered the takeout, e.g. about the copy's state
+	Notes string `json:"notes,omitempty"`
+}
+
+// LoanStatus is the state of a loan
+type LoanStatus string
+
+const (
+	// LoanOpen means the book is yet to be returned
+	LoanOpen LoanStatus = "open"
+	// LoanReturned means the book has been returned intact
+	LoanReturned LoanStatus = "returned"
+	// LoanLost means the user has lost the book
+	LoanLost LoanStatus = "lost"
+	// LoanDamaged means the book has been returned damaged
+	LoanDamaged LoanStatus = "damaged"
+	// LoanWrittenOff means the library has given up on getting the book back
+	LoanWrittenOff LoanStatus = "written_off"
+)
+
+// Copy stores the information about a physical copy of a book
+type Copy struct {
+	// ID is the UUID of the copy
+	ID string `json:"id"`
+	// BookID is the UUID of the book this is a copy of
+	BookID string `json:"book_id"`
+	// Barcode is the unique label attached to the copy
+	Barcode string `json:"barcode"`
+	// Condition is the physical state of the copy
+	Condition CopyCondition `json:"condition"`
+	// ShelfLocation tells where the copy is stored when it's not lent out
+	ShelfLocation string `json:"shelf_location"`
+}
+
+// CopyCondition is the physical state of a copy
+type CopyCondition string
+
+const (
+	// CopyGood means the copy is as good as new
+	CopyGood CopyCondition = "good"
+	// CopyWorn means the copy shows signs of use, but can still be lent out
+	CopyWorn CopyCondition = "worn"
+	// CopyDamaged means the copy needs repair before it can be lent out again
+	CopyDamaged CopyCondition = "damaged"
+	// CopyWithdrawn means the copy is permanently out of circulation
+	CopyWithdrawn CopyCondition = "withdrawn"
+)
+
+// Hold stores the information about a user waiting for a book that is out of stock
+type Hold struct {
+	// ID is the UUID of the hold
+	ID string `json:"id"`
+	// UserID is the UUID of the user waiting for the book
+	UserID string `json:"user_id"`
+	// BookID is the UUID of the book being waited for
+	BookID string `json:"book_id"`
+	// PlacedAt is the timestamp (UTC) when the hold was placed
+	PlacedAt uint64 `json:"placed_at"`
+	// PickupWindow is the number of milliseconds a returned copy stays reserved for the user
+	PickupWindow uint64 `json:"pickup_window"`
+	// ReservedUntil is the timestamp (UTC) until which a copy is reserved for the user,
+	// or 0 if the user is still waiting in the queue
+	ReservedUntil uint64 `json:"reserved_until"`
+}
+
+// Fine stores the information about a fee charged to a user
+type Fine struct {
+	// ID is the UUID of the fine
+	ID string `json:"id"`
+	// UserID is the UUID of the user being charged
+	UserID string `json:"user_id"`
+	// LoanID is the UUID of the loan the fine is charged for
+	LoanID string `json:"loan_id"`
+	// BookID is the UUID of the book the fine is charged for
+	BookID string `json:"book_id"`
+	// Reason tells what the fine is charged for
+	Reason FineReason `json:"reason"`
+	// Amount is the fee in minor currency units
+	Amount uint64 `json:"amount"`
+	// IssuedAt is the timestamp (UTC) when the fine was charged
+	IssuedAt uint64 `json:"issued_at"`
+	// Status tells whether the fine is still to be paid
+	Status FineStatus `json:"status"`
+	// ResolvedAt is the timestamp (UTC) when the fine was paid or waived, if it was already
+	ResolvedAt uint64 `json:"resolved_at"`
+}
+
+// FineReason is what a fine is charged for
+type FineReason string
+
+const (
+	// FineLate means the book was returned after the deadline
+	FineLate FineReason = "late"
+	// FineReplacement means the book was lost or damaged and has to be replaced
+	FineReplacement FineReason = "replacement"
+)
+
+// FineStatus is the state of a fine
+type FineStatus string
+
+const (
+	// FineOutstanding means the fine is yet to be paid
+	FineOutstanding FineStatus = "outstanding"
+	// FinePaid means the fine has been paid
+	FinePaid FineStatus = "paid"
+	// FineWaived means a librarian has cancelled the fine
+	FineWaived FineStatus = "waived"
+)
+
+// UserLoans stores the summary of a user's debts to the library
+type UserLoans struct {
+	// Unreturned is the number of books the user has yet to return
+	Unreturned uint `json:"unreturned"`
+	// OutstandingFines is the total amount of the user's unpaid fines, in minor currency units
+	OutstandingFines uint64 `json:"outstanding_fines"`
+}
+
+// ClockState describes the time the service lives in
+type ClockState struct {
+	// Now is the current timestamp (UTC) according to the service
+	Now uint64 `json:"now"`
+	// Offset is how many milliseconds the service clock is ahead of the real time (negative if behind)
+	Offset int64 `json:"offset"`
+}
+
+// IdempotencyRecord is the outcome of a request made with an idempotency key,
+// replayed when the request is retried with the same key
+type IdempotencyRecord struct {
+	// Key is the idempotency key, scoped to the client that has sent it
+	Key string `json:"key"`
+	// Fingerprint identifies the parameters of the request, which retries must repeat
+	Fingerprint string `json:"fingerprint"`
+	// Done is false while the original request is still being handled
+	Done bool `json:"done"`
+	// Status is the HTTP status code of the response
+	Status int `json:"status"`
+	// ContentType is the type of the response body
+	ContentType string `json:"content_type"`
+	// Body is the response body
+	Body []byte `json:"body"`
+	// ExpiresAt is the timestamp (UTC) when the key may be used anew
+	ExpiresAt uint64 `json:"expires_at"`
 }
 
 // Service is the interface for the business logic module of this microservice
 type Service interface {
 	// TakeBook records than a book is taken at the current date and time,
 	// if it is in stock and the user has permission to take it.
-	// If userID is not empty, the book is taken on behalf of the user with the given ID
-	TakeBook(ctx context.Context, authToken string, userID string, bookID string) error
+	// If userID is not empty, the book is taken on behalf of the user with the given ID.
+	// If barcode is not empty, that particular copy is lent out, otherwise a free copy is picked.
+	// The notes are kept with the loan as is.
+	// Setting any of the overrides requires PermLoanBooks
+	TakeBook(
+		ctx context.Context,
+		authToken string,
+		userID string,
+		bookID string,
+		barcode string,
+		notes string,
+		overrides TakeOverrides,
+	) error
 
 	// ReturnBook records than a book is returned at the current date and time,
 	// if the user has permission to do so (is the one who had taken the book or a librarian).
 	// If userID is not empty, the book is returned on behalf of the user with the given ID
 	ReturnBook(ctx context.Context, authToken string, userID string, bookID string) error
 
+	// ReturnLoan records that the book lent out in the loan with the given ID is returned
+	// at the current date and time, if the user has permission to do so
+	// (is the one who had taken the book or a librarian)
+	ReturnLoan(ctx context.Context, authToken string, loanID string) error
+
+	// GetLoan returns the loan with the given ID, if the user has permission to inquire this
+	// (is the one who had taken the book or a librarian)
+	GetLoan(ctx context.Context, authToken string, loanID string) (LentBook, error)
+
+	// ListUserLoans returns the loans of a user matching the filter in the given order, a page at a time,
+	// if the user has permission to inquire this (is the one who had taken the books or a librarian).
+	// If userID is not empty, the loans of the user with the given ID are listed
+	ListUserLoans(
+		ctx context.Context,
+		authToken string,
+		userID string,
+		filter LoanFilter,
+		order LoanSort,
+		page Page,
+	) (LoanPage, error)
+
+	// ReturnCopy records that the copy with the given barcode is returned at the current date and time,
+	// if the user has permission to do so (is the one who had taken the copy or a librarian)
+	ReturnCopy(ctx context.Context, authToken string, barcode string) error
+
+	// CloseLoan records that a book taken by a user is lost, returned damaged or written off
+	// (according to status) at the current date and time, if the user has permission to do so.
+	// If userID is not empty, the loan of the user with the given ID is closed
+	CloseLoan(ctx context.Context, authToken string, userID string, bookID string, status LoanStatus) error
+
+	// RenewLoan extends the return deadline of a book taken by a user,
+	// if the user has permission to do so (is the one who had taken the book or a librarian).
+	// Overdue loans may only be renewed by a librarian.
+	// If userID is not empty, the loan is renewed on behalf of the user with the given ID
+	RenewLoan(ctx context.Context, authToken string, userID string, bookID string) error
+
+	// PlaceHold puts the user in the queue for a book that is out of stock,
+	// if the user has permission to do so (is the one waiting for the book or a librarian).
+	// If userID is not empty, the hold is placed on behalf of the user with the given ID
+	PlaceHold(ctx context.Context, authToken string, userID string, bookID string) error
+
+	// CancelHold removes the user from the queue for a book,
+	// if the user has permission to do so (is the one waiting for the book or a librarian).
+	// If userID is not empty, the hold is cancelled on behalf of the user with the given ID
+	CancelHold(ctx context.Context, authToken string, userID string, bookID string) error
+
+	// ListHolds returns the list of holds in queue order, if the user has permission to inquire this.
+	// If either of (userID, bookID) is empty, that criterion is ignored,
+	// except that users without PermQueryReservations only see their own holds
+	ListHolds(ctx context.Context, authToken string, userID string, bookID string) ([]Hold, error)
+
+	// RegisterCopy adds a physical copy of a book to the inventory,
+	// if the user has permission to do so
+	RegisterCopy(
+		ctx context.Context,
+		authToken string,
+		bookID string,
+		barcode string,
+		condition CopyCondition,
+		shelfLocation string,
+	) (Copy, error)
+
+	// UpdateCopy changes the condition and the shelf location of the copy with the given barcode,
+	// if the user has permission to do so. Empty arguments leave the corresponding field unchanged
+	UpdateCopy(
+		ctx context.Context,
+		authToken string,
+		barcode string,
+		condition CopyCondition,
+		shelfLocation string,
+	) (Copy, error)
+
+	// ListCopies returns the registered copies of the given book,
+	// if the user has permission to inquire this
+	ListCopies(ctx context.Context, authToken string, bookID string) ([]Copy, error)
+
 	// CountAvailableBook returns the number of copies available for the given book,
 	// if the user has permission to inquire this.
 	CountAvailableBook(ctx context.Context, authToken string, bookID string) (uint, error)
 
 	// ListReservations returns the list of books lent out at
-	// the given time (now by default), if the user has permission to do so.
-	ListReservations(ctx context.Context, authToken string, at time.Time) ([]LentBook, error)
+	// the given time (now by default), a page at a time, if the user has permission to do so.
+	ListReservations(ctx context.Context, authToken string, at time.Time, page Page) (LoanPage, error)
 
 	// ListOverdue returns the list of books that will become overdue by
-	// the given time (now by default), if the user has permission to do so.
-	ListOverdue(ctx context.Context, authToken string, at time.Time) ([]LentBook, error)
+	// the given time (now by default), a page at a time, if the user has permission to do so.
+	ListOverdue(ctx context.Context, authToken string, at time.Time, page Page) (LoanPage, error)
+
+	// ListFines returns the list of fines charged to a user, if the user has permission to inquire this
+	// (is the one being charged or a librarian).
+	// If userID is not empty, the fines of the user with the given ID are listed
+	ListFines(ctx context.Context, authToken string, userID string) ([]Fine, error)
+
+	// PayFine records that an outstanding fine has been paid, if the user has permission to do so
+	PayFine(ctx context.Context, authToken string, fineID string) error
+
+	// WaiveFine cancels an outstanding fine, if the user has permission to do so
+	WaiveFine(ctx context.Context, authToken string, fineID string) error
+
+	// GetClock returns the current time of the service, if the user is an administrator
+	GetClock(ctx context.Context, authToken string) (ClockState, error)
+
+	// TravelInTime moves the service clock to be the given offset ahead of the real time,
+	// if time travel is enabled (on staging environments only) and the user is an administrator
+	TravelInTime(ctx context.Context, authToken string, offset time.Duration) (ClockState, error)
 
 	// GetUserLoans returns how many unreturned lent books a particular user has at the moment
-	GetUserLoans(ctx context.Context, userID string) (uint, error)
+	// and how much the user owes in fines
+	GetUserLoans(ctx context.Context, userID string) (UserLoans, error)
+
+	// InvalidateBook drops what is cached about the book, e.g. after its stock has changed
+	// in the book service. Does nothing unless the book service connection caches the books
+	InvalidateBook(ctx context.Context, bookID string) error
+
+	// RevokeToken drops what is cached about the auth token, e.g. after the user has logged out
+	// or lost permissions. Does nothing unless the user service connection caches the tokens
+	RevokeToken(ctx context.Context, authToken string) error
+
+	// BeginIdempotentRequest reserves the idempotency key for a request with the given fingerprint.
+	// If the key has already been used, the saved record is returned instead: a done one
+	// is to be replayed, otherwise the original request is still being handled.
+	// Reusing a key for a request with another fingerprint fails with fail.ErrIdempotencyMismatch
+	BeginIdempotentRequest(ctx context.Context, key string, fingerprint string) (*IdempotencyRecord, error)
+
+	// FinishIdempotentRequest saves the outcome of the request with a reserved key (record.Key),
+	// to be replayed on retries for as long as the policy says
+	FinishIdempotentRequest(ctx context.Context, record *IdempotencyRecord) error
+
+	// AbandonIdempotentRequest releases the key of a request that has failed and may be retried
+	AbandonIdempotentRequest(ctx context.Context, key string) error
 
 	// TODO: Some statistics? Clean up database?
 }
 
 // Repo is the interface for the memory module of this microservice
 type Repo interface {
-	// FindLentBooks returns the list of books lent out at the given time
-	FindLentBooks(ctx context.Context, at time.Time) ([]LentBook, error)
+	// FindLentBooks lists the books lent out at the given time, ordered by the time they were taken,
+	// a page at a time. page.Limit must be positive
+	FindLentBooks(ctx context.Context, at time.Time, page Page) (LoanPage, error)
 
-	// FindOverdueBooks returns the list of books that will become overdue by the given time
-	FindOverdueBooks(ctx context.Context, at time.Time) ([]LentBook, error)
+	// FindOverdueBooks lists the books that will become overdue by the given time,
+	// ordered by the return deadline, a page at a time. page.Limit must be positive
+	FindOverdueBooks(ctx context.Context, at time.Time, page Page) (LoanPage, error)
 
 	// TakeBook tests that the book isn't out of stock and registers it as taken.
+	// If the book has registered copies, the stock is computed from them instead of totalStock,
+	// and book.CopyID is filled with a free copy unless a particular one is requested.
+	// Copies reserved for other users' holds are not considered in stock,
+	// and the user's own hold on the book, if any, is fulfilled.
+	// Returns fail.ErrLimitExceeded if the user already has as many books as limits allow.
 	// book's fields must be set as if it was already taken
-	TakeBook(ctx context.Context, book *LentBook, totalStock uint) error
+	TakeBook(ctx context.Context, book *LentBook, totalStock uint, limits LoanLimits) error
 
-	// ReturnBook tests that the book is taken and registers it as returned.
+	// ReturnBook tests that the book is taken and registers it as returned
+	// or otherwise closed (according to book.Status), charging the given fines.
+	// If the loan has a registered copy, a lost or written off copy is withdrawn
+	// and a damaged one is marked as such. A copy returned intact
+	// is reserved for the next hold in the queue, if any.
 	// book's fields must be set as if it was already returned
-	ReturnBook(ctx context.Context, book *LentBook) error
+	ReturnBook(ctx context.Context, book *LentBook, fines []Fine) error
+
+	// RenewLoan tests that the book is taken and registers the renewal.
+	// book's fields must be set as if it was already renewed
+	RenewLoan(ctx context.Context, book *LentBook) error
+
+	// CountOverdueLoansOf returns the number of loans of a particular user
+	// that are overdue by the given time and still not returned
+	CountOverdueLoansOf(ctx context.Context, userID string, at time.Time) (uint, error)
+
+	// GetLoan returns the loan with the given ID
+	GetLoan(ctx context.Context, loanID string) (LentBook, error)
 
 	// FindLoansOf finds all loans of a particular book by a particular user.
-	// If either of (userID, bookID) is empty, that criterion is ignored
+	// If either of (userID, bookID) is empty, that criterion is ignored.
+	// The loans are ordered by taking time and then by ID
 	FindLoansOf(ctx context.Context, userID string, bookID string) ([]LentBook, error)
+
+	// FindLoans lists the loans matching the filter in the given order, a page at a time.
+	// page.Limit must be positive
+	FindLoans(ctx context.Context, filter LoanFilter, order LoanSort, page Page) (LoanPage, error)
+
+	// InsertCopy tests that neither the ID nor the barcode of the copy are taken and registers it
+	InsertCopy(ctx context.Context, bookCopy *Copy) error
+
+	// UpdateCopy tests that the copy exists and overwrites it
+	UpdateCopy(ctx context.Context, bookCopy *Copy) error
+
+	// LookupCopy returns the copy with the given barcode
+	LookupCopy(ctx context.Context, barcode string) (Copy, error)
+
+	// FindCopies finds all registered copies of a particular book, ordered by barcode
+	FindCopies(ctx context.Context, bookID string) ([]Copy, error)
+
+	// LookupFine returns the fine with the given ID
+	LookupFine(ctx context.Context, fineID string) (Fine, error)
+
+	// FindFines finds all fines charged to a particular user, ordered by the time they were issued
+	FindFines(ctx context.Context, userID string) ([]Fine, error)
+
+	// ResolveFine tests that the fine is outstanding and registers it as paid or waived.
+	// fine's fields must be set as if it was already resolved
+	ResolveFine(ctx context.Context, fine *Fine) error
+
+	// PlaceHold tests that the user isn't already waiting for the book
+	// and puts the hold at the end of the book's queue.
+	// hold's fields must be set as if it was already placed
+	PlaceHold(ctx context.Context, hold *Hold) error
+
+	// CancelHold removes the hold from the queue at the given time,
+	// passing the copy reserved for it (if any) on to the next hold in the queue
+	CancelHold(ctx context.Context, hold *Hold, at time.Time) error
+
+	// FindHolds finds all holds on a particular book by a particular user
+	// as of the given time, in queue order.
+	// If either of (userID, bookID) is empty, that criterion is ignored
+	FindHolds(ctx context.Context, userID string, bookID string, at time.Time) ([]Hold, error)
+
+	// ReserveIdempotencyKey saves the record unless an unexpired one with the same key exists
+	// at the given time, failing with fail.ErrCollision then. Expired records are dropped
+	ReserveIdempotencyKey(ctx context.Context, record *IdempotencyRecord, at time.Time) error
+
+	// LookupIdempotencyKey returns the record with the given key, unless it is expired at the given time
+	LookupIdempotencyKey(ctx context.Context, key string, at time.Time) (IdempotencyRecord, error)
+
+	// CompleteIdempotencyKey tests that the record with the key exists and overwrites it
+	CompleteIdempotencyKey(ctx context.Context, record *IdempotencyRecord) error
+
+	// ReleaseIdempotencyKey removes the record with the given key, if any
+	ReleaseIdempotencyKey(ctx context.Context, key string) error
 }
@@ -2,6 +2,8 @@ package mock
 
 import (
 	"context"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/mipt-kp-2024-go-beer/loan-service/internal/fail"
@@ -9,12 +11,25 @@ import (
 )
 
 func NewService() loans.Service {
-	return &implService{}
+	return &implService{
+		idempotencyKeys: make(map[string]loans.IdempotencyRecord),
+	}
 }
 
-type implService struct{}
+type implService struct {
+	mutex           sync.Mutex
+	idempotencyKeys map[string]loans.IdempotencyRecord
+}
 
-func (s *implService) TakeBook(ctx context.Context, authToken string, userID string, bookID string) error {
+func (s *implService) TakeBook(
+	ctx context.Context,
+	authToken string,
+	userID string,
+	bookID string,
+	barcode string,
+	notes string,
+	overrides loans.TakeOverrides,
+) error {
 	if authToken == "bad-token" {
 		return fail.ErrForbidden
 	}
@@ -23,6 +38,18 @@ func (s *implService) TakeBook(ctx context.Context, authToken string, userID str
 		return fail.ErrNoStock
 	}
 
+	if barcode == "bad-barcode" {
+		return fail.ErrNotFound
+	}
+
+	if bookID == "limited-book" && !overrides.Limits {
+		return fail.ErrLimitExceeded
+	}
+
+	if userID == "overdue-user" && !overrides.Overdue {
+		return fail.ErrHasOverdue
+	}
+
 	return nil
 }
 
@@ -38,6 +65,227 @@ func (s *implService) ReturnBook(ctx context.Context, authToken string, userID s
 	return nil
 }
 
+func (s *implService) ReturnLoan(ctx context.Context, authToken string, loanID string) error {
+	if authToken == "bad-token" {
+		return fail.ErrForbidden
+	}
+
+	if loanID == "bad-loan" {
+		return fail.ErrNotFound
+	}
+
+	return nil
+}
+
+func (s *implService) GetLoan(ctx context.Context, authToken string, loanID string) (loans.LentBook, error) {
+	if authToken == "bad-token" {
+		return loans.LentBook{}, fail.ErrForbidden
+	}
+
+	if loanID == "bad-loan" {
+		return loans.LentBook{}, fail.ErrNotFound
+	}
+
+	return loans.LentBook{
+		ID:             loanID,
+		UserID:         "user-id",
+		BookID:         "book-id",
+		TakenAt:        123000,
+		ReturnDeadline: 456000,
+		Returned:       false,
+		ReturnedAt:     0,
+		Renewals:       0,
+		Status:         loans.LoanOpen,
+	}, nil
+}
+
+func (s *implService) ListUserLoans(
+	ctx context.Context,
+	authToken string,
+	userID string,
+	filter loans.LoanFilter,
+	order loans.LoanSort,
+	page loans.Page,
+) (loans.LoanPage, error) {
+	if authToken == "bad-token" {
+		return loans.LoanPage{}, fail.ErrForbidden
+	}
+
+	if page.Cursor == "bad-cursor" {
+		return loans.LoanPage{}, fail.ErrMissingParams
+	}
+
+	return loans.LoanPage{
+		Loans: []loans.LentBook{
+			{
+				ID:             "loan-id",
+				UserID:         userID,
+				BookID:         "book-id",
+				TakenAt:        123000,
+				ReturnDeadline: 456000,
+				Returned:       false,
+				ReturnedAt:     0,
+				Renewals:       0,
+				Status:         loans.LoanOpen,
+			},
+		},
+		NextCursor: "next-cursor",
+		Total:      1,
+	}, nil
+}
+
+func (s *implService) ReturnCopy(ctx context.Context, authToken string, barcode string) error {
+	if authToken == "bad-token" {
+		return fail.ErrForbidden
+	}
+
+	if barcode == "bad-barcode" {
+		return fail.ErrNotFound
+	}
+
+	return nil
+}
+
+func (s *implService) CloseLoan(
+	ctx context.Context,
+	authToken string,
+	userID string,
+	bookID string,
+	status loans.LoanStatus,
+) error {
+	if authToken == "bad-token" {
+		return fail.ErrForbidden
+	}
+
+	if status != loans.LoanLost && status != loans.LoanDamaged && status != loans.LoanWrittenOff {
+		return fail.ErrMissingParams
+	}
+
+	if bookID == "bad-book" {
+		return fail.ErrNotFound
+	}
+
+	return nil
+}
+
+func (s *implService) RenewLoan(ctx context.Context, authToken string, userID string, bookID string) error {
+	if authToken == "bad-token" {
+		return fail.ErrForbidden
+	}
+
+	if bookID == "bad-book" {
+		return fail.ErrRenewalLimit
+	}
+
+	return nil
+}
+
+func (s *implService) PlaceHold(ctx context.Context, authToken string, userID string, bookID string) error {
+	if authToken == "bad-token" {
+		return fail.ErrForbidden
+	}
+
+	if bookID == "bad-book" {
+		return fail.ErrCollision
+	}
+
+	return nil
+}
+
+func (s *implService) CancelHold(ctx context.Context, authToken string, userID string, bookID string) error {
+	if authToken == "bad-token" {
+		return fail.ErrForbidden
+	}
+
+	if bookID == "bad-book" {
+		return fail.ErrNotFound
+	}
+
+	return nil
+}
+
+func (s *implService) ListHolds(ctx context.Context, authToken string, userID string, bookID string) ([]loans.Hold, error) {
+	if authToken == "bad-token" {
+		return nil, fail.ErrForbidden
+	}
+
+	return []loans.Hold{
+		{
+			ID:            "hold-id",
+			UserID:        "user-id",
+			BookID:        "book-id",
+			PlacedAt:      123000,
+			PickupWindow:  100000,
+			ReservedUntil: 0,
+		},
+	}, nil
+}
+
+func (s *implService) RegisterCopy(
+	ctx context.Context,
+	authToken string,
+	bookID string,
+	barcode string,
+	condition loans.CopyCondition,
+	shelfLocation string,
+) (loans.Copy, error) {
+	if authToken == "bad-token" {
+		return loans.Copy{}, fail.ErrForbidden
+	}
+
+	if barcode == "bad-barcode" {
+		return loans.Copy{}, fail.ErrCollision
+	}
+
+	return loans.Copy{
+		ID:            "copy-id",
+		BookID:        bookID,
+		Barcode:       barcode,
+		Condition:     condition,
+		ShelfLocation: shelfLocation,
+	}, nil
+}
+
+func (s *implService) UpdateCopy(
+	ctx context.Context,
+	authToken string,
+	barcode string,
+	condition loans.CopyCondition,
+	shelfLocation string,
+) (loans.Copy, error) {
+	if authToken == "bad-token" {
+		return loans.Copy{}, fail.ErrForbidden
+	}
+
+	if barcode == "bad-barcode" {
+		return loans.Copy{}, fail.ErrNotFound
+	}
+
+	return loans.Copy{
+		ID:            "copy-id",
+		BookID:        "book-id",
+		Barcode:       barcode,
+		Condition:     condition,
+		ShelfLocation: shelfLocation,
+	}, nil
+}
+
+func (s *implService) ListCopies(ctx context.Context, authToken string, bookID string) ([]loans.Copy, error) {
+	if authToken == "bad-token" {
+		return nil, fail.ErrForbidden
+	}
+
+	return []loans.Copy{
+		{
+			ID:            "copy-id",
+			BookID:        bookID,
+			Barcode:       "0001",
+			Condition:     loans.CopyGood,
+			ShelfLocation: "A-1",
+		},
+	}, nil
+}
+
 func (s *implService) CountAvailableBook(ctx context.Context, authToken string, bookID string) (uint, error) {
 	if authToken == "bad-token" {
 		return 0, fail.ErrForbidden
@@ -50,42 +298,189 @@ func (s *implService) CountAvailableBook(ctx context.Context, authToken string,
 	return 10, nil
 }
 
-func (s *implService) ListReservations(ctx context.Context, authToken string, at time.Time) ([]loans.LentBook, error) {
+func (s *implService) ListReservations(
+	ctx context.Context,
+	authToken string,
+	at time.Time,
+	page loans.Page,
+) (loans.LoanPage, error) {
 	if authToken == "bad-token" {
-		return nil, fail.ErrForbidden
+		return loans.LoanPage{}, fail.ErrForbidden
 	}
 
-	return []loans.LentBook{
-		{
-			ID:             "loan-id",
-			UserID:         "user-id",
-			BookID:         "book-id",
-			TakenAt:        123,
-			ReturnDeadline: 456,
-			Returned:       false,
-			ReturnedAt:     0,
+	if page.Cursor == "bad-cursor" {
+		return loans.LoanPage{}, fail.ErrMissingParams
+	}
+
+	return loans.LoanPage{
+		Loans: []loans.LentBook{
+			{
+				ID:             "loan-id",
+				UserID:         "user-id",
+				BookID:         "book-id",
+				TakenAt:        123000,
+				ReturnDeadline: 456000,
+				Returned:       false,
+				ReturnedAt:     0,
+				Renewals:       0,
+				Status:         loans.LoanOpen,
+			},
+		},
+		NextCursor: "next-cursor",
+		Total:      1,
+	}, nil
+}
+
+func (s *implService) ListOverdue(
+	ctx context.Context,
+	authToken string,
+	at time.Time,
+	page loans.Page,
+) (loans.LoanPage, error) {
+	if authToken == "bad-token" {
+		return loans.LoanPage{}, fail.ErrForbidden
+	}
+
+	if page.Cursor == "bad-cursor" {
+		return loans.LoanPage{}, fail.ErrMissingParams
+	}
+
+	return loans.LoanPage{
+		Loans: []loans.LentBook{
+			{
+				ID:             "loan-id",
+				UserID:         "user-id",
+				BookID:         "book-id",
+				TakenAt:        123000,
+				ReturnDeadline: 456000,
+				Returned:       false,
+				ReturnedAt:     0,
+				Renewals:       0,
+				Status:         loans.LoanOpen,
+			},
 		},
+		NextCursor: "next-cursor",
+		Total:      1,
 	}, nil
 }
 
-func (s *implService) ListOverdue(ctx context.Context, authToken string, at time.Time) ([]loans.LentBook, error) {
+func (s *implService) ListFines(ctx context.Context, authToken string, userID string) ([]loans.Fine, error) {
 	if authToken == "bad-token" {
 		return nil, fail.ErrForbidden
 	}
 
-	return []loans.LentBook{
+	return []loans.Fine{
 		{
-			ID:             "loan-id",
-			UserID:         "user-id",
-			BookID:         "book-id",
-			TakenAt:        123,
-			ReturnDeadline: 456,
-			Returned:       false,
-			ReturnedAt:     0,
+			ID:         "fine-id",
+			UserID:     "user-id",
+			LoanID:     "loan-id",
+			BookID:     "book-id",
+			Reason:     loans.FineLate,
+			Amount:     300,
+			IssuedAt:   789000,
+			Status:     loans.FineOutstanding,
+			ResolvedAt: 0,
 		},
 	}, nil
 }
 
-func (s *implService) GetUserLoans(ctx context.Context, userID string) (uint, error) {
-	return 123, nil
+func (s *implService) PayFine(ctx context.Context, authToken string, fineID string) error {
+	if authToken == "bad-token" {
+		return fail.ErrForbidden
+	}
+
+	if fineID == "bad-fine" {
+		return fail.ErrNotFound
+	}
+
+	return nil
+}
+
+func (s *implService) WaiveFine(ctx context.Context, authToken string, fineID string) error {
+	if authToken == "bad-token" {
+		return fail.ErrForbidden
+	}
+
+	if fineID == "bad-fine" {
+		return fail.ErrNotFound
+	}
+
+	return nil
+}
+
+func (s *implService) GetClock(ctx context.Context, authToken string) (loans.ClockState, error) {
+	if authToken == "bad-token" {
+		return loans.ClockState{}, fail.ErrForbidden
+	}
+
+	return loans.ClockState{
+		Now:    1000000,
+		Offset: 0,
+	}, nil
+}
+
+func (s *implService) TravelInTime(ctx context.Context, authToken string, offset time.Duration) (loans.ClockState, error) {
+	if authToken == "bad-token" {
+		return loans.ClockState{}, fail.ErrForbidden
+	}
+
+	return loans.ClockState{
+		Now:    1000000 + uint64(offset.Milliseconds()),
+		Offset: offset.Milliseconds(),
+	}, nil
+}
+
+func (s *implService) GetUserLoans(ctx context.Context, userID string) (loans.UserLoans, error) {
+	return loans.UserLoans{
+		Unreturned:       123,
+		OutstandingFines: 456,
+	}, nil
+}
+
+func (s *implService) InvalidateBook(ctx context.Context, bookID string) error {
+	return nil
+}
+
+func (s *implService) RevokeToken(ctx context.Context, authToken string) error {
+	return nil
+}
+
+func (s *implService) BeginIdempotentRequest(
+	ctx context.Context,
+	key string,
+	fingerprint string,
+) (*loans.IdempotencyRecord, error) {
+	if strings.HasSuffix(key, ":busy-key") {
+		return &loans.IdempotencyRecord{Key: key, Fingerprint: fingerprint}, nil
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	saved, ok := s.idempotencyKeys[key]
+	if !ok {
+		s.idempotencyKeys[key] = loans.IdempotencyRecord{Key: key, Fingerprint: fingerprint}
+		return nil, nil
+	}
+	if saved.Fingerprint != fingerprint {
+		return nil, fail.ErrIdempotencyMismatch
+	}
+	return &saved, nil
+}
+
+func (s *implService) FinishIdempotentRequest(ctx context.Context, record *loans.IdempotencyRecord) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	record.Done = true
+	s.idempotencyKeys[record.Key] = *record
+	return nil
+}
+
+func (s *implService) AbandonIdempotentRequest(ctx context.Context, key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.idempotencyKeys, key)
+	return nil
 }
@@ -0,0 +1,468 @@
+package loans_test
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"math/rand/v2"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/clock"
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/fail"
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/loans"
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/loans/mock"
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/loans/repo"
+)
+
+var modelSeed = flag.Uint64("model.seed", 0, "seed of the model-based test, random if 0")
+
+// The model-based test runs random sequences of operations through the service
+// and compares every result to the one predicted by a simple reference model.
+// A failing sequence is shrunk to a minimal one before being reported.
+// To reproduce a failure, rerun with the reported -model.seed
+func TestService_Model(t *testing.T) {
+	seed := *modelSeed
+	if seed == 0 {
+		seed = rand.Uint64()
+	}
+	t.Logf("seed: %d", seed)
+
+	backends := []struct {
+		name    string
+		runs    int
+		newRepo func(t *testing.T) loans.Repo
+	}{
+		{
+			name: "memory",
+			runs: 200,
+			newRepo: func(t *testing.T) loans.Repo {
+				return repo.NewMemoryRepo("memory://")
+			},
+		},
+		{
+			name: "sqlite",
+			runs: 20,
+			newRepo: func(t *testing.T) loans.Repo {
+				result, err := repo.NewSqliteRepo("sqlite://" + filepath.Join(t.TempDir(), "loans.sqlite"))
+				if err != nil {
+					t.Fatalf("failed to open repo: %v", err)
+				}
+				t.Cleanup(func() { result.(io.Closer).Close() })
+				return result
+			},
+		},
+		{
+			name: "file",
+			runs: 20,
+			newRepo: func(t *testing.T) loans.Repo {
+				result, err := repo.NewFileRepo("file://" + t.TempDir())
+				if err != nil {
+					t.Fatalf("failed to open repo: %v", err)
+				}
+				t.Cleanup(func() { result.(io.Closer).Close() })
+				return result
+			},
+		},
+	}
+
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			runs := backend.runs
+			if testing.Short() {
+				runs = max(runs/10, 1)
+			}
+
+			rng := rand.New(rand.NewPCG(seed, 0))
+			for range runs {
+				ops := generateModelOps(rng, 80)
+
+				check := func(ops []modelOp) error {
+					return runModel(t, backend.newRepo(t), ops)
+				}
+				err := check(ops)
+				if err == nil {
+					continue
+				}
+
+				ops = shrinkModelOps(ops, func(ops []modelOp) bool {
+					return check(ops) != nil
+				})
+				t.Fatalf(
+					"seed %d: the service diverges from the model: %v\nminimal sequence:\n%s",
+					seed, check(ops), formatModelOps(ops),
+				)
+			}
+		})
+	}
+}
+
+var (
+	modelUsers = []string{"vasya-pupkin", "user-1", "user-2", "user-3"}
+	modelBooks = map[string]uint{"single-book": 1, "multi-book": 5}
+	modelSteps = []time.Duration{time.Minute, time.Hour, 23 * time.Hour, 48 * time.Hour, 72 * time.Hour}
+)
+
+type modelOpKind string
+
+const (
+	opAdvance          modelOpKind = "advance"
+	opTake             modelOpKind = "take"
+	opReturn           modelOpKind = "return"
+	opRenew            modelOpKind = "renew"
+	opCountAvailable   modelOpKind = "count_available"
+	opUserLoans        modelOpKind = "user_loans"
+	opListFines        modelOpKind = "list_fines"
+	opListReservations modelOpKind = "list_reservations"
+	opListOverdue      modelOpKind = "list_overdue"
+)
+
+// modelOp is a single step of a test sequence. Only the fields relevant to the kind are set
+type modelOp struct {
+	kind   modelOpKind
+	token  string
+	userID string
+	bookID string
+	step   time.Duration
+}
+
+func (op modelOp) String() string {
+	switch op.kind {
+	case opAdvance:
+		return fmt.Sprintf("%s(%v)", op.kind, op.step)
+	case opTake, opReturn, opRenew:
+		return fmt.Sprintf("%s(%s, %s, %s)", op.kind, op.token, op.userID, op.bookID)
+	case opCountAvailable:
+		return fmt.Sprintf("%s(%s)", op.kind, op.bookID)
+	case opUserLoans:
+		return fmt.Sprintf("%s(%s)", op.kind, op.userID)
+	case opListFines:
+		return fmt.Sprintf("%s(%s, %s)", op.kind, op.token, op.userID)
+	}
+	return string(op.kind)
+}
+
+func formatModelOps(ops []modelOp) string {
+	var result strings.Builder
+	for i, op := range ops {
+		fmt.Fprintf(&result, "%3d: %v\n", i, op)
+	}
+	return result.String()
+}
+
+func generateModelOps(rng *rand.Rand, length int) []modelOp {
+	pick := func(values []string) string {
+		return values[rng.IntN(len(values))]
+	}
+	token := func() string {
+		// Mostly a librarian acting for anybody, sometimes a regular user who may only act for self
+		if rng.IntN(4) == 0 {
+			return "token-regular-user"
+		}
+		return "token-librarian"
+	}
+	bookIDs := slices.Sorted(maps.Keys(modelBooks))
+
+	result := make([]modelOp, 0, length)
+	for range length {
+		var op modelOp
+		switch n := rng.IntN(20); {
+		case n < 3:
+			op = modelOp{kind: opAdvance, step: modelSteps[rng.IntN(len(modelSteps))]}
+		case n < 8:
+			op = modelOp{kind: opTake, token: token(), userID: pick(modelUsers), bookID: pick(bookIDs)}
+		case n < 12:
+			op = modelOp{kind: opReturn, token: token(), userID: pick(modelUsers), bookID: pick(bookIDs)}
+		case n < 14:
+			op = modelOp{kind: opRenew, token: token(), userID: pick(modelUsers), bookID: pick(bookIDs)}
+		case n < 15:
+			op = modelOp{kind: opCountAvailable, bookID: pick(bookIDs)}
+		case n < 16:
+			op = modelOp{kind: opUserLoans, userID: pick(modelUsers)}
+		case n < 17:
+			op = modelOp{kind: opListFines, token: token(), userID: pick(modelUsers)}
+		case n < 18:
+			op = modelOp{kind: opListReservations}
+		default:
+			op = modelOp{kind: opListOverdue}
+		}
+		result = append(result, op)
+	}
+	return result
+}
+
+// shrinkModelOps removes as many operations from a failing sequence as possible
+// while keeping it failing: first in large chunks, then one by one
+func shrinkModelOps(ops []modelOp, fails func([]modelOp) bool) []modelOp {
+	for chunk := len(ops) / 2; chunk > 0; chunk /= 2 {
+		for start := 0; start < len(ops); {
+			end := min(start+chunk, len(ops))
+			candidate := slices.Concat(ops[:start], ops[end:])
+			if fails(candidate) {
+				ops = candidate
+			} else {
+				start = end
+			}
+		}
+	}
+	return ops
+}
+
+// modelLoan is the reference model's view of a loan
+type modelLoan struct {
+	userID   string
+	bookID   string
+	deadline uint64
+	renewals uint
+	returned bool
+}
+
+// model is the reference implementation of the lending rules, as simple as possible.
+// Every user may have at most one unreturned copy of a book, so which loan
+// an operation applies to is never ambiguous. Times are in milliseconds, like the stored timestamps
+type model struct {
+	now   uint64
+	loans []modelLoan
+	fines map[string][]uint64
+}
+
+var modelPolicy = func() loans.Policy {
+	policy := makePolicy()
+	policy.Limits.PerBookPerUser = 1
+	return policy
+}()
+
+func (m *model) openLoans(match func(loan *modelLoan) bool) []*modelLoan {
+	result := make([]*modelLoan, 0)
+	for i := range m.loans {
+		if !m.loans[i].returned && match(&m.loans[i]) {
+			result = append(result, &m.loans[i])
+		}
+	}
+	return result
+}
+
+func (m *model) loanOf(userID string, bookID string) *modelLoan {
+	found := m.openLoans(func(loan *modelLoan) bool {
+		return loan.userID == userID && loan.bookID == bookID
+	})
+	if len(found) == 0 {
+		return nil
+	}
+	return found[0]
+}
+
+func (m *model) take(token string, userID string, bookID string) error {
+	if token != "token-librarian" && userID != "vasya-pupkin" {
+		return fail.ErrForbidden
+	}
+
+	graceDeadline := m.now - uint64(overdueGracePeriod.Milliseconds())
+	overdue := m.openLoans(func(loan *modelLoan) bool {
+		return loan.userID == userID && loan.deadline <= graceDeadline
+	})
+	if len(overdue) != 0 {
+		return fail.ErrHasOverdue
+	}
+
+	userLoans := m.openLoans(func(loan *modelLoan) bool {
+		return loan.userID == userID
+	})
+	if len(userLoans) >= maxLoansPerUser || m.loanOf(userID, bookID) != nil {
+		return fail.ErrLimitExceeded
+	}
+
+	bookLoans := m.openLoans(func(loan *modelLoan) bool {
+		return loan.bookID == bookID
+	})
+	if uint(len(bookLoans)) >= modelBooks[bookID] {
+		return fail.ErrNoStock
+	}
+
+	m.loans = append(m.loans, modelLoan{
+		userID:   userID,
+		bookID:   bookID,
+		deadline: m.now + uint64(bookReturnDeadline.Milliseconds()),
+	})
+	return nil
+}
+
+func (m *model) returnBook(token string, userID string, bookID string) error {
+	if token != "token-librarian" && userID != "vasya-pupkin" {
+		return fail.ErrForbidden
+	}
+
+	loan := m.loanOf(userID, bookID)
+	if loan == nil {
+		return fail.ErrNotFound
+	}
+
+	loan.returned = true
+	if m.now > loan.deadline {
+		const day = uint64(24 * 60 * 60 * 1000)
+		daysLate := (m.now - loan.deadline + day - 1) / day
+		m.fines[userID] = append(m.fines[userID], min(daysLate*finePerDay, fineCap))
+	}
+	return nil
+}
+
+func (m *model) renew(token string, userID string, bookID string) error {
+	if token != "token-librarian" && userID != "vasya-pupkin" {
+		return fail.ErrForbidden
+	}
+
+	loan := m.loanOf(userID, bookID)
+	if loan == nil {
+		return fail.ErrNotFound
+	}
+
+	if loan.renewals >= maxRenewals {
+		return fail.ErrRenewalLimit
+	}
+
+	base := loan.deadline
+	if loan.deadline <= m.now {
+		if token != "token-librarian" {
+			return fail.ErrForbidden
+		}
+		base = m.now
+	}
+
+	loan.deadline = base + uint64(bookReturnDeadline.Milliseconds())
+	loan.renewals += 1
+	return nil
+}
+
+// describeLoans summarizes the loans for comparison, ignoring their order
+func describeLoans(loans []loans.LentBook) []string {
+	result := make([]string, 0, len(loans))
+	for _, loan := range loans {
+		result = append(result, fmt.Sprintf("%s/%s/%d/%d", loan.UserID, loan.BookID, loan.ReturnDeadline, loan.Renewals))
+	}
+	slices.Sort(result)
+	return result
+}
+
+func describeModelLoans(loans []*modelLoan) []string {
+	result := make([]string, 0, len(loans))
+	for _, loan := range loans {
+		result = append(result, fmt.Sprintf("%s/%s/%d/%d", loan.userID, loan.bookID, loan.deadline, loan.renewals))
+	}
+	slices.Sort(result)
+	return result
+}
+
+// runModel runs the operations through a service on top of the given empty repo
+// and returns the first divergence from the model, if any
+func runModel(t *testing.T, loanRepo loans.Repo, ops []modelOp) error {
+	t.Helper()
+
+	ctx := context.Background()
+	m := &model{
+		now:   1_700_000_000_000,
+		loans: make([]modelLoan, 0),
+		fines: make(map[string][]uint64),
+	}
+	serviceClock := clock.NewFake(time.UnixMilli(int64(m.now)))
+	service := loans.NewService(loanRepo, mock.NewUsersConn(), mock.NewBooksConn(), modelPolicy, serviceClock)
+
+	expectError := func(want error, got error) error {
+		if (want == nil) != (got == nil) || (want != nil && !errors.Is(got, want)) {
+			return fmt.Errorf("wrong error: want %v, got %v", want, got)
+		}
+		return nil
+	}
+
+	for i, op := range ops {
+		var err error
+		switch op.kind {
+		case opAdvance:
+			m.now += uint64(op.step.Milliseconds())
+			serviceClock.Advance(op.step)
+
+		case opTake:
+			got := service.TakeBook(ctx, op.token, op.userID, op.bookID, "", "", loans.TakeOverrides{})
+			err = expectError(m.take(op.token, op.userID, op.bookID), got)
+
+		case opReturn:
+			got := service.ReturnBook(ctx, op.token, op.userID, op.bookID)
+			err = expectError(m.returnBook(op.token, op.userID, op.bookID), got)
+
+		case opRenew:
+			got := service.RenewLoan(ctx, op.token, op.userID, op.bookID)
+			err = expectError(m.renew(op.token, op.userID, op.bookID), got)
+
+		case opCountAvailable:
+			got, gotErr := service.CountAvailableBook(ctx, "token-regular-user", op.bookID)
+			err = expectError(nil, gotErr)
+			bookLoans := m.openLoans(func(loan *modelLoan) bool {
+				return loan.bookID == op.bookID
+			})
+			if want := modelBooks[op.bookID] - uint(len(bookLoans)); err == nil && got != want {
+				err = fmt.Errorf("wrong number available: want %d, got %d", want, got)
+			}
+
+		case opUserLoans:
+			got, gotErr := service.GetUserLoans(ctx, op.userID)
+			err = expectError(nil, gotErr)
+			userLoans := m.openLoans(func(loan *modelLoan) bool {
+				return loan.userID == op.userID
+			})
+			want := loans.UserLoans{Unreturned: uint(len(userLoans))}
+			for _, amount := range m.fines[op.userID] {
+				want.OutstandingFines += amount
+			}
+			if diff := cmp.Diff(want, got); err == nil && diff != "" {
+				err = fmt.Errorf("wrong user loans (-want +got):\n%s", diff)
+			}
+
+		case opListFines:
+			got, gotErr := service.ListFines(ctx, op.token, op.userID)
+			var wantErr error
+			if op.token != "token-librarian" && op.userID != "vasya-pupkin" {
+				wantErr = fail.ErrForbidden
+			}
+			err = expectError(wantErr, gotErr)
+			if err == nil && wantErr == nil {
+				gotAmounts := make([]uint64, 0, len(got))
+				for _, fine := range got {
+					gotAmounts = append(gotAmounts, fine.Amount)
+				}
+				slices.Sort(gotAmounts)
+				wantAmounts := append(make([]uint64, 0), m.fines[op.userID]...)
+				slices.Sort(wantAmounts)
+				if diff := cmp.Diff(wantAmounts, gotAmounts); diff != "" {
+					err = fmt.Errorf("wrong fines (-want +got):\n%s", diff)
+				}
+			}
+
+		case opListReservations, opListOverdue:
+			list, match := service.ListReservations, func(loan *modelLoan) bool { return true }
+			if op.kind == opListOverdue {
+				list, match = service.ListOverdue, func(loan *modelLoan) bool { return loan.deadline <= m.now }
+			}
+			got, gotErr := list(ctx, "token-regular-user", time.UnixMilli(int64(m.now)), loans.Page{Limit: loans.MaxPageLimit})
+			err = expectError(nil, gotErr)
+			want := describeModelLoans(m.openLoans(match))
+			if diff := cmp.Diff(want, describeLoans(got.Loans)); err == nil && diff != "" {
+				err = fmt.Errorf("wrong loans (-want +got):\n%s", diff)
+			}
+			if err == nil && got.Total != uint(len(want)) {
+				err = fmt.Errorf("wrong total: want %d, got %d", len(want), got.Total)
+			}
+		}
+
+		if err != nil {
+			return fmt.Errorf("step %d (%v): %w", i, op, err)
+		}
+	}
+
+	return nil
+}
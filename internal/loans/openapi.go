@@ -0,0 +1,23 @@
+package loans
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// openAPISpec is the OpenAPI document describing every route of both servers.
+// Keep it in sync with Register, TestOpenAPISpec checks the routes
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// OpenAPISpec returns the OpenAPI document of the service
+func OpenAPISpec() []byte {
+	return openAPISpec
+}
+
+func getOpenAPISpec(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(openAPISpec)
+}
@@ -0,0 +1,141 @@
+package loans_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/go-cmp/cmp"
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/clock"
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/loans"
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/loans/mock"
+)
+
+// walkRoutes returns "METHOD /path" for every route registered in the router
+func walkRoutes(t *testing.T, router chi.Routes) []string {
+	t.Helper()
+
+	result := make([]string, 0)
+	err := chi.Walk(router, func(method string, route string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
+		result = append(result, method+" "+route)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to walk routes: %v", err)
+	}
+
+	sort.Strings(result)
+	return result
+}
+
+// collectRefs returns all "$ref" values found in the document
+func collectRefs(node any, refs map[string]bool) {
+	switch node := node.(type) {
+	case map[string]any:
+		for key, value := range node {
+			if ref, ok := value.(string); ok && key == "$ref" {
+				refs[ref] = true
+			}
+			collectRefs(value, refs)
+		}
+	case []any:
+		for _, value := range node {
+			collectRefs(value, refs)
+		}
+	}
+}
+
+func TestOpenAPISpec(t *testing.T) {
+	var spec struct {
+		OpenAPI    string                               `json:"openapi"`
+		Paths      map[string]map[string]map[string]any `json:"paths"`
+		Components map[string]map[string]any            `json:"components"`
+	}
+	err := json.Unmarshal(loans.OpenAPISpec(), &spec)
+	if err != nil {
+		t.Fatalf("malformed spec: %v", err)
+	}
+	if !strings.HasPrefix(spec.OpenAPI, "3.") {
+		t.Errorf("unexpected OpenAPI version %q", spec.OpenAPI)
+	}
+
+	router := chi.NewRouter()
+	routerInternal := chi.NewRouter()
+	h := loans.NewHandler(router, routerInternal, mock.NewService(), clock.NewFake(time.Unix(12345, 0)))
+	h.Register()
+
+	t.Run("routes documented", func(t *testing.T) {
+		registered := make(map[string]bool)
+		for _, routes := range []chi.Routes{router, routerInternal} {
+			for _, route := range walkRoutes(t, routes) {
+				registered[route] = true
+			}
+		}
+
+		for route := range registered {
+			method, path, _ := strings.Cut(route, " ")
+			if _, ok := spec.Paths[path][strings.ToLower(method)]; !ok {
+				t.Errorf("route %s is missing from the spec", route)
+			}
+		}
+
+		for path, operations := range spec.Paths {
+			for method := range operations {
+				route := strings.ToUpper(method) + " " + path
+				if !registered[route] {
+					t.Errorf("route %s is in the spec but not registered", route)
+				}
+			}
+		}
+	})
+
+	t.Run("operations", func(t *testing.T) {
+		operationIDs := make(map[string]string)
+		for path, operations := range spec.Paths {
+			for method, operation := range operations {
+				route := strings.ToUpper(method) + " " + path
+				id, _ := operation["operationId"].(string)
+				if id == "" {
+					t.Errorf("route %s has no operationId", route)
+				} else if other, ok := operationIDs[id]; ok {
+					t.Errorf("routes %s and %s share operationId %q", route, other, id)
+				}
+				operationIDs[id] = route
+
+				if _, ok := operation["responses"].(map[string]any)["200"]; !ok {
+					t.Errorf("route %s has no success response", route)
+				}
+			}
+		}
+	})
+
+	t.Run("references resolve", func(t *testing.T) {
+		refs := make(map[string]bool)
+		collectRefs(map[string]any{"paths": spec.Paths, "components": spec.Components}, refs)
+		for ref := range refs {
+			section, name, _ := strings.Cut(strings.TrimPrefix(ref, "#/components/"), "/")
+			if _, ok := spec.Components[section][name]; !ok {
+				t.Errorf("unresolved reference %q", ref)
+			}
+		}
+	})
+
+	t.Run("served", func(t *testing.T) {
+		for _, routes := range []http.Handler{router, routerInternal} {
+			rr := httptest.NewRecorder()
+			routes.ServeHTTP(rr, httptest.NewRequest("GET", "/openapi.json", nil))
+
+			if rr.Code != http.StatusOK {
+				t.Errorf("unexpected status code: want %d, got %d", http.StatusOK, rr.Code)
+			}
+			if diff := cmp.Diff(string(loans.OpenAPISpec()), rr.Body.String()); diff != "" {
+				t.Errorf("response body mismatch (-want +got):\n%s", diff)
+			}
+		}
+	})
+}
@@ -0,0 +1,145 @@
+package loans
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/fail"
+)
+
+const (
+	// DefaultPageLimit is the page size used when the client doesn't specify one
+	DefaultPageLimit = 50
+	// MaxPageLimit is the largest page size a client may request
+	MaxPageLimit = 500
+)
+
+// LoanState selects loans by whether they are still open
+type LoanState string
+
+const (
+	// LoanStateAny matches all loans
+	LoanStateAny LoanState = ""
+	// LoanStateOpen matches the loans whose books are yet to be returned
+	LoanStateOpen LoanState = "open"
+	// LoanStateReturned matches the closed loans
+	LoanStateReturned LoanState = "returned"
+	// LoanStateOverdue matches the open loans past their return deadline
+	LoanStateOverdue LoanState = "overdue"
+)
+
+// Valid returns true if the state is one of the known ones
+func (s LoanState) Valid() bool {
+	switch s {
+	case LoanStateAny, LoanStateOpen, LoanStateReturned, LoanStateOverdue:
+		return true
+	}
+	return false
+}
+
+// LoanSort selects the order in which loans are listed
+type LoanSort string
+
+const (
+	// SortTakenAsc lists the loans from the earliest taken to the latest
+	SortTakenAsc LoanSort = "taken_asc"
+	// SortTakenDesc lists the loans from the latest taken to the earliest
+	SortTakenDesc LoanSort = "taken_desc"
+)
+
+// Valid returns true if the sort order is one of the known ones
+func (s LoanSort) Valid() bool {
+	return s == SortTakenAsc || s == SortTakenDesc
+}
+
+// LoanFilter stores the criteria for listing loans
+type LoanFilter struct {
+	// UserID is the UUID of the user whose loans are listed
+	UserID string
+	// BookID is the UUID of the book whose loans are listed, or empty for any book
+	BookID string
+	// State restricts the loans by whether they are still open
+	State LoanState
+	// TakenFrom is the timestamp (UTC) before which the loans were not taken, inclusive
+	TakenFrom uint64
+	// TakenUntil is the timestamp (UTC) by which the loans were taken, exclusive, or 0 for no bound
+	TakenUntil uint64
+	// At is the timestamp (UTC) at which loans are tested for being overdue
+	At uint64
+}
+
+// Matches returns true if the loan satisfies the filter
+func (f *LoanFilter) Matches(book *LentBook) bool {
+	if book.UserID != f.UserID || (f.BookID != "" && book.BookID != f.BookID) {
+		return false
+	}
+	if book.TakenAt < f.TakenFrom || (f.TakenUntil != 0 && book.TakenAt >= f.TakenUntil) {
+		return false
+	}
+
+	switch f.State {
+	case LoanStateOpen:
+		return !book.Returned
+	case LoanStateReturned:
+		return book.Returned
+	case LoanStateOverdue:
+		return !book.Returned && book.ReturnDeadline <= f.At
+	}
+	return true
+}
+
+// Page selects a slice of a listing
+type Page struct {
+	// Limit is the maximum number of items on the page
+	Limit uint
+	// Cursor is the opaque position returned along with the previous page, or empty for the first page
+	Cursor string
+}
+
+// LoanPage stores a slice of a loan listing
+type LoanPage struct {
+	// Loans lists the loans on the page
+	Loans []LentBook `json:"loans"`
+	// NextCursor is the position of the next page, or empty if this is the last one
+	NextCursor string `json:"next_cursor"`
+	// Total is the number of loans in the whole listing
+	Total uint `json:"total"`
+}
+
+// Cursor is the decoded position in a listing: the sort key and the ID of the last item listed
+type Cursor struct {
+	Key uint64
+	ID  string
+}
+
+// Encode returns the opaque representation of the cursor
+func (c Cursor) Encode() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatUint(c.Key, 10) + ":" + c.ID))
+}
+
+// DecodeCursor parses the opaque representation of a cursor.
+// An empty string is decoded as nil, meaning the start of the listing
+func DecodeCursor(encoded string) (*Cursor, error) {
+	if encoded == "" {
+		return nil, nil
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed cursor", fail.ErrMissingParams)
+	}
+
+	key, id, ok := strings.Cut(string(raw), ":")
+	if !ok {
+		return nil, fmt.Errorf("%w: malformed cursor", fail.ErrMissingParams)
+	}
+
+	keyValue, err := strconv.ParseUint(key, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed cursor", fail.ErrMissingParams)
+	}
+
+	return &Cursor{Key: keyValue, ID: id}, nil
+}
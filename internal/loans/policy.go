@@ -0,0 +1,119 @@
+package loans
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/fail"
+)
+
+// Policy stores the library rules the service enforces when lending books
+type Policy struct {
+	// ReturnDeadline is the time span that a user has to return a book after it has been taken
+	ReturnDeadline time.Duration
+	// MaxRenewals is the number of times a single loan's return deadline may be extended
+	MaxRenewals uint
+	// HoldPickupWindow is the time span that a returned copy stays reserved for the next user in the queue
+	HoldPickupWindow time.Duration
+	// Limits restricts the number of books a user may have at once
+	Limits LoanLimits
+	// OverdueGracePeriod is the time span after the return deadline during which
+	// an overdue loan doesn't yet prevent the user from taking more books
+	OverdueGracePeriod time.Duration
+	// Fines determines the late fees charged for overdue returns
+	Fines FineRates
+	// IdempotencyKeyTTL is the time span that the outcome of a request with an idempotency key
+	// is replayed to the retries
+	IdempotencyKeyTTL time.Duration
+}
+
+// FineRates stores the rules for computing late fees, in minor currency units
+type FineRates struct {
+	// PerDay is the fee for each started day past the return deadline
+	PerDay uint64
+	// Cap is the maximum fee for a single loan, or 0 for no cap
+	Cap uint64
+	// Replacement is the fee for a lost or damaged book, or 0 to not charge it
+	Replacement uint64
+}
+
+// Compute returns the fee for a book returned at returnedAt with the given return deadline
+func (f FineRates) Compute(returnDeadline uint64, returnedAt uint64) uint64 {
+	if returnedAt <= returnDeadline {
+		return 0
+	}
+
+	day := ToMillis(24 * time.Hour)
+	daysLate := (returnedAt - returnDeadline + day - 1) / day
+
+	amount := daysLate * f.PerDay
+	if f.Cap != 0 && amount > f.Cap {
+		amount = f.Cap
+	}
+	return amount
+}
+
+// ComputeFor returns the fines charged for closing the loan in its current status.
+// Late fees are charged for books that are returned, replacement fees for books that can't be lent out again
+func (f FineRates) ComputeFor(lentBook *LentBook) []Fine {
+	result := make([]Fine, 0)
+
+	addFine := func(reason FineReason, amount uint64) {
+		if amount == 0 {
+			return
+		}
+		result = append(result, Fine{
+			ID:         uuid.NewString(),
+			UserID:     lentBook.UserID,
+			LoanID:     lentBook.ID,
+			BookID:     lentBook.BookID,
+			Reason:     reason,
+			Amount:     amount,
+			IssuedAt:   lentBook.ReturnedAt,
+			Status:     FineOutstanding,
+			ResolvedAt: 0,
+		})
+	}
+
+	switch lentBook.Status {
+	case LoanReturned:
+		addFine(FineLate, f.Compute(lentBook.ReturnDeadline, lentBook.ReturnedAt))
+	case LoanDamaged:
+		addFine(FineLate, f.Compute(lentBook.ReturnDeadline, lentBook.ReturnedAt))
+		addFine(FineReplacement, f.Replacement)
+	case LoanLost:
+		addFine(FineReplacement, f.Replacement)
+	}
+
+	return result
+}
+
+// TakeOverrides lists the lending restrictions a librarian chooses to ignore when registering a takeout
+type TakeOverrides struct {
+	// Limits ignores the loan limits
+	Limits bool
+	// Overdue ignores the user's overdue loans
+	Overdue bool
+}
+
+// LoanLimits stores the caps on the number of unreturned loans a user may have.
+// A zero value means there is no limit
+type LoanLimits struct {
+	// PerUser is the maximum number of unreturned loans of a user
+	PerUser uint
+	// PerBookPerUser is the maximum number of unreturned copies of a single book a user may have
+	PerBookPerUser uint
+}
+
+// Check tests that a user having the given numbers of unreturned loans (in total and
+// of the book being taken) may take one more book, and returns fail.ErrLimitExceeded otherwise
+func (l LoanLimits) Check(userLoans uint, userBookLoans uint) error {
+	if l.PerUser != 0 && userLoans >= l.PerUser {
+		return fmt.Errorf("%w: at most %d books per user", fail.ErrLimitExceeded, l.PerUser)
+	}
+	if l.PerBookPerUser != 0 && userBookLoans >= l.PerBookPerUser {
+		return fmt.Errorf("%w: at most %d copies of a book per user", fail.ErrLimitExceeded, l.PerBookPerUser)
+	}
+	return nil
+}
@@ -0,0 +1,665 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/fail"
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/loans"
+)
+
+func TestRepoConformance(t *testing.T) {
+	backends := []struct {
+		name    string
+		newRepo func(t *testing.T) loans.Repo
+	}{
+		{
+			name: "memory",
+			newRepo: func(t *testing.T) loans.Repo {
+				return NewMemoryRepo("memory://")
+			},
+		},
+		{
+			name: "sqlite",
+			newRepo: func(t *testing.T) loans.Repo {
+				return openConformanceRepo(t, NewSqliteRepo, "sqlite://"+filepath.Join(t.TempDir(), "loans.sqlite"))
+			},
+		},
+		{
+			name: "file",
+			newRepo: func(t *testing.T) loans.Repo {
+				return openConformanceRepo(t, NewFileRepo, "file://"+t.TempDir())
+			},
+		},
+	}
+
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			testRepoConformance(t, backend.newRepo)
+		})
+	}
+}
+
+func openConformanceRepo(t *testing.T, open func(dsn string) (loans.Repo, error), dsn string) loans.Repo {
+	t.Helper()
+
+	repo, err := open(dsn)
+	if err != nil {
+		t.Fatalf("failed to open repo: %v", err)
+	}
+	if closer, ok := repo.(io.Closer); ok {
+		t.Cleanup(func() { closer.Close() })
+	}
+
+	return repo
+}
+
+// testRepoConformance checks the behavior every loans.Repo implementation must share.
+// newRepo must return a new empty repo on every call
+func testRepoConformance(t *testing.T, newRepo func(t *testing.T) loans.Repo) {
+	t.Run("stock", func(t *testing.T) {
+		repo := newRepo(t)
+
+		for _, id := range []string{"loan-1", "loan-2"} {
+			expectError(t, nil, takeLoan(repo, id, "user-1", "book-1", 100, 2))
+		}
+		expectError(t, fail.ErrNoStock, takeLoan(repo, "loan-3", "user-2", "book-1", 100, 2))
+
+		// Other books are not affected
+		expectError(t, nil, takeLoan(repo, "loan-3", "user-2", "book-2", 100, 1))
+
+		// Returned loans don't count against the stock
+		expectError(t, nil, closeLoan(repo, "loan-1", 150, loans.LoanReturned, nil))
+		expectError(t, nil, takeLoan(repo, "loan-4", "user-2", "book-1", 200, 2))
+		expectError(t, fail.ErrNoStock, takeLoan(repo, "loan-5", "user-2", "book-1", 200, 2))
+
+		// Neither do the ones returned damaged
+		expectError(t, nil, closeLoan(repo, "loan-2", 250, loans.LoanDamaged, nil))
+		expectError(t, nil, takeLoan(repo, "loan-5", "user-2", "book-1", 300, 2))
+
+		// But the missing books are still missing
+		expectError(t, nil, closeLoan(repo, "loan-4", 350, loans.LoanLost, nil))
+		expectError(t, nil, closeLoan(repo, "loan-5", 350, loans.LoanWrittenOff, nil))
+		expectError(t, nil, takeLoan(repo, "loan-6", "user-3", "book-1", 400, 3))
+		expectError(t, fail.ErrNoStock, takeLoan(repo, "loan-7", "user-3", "book-1", 400, 3))
+	})
+
+	t.Run("limits", func(t *testing.T) {
+		repo := newRepo(t)
+		ctx := context.Background()
+		limits := loans.LoanLimits{PerUser: 2, PerBookPerUser: 1}
+
+		take := func(id string, bookID string) error {
+			return repo.TakeBook(ctx, newLoan(id, "user-1", bookID, 100), 10, limits)
+		}
+
+		expectError(t, nil, take("loan-1", "book-1"))
+		expectError(t, fail.ErrLimitExceeded, take("loan-2", "book-1"))
+		expectError(t, nil, take("loan-2", "book-2"))
+		expectError(t, fail.ErrLimitExceeded, take("loan-3", "book-3"))
+
+		expectError(t, nil, closeLoan(repo, "loan-1", 150, loans.LoanReturned, nil))
+		expectError(t, nil, take("loan-3", "book-1"))
+	})
+
+	t.Run("collisions", func(t *testing.T) {
+		repo := newRepo(t)
+		ctx := context.Background()
+
+		expectError(t, nil, takeLoan(repo, "loan-1", "user-1", "book-1", 100, 1))
+
+		// A taken ID is reported even if the book is out of stock
+		expectError(t, fail.ErrCollision, takeLoan(repo, "loan-1", "user-1", "book-1", 100, 1))
+		expectError(t, fail.ErrCollision, takeLoan(repo, "loan-1", "user-2", "book-2", 100, 1))
+
+		book := getLoan(t, repo, "loan-1")
+		book.UserID = "user-2"
+		book.Returned, book.ReturnedAt, book.Status = true, 150, loans.LoanReturned
+		expectError(t, fail.ErrCollision, repo.ReturnBook(ctx, &book, nil))
+
+		unknown := *newLoan("loan-2", "user-1", "book-1", 100)
+		unknown.Returned, unknown.ReturnedAt, unknown.Status = true, 150, loans.LoanReturned
+		expectError(t, fail.ErrNotFound, repo.ReturnBook(ctx, &unknown, nil))
+
+		fine := newFine("fine-1", "loan-1", 150)
+		expectError(t, nil, closeLoan(repo, "loan-1", 150, loans.LoanReturned, []loans.Fine{fine}))
+		expectError(t, fail.ErrCollision, closeLoan(repo, "loan-1", 160, loans.LoanReturned, nil))
+
+		// A duplicate fine leaves the loan open
+		expectError(t, nil, takeLoan(repo, "loan-2", "user-1", "book-1", 200, 1))
+		expectError(t, fail.ErrCollision, closeLoan(repo, "loan-2", 250, loans.LoanReturned, []loans.Fine{fine}))
+		if got := getLoan(t, repo, "loan-2"); got.Returned {
+			t.Errorf("loan returned despite the error: %+v", got)
+		}
+
+		expectError(t, nil, repo.InsertCopy(ctx, &loans.Copy{ID: "copy-1", BookID: "book-3", Barcode: "0001"}))
+		expectError(t, fail.ErrCollision, repo.InsertCopy(ctx, &loans.Copy{ID: "copy-1", BookID: "book-3", Barcode: "0002"}))
+		expectError(t, fail.ErrCollision, repo.InsertCopy(ctx, &loans.Copy{ID: "copy-2", BookID: "book-4", Barcode: "0001"}))
+		expectError(t, fail.ErrNotFound, repo.UpdateCopy(ctx, &loans.Copy{ID: "copy-2", BookID: "book-3", Barcode: "0002"}))
+		expectError(t, fail.ErrCollision, repo.UpdateCopy(ctx, &loans.Copy{ID: "copy-1", BookID: "book-4", Barcode: "0001"}))
+
+		hold := loans.Hold{ID: "hold-1", UserID: "user-2", BookID: "book-1", PlacedAt: 100, PickupWindow: 50}
+		expectError(t, nil, repo.PlaceHold(ctx, &hold))
+		expectError(t, fail.ErrCollision, repo.PlaceHold(ctx, &loans.Hold{ID: "hold-1", UserID: "user-3", BookID: "book-2"}))
+		expectError(t, fail.ErrCollision, repo.PlaceHold(ctx, &loans.Hold{ID: "hold-2", UserID: "user-2", BookID: "book-1"}))
+		expectError(t, fail.ErrNotFound, repo.CancelHold(ctx, &loans.Hold{ID: "hold-3", BookID: "book-1"}, time.UnixMilli(100)))
+	})
+
+	t.Run("renew", func(t *testing.T) {
+		repo := newRepo(t)
+		ctx := context.Background()
+
+		expectError(t, nil, takeLoan(repo, "loan-1", "user-1", "book-1", 100, 1))
+
+		book := getLoan(t, repo, "loan-1")
+		book.ReturnDeadline += 100
+		book.Renewals = 1
+		expectError(t, nil, repo.RenewLoan(ctx, &book))
+		if diff := cmp.Diff(book, getLoan(t, repo, "loan-1")); diff != "" {
+			t.Errorf("renewal not stored (-want +got):\n%s", diff)
+		}
+
+		// Renewing the same version again means a concurrent renewal
+		expectError(t, fail.ErrCollision, repo.RenewLoan(ctx, &book))
+
+		unknown := book
+		unknown.ID = "loan-2"
+		expectError(t, fail.ErrNotFound, repo.RenewLoan(ctx, &unknown))
+
+		expectError(t, nil, closeLoan(repo, "loan-1", 150, loans.LoanReturned, nil))
+		book.Renewals = 2
+		expectError(t, fail.ErrCollision, repo.RenewLoan(ctx, &book))
+	})
+
+	t.Run("time windows", func(t *testing.T) {
+		repo := newRepo(t)
+		ctx := context.Background()
+
+		expectError(t, nil, takeLoan(repo, "loan-a", "user-1", "book-1", 100, 10))
+		expectError(t, nil, takeLoan(repo, "loan-b", "user-1", "book-1", 120, 10))
+		expectError(t, nil, takeLoan(repo, "loan-c", "user-2", "book-2", 300, 10))
+		expectError(t, nil, closeLoan(repo, "loan-a", 150, loans.LoanReturned, nil))
+
+		lentCases := []struct {
+			at   int64
+			want []string
+		}{
+			{at: 50, want: []string{}},
+			{at: 100, want: []string{"loan-a"}},
+			{at: 130, want: []string{"loan-a", "loan-b"}},
+			{at: 150, want: []string{"loan-b"}},
+			{at: 350, want: []string{"loan-b", "loan-c"}},
+		}
+		for _, c := range lentCases {
+			page, err := repo.FindLentBooks(ctx, time.UnixMilli(c.at), loans.Page{Limit: 10})
+			expectError(t, nil, err)
+			if diff := cmp.Diff(c.want, loanIDs(page.Loans)); diff != "" {
+				t.Errorf("wrong books lent at %d (-want +got):\n%s", c.at, diff)
+			}
+		}
+
+		// Deadlines are taken+100, and loan-a is returned in time
+		overdueCases := []struct {
+			at   int64
+			want []string
+		}{
+			{at: 199, want: []string{}},
+			{at: 200, want: []string{}},
+			{at: 220, want: []string{"loan-b"}},
+			{at: 500, want: []string{"loan-b", "loan-c"}},
+		}
+		for _, c := range overdueCases {
+			page, err := repo.FindOverdueBooks(ctx, time.UnixMilli(c.at), loans.Page{Limit: 10})
+			expectError(t, nil, err)
+			if diff := cmp.Diff(c.want, loanIDs(page.Loans)); diff != "" {
+				t.Errorf("wrong books overdue at %d (-want +got):\n%s", c.at, diff)
+			}
+		}
+
+		count, err := repo.CountOverdueLoansOf(ctx, "user-1", time.UnixMilli(500))
+		expectError(t, nil, err)
+		if count != 1 {
+			t.Errorf("wrong overdue count: want 1, got %d", count)
+		}
+
+		first, err := repo.FindLentBooks(ctx, time.UnixMilli(350), loans.Page{Limit: 1})
+		expectError(t, nil, err)
+		if first.Total != 2 || first.NextCursor == "" || !cmp.Equal(loanIDs(first.Loans), []string{"loan-b"}) {
+			t.Fatalf("wrong first page: %+v", first)
+		}
+		second, err := repo.FindLentBooks(ctx, time.UnixMilli(350), loans.Page{Limit: 1, Cursor: first.NextCursor})
+		expectError(t, nil, err)
+		if second.Total != 2 || second.NextCursor != "" || !cmp.Equal(loanIDs(second.Loans), []string{"loan-c"}) {
+			t.Errorf("wrong second page: %+v", second)
+		}
+	})
+
+	t.Run("loan queries", func(t *testing.T) {
+		repo := newRepo(t)
+		ctx := context.Background()
+
+		expectError(t, nil, takeLoan(repo, "loan-c", "user-1", "book-1", 100, 10))
+		expectError(t, nil, takeLoan(repo, "loan-b", "user-1", "book-2", 100, 10))
+		expectError(t, nil, takeLoan(repo, "loan-a", "user-1", "book-1", 200, 10))
+		expectError(t, nil, takeLoan(repo, "loan-d", "user-2", "book-1", 50, 10))
+		expectError(t, nil, closeLoan(repo, "loan-c", 150, loans.LoanReturned, nil))
+
+		_, err := repo.GetLoan(ctx, "loan-e")
+		expectError(t, fail.ErrNotFound, err)
+
+		want := *newLoan("loan-c", "user-1", "book-1", 100)
+		want.Returned, want.ReturnedAt, want.Status = true, 150, loans.LoanReturned
+		if diff := cmp.Diff(want, getLoan(t, repo, "loan-c")); diff != "" {
+			t.Errorf("wrong loan (-want +got):\n%s", diff)
+		}
+
+		findCases := []struct {
+			userID string
+			bookID string
+			want   []string
+		}{
+			{userID: "user-1", bookID: "book-1", want: []string{"loan-c", "loan-a"}},
+			{userID: "user-1", want: []string{"loan-b", "loan-c", "loan-a"}},
+			{bookID: "book-1", want: []string{"loan-d", "loan-c", "loan-a"}},
+			{userID: "user-3", want: []string{}},
+		}
+		for _, c := range findCases {
+			found, err := repo.FindLoansOf(ctx, c.userID, c.bookID)
+			expectError(t, nil, err)
+			if diff := cmp.Diff(c.want, loanIDs(found)); diff != "" {
+				t.Errorf("wrong loans of %q/%q (-want +got):\n%s", c.userID, c.bookID, diff)
+			}
+		}
+
+		filterCases := []struct {
+			filter loans.LoanFilter
+			order  loans.LoanSort
+			want   []string
+		}{
+			{
+				filter: loans.LoanFilter{UserID: "user-1"},
+				order:  loans.SortTakenDesc,
+				want:   []string{"loan-a", "loan-c", "loan-b"},
+			},
+			{
+				filter: loans.LoanFilter{UserID: "user-1", State: loans.LoanStateOpen},
+				order:  loans.SortTakenAsc,
+				want:   []string{"loan-b", "loan-a"},
+			},
+			{
+				filter: loans.LoanFilter{UserID: "user-1", State: loans.LoanStateReturned},
+				want:   []string{"loan-c"},
+			},
+			{
+				filter: loans.LoanFilter{UserID: "user-1", State: loans.LoanStateOverdue, At: 250},
+				order:  loans.SortTakenAsc,
+				want:   []string{"loan-b"},
+			},
+			{
+				filter: loans.LoanFilter{UserID: "user-1", BookID: "book-1", TakenFrom: 150, TakenUntil: 300},
+				want:   []string{"loan-a"},
+			},
+		}
+		for _, c := range filterCases {
+			page, err := repo.FindLoans(ctx, c.filter, c.order, loans.Page{Limit: 10})
+			expectError(t, nil, err)
+			if diff := cmp.Diff(c.want, loanIDs(page.Loans)); diff != "" {
+				t.Errorf("wrong loans for %+v (-want +got):\n%s", c.filter, diff)
+			}
+			if page.Total != uint(len(c.want)) {
+				t.Errorf("wrong total for %+v: want %d, got %d", c.filter, len(c.want), page.Total)
+			}
+		}
+	})
+
+	t.Run("copies", func(t *testing.T) {
+		repo := newRepo(t)
+		ctx := context.Background()
+
+		for _, bookCopy := range []loans.Copy{
+			{ID: "copy-2", BookID: "book-1", Barcode: "0002", Condition: loans.CopyGood},
+			{ID: "copy-1", BookID: "book-1", Barcode: "0001", Condition: loans.CopyWorn},
+			{ID: "copy-3", BookID: "book-1", Barcode: "0003", Condition: loans.CopyDamaged},
+		} {
+			expectError(t, nil, repo.InsertCopy(ctx, &bookCopy))
+		}
+
+		copies, err := repo.FindCopies(ctx, "book-1")
+		expectError(t, nil, err)
+		if diff := cmp.Diff([]string{"0001", "0002", "0003"}, barcodes(copies)); diff != "" {
+			t.Errorf("wrong copies (-want +got):\n%s", diff)
+		}
+
+		_, err = repo.LookupCopy(ctx, "0004")
+		expectError(t, fail.ErrNotFound, err)
+
+		// The total stock is ignored for books with registered copies
+		book := newLoan("loan-1", "user-1", "book-1", 100)
+		expectError(t, nil, repo.TakeBook(ctx, book, 10, loans.LoanLimits{}))
+		if book.CopyID != "copy-1" {
+			t.Errorf("wrong copy picked: want copy-1, got %q", book.CopyID)
+		}
+
+		book = newLoan("loan-2", "user-1", "book-1", 100)
+		book.CopyID = "copy-1"
+		expectError(t, fail.ErrCollision, repo.TakeBook(ctx, book, 10, loans.LoanLimits{}))
+		book.CopyID = "copy-3"
+		expectError(t, fail.ErrCollision, repo.TakeBook(ctx, book, 10, loans.LoanLimits{}))
+		book.CopyID = "copy-2"
+		expectError(t, nil, repo.TakeBook(ctx, book, 10, loans.LoanLimits{}))
+		expectError(t, fail.ErrNoStock, takeLoan(repo, "loan-3", "user-1", "book-1", 100, 10))
+
+		book = newLoan("loan-3", "user-1", "book-2", 100)
+		book.CopyID = "copy-1"
+		expectError(t, fail.ErrNotFound, repo.TakeBook(ctx, book, 10, loans.LoanLimits{}))
+
+		expectError(t, nil, closeLoan(repo, "loan-1", 150, loans.LoanLost, nil))
+		expectError(t, nil, closeLoan(repo, "loan-2", 150, loans.LoanDamaged, nil))
+
+		conditions := make(map[string]loans.CopyCondition)
+		for _, barcode := range []string{"0001", "0002"} {
+			bookCopy, err := repo.LookupCopy(ctx, barcode)
+			expectError(t, nil, err)
+			conditions[barcode] = bookCopy.Condition
+		}
+		want := map[string]loans.CopyCondition{"0001": loans.CopyWithdrawn, "0002": loans.CopyDamaged}
+		if diff := cmp.Diff(want, conditions); diff != "" {
+			t.Errorf("wrong conditions of closed copies (-want +got):\n%s", diff)
+		}
+
+		expectError(t, nil, repo.UpdateCopy(ctx, &loans.Copy{ID: "copy-2", BookID: "book-1", Barcode: "0002", Condition: loans.CopyGood}))
+		expectError(t, nil, takeLoan(repo, "loan-3", "user-1", "book-1", 200, 10))
+	})
+
+	t.Run("fines", func(t *testing.T) {
+		repo := newRepo(t)
+		ctx := context.Background()
+
+		expectError(t, nil, takeLoan(repo, "loan-1", "user-1", "book-1", 100, 10))
+		expectError(t, nil, takeLoan(repo, "loan-2", "user-1", "book-2", 100, 10))
+		expectError(t, nil, closeLoan(repo, "loan-2", 300, loans.LoanReturned, []loans.Fine{newFine("fine-b", "loan-2", 300)}))
+		expectError(t, nil, closeLoan(repo, "loan-1", 250, loans.LoanDamaged, []loans.Fine{
+			newFine("fine-c", "loan-1", 250),
+			newFine("fine-a", "loan-1", 250),
+		}))
+
+		fines, err := repo.FindFines(ctx, "user-1")
+		expectError(t, nil, err)
+		ids := make([]string, 0, len(fines))
+		for _, fine := range fines {
+			ids = append(ids, fine.ID)
+		}
+		if diff := cmp.Diff([]string{"fine-a", "fine-c", "fine-b"}, ids); diff != "" {
+			t.Errorf("wrong fines (-want +got):\n%s", diff)
+		}
+
+		fine, err := repo.LookupFine(ctx, "fine-b")
+		expectError(t, nil, err)
+		if diff := cmp.Diff(newFine("fine-b", "loan-2", 300), fine); diff != "" {
+			t.Errorf("wrong fine (-want +got):\n%s", diff)
+		}
+		_, err = repo.LookupFine(ctx, "fine-d")
+		expectError(t, fail.ErrNotFound, err)
+
+		fine.Status, fine.ResolvedAt = loans.FinePaid, 400
+		expectError(t, nil, repo.ResolveFine(ctx, &fine))
+		expectError(t, fail.ErrCollision, repo.ResolveFine(ctx, &fine))
+		fine.ID = "fine-d"
+		expectError(t, fail.ErrNotFound, repo.ResolveFine(ctx, &fine))
+
+		fine, err = repo.LookupFine(ctx, "fine-b")
+		expectError(t, nil, err)
+		if fine.Status != loans.FinePaid || fine.ResolvedAt != 400 {
+			t.Errorf("resolution not stored: %+v", fine)
+		}
+	})
+
+	t.Run("holds", func(t *testing.T) {
+		repo := newRepo(t)
+		ctx := context.Background()
+
+		expectError(t, nil, takeLoan(repo, "loan-1", "user-1", "book-1", 100, 1))
+		for i, userID := range []string{"user-2", "user-3"} {
+			hold := loans.Hold{
+				ID:           "hold-" + userID,
+				UserID:       userID,
+				BookID:       "book-1",
+				PlacedAt:     uint64(110 + i),
+				PickupWindow: 50,
+			}
+			expectError(t, nil, repo.PlaceHold(ctx, &hold))
+		}
+
+		// The returned copy is reserved for the head of the queue
+		expectError(t, nil, closeLoan(repo, "loan-1", 200, loans.LoanReturned, nil))
+		expectHolds(t, repo, "", 210, map[string]uint64{"hold-user-2": 250, "hold-user-3": 0})
+		expectError(t, fail.ErrNoStock, takeLoan(repo, "loan-2", "user-3", "book-1", 210, 1))
+
+		// Once the reservation expires, it passes on to the next hold
+		expectHolds(t, repo, "user-3", 260, map[string]uint64{"hold-user-3": 300})
+		expectError(t, fail.ErrNoStock, takeLoan(repo, "loan-2", "user-2", "book-1", 260, 1))
+
+		// Taking the book fulfills the own hold
+		expectError(t, nil, takeLoan(repo, "loan-2", "user-3", "book-1", 270, 1))
+		expectHolds(t, repo, "", 270, map[string]uint64{})
+
+		// Cancelling a reservation passes the copy on
+		expectError(t, nil, repo.PlaceHold(ctx, &loans.Hold{ID: "hold-4", UserID: "user-4", BookID: "book-1", PlacedAt: 280, PickupWindow: 50}))
+		expectError(t, nil, repo.PlaceHold(ctx, &loans.Hold{ID: "hold-5", UserID: "user-5", BookID: "book-1", PlacedAt: 290, PickupWindow: 50}))
+		expectError(t, nil, closeLoan(repo, "loan-2", 300, loans.LoanReturned, nil))
+		expectError(t, nil, repo.CancelHold(ctx, &loans.Hold{ID: "hold-4", UserID: "user-4", BookID: "book-1"}, time.UnixMilli(310)))
+		expectHolds(t, repo, "", 310, map[string]uint64{"hold-5": 360})
+
+		// A lost copy is not reserved for anybody
+		expectError(t, nil, takeLoan(repo, "loan-3", "user-5", "book-1", 320, 1))
+		expectError(t, nil, repo.PlaceHold(ctx, &loans.Hold{ID: "hold-6", UserID: "user-6", BookID: "book-1", PlacedAt: 330, PickupWindow: 50}))
+		expectError(t, nil, closeLoan(repo, "loan-3", 340, loans.LoanLost, nil))
+		expectHolds(t, repo, "", 340, map[string]uint64{"hold-6": 0})
+
+		// A damaged book without registered copies is back in stock, so the queue gets it first
+		expectError(t, nil, takeLoan(repo, "loan-4", "user-7", "book-1", 350, 2))
+		expectError(t, nil, closeLoan(repo, "loan-4", 370, loans.LoanDamaged, nil))
+		expectHolds(t, repo, "", 370, map[string]uint64{"hold-6": 420})
+		expectError(t, fail.ErrNoStock, takeLoan(repo, "loan-5", "user-8", "book-1", 380, 2))
+		expectError(t, nil, takeLoan(repo, "loan-5", "user-6", "book-1", 380, 2))
+	})
+
+	t.Run("idempotency keys", func(t *testing.T) {
+		repo := newRepo(t)
+		ctx := context.Background()
+
+		record := loans.IdempotencyRecord{Key: "key-1", Fingerprint: "fingerprint-1", ExpiresAt: 200}
+		expectError(t, nil, repo.ReserveIdempotencyKey(ctx, &record, time.UnixMilli(100)))
+		expectError(t, fail.ErrCollision, repo.ReserveIdempotencyKey(ctx, &record, time.UnixMilli(150)))
+
+		saved, err := repo.LookupIdempotencyKey(ctx, "key-1", time.UnixMilli(150))
+		expectError(t, nil, err)
+		if diff := cmp.Diff(record, saved); diff != "" {
+			t.Errorf("wrong record (-want +got):\n%s", diff)
+		}
+
+		record.Done, record.Status, record.ContentType, record.Body, record.ExpiresAt = true, 200, "application/json", []byte(`{"success":true}`), 300
+		expectError(t, nil, repo.CompleteIdempotencyKey(ctx, &record))
+		saved, err = repo.LookupIdempotencyKey(ctx, "key-1", time.UnixMilli(250))
+		expectError(t, nil, err)
+		if diff := cmp.Diff(record, saved); diff != "" {
+			t.Errorf("wrong record (-want +got):\n%s", diff)
+		}
+		expectError(t, fail.ErrNotFound, repo.CompleteIdempotencyKey(ctx, &loans.IdempotencyRecord{Key: "key-2", ExpiresAt: 300}))
+
+		// Expired keys are gone and may be reserved again
+		_, err = repo.LookupIdempotencyKey(ctx, "key-1", time.UnixMilli(300))
+		expectError(t, fail.ErrNotFound, err)
+		record = loans.IdempotencyRecord{Key: "key-1", Fingerprint: "fingerprint-2", ExpiresAt: 400}
+		expectError(t, nil, repo.ReserveIdempotencyKey(ctx, &record, time.UnixMilli(300)))
+
+		expectError(t, nil, repo.ReleaseIdempotencyKey(ctx, "key-1"))
+		_, err = repo.LookupIdempotencyKey(ctx, "key-1", time.UnixMilli(310))
+		expectError(t, fail.ErrNotFound, err)
+		expectError(t, nil, repo.ReleaseIdempotencyKey(ctx, "key-1"))
+	})
+
+	t.Run("concurrency", func(t *testing.T) {
+		repo := newRepo(t)
+		ctx := context.Background()
+
+		const takers, stock = 20, 5
+		errs := make([]error, takers)
+		var wg sync.WaitGroup
+		for i := range takers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				id := "loan-" + string(rune('a'+i))
+				errs[i] = takeLoan(repo, id, "user-"+string(rune('a'+i)), "book-1", 100, stock)
+			}()
+		}
+		wg.Wait()
+
+		taken := 0
+		for _, err := range errs {
+			switch {
+			case err == nil:
+				taken++
+			case !errors.Is(err, fail.ErrNoStock):
+				t.Errorf("unexpected error: %v", err)
+			}
+		}
+		if taken != stock {
+			t.Errorf("wrong number of books taken: want %d, got %d", stock, taken)
+		}
+
+		page, err := repo.FindLentBooks(ctx, time.UnixMilli(100), loans.Page{Limit: takers})
+		expectError(t, nil, err)
+		if page.Total != stock {
+			t.Errorf("wrong number of books lent: want %d, got %d", stock, page.Total)
+		}
+
+		book := page.Loans[0]
+		book.ReturnDeadline += 100
+		book.Renewals = 1
+		renewed := make([]error, takers)
+		for i := range takers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				renewal := book
+				renewed[i] = repo.RenewLoan(ctx, &renewal)
+			}()
+		}
+		wg.Wait()
+
+		succeeded := 0
+		for _, err := range renewed {
+			switch {
+			case err == nil:
+				succeeded++
+			case !errors.Is(err, fail.ErrCollision):
+				t.Errorf("unexpected error: %v", err)
+			}
+		}
+		if succeeded != 1 {
+			t.Errorf("wrong number of concurrent renewals: want 1, got %d", succeeded)
+		}
+	})
+}
+
+// newLoan returns an open loan taken at the given time for 100 seconds
+func newLoan(id string, userID string, bookID string, takenAt uint64) *loans.LentBook {
+	return &loans.LentBook{
+		ID:             id,
+		UserID:         userID,
+		BookID:         bookID,
+		TakenAt:        takenAt,
+		ReturnDeadline: takenAt + 100,
+		Status:         loans.LoanOpen,
+		Notes:          "taken by " + userID,
+	}
+}
+
+func newFine(id string, loanID string, issuedAt uint64) loans.Fine {
+	return loans.Fine{
+		ID:       id,
+		UserID:   "user-1",
+		LoanID:   loanID,
+		BookID:   "book-1",
+		Reason:   loans.FineLate,
+		Amount:   100,
+		IssuedAt: issuedAt,
+		Status:   loans.FineOutstanding,
+	}
+}
+
+func takeLoan(repo loans.Repo, id string, userID string, bookID string, takenAt uint64, totalStock uint) error {
+	return repo.TakeBook(context.Background(), newLoan(id, userID, bookID, takenAt), totalStock, loans.LoanLimits{})
+}
+
+// closeLoan closes the stored loan with the given ID in the given status
+func closeLoan(repo loans.Repo, id string, at uint64, status loans.LoanStatus, fines []loans.Fine) error {
+	book, err := repo.GetLoan(context.Background(), id)
+	if err != nil {
+		return err
+	}
+	book.Returned, book.ReturnedAt, book.Status = true, at, status
+	return repo.ReturnBook(context.Background(), &book, fines)
+}
+
+func getLoan(t *testing.T, repo loans.Repo, id string) loans.LentBook {
+	t.Helper()
+
+	book, err := repo.GetLoan(context.Background(), id)
+	if err != nil {
+		t.Fatalf("failed to get loan %q: %v", id, err)
+	}
+	return book
+}
+
+func expectError(t *testing.T, want error, got error) {
+	t.Helper()
+
+	if want == nil && got != nil {
+		t.Fatalf("unexpected error: %v", got)
+	}
+	if want != nil && !errors.Is(got, want) {
+		t.Fatalf("wrong error: want %v, got %v", want, got)
+	}
+}
+
+// expectHolds checks the holds of the user (or everyone's) at the given time
+// against a map from hold IDs to the time their copies are reserved until
+func expectHolds(t *testing.T, repo loans.Repo, userID string, at int64, want map[string]uint64) {
+	t.Helper()
+
+	holds, err := repo.FindHolds(context.Background(), userID, "book-1", time.UnixMilli(at))
+	expectError(t, nil, err)
+
+	got := make(map[string]uint64)
+	for _, hold := range holds {
+		got[hold.ID] = hold.ReservedUntil
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("wrong holds at %d (-want +got):\n%s", at, diff)
+	}
+}
+
+func loanIDs(books []loans.LentBook) []string {
+	result := make([]string, 0, len(books))
+	for _, book := range books {
+		result = append(result, book.ID)
+	}
+	return result
+}
+
+func barcodes(copies []loans.Copy) []string {
+	result := make([]string, 0, len(copies))
+	for _, bookCopy := range copies {
+		result = append(result, bookCopy.Barcode)
+	}
+	return result
+}
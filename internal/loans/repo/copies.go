@@ -0,0 +1,69 @@
+package repo
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/fail"
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/loans"
+)
+
+// pickCopy chooses the copy to lend out from the stock of a book with the given registered copies.
+// If requestedCopyID is not empty, that copy must be free, otherwise the first free copy is chosen.
+// Returns an empty ID for books without registered copies
+func pickCopy(stock loans.Stock, copies []loans.Copy, requestedCopyID string) (string, error) {
+	if len(copies) == 0 {
+		if requestedCopyID != "" {
+			return "", fail.ErrNotFound
+		}
+		return "", nil
+	}
+
+	if requestedCopyID == "" {
+		if len(stock.FreeCopies) == 0 {
+			return "", fail.ErrNoStock
+		}
+		return stock.FreeCopies[0].ID, nil
+	}
+
+	isFree := slices.ContainsFunc(stock.FreeCopies, func(free loans.Copy) bool {
+		return free.ID == requestedCopyID
+	})
+	if !isFree {
+		return "", fmt.Errorf("%w: the copy is lent out or out of circulation", fail.ErrCollision)
+	}
+	return requestedCopyID, nil
+}
+
+// sortCopies orders the copies of a book by barcode
+func sortCopies(copies []loans.Copy) {
+	slices.SortFunc(copies, func(a, b loans.Copy) int {
+		return strings.Compare(a.Barcode, b.Barcode)
+	})
+}
+
+// closedCopyCondition returns the condition the copy of a loan closed in the given status is left in,
+// and false if the copy is returned intact
+func closedCopyCondition(status loans.LoanStatus) (loans.CopyCondition, bool) {
+	switch status {
+	case loans.LoanLost, loans.LoanWrittenOff:
+		return loans.CopyWithdrawn, true
+	case loans.LoanDamaged:
+		return loans.CopyDamaged, true
+	}
+	return "", false
+}
+
+// returnFreesStock returns true if closing the loan puts a lendable book back in stock,
+// so that the next user in the hold queue gets it. A damaged book without a registered copy
+// to mark as such is back in stock, since ComputeStock can't tell it from an intact one
+func returnFreesStock(book *loans.LentBook) bool {
+	switch book.Status {
+	case loans.LoanLost, loans.LoanWrittenOff:
+		return false
+	case loans.LoanDamaged:
+		return book.CopyID == ""
+	}
+	return true
+}
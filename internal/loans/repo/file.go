@@ -0,0 +1,539 @@
+package repo
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/fail"
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/loans"
+)
+
+const (
+	// fileSnapshotName is the name of the compacted snapshot inside the data directory
+	fileSnapshotName = "snapshot.json"
+	// fileLogName is the name of the operation log inside the data directory
+	fileLogName = "oplog.jsonl"
+	// defaultSnapshotInterval is the number of logged operations after which a new snapshot is taken
+	defaultSnapshotInterval = 1000
+)
+
+const (
+	// fileFormatSeconds is the format of the data written when timestamps were in seconds
+	fileFormatSeconds = 0
+	// fileFormatMillis is the current format, with timestamps in milliseconds
+	fileFormatMillis = 1
+)
+
+// NewFileRepo opens a persistent repository stored in the directory given by a file:// DSN,
+// creating it if needed. The data lives in memory and every successful write is appended
+// to an operation log, which is synced to disk before the write is acknowledged.
+// The log is periodically compacted into a snapshot
+func NewFileRepo(dsn string) (loans.Repo, error) {
+	dir, ok := strings.CutPrefix(dsn, "file://")
+	if !ok || dir == "" {
+		return nil, fail.ErrInvalidDSN
+	}
+
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	repo := &fileRepo{
+		memoryRepo: newMemoryRepo(),
+		writeMutex: sync.Mutex{},
+		dir:        dir,
+		log:        nil,
+		seq:        0,
+		logged:     0,
+
+		snapshotInterval: defaultSnapshotInterval,
+	}
+
+	repo.mutex.Lock()
+	err = repo.load()
+	repo.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	return repo, nil
+}
+
+// fileRepo serves reads from the embedded memoryRepo and persists its writes
+type fileRepo struct {
+	*memoryRepo
+
+	// writeMutex serializes the writes, so that the log order matches the order they were applied in
+	writeMutex sync.Mutex
+	dir        string
+	log        *os.File
+	// seq is the sequence number of the last logged operation
+	seq uint64
+	// logged is the number of operations in the log since the last snapshot
+	logged int
+
+	snapshotInterval int
+}
+
+// fileOp is a single entry of the operation log. Replaying the operations
+// on top of the snapshot reproduces the state, since memoryRepo is deterministic
+type fileOp struct {
+	Seq        uint64           `json:"seq"`
+	Format     int              `json:"format,omitempty"`
+	Op         string           `json:"op"`
+	Loan       *loans.LentBook  `json:"loan,omitempty"`
+	TotalStock uint             `json:"total_stock,omitempty"`
+	Limits     loans.LoanLimits `json:"limits"`
+	Fines      []loans.Fine     `json:"fines,omitempty"`
+	Fine       *loans.Fine      `json:"fine,omitempty"`
+	Copy       *loans.Copy      `json:"copy,omitempty"`
+	Hold       *loans.Hold      `json:"hold,omitempty"`
+	At         int64            `json:"at,omitempty"`
+
+	Idempotency *loans.IdempotencyRecord `json:"idempotency,omitempty"`
+	Key         string                   `json:"key,omitempty"`
+}
+
+const (
+	fileOpTakeBook    = "take_book"
+	fileOpReturnBook  = "return_book"
+	fileOpRenewLoan   = "renew_loan"
+	fileOpInsertCopy  = "insert_copy"
+	fileOpUpdateCopy  = "update_copy"
+	fileOpResolveFine = "resolve_fine"
+	fileOpPlaceHold   = "place_hold"
+	fileOpCancelHold  = "cancel_hold"
+
+	fileOpReserveIdempotencyKey  = "reserve_idempotency_key"
+	fileOpCompleteIdempotencyKey = "complete_idempotency_key"
+	fileOpReleaseIdempotencyKey  = "release_idempotency_key"
+)
+
+// fileSnapshot is the compacted state, including all operations up to Seq
+type fileSnapshot struct {
+	Seq       uint64           `json:"seq"`
+	Format    int              `json:"format,omitempty"`
+	LentBooks []loans.LentBook `json:"lent_books"`
+	Holds     []loans.Hold     `json:"holds"`
+	Fines     []loans.Fine     `json:"fines"`
+	Copies    []loans.Copy     `json:"copies"`
+
+	IdempotencyKeys []loans.IdempotencyRecord `json:"idempotency_keys,omitempty"`
+}
+
+// load restores the state from the snapshot and the log, and opens the log for appending.
+// Must be called with the memory repo locked
+func (f *fileRepo) load() error {
+	snapshotData, err := os.ReadFile(filepath.Join(f.dir, fileSnapshotName))
+	if err == nil {
+		var snapshot fileSnapshot
+		if err := json.Unmarshal(snapshotData, &snapshot); err != nil {
+			return fmt.Errorf("%w: failed to parse snapshot: %w", fail.ErrMalformedStorage, err)
+		}
+		if err := upgradeSnapshot(&snapshot); err != nil {
+			return err
+		}
+		f.restore(&snapshot)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	log, err := os.OpenFile(filepath.Join(f.dir, fileLogName), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+
+	validLength, err := f.replay(log)
+	if err != nil {
+		log.Close()
+		return err
+	}
+
+	// Drop the torn tail left by a crash in the middle of a write, which was never acknowledged
+	err = log.Truncate(validLength)
+	if err != nil {
+		log.Close()
+		return err
+	}
+	_, err = log.Seek(validLength, io.SeekStart)
+	if err != nil {
+		log.Close()
+		return err
+	}
+
+	f.log = log
+	return nil
+}
+
+// restore replaces the state with the snapshot
+func (f *fileRepo) restore(snapshot *fileSnapshot) {
+	m := f.memoryRepo
+	for _, book := range snapshot.LentBooks {
+		m.lentBooks[book.ID] = book
+	}
+	for _, hold := range snapshot.Holds {
+		m.holds[hold.ID] = hold
+	}
+	for _, fine := range snapshot.Fines {
+		m.fines[fine.ID] = fine
+	}
+	for _, bookCopy := range snapshot.Copies {
+		m.copies[bookCopy.ID] = bookCopy
+	}
+	for _, record := range snapshot.IdempotencyKeys {
+		m.idempotencyKeys[record.Key] = record
+	}
+	f.seq = snapshot.Seq
+}
+
+// replay applies the logged operations newer than the snapshot.
+// Returns the length of the log up to the last complete entry
+func (f *fileRepo) replay(log *os.File) (int64, error) {
+	reader := bufio.NewReader(log)
+	validLength := int64(0)
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			// An incomplete last line is a torn write
+			return validLength, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		var op fileOp
+		if err := json.Unmarshal(line, &op); err != nil {
+			return 0, fmt.Errorf("%w: failed to parse operation log: %w", fail.ErrMalformedStorage, err)
+		}
+		if err := upgradeOp(&op); err != nil {
+			return 0, err
+		}
+
+		if op.Seq > f.seq {
+			if err := f.apply(&op); err != nil {
+				return 0, fmt.Errorf("%w: failed to replay operation %d: %w", fail.ErrMalformedStorage, op.Seq, err)
+			}
+			f.seq = op.Seq
+			f.logged += 1
+		}
+		validLength += int64(len(line))
+	}
+}
+
+// apply performs a logged operation on the in-memory state.
+// Must be called with the memory repo locked
+func (f *fileRepo) apply(op *fileOp) error {
+	ctx := context.Background()
+	m := f.memoryRepo
+
+	switch op.Op {
+	case fileOpTakeBook:
+		return m.takeBook(ctx, op.Loan, op.TotalStock, op.Limits)
+	case fileOpReturnBook:
+		return m.returnBook(ctx, op.Loan, op.Fines)
+	case fileOpRenewLoan:
+		return m.renewLoan(ctx, op.Loan)
+	case fileOpInsertCopy:
+		return m.insertCopy(ctx, op.Copy)
+	case fileOpUpdateCopy:
+		return m.updateCopy(ctx, op.Copy)
+	case fileOpResolveFine:
+		return m.resolveFine(ctx, op.Fine)
+	case fileOpPlaceHold:
+		return m.placeHold(ctx, op.Hold)
+	case fileOpCancelHold:
+		return m.cancelHold(ctx, op.Hold, loans.FromTimestamp(uint64(op.At)))
+	case fileOpReserveIdempotencyKey:
+		return m.reserveIdempotencyKey(ctx, op.Idempotency, loans.FromTimestamp(uint64(op.At)))
+	case fileOpCompleteIdempotencyKey:
+		return m.completeIdempotencyKey(ctx, op.Idempotency)
+	case fileOpReleaseIdempotencyKey:
+		return m.releaseIdempotencyKey(ctx, op.Key)
+	}
+	return fmt.Errorf("unknown operation %q", op.Op)
+}
+
+// write applies the operation and, if it succeeds, logs it and syncs the log to disk.
+// The operation is logged as it was applied, e.g. with the copy TakeBook has picked,
+// so that replaying it yields the same result
+func (f *fileRepo) write(op fileOp) error {
+	f.writeMutex.Lock()
+	defer f.writeMutex.Unlock()
+
+	err := f.commit(&op)
+	if err != nil {
+		return err
+	}
+
+	if f.logged >= f.snapshotInterval {
+		// The write is already durable, a failed compaction only leaves a longer log behind
+		_ = f.compact()
+	}
+
+	return nil
+}
+
+// commit applies and logs the operation. The memory repo stays locked until the log is synced,
+// so that no one reads the state that is lost if the write fails.
+// Must be called with the write lock held
+func (f *fileRepo) commit(op *fileOp) error {
+	m := f.memoryRepo
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	err := f.apply(op)
+	if err != nil {
+		return err
+	}
+
+	op.Seq = f.seq + 1
+	op.Format = fileFormatMillis
+	line, err := json.Marshal(op)
+	if err != nil {
+		return errors.Join(err, f.reload())
+	}
+	line = append(line, '\n')
+
+	_, err = f.log.Write(line)
+	if err == nil {
+		err = f.log.Sync()
+	}
+	if err != nil {
+		// The in-memory state is ahead of the disk now, so restore
+		// the state the disk has and report that the write failed
+		return errors.Join(err, f.reload())
+	}
+	f.seq = op.Seq
+	f.logged += 1
+
+	return nil
+}
+
+// reload discards the in-memory state and loads it from disk again.
+// Must be called with the write lock held and the memory repo locked
+func (f *fileRepo) reload() error {
+	f.log.Close()
+
+	m := f.memoryRepo
+	fresh := newMemoryRepo()
+	m.lentBooks, m.holds, m.fines, m.copies = fresh.lentBooks, fresh.holds, fresh.fines, fresh.copies
+	m.idempotencyKeys = fresh.idempotencyKeys
+
+	f.seq = 0
+	f.logged = 0
+	return f.load()
+}
+
+// compact writes a snapshot of the current state and starts a new empty log.
+// Must be called with the write lock held
+func (f *fileRepo) compact() error {
+	m := f.memoryRepo
+	m.mutex.RLock()
+	snapshot := fileSnapshot{
+		Seq:       f.seq,
+		Format:    fileFormatMillis,
+		LentBooks: slicesOfValues(m.lentBooks),
+		Holds:     slicesOfValues(m.holds),
+		Fines:     slicesOfValues(m.fines),
+		Copies:    slicesOfValues(m.copies),
+
+		IdempotencyKeys: slicesOfValues(m.idempotencyKeys),
+	}
+	m.mutex.RUnlock()
+
+	data, err := json.Marshal(&snapshot)
+	if err != nil {
+		return err
+	}
+
+	err = writeFileSynced(filepath.Join(f.dir, fileSnapshotName), data)
+	if err != nil {
+		return err
+	}
+
+	// The snapshot includes all logged operations, which are skipped
+	// on replay by their sequence numbers even if truncation fails
+	err = writeFileSynced(filepath.Join(f.dir, fileLogName), []byte{})
+	if err != nil {
+		return err
+	}
+
+	log, err := os.OpenFile(filepath.Join(f.dir, fileLogName), os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	f.log.Close()
+	f.log = log
+	f.logged = 0
+
+	return nil
+}
+
+// upgradeSnapshot converts a snapshot of an older format to the current one
+func upgradeSnapshot(snapshot *fileSnapshot) error {
+	switch snapshot.Format {
+	case fileFormatMillis:
+		return nil
+	case fileFormatSeconds:
+		for i := range snapshot.LentBooks {
+			secondsToMillisLoan(&snapshot.LentBooks[i])
+		}
+		for i := range snapshot.Holds {
+			secondsToMillisHold(&snapshot.Holds[i])
+		}
+		for i := range snapshot.Fines {
+			secondsToMillisFine(&snapshot.Fines[i])
+		}
+		snapshot.Format = fileFormatMillis
+		return nil
+	}
+	return fmt.Errorf("%w: unknown snapshot format %d", fail.ErrMalformedStorage, snapshot.Format)
+}
+
+// upgradeOp converts a logged operation of an older format to the current one
+func upgradeOp(op *fileOp) error {
+	switch op.Format {
+	case fileFormatMillis:
+		return nil
+	case fileFormatSeconds:
+		if op.Loan != nil {
+			secondsToMillisLoan(op.Loan)
+		}
+		for i := range op.Fines {
+			secondsToMillisFine(&op.Fines[i])
+		}
+		if op.Fine != nil {
+			secondsToMillisFine(op.Fine)
+		}
+		if op.Hold != nil {
+			secondsToMillisHold(op.Hold)
+		}
+		op.At *= 1000
+		op.Format = fileFormatMillis
+		return nil
+	}
+	return fmt.Errorf("%w: unknown format %d of operation %d", fail.ErrMalformedStorage, op.Format, op.Seq)
+}
+
+func secondsToMillisLoan(book *loans.LentBook) {
+	book.TakenAt *= 1000
+	book.ReturnDeadline *= 1000
+	book.ReturnedAt *= 1000
+}
+
+func secondsToMillisHold(hold *loans.Hold) {
+	hold.PlacedAt *= 1000
+	hold.PickupWindow *= 1000
+	hold.ReservedUntil *= 1000
+}
+
+func secondsToMillisFine(fine *loans.Fine) {
+	fine.IssuedAt *= 1000
+	fine.ResolvedAt *= 1000
+}
+
+// Close closes the operation log. Every acknowledged write is already on disk by then
+func (f *fileRepo) Close() error {
+	f.writeMutex.Lock()
+	defer f.writeMutex.Unlock()
+
+	return f.log.Close()
+}
+
+// writeFileSynced atomically replaces the file with the given contents,
+// making sure both the contents and the rename reach the disk
+func writeFileSynced(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, bytes.NewReader(data))
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return err
+	}
+
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// slicesOfValues returns the values of the map
+func slicesOfValues[K comparable, V any](data map[K]V) []V {
+	result := make([]V, 0, len(data))
+	for _, value := range data {
+		result = append(result, value)
+	}
+	return result
+}
+
+func (f *fileRepo) TakeBook(ctx context.Context, book *loans.LentBook, totalStock uint, limits loans.LoanLimits) error {
+	return f.write(fileOp{Op: fileOpTakeBook, Loan: book, TotalStock: totalStock, Limits: limits})
+}
+
+func (f *fileRepo) ReturnBook(ctx context.Context, book *loans.LentBook, fines []loans.Fine) error {
+	return f.write(fileOp{Op: fileOpReturnBook, Loan: book, Fines: fines})
+}
+
+func (f *fileRepo) RenewLoan(ctx context.Context, book *loans.LentBook) error {
+	return f.write(fileOp{Op: fileOpRenewLoan, Loan: book})
+}
+
+func (f *fileRepo) InsertCopy(ctx context.Context, bookCopy *loans.Copy) error {
+	return f.write(fileOp{Op: fileOpInsertCopy, Copy: bookCopy})
+}
+
+func (f *fileRepo) UpdateCopy(ctx context.Context, bookCopy *loans.Copy) error {
+	return f.write(fileOp{Op: fileOpUpdateCopy, Copy: bookCopy})
+}
+
+func (f *fileRepo) ResolveFine(ctx context.Context, fine *loans.Fine) error {
+	return f.write(fileOp{Op: fileOpResolveFine, Fine: fine})
+}
+
+func (f *fileRepo) PlaceHold(ctx context.Context, hold *loans.Hold) error {
+	return f.write(fileOp{Op: fileOpPlaceHold, Hold: hold})
+}
+
+func (f *fileRepo) CancelHold(ctx context.Context, hold *loans.Hold, at time.Time) error {
+	return f.write(fileOp{Op: fileOpCancelHold, Hold: hold, At: int64(loans.ToTimestamp(at))})
+}
+
+func (f *fileRepo) ReserveIdempotencyKey(ctx context.Context, record *loans.IdempotencyRecord, at time.Time) error {
+	return f.write(fileOp{Op: fileOpReserveIdempotencyKey, Idempotency: record, At: int64(loans.ToTimestamp(at))})
+}
+
+func (f *fileRepo) CompleteIdempotencyKey(ctx context.Context, record *loans.IdempotencyRecord) error {
+	return f.write(fileOp{Op: fileOpCompleteIdempotencyKey, Idempotency: record})
+}
+
+func (f *fileRepo) ReleaseIdempotencyKey(ctx context.Context, key string) error {
+	return f.write(fileOp{Op: fileOpReleaseIdempotencyKey, Key: key})
+}
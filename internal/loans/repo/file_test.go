@@ -0,0 +1,286 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/fail"
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/loans"
+)
+
+func openFileRepo(t *testing.T, dir string) *fileRepo {
+	t.Helper()
+
+	repo, err := NewFileRepo("file://" + dir)
+	if err != nil {
+		t.Fatalf("failed to open repo: %v", err)
+	}
+	t.Cleanup(func() { repo.(*fileRepo).Close() })
+
+	return repo.(*fileRepo)
+}
+
+// fillFileRepo performs a few writes of every kind
+func fillFileRepo(t *testing.T, repo loans.Repo) {
+	t.Helper()
+
+	ctx := context.Background()
+	now := time.Unix(1_000_000, 0)
+
+	err := repo.InsertCopy(ctx, &loans.Copy{ID: "copy-1", BookID: "book-1", Barcode: "0001", Condition: loans.CopyGood})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, id := range []string{"loan-1", "loan-2"} {
+		err = repo.TakeBook(ctx, &loans.LentBook{
+			ID:             id,
+			UserID:         "user-1",
+			BookID:         "book-1",
+			TakenAt:        loans.ToTimestamp(now),
+			ReturnDeadline: loans.ToTimestamp(now) + 100,
+			Status:         loans.LoanOpen,
+		}, 0, loans.LoanLimits{})
+		if id == "loan-2" {
+			if !errors.Is(err, fail.ErrNoStock) {
+				t.Fatalf("wrong error: want %v, got %v", fail.ErrNoStock, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	err = repo.PlaceHold(ctx, &loans.Hold{ID: "hold-1", UserID: "user-2", BookID: "book-1", PlacedAt: 1, PickupWindow: 50})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	book, err := repo.GetLoan(ctx, "loan-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	book.Returned = true
+	book.ReturnedAt = book.ReturnDeadline + 10
+	book.Status = loans.LoanReturned
+	err = repo.ReturnBook(ctx, &book, []loans.Fine{{
+		ID:       "fine-1",
+		UserID:   "user-1",
+		LoanID:   "loan-1",
+		BookID:   "book-1",
+		Reason:   loans.FineLate,
+		Amount:   100,
+		IssuedAt: book.ReturnedAt,
+		Status:   loans.FineOutstanding,
+	}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	err = repo.ResolveFine(ctx, &loans.Fine{
+		ID:         "fine-1",
+		UserID:     "user-1",
+		LoanID:     "loan-1",
+		BookID:     "book-1",
+		Reason:     loans.FineLate,
+		Amount:     100,
+		IssuedAt:   book.ReturnedAt,
+		Status:     loans.FinePaid,
+		ResolvedAt: book.ReturnedAt + 1,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// dumpFileRepo returns the whole state of the repo for comparison
+func dumpFileRepo(repo *fileRepo) []any {
+	return []any{repo.RawData(), repo.RawHolds(), repo.RawFines(), repo.RawCopies()}
+}
+
+func TestFileRepo(t *testing.T) {
+	t.Run("reopen", func(t *testing.T) {
+		dir := t.TempDir()
+		repo := openFileRepo(t, dir)
+		fillFileRepo(t, repo)
+		want := dumpFileRepo(repo)
+		repo.Close()
+
+		got := dumpFileRepo(openFileRepo(t, dir))
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("state mismatch after reopening (-want +got):\n%s", diff)
+		}
+
+		if got[0].(map[string]loans.LentBook)["loan-1"].CopyID != "copy-1" {
+			t.Errorf("the copy picked by TakeBook is not persisted")
+		}
+	})
+
+	t.Run("snapshot", func(t *testing.T) {
+		dir := t.TempDir()
+		repo := openFileRepo(t, dir)
+		repo.snapshotInterval = 2
+		fillFileRepo(t, repo)
+		want := dumpFileRepo(repo)
+		repo.Close()
+
+		_, err := os.Stat(filepath.Join(dir, fileSnapshotName))
+		if err != nil {
+			t.Fatalf("expected a snapshot to be written: %v", err)
+		}
+
+		got := dumpFileRepo(openFileRepo(t, dir))
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("state mismatch after reopening (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("reading ahead", func(t *testing.T) {
+		dir := t.TempDir()
+		repo := openFileRepo(t, dir)
+		fillFileRepo(t, repo)
+		want := dumpFileRepo(repo)
+
+		// Looking at the queue after the reservation has expired, e.g. with a traveling clock,
+		// changes nothing that wouldn't be replayed
+		holds, err := repo.FindHolds(context.Background(), "", "book-1", time.Unix(2_000_000, 0))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(holds) != 0 {
+			t.Errorf("expected the reservation to have expired, got %v", holds)
+		}
+		if diff := cmp.Diff(want, dumpFileRepo(repo)); diff != "" {
+			t.Errorf("state changed by reading (-want +got):\n%s", diff)
+		}
+		repo.Close()
+
+		got := dumpFileRepo(openFileRepo(t, dir))
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("state mismatch after reopening (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("failed write", func(t *testing.T) {
+		dir := t.TempDir()
+		repo := openFileRepo(t, dir)
+		fillFileRepo(t, repo)
+		want := dumpFileRepo(repo)
+
+		// Writing to a read-only log fails, like a full disk would
+		repo.log.Close()
+		log, err := os.Open(filepath.Join(dir, fileLogName))
+		if err != nil {
+			t.Fatalf("failed to open log: %v", err)
+		}
+		repo.log = log
+
+		err = repo.InsertCopy(context.Background(), &loans.Copy{ID: "copy-2", BookID: "book-2", Barcode: "0002", Condition: loans.CopyGood})
+		if err == nil {
+			t.Fatalf("expected the write to fail")
+		}
+		if diff := cmp.Diff(want, dumpFileRepo(repo)); diff != "" {
+			t.Errorf("the failed write is visible (-want +got):\n%s", diff)
+		}
+
+		// The log is reopened, so the next write succeeds
+		err = repo.InsertCopy(context.Background(), &loans.Copy{ID: "copy-2", BookID: "book-2", Barcode: "0002", Condition: loans.CopyGood})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		repo.Close()
+		if _, ok := openFileRepo(t, dir).RawCopies()["copy-2"]; !ok {
+			t.Errorf("the write after the failed one is not persisted")
+		}
+	})
+
+	t.Run("torn write", func(t *testing.T) {
+		dir := t.TempDir()
+		repo := openFileRepo(t, dir)
+		fillFileRepo(t, repo)
+		want := dumpFileRepo(repo)
+		repo.Close()
+
+		log, err := os.OpenFile(filepath.Join(dir, fileLogName), os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			t.Fatalf("failed to open log: %v", err)
+		}
+		_, err = log.WriteString(`{"seq":100,"op":"take_bo`)
+		log.Close()
+		if err != nil {
+			t.Fatalf("failed to write log: %v", err)
+		}
+
+		repo = openFileRepo(t, dir)
+		got := dumpFileRepo(repo)
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("state mismatch after reopening (-want +got):\n%s", diff)
+		}
+
+		// The torn tail is dropped, so new writes are readable afterwards
+		err = repo.InsertCopy(context.Background(), &loans.Copy{ID: "copy-2", BookID: "book-1", Barcode: "0002"})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		repo.Close()
+
+		if _, ok := openFileRepo(t, dir).RawCopies()["copy-2"]; !ok {
+			t.Errorf("write after a torn tail is lost")
+		}
+	})
+
+	t.Run("seconds format", func(t *testing.T) {
+		dir := t.TempDir()
+		log := `{"seq":1,"op":"take_book","loan":{"id":"loan-1","user_id":"user-1","book_id":"book-1",` +
+			`"taken_at":100,"return_deadline":200,"status":"open"},"total_stock":1,"limits":{}}` + "\n" +
+			`{"seq":2,"op":"place_hold","hold":{"id":"hold-1","user_id":"user-2","book_id":"book-1",` +
+			`"placed_at":150,"pickup_window":50},"limits":{}}` + "\n" +
+			`{"seq":3,"format":1,"op":"insert_copy","copy":{"id":"copy-1","book_id":"book-1","barcode":"0001"},"limits":{}}` + "\n"
+		err := os.WriteFile(filepath.Join(dir, fileLogName), []byte(log), 0o644)
+		if err != nil {
+			t.Fatalf("failed to write log: %v", err)
+		}
+
+		repo := openFileRepo(t, dir)
+		book := repo.RawData()["loan-1"]
+		if book.TakenAt != 100_000 || book.ReturnDeadline != 200_000 {
+			t.Errorf("loan timestamps not converted to milliseconds: got %d and %d", book.TakenAt, book.ReturnDeadline)
+		}
+		hold := repo.RawHolds()["hold-1"]
+		if hold.PlacedAt != 150_000 || hold.PickupWindow != 50_000 {
+			t.Errorf("hold timestamps not converted to milliseconds: got %d and %d", hold.PlacedAt, hold.PickupWindow)
+		}
+	})
+
+	t.Run("unknown format", func(t *testing.T) {
+		dir := t.TempDir()
+		err := os.WriteFile(filepath.Join(dir, fileLogName), []byte(`{"seq":1,"format":100,"op":"take_book","limits":{}}`+"\n"), 0o644)
+		if err != nil {
+			t.Fatalf("failed to write log: %v", err)
+		}
+
+		_, err = NewFileRepo("file://" + dir)
+		if !errors.Is(err, fail.ErrMalformedStorage) {
+			t.Errorf("wrong error: want %v, got %v", fail.ErrMalformedStorage, err)
+		}
+	})
+
+	t.Run("corrupted log", func(t *testing.T) {
+		dir := t.TempDir()
+		err := os.WriteFile(filepath.Join(dir, fileLogName), []byte("garbage\n"), 0o644)
+		if err != nil {
+			t.Fatalf("failed to write log: %v", err)
+		}
+
+		_, err = NewFileRepo("file://" + dir)
+		if !errors.Is(err, fail.ErrMalformedStorage) {
+			t.Errorf("wrong error: want %v, got %v", fail.ErrMalformedStorage, err)
+		}
+	})
+}
@@ -0,0 +1,81 @@
+package repo
+
+import (
+	"cmp"
+	"slices"
+
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/loans"
+)
+
+// sortHoldQueue orders the holds on a single book by their position in the queue
+func sortHoldQueue(queue []loans.Hold) {
+	slices.SortFunc(queue, func(a, b loans.Hold) int {
+		return cmp.Or(cmp.Compare(a.PlacedAt, b.PlacedAt), cmp.Compare(a.ID, b.ID))
+	})
+}
+
+// advanceHoldQueue brings the queue of holds on a single book (in queue order) up to the given time.
+// Reservations that have expired are dropped and passed on to the next waiting holds,
+// and then up to `freed` newly available copies are reserved for the next waiting holds.
+// Returns the remaining queue and the dropped holds
+func advanceHoldQueue(queue []loans.Hold, at uint64, freed int) ([]loans.Hold, []loans.Hold) {
+	queue = slices.Clone(queue)
+	dropped := make([]loans.Hold, 0)
+
+	for {
+		expired := -1
+		for i, hold := range queue {
+			if hold.ReservedUntil == 0 || hold.ReservedUntil > at {
+				continue
+			}
+			if expired == -1 || hold.ReservedUntil < queue[expired].ReservedUntil {
+				expired = i
+			}
+		}
+		if expired == -1 {
+			break
+		}
+
+		expiredHold := queue[expired]
+		dropped = append(dropped, expiredHold)
+		queue = slices.Delete(queue, expired, expired+1)
+
+		// The copy has been waiting on the shelf since the previous reservation expired
+		if next := firstWaitingHold(queue); next != -1 {
+			queue[next].ReservedUntil = expiredHold.ReservedUntil + queue[next].PickupWindow
+		}
+	}
+
+	for ; freed > 0; freed-- {
+		next := firstWaitingHold(queue)
+		if next == -1 {
+			break
+		}
+		queue[next].ReservedUntil = at + queue[next].PickupWindow
+	}
+
+	return queue, dropped
+}
+
+// firstWaitingHold returns the index of the first hold in the queue
+// that doesn't have a reserved copy yet, or -1 if there is none
+func firstWaitingHold(queue []loans.Hold) int {
+	return slices.IndexFunc(queue, func(hold loans.Hold) bool {
+		return hold.ReservedUntil == 0
+	})
+}
+
+// countReservedFor returns the number of copies reserved at the given time for holds
+// of users other than userID, and whether userID has a hold in the queue
+func countReservedFor(queue []loans.Hold, userID string, at uint64) (reservedForOthers int64, ownHold *loans.Hold) {
+	for i, hold := range queue {
+		if hold.UserID == userID {
+			ownHold = &queue[i]
+			continue
+		}
+		if hold.ReservedUntil > at {
+			reservedForOthers += 1
+		}
+	}
+	return reservedForOthers, ownHold
+}
@@ -1,8 +1,10 @@
 package repo
 
 import (
+	"cmp"
 	"context"
 	"maps"
+	"slices"
 	"sync"
 	"time"
 
@@ -11,15 +13,31 @@ import (
 )
 
 func NewMemoryRepo(dsn string) TestMemoryRepo {
+	return newMemoryRepo()
+}
+
+func newMemoryRepo() *memoryRepo {
 	return &memoryRepo{
 		mutex:     sync.RWMutex{},
 		lentBooks: make(map[string]loans.LentBook),
+		holds:     make(map[string]loans.Hold),
+		fines:     make(map[string]loans.Fine),
+		copies:    make(map[string]loans.Copy),
+
+		idempotencyKeys: make(map[string]loans.IdempotencyRecord),
 	}
 }
 
 type memoryRepo struct {
+	// mutex guards the data. The unexported writes expect it to be held,
+	// so that fileRepo may hold it until the write is on disk
 	mutex     sync.RWMutex
 	lentBooks map[string]loans.LentBook
+	holds     map[string]loans.Hold
+	fines     map[string]loans.Fine
+	copies    map[string]loans.Copy
+
+	idempotencyKeys map[string]loans.IdempotencyRecord
 }
 
 // TestMemoryRepo is an interface that exposes memoryRepo's internal methods
@@ -31,6 +49,12 @@ type TestMemoryRepo interface {
 	InsertBook(ctx context.Context, book loans.LentBook) error
 	RawData() map[string]loans.LentBook
 	ResetRawData(map[string]loans.LentBook)
+	RawHolds() map[string]loans.Hold
+	ResetRawHolds(map[string]loans.Hold)
+	RawFines() map[string]loans.Fine
+	ResetRawFines(map[string]loans.Fine)
+	RawCopies() map[string]loans.Copy
+	ResetRawCopies(map[string]loans.Copy)
 }
 
 func (m *memoryRepo) LookupBook(ctx context.Context, ID string) (loans.LentBook, error) {
@@ -80,63 +104,126 @@ func (m *memoryRepo) ResetRawData(data map[string]loans.LentBook) {
 	m.lentBooks = maps.Clone(data)
 }
 
-func (m *memoryRepo) FindLentBooks(ctx context.Context, at time.Time) ([]loans.LentBook, error) {
+func (m *memoryRepo) RawHolds() map[string]loans.Hold {
 	m.mutex.RLock()
 	defer m.mutex.RUnlock()
 
-	atUnix := uint64(at.Unix())
-	result := make([]loans.LentBook, 0)
-	for _, book := range m.lentBooks {
-		if book.TakenAt <= atUnix && !(book.Returned && book.ReturnedAt <= atUnix) {
-			result = append(result, book)
-		}
-	}
-	return result, nil
+	return maps.Clone(m.holds)
 }
 
-func (m *memoryRepo) FindOverdueBooks(ctx context.Context, at time.Time) ([]loans.LentBook, error) {
+func (m *memoryRepo) ResetRawHolds(data map[string]loans.Hold) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.holds = maps.Clone(data)
+}
+
+func (m *memoryRepo) RawFines() map[string]loans.Fine {
 	m.mutex.RLock()
 	defer m.mutex.RUnlock()
 
-	atUnix := uint64(at.Unix())
-	result := make([]loans.LentBook, 0)
-	for _, book := range m.lentBooks {
-		if book.ReturnDeadline <= atUnix && !(book.Returned && book.ReturnedAt <= atUnix) {
-			result = append(result, book)
-		}
-	}
-	return result, nil
+	return maps.Clone(m.fines)
+}
+
+func (m *memoryRepo) ResetRawFines(data map[string]loans.Fine) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.fines = maps.Clone(data)
+}
+
+func (m *memoryRepo) RawCopies() map[string]loans.Copy {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return maps.Clone(m.copies)
+}
+
+func (m *memoryRepo) ResetRawCopies(data map[string]loans.Copy) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.copies = maps.Clone(data)
+}
+
+func (m *memoryRepo) FindLentBooks(ctx context.Context, at time.Time, page loans.Page) (loans.LoanPage, error) {
+	atTimestamp := loans.ToTimestamp(at)
+	return m.findLoanPage(func(book *loans.LentBook) bool {
+		return book.TakenAt <= atTimestamp && !(book.Returned && book.ReturnedAt <= atTimestamp)
+	}, takenAtKey, false, page)
+}
+
+func (m *memoryRepo) FindOverdueBooks(ctx context.Context, at time.Time, page loans.Page) (loans.LoanPage, error) {
+	atTimestamp := loans.ToTimestamp(at)
+	return m.findLoanPage(func(book *loans.LentBook) bool {
+		return book.ReturnDeadline <= atTimestamp && !(book.Returned && book.ReturnedAt <= atTimestamp)
+	}, returnDeadlineKey, false, page)
 }
 
-func (m *memoryRepo) TakeBook(ctx context.Context, book *loans.LentBook, totalStock uint) error {
+func (m *memoryRepo) TakeBook(ctx context.Context, book *loans.LentBook, totalStock uint, limits loans.LoanLimits) error {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
+	return m.takeBook(ctx, book, totalStock, limits)
+}
+
+func (m *memoryRepo) takeBook(ctx context.Context, book *loans.LentBook, totalStock uint, limits loans.LoanLimits) error {
 	if _, ok := m.lentBooks[book.ID]; ok {
 		return fail.ErrCollision
 	}
 
-	remainingStock := int64(totalStock)
+	userLoans, userBookLoans := uint(0), uint(0)
+	for _, lentBook := range m.lentBooks {
+		if lentBook.UserID == book.UserID && !lentBook.Returned {
+			userLoans += 1
+			if lentBook.BookID == book.BookID {
+				userBookLoans += 1
+			}
+		}
+	}
+
+	if err := limits.Check(userLoans, userBookLoans); err != nil {
+		return err
+	}
 
+	queue := m.advanceHolds(book.BookID, book.TakenAt, 0)
+	reservedForOthers, ownHold := countReservedFor(queue, book.UserID, book.TakenAt)
+
+	bookLoans := make([]loans.LentBook, 0)
 	for _, lentBook := range m.lentBooks {
 		if lentBook.BookID == book.BookID {
-			remainingStock -= 1
+			bookLoans = append(bookLoans, lentBook)
 		}
 	}
+	copies := m.findCopies(book.BookID)
+	stock := loans.ComputeStock(totalStock, copies, bookLoans)
 
-	if remainingStock <= 0 {
+	if stock.InStock-reservedForOthers <= 0 {
 		return fail.ErrNoStock
 	}
 
+	copyID, err := pickCopy(stock, copies, book.CopyID)
+	if err != nil {
+		return err
+	}
+	book.CopyID = copyID
+
 	m.lentBooks[book.ID] = *book
+	if ownHold != nil {
+		delete(m.holds, ownHold.ID)
+	}
 
 	return nil
 }
 
-func (m *memoryRepo) ReturnBook(ctx context.Context, book *loans.LentBook) error {
+func (m *memoryRepo) ReturnBook(ctx context.Context, book *loans.LentBook, fines []loans.Fine) error {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
+	return m.returnBook(ctx, book, fines)
+}
+
+func (m *memoryRepo) returnBook(ctx context.Context, book *loans.LentBook, fines []loans.Fine) error {
 	oldBook, ok := m.lentBooks[book.ID]
 	if !ok {
 		return fail.ErrNotFound
@@ -151,11 +238,86 @@ func (m *memoryRepo) ReturnBook(ctx context.Context, book *loans.LentBook) error
 		return fail.ErrCollision
 	}
 
+	for _, fine := range fines {
+		if _, ok := m.fines[fine.ID]; ok {
+			return fail.ErrCollision
+		}
+	}
+	for _, fine := range fines {
+		m.fines[fine.ID] = fine
+	}
+
 	m.lentBooks[book.ID] = *book
 
+	if condition, damaged := closedCopyCondition(book.Status); damaged {
+		if bookCopy, ok := m.copies[book.CopyID]; ok {
+			bookCopy.Condition = condition
+			m.copies[book.CopyID] = bookCopy
+		}
+	}
+	if returnFreesStock(book) {
+		m.advanceHolds(book.BookID, book.ReturnedAt, 1)
+	}
+
 	return nil
 }
 
+func (m *memoryRepo) RenewLoan(ctx context.Context, book *loans.LentBook) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.renewLoan(ctx, book)
+}
+
+func (m *memoryRepo) renewLoan(ctx context.Context, book *loans.LentBook) error {
+	oldBook, ok := m.lentBooks[book.ID]
+	if !ok {
+		return fail.ErrNotFound
+	}
+
+	if oldBook.Returned {
+		return fail.ErrCollision
+	}
+
+	if oldBook.UserID != book.UserID || oldBook.BookID != book.BookID {
+		return fail.ErrCollision
+	}
+
+	if oldBook.Renewals+1 != book.Renewals {
+		// Someone else has renewed the loan concurrently
+		return fail.ErrCollision
+	}
+
+	m.lentBooks[book.ID] = *book
+
+	return nil
+}
+
+func (m *memoryRepo) CountOverdueLoansOf(ctx context.Context, userID string, at time.Time) (uint, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	atTimestamp := loans.ToTimestamp(at)
+	result := uint(0)
+	for _, book := range m.lentBooks {
+		if book.UserID == userID && !book.Returned && book.ReturnDeadline <= atTimestamp {
+			result += 1
+		}
+	}
+	return result, nil
+}
+
+func (m *memoryRepo) GetLoan(ctx context.Context, loanID string) (loans.LentBook, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	book, ok := m.lentBooks[loanID]
+	if !ok {
+		return loans.LentBook{}, fail.ErrNotFound
+	}
+	return book, nil
+}
+
 func (m *memoryRepo) FindLoansOf(ctx context.Context, userID string, bookID string) ([]loans.LentBook, error) {
 	m.mutex.RLock()
 	defer m.mutex.RUnlock()
@@ -166,5 +328,348 @@ func (m *memoryRepo) FindLoansOf(ctx context.Context, userID string, bookID stri
 			result = append(result, book)
 		}
 	}
+	sortLoans(result, takenAtKey, false)
 	return result, nil
 }
+
+func (m *memoryRepo) FindLoans(
+	ctx context.Context,
+	filter loans.LoanFilter,
+	order loans.LoanSort,
+	page loans.Page,
+) (loans.LoanPage, error) {
+	return m.findLoanPage(filter.Matches, takenAtKey, order == loans.SortTakenDesc, page)
+}
+
+// findLoanPage lists the loans that match, ordered by the given sort key and then by ID, a page at a time
+func (m *memoryRepo) findLoanPage(
+	match func(*loans.LentBook) bool,
+	key func(*loans.LentBook) uint64,
+	descending bool,
+	page loans.Page,
+) (loans.LoanPage, error) {
+	cursor, err := loans.DecodeCursor(page.Cursor)
+	if err != nil {
+		return loans.LoanPage{}, err
+	}
+
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	total := uint(0)
+	result := make([]loans.LentBook, 0)
+	for _, book := range m.lentBooks {
+		if !match(&book) {
+			continue
+		}
+		total += 1
+		if isAfterCursor(&book, cursor, key, descending) {
+			result = append(result, book)
+		}
+	}
+
+	sortLoans(result, key, descending)
+	if uint(len(result)) > page.Limit+1 {
+		result = result[:page.Limit+1]
+	}
+
+	return cutLoanPage(result, page.Limit, total, key), nil
+}
+
+func (m *memoryRepo) InsertCopy(ctx context.Context, bookCopy *loans.Copy) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.insertCopy(ctx, bookCopy)
+}
+
+func (m *memoryRepo) insertCopy(ctx context.Context, bookCopy *loans.Copy) error {
+	if _, ok := m.copies[bookCopy.ID]; ok {
+		return fail.ErrCollision
+	}
+
+	for _, otherCopy := range m.copies {
+		if otherCopy.Barcode == bookCopy.Barcode {
+			return fail.ErrCollision
+		}
+	}
+
+	m.copies[bookCopy.ID] = *bookCopy
+
+	return nil
+}
+
+func (m *memoryRepo) UpdateCopy(ctx context.Context, bookCopy *loans.Copy) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.updateCopy(ctx, bookCopy)
+}
+
+func (m *memoryRepo) updateCopy(ctx context.Context, bookCopy *loans.Copy) error {
+	oldCopy, ok := m.copies[bookCopy.ID]
+	if !ok {
+		return fail.ErrNotFound
+	}
+
+	if oldCopy.BookID != bookCopy.BookID || oldCopy.Barcode != bookCopy.Barcode {
+		return fail.ErrCollision
+	}
+
+	m.copies[bookCopy.ID] = *bookCopy
+
+	return nil
+}
+
+func (m *memoryRepo) LookupCopy(ctx context.Context, barcode string) (loans.Copy, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	for _, bookCopy := range m.copies {
+		if bookCopy.Barcode == barcode {
+			return bookCopy, nil
+		}
+	}
+	return loans.Copy{}, fail.ErrNotFound
+}
+
+func (m *memoryRepo) FindCopies(ctx context.Context, bookID string) ([]loans.Copy, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return m.findCopies(bookID), nil
+}
+
+// findCopies returns the copies of the given book ordered by barcode.
+// Must be called with the lock held
+func (m *memoryRepo) findCopies(bookID string) []loans.Copy {
+	result := make([]loans.Copy, 0)
+	for _, bookCopy := range m.copies {
+		if bookCopy.BookID == bookID {
+			result = append(result, bookCopy)
+		}
+	}
+	sortCopies(result)
+	return result
+}
+
+func (m *memoryRepo) LookupFine(ctx context.Context, fineID string) (loans.Fine, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	fine, ok := m.fines[fineID]
+	if !ok {
+		return loans.Fine{}, fail.ErrNotFound
+	}
+	return fine, nil
+}
+
+func (m *memoryRepo) FindFines(ctx context.Context, userID string) ([]loans.Fine, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	result := make([]loans.Fine, 0)
+	for _, fine := range m.fines {
+		if fine.UserID == userID {
+			result = append(result, fine)
+		}
+	}
+	slices.SortFunc(result, func(a, b loans.Fine) int {
+		return cmp.Or(cmp.Compare(a.IssuedAt, b.IssuedAt), cmp.Compare(a.ID, b.ID))
+	})
+	return result, nil
+}
+
+func (m *memoryRepo) ResolveFine(ctx context.Context, fine *loans.Fine) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.resolveFine(ctx, fine)
+}
+
+func (m *memoryRepo) resolveFine(ctx context.Context, fine *loans.Fine) error {
+	oldFine, ok := m.fines[fine.ID]
+	if !ok {
+		return fail.ErrNotFound
+	}
+
+	if oldFine.Status != loans.FineOutstanding {
+		return fail.ErrCollision
+	}
+
+	m.fines[fine.ID] = *fine
+
+	return nil
+}
+
+func (m *memoryRepo) PlaceHold(ctx context.Context, hold *loans.Hold) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.placeHold(ctx, hold)
+}
+
+func (m *memoryRepo) placeHold(ctx context.Context, hold *loans.Hold) error {
+	if _, ok := m.holds[hold.ID]; ok {
+		return fail.ErrCollision
+	}
+
+	for _, otherHold := range m.holds {
+		if otherHold.UserID == hold.UserID && otherHold.BookID == hold.BookID {
+			return fail.ErrCollision
+		}
+	}
+
+	m.holds[hold.ID] = *hold
+
+	return nil
+}
+
+func (m *memoryRepo) CancelHold(ctx context.Context, hold *loans.Hold, at time.Time) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.cancelHold(ctx, hold, at)
+}
+
+func (m *memoryRepo) cancelHold(ctx context.Context, hold *loans.Hold, at time.Time) error {
+	atTimestamp := loans.ToTimestamp(at)
+	m.advanceHolds(hold.BookID, atTimestamp, 0)
+
+	oldHold, ok := m.holds[hold.ID]
+	if !ok {
+		// Might have also expired just now
+		return fail.ErrNotFound
+	}
+
+	delete(m.holds, hold.ID)
+	if oldHold.ReservedUntil != 0 {
+		m.advanceHolds(hold.BookID, atTimestamp, 1)
+	}
+
+	return nil
+}
+
+func (m *memoryRepo) FindHolds(ctx context.Context, userID string, bookID string, at time.Time) ([]loans.Hold, error) {
+	// The queues are advanced on copies, so that reading doesn't change the state: the file repo
+	// only logs the writes, and the expired reservations are dropped by the next write anyway
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	atTimestamp := loans.ToTimestamp(at)
+	bookIDs := make(map[string]struct{})
+	for _, hold := range m.holds {
+		if bookID == "" || hold.BookID == bookID {
+			bookIDs[hold.BookID] = struct{}{}
+		}
+	}
+
+	result := make([]loans.Hold, 0)
+	for _, id := range slices.Sorted(maps.Keys(bookIDs)) {
+		queue, _ := advanceHoldQueue(m.holdQueue(id), atTimestamp, 0)
+		for _, hold := range queue {
+			if userID == "" || hold.UserID == userID {
+				result = append(result, hold)
+			}
+		}
+	}
+	return result, nil
+}
+
+// advanceHolds brings the queue of holds on the given book up to the given time,
+// reserving `freed` newly available copies. Returns the resulting queue.
+// Must be called with the write lock held
+func (m *memoryRepo) advanceHolds(bookID string, at uint64, freed int) []loans.Hold {
+	queue, dropped := advanceHoldQueue(m.holdQueue(bookID), at, freed)
+	for _, hold := range dropped {
+		delete(m.holds, hold.ID)
+	}
+	for _, hold := range queue {
+		m.holds[hold.ID] = hold
+	}
+
+	return queue
+}
+
+// holdQueue returns the holds on the given book in queue order, as they are stored.
+// Must be called with the lock held
+func (m *memoryRepo) holdQueue(bookID string) []loans.Hold {
+	queue := make([]loans.Hold, 0)
+	for _, hold := range m.holds {
+		if hold.BookID == bookID {
+			queue = append(queue, hold)
+		}
+	}
+	sortHoldQueue(queue)
+	return queue
+}
+
+func (m *memoryRepo) ReserveIdempotencyKey(ctx context.Context, record *loans.IdempotencyRecord, at time.Time) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.reserveIdempotencyKey(ctx, record, at)
+}
+
+func (m *memoryRepo) reserveIdempotencyKey(ctx context.Context, record *loans.IdempotencyRecord, at time.Time) error {
+	atTimestamp := loans.ToTimestamp(at)
+	maps.DeleteFunc(m.idempotencyKeys, func(key string, record loans.IdempotencyRecord) bool {
+		return record.ExpiresAt <= atTimestamp
+	})
+
+	if _, ok := m.idempotencyKeys[record.Key]; ok {
+		return fail.ErrCollision
+	}
+
+	m.idempotencyKeys[record.Key] = cloneIdempotencyRecord(record)
+
+	return nil
+}
+
+func (m *memoryRepo) LookupIdempotencyKey(ctx context.Context, key string, at time.Time) (loans.IdempotencyRecord, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	record, ok := m.idempotencyKeys[key]
+	if !ok || record.ExpiresAt <= loans.ToTimestamp(at) {
+		return loans.IdempotencyRecord{}, fail.ErrNotFound
+	}
+	return cloneIdempotencyRecord(&record), nil
+}
+
+func (m *memoryRepo) CompleteIdempotencyKey(ctx context.Context, record *loans.IdempotencyRecord) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.completeIdempotencyKey(ctx, record)
+}
+
+func (m *memoryRepo) completeIdempotencyKey(ctx context.Context, record *loans.IdempotencyRecord) error {
+	if _, ok := m.idempotencyKeys[record.Key]; !ok {
+		return fail.ErrNotFound
+	}
+
+	m.idempotencyKeys[record.Key] = cloneIdempotencyRecord(record)
+
+	return nil
+}
+
+func (m *memoryRepo) ReleaseIdempotencyKey(ctx context.Context, key string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.releaseIdempotencyKey(ctx, key)
+}
+
+func (m *memoryRepo) releaseIdempotencyKey(ctx context.Context, key string) error {
+	delete(m.idempotencyKeys, key)
+
+	return nil
+}
+
+// cloneIdempotencyRecord copies the record, so that the caller can't modify the stored body
+func cloneIdempotencyRecord(record *loans.IdempotencyRecord) loans.IdempotencyRecord {
+	result := *record
+	result.Body = slices.Clone(record.Body)
+	return result
+}
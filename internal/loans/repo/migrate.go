@@ -0,0 +1,225 @@
+package repo
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/fail"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migration is a single numbered step of the schema evolution
+type migration struct {
+	version int
+	name    string
+	script  string
+	// prepare, if set, runs before the script in the same transaction
+	prepare func(ctx context.Context, tx *sql.Tx) error
+}
+
+// migrationPreparations are the steps that can't be written in plain SQL, by migration version
+var migrationPreparations = map[int]func(ctx context.Context, tx *sql.Tx) error{
+	2: completeLegacySchema,
+}
+
+// legacyTables is the schema once created by hand from db/init.sql, which grew the columns
+// and tables over time. Databases created from any revision of it are adopted by migration 2
+var legacyTables = []struct {
+	name    string
+	columns []string
+}{
+	{"lent_books", []string{
+		"id TEXT", "user_id TEXT", "book_id TEXT", "copy_id TEXT", "taken_at INTEGER", "return_deadline INTEGER",
+		"returned BOOLEAN", "returned_at INTEGER", "renewals INTEGER", "status TEXT",
+	}},
+	{"holds", []string{
+		"id TEXT", "user_id TEXT", "book_id TEXT", "placed_at INTEGER", "pickup_window INTEGER", "reserved_until INTEGER",
+	}},
+	{"fines", []string{
+		"id TEXT", "user_id TEXT", "loan_id TEXT", "book_id TEXT", "reason TEXT", "amount INTEGER",
+		"issued_at INTEGER", "status TEXT", "resolved_at INTEGER",
+	}},
+	{"copies", []string{
+		"id TEXT", "book_id TEXT", "barcode TEXT", "condition TEXT", "shelf_location TEXT",
+	}},
+}
+
+// completeLegacySchema brings the hand-made schema to the latest revision of db/init.sql,
+// creating the missing tables and adding the missing columns, all left empty.
+// Migration 2 then rebuilds each table, keeping the rows that are already there
+func completeLegacySchema(ctx context.Context, tx *sql.Tx) error {
+	for _, table := range legacyTables {
+		existing, err := tableColumns(ctx, tx, table.name)
+		if err != nil {
+			return err
+		}
+		if len(existing) == 0 {
+			_, err := tx.ExecContext(ctx, fmt.Sprintf("CREATE TABLE %s (%s)", table.name, strings.Join(table.columns, ", ")))
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		for _, column := range table.columns {
+			name, _, _ := strings.Cut(column, " ")
+			if existing[name] {
+				continue
+			}
+			_, err := tx.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s", table.name, column))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// tableColumns returns the set of the columns of the table, which is empty if there is no such table
+func tableColumns(ctx context.Context, tx *sql.Tx, table string) (map[string]bool, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		err := rows.Scan(&name)
+		if err != nil {
+			return nil, err
+		}
+		result[name] = true
+	}
+	return result, rows.Err()
+}
+
+// loadMigrations reads the embedded migrations, which are named "<version>_<description>.sql",
+// and returns them ordered by version. The versions must go 1, 2, 3... without gaps
+func loadMigrations() ([]migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]migration, 0, len(entries))
+	for _, entry := range entries {
+		prefix, _, ok := strings.Cut(entry.Name(), "_")
+		if !ok {
+			return nil, fmt.Errorf("migration %q is not numbered", entry.Name())
+		}
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("migration %q is not numbered: %w", entry.Name(), err)
+		}
+
+		script, err := fs.ReadFile(migrationFiles, "migrations/"+entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, migration{
+			version: version,
+			name:    entry.Name(),
+			script:  string(script),
+			prepare: migrationPreparations[version],
+		})
+	}
+
+	slices.SortFunc(result, func(a, b migration) int {
+		return a.version - b.version
+	})
+	for i, m := range result {
+		if m.version != i+1 {
+			return nil, fmt.Errorf("migration %q is out of sequence", m.name)
+		}
+	}
+
+	return result, nil
+}
+
+// migrate brings the database schema up to the latest known version,
+// applying each pending migration in its own transaction.
+// Refuses to touch a database with a schema newer than this code knows about
+func migrate(ctx context.Context, db *sql.DB) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL)")
+	if err != nil {
+		return err
+	}
+
+	current, err := schemaVersion(ctx, db)
+	if err != nil {
+		return err
+	}
+	if current > len(migrations) {
+		return fmt.Errorf(
+			"%w: schema version %d is newer than the latest known %d",
+			fail.ErrMalformedStorage, current, len(migrations),
+		)
+	}
+
+	for _, m := range migrations[current:] {
+		err := applyMigration(ctx, db, m)
+		if err != nil {
+			return fmt.Errorf("failed to apply migration %q: %w", m.name, err)
+		}
+	}
+
+	return nil
+}
+
+// schemaVersion returns the version of the last applied migration, or 0 if there is none
+func schemaVersion(ctx context.Context, db *sql.DB) (int, error) {
+	var version sql.NullInt64
+	err := db.QueryRowContext(ctx, "SELECT max(version) FROM schema_version").Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+	return int(version.Int64), nil
+}
+
+// applyMigration runs the migration and records its version atomically
+func applyMigration(ctx context.Context, db *sql.DB, m migration) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if m.prepare != nil {
+		err = m.prepare(ctx, tx)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, m.script)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM schema_version")
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO schema_version (version) VALUES (?)", m.version)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
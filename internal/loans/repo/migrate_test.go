@@ -0,0 +1,243 @@
+package repo
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/fail"
+)
+
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "loans.sqlite"))
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+func TestMigrate(t *testing.T) {
+	t.Run("fresh", func(t *testing.T) {
+		ctx := context.Background()
+		db := openTestDB(t)
+
+		err := migrate(ctx, db)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		migrations, err := loadMigrations()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		version, err := schemaVersion(ctx, db)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if version != len(migrations) {
+			t.Errorf("wrong schema version: want %d, got %d", len(migrations), version)
+		}
+
+		// Applying the migrations again is a no-op
+		err = migrate(ctx, db)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("adopt hand-made schema", func(t *testing.T) {
+		ctx := context.Background()
+		db := openTestDB(t)
+
+		_, err := db.Exec(`
+			CREATE TABLE lent_books (
+				id TEXT,
+				user_id TEXT,
+				book_id TEXT,
+				taken_at INTEGER,
+				return_deadline INTEGER,
+				returned BOOLEAN,
+				returned_at INTEGER
+			);
+			INSERT INTO lent_books VALUES ('loan-1', 'user-1', 'book-1', 100, 200, TRUE, 150);
+			INSERT INTO lent_books VALUES ('loan-2', 'user-1', 'book-1', 100, 200, FALSE, 0);
+		`)
+		if err != nil {
+			t.Fatalf("failed to create legacy schema: %v", err)
+		}
+
+		err = migrate(ctx, db)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		statuses := make(map[string]string)
+		returnedAt := make(map[string]uint64)
+		rows, err := db.Query("SELECT id, status, taken_at, return_deadline, returned_at FROM lent_books")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id, status string
+			var takenAt, returnDeadline, returned uint64
+			if err := rows.Scan(&id, &status, &takenAt, &returnDeadline, &returned); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if takenAt != 100_000 || returnDeadline != 200_000 {
+				t.Errorf("timestamps of %s not converted to milliseconds: got %d and %d", id, takenAt, returnDeadline)
+			}
+			statuses[id] = status
+			returnedAt[id] = returned
+		}
+
+		if statuses["loan-1"] != "returned" || statuses["loan-2"] != "open" || len(statuses) != 2 {
+			t.Errorf("loans not preserved: got %v", statuses)
+		}
+		if returnedAt["loan-1"] != 150_000 || returnedAt["loan-2"] != 0 {
+			t.Errorf("return times not converted to milliseconds: got %v", returnedAt)
+		}
+
+		_, err = db.Exec("INSERT INTO lent_books (id, user_id, book_id, taken_at, return_deadline) VALUES ('loan-1', 'user-2', 'book-2', 1, 2)")
+		if err == nil {
+			t.Errorf("expected the primary key to be enforced")
+		}
+	})
+
+	t.Run("adopt init.sql schema", func(t *testing.T) {
+		ctx := context.Background()
+		db := openTestDB(t)
+
+		// The last revision of db/init.sql, with a row in each table
+		_, err := db.Exec(`
+			CREATE TABLE lent_books (
+				id TEXT, user_id TEXT, book_id TEXT, copy_id TEXT, taken_at INTEGER, return_deadline INTEGER,
+				returned BOOLEAN, returned_at INTEGER, renewals INTEGER, status TEXT
+			);
+			CREATE TABLE holds (
+				id TEXT, user_id TEXT, book_id TEXT, placed_at INTEGER, pickup_window INTEGER, reserved_until INTEGER
+			);
+			CREATE TABLE fines (
+				id TEXT, user_id TEXT, loan_id TEXT, book_id TEXT, reason TEXT, amount INTEGER,
+				issued_at INTEGER, status TEXT, resolved_at INTEGER
+			);
+			CREATE TABLE copies (id TEXT, book_id TEXT, barcode TEXT, condition TEXT, shelf_location TEXT);
+			INSERT INTO lent_books VALUES ('loan-1', 'user-1', 'book-1', 'copy-1', 100, 200, TRUE, 150, 2, 'lost');
+			INSERT INTO holds VALUES ('hold-1', 'user-2', 'book-1', 120, 60, 0);
+			INSERT INTO fines VALUES ('fine-1', 'user-1', 'loan-1', 'book-1', 'lost', 500, 150, 'unpaid', 0);
+			INSERT INTO copies VALUES ('copy-1', 'book-1', 'barcode-1', 'good', 'A-1');
+		`)
+		if err != nil {
+			t.Fatalf("failed to create legacy schema: %v", err)
+		}
+
+		err = migrate(ctx, db)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		var copyID, status string
+		var renewals int
+		err = db.QueryRow("SELECT copy_id, renewals, status FROM lent_books WHERE id = 'loan-1'").Scan(&copyID, &renewals, &status)
+		if err != nil {
+			t.Fatalf("loan not preserved: %v", err)
+		}
+		if copyID != "copy-1" || renewals != 2 || status != "lost" {
+			t.Errorf("loan columns not preserved: got %q, %d, %q", copyID, renewals, status)
+		}
+
+		var pickupWindow uint64
+		err = db.QueryRow("SELECT pickup_window FROM holds WHERE id = 'hold-1'").Scan(&pickupWindow)
+		if err != nil {
+			t.Fatalf("hold not preserved: %v", err)
+		}
+		if pickupWindow != 60_000 {
+			t.Errorf("pickup window not converted to milliseconds: got %d", pickupWindow)
+		}
+
+		var reason string
+		err = db.QueryRow("SELECT reason FROM fines WHERE id = 'fine-1'").Scan(&reason)
+		if err != nil {
+			t.Fatalf("fine not preserved: %v", err)
+		}
+		if reason != "lost" {
+			t.Errorf("fine reason not preserved: got %q", reason)
+		}
+
+		var shelfLocation string
+		err = db.QueryRow("SELECT shelf_location FROM copies WHERE id = 'copy-1'").Scan(&shelfLocation)
+		if err != nil {
+			t.Fatalf("copy not preserved: %v", err)
+		}
+		if shelfLocation != "A-1" {
+			t.Errorf("shelf location not preserved: got %q", shelfLocation)
+		}
+	})
+
+	t.Run("adopt early init.sql schema", func(t *testing.T) {
+		ctx := context.Background()
+		db := openTestDB(t)
+
+		// db/init.sql once had renewals and fines, but no copies, loan states or fine reasons yet
+		_, err := db.Exec(`
+			CREATE TABLE lent_books (
+				id TEXT, user_id TEXT, book_id TEXT, taken_at INTEGER, return_deadline INTEGER,
+				returned BOOLEAN, returned_at INTEGER, renewals INTEGER
+			);
+			CREATE TABLE fines (
+				id TEXT, user_id TEXT, loan_id TEXT, book_id TEXT, amount INTEGER,
+				issued_at INTEGER, status TEXT, resolved_at INTEGER
+			);
+			INSERT INTO lent_books VALUES ('loan-1', 'user-1', 'book-1', 100, 200, TRUE, 150, 1);
+			INSERT INTO fines VALUES ('fine-1', 'user-1', 'loan-1', 'book-1', 500, 150, 'unpaid', 0);
+		`)
+		if err != nil {
+			t.Fatalf("failed to create legacy schema: %v", err)
+		}
+
+		err = migrate(ctx, db)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		var copyID, status string
+		var renewals int
+		err = db.QueryRow("SELECT copy_id, renewals, status FROM lent_books WHERE id = 'loan-1'").Scan(&copyID, &renewals, &status)
+		if err != nil {
+			t.Fatalf("loan not preserved: %v", err)
+		}
+		if copyID != "" || renewals != 1 || status != "returned" {
+			t.Errorf("wrong loan columns: got %q, %d, %q", copyID, renewals, status)
+		}
+
+		var reason string
+		err = db.QueryRow("SELECT reason FROM fines WHERE id = 'fine-1'").Scan(&reason)
+		if err != nil {
+			t.Fatalf("fine not preserved: %v", err)
+		}
+		if reason != "late" {
+			t.Errorf("wrong fine reason: got %q", reason)
+		}
+	})
+
+	t.Run("newer schema", func(t *testing.T) {
+		ctx := context.Background()
+		db := openTestDB(t)
+
+		_, err := db.Exec("CREATE TABLE schema_version (version INTEGER NOT NULL); INSERT INTO schema_version VALUES (1000)")
+		if err != nil {
+			t.Fatalf("failed to create schema table: %v", err)
+		}
+
+		err = migrate(ctx, db)
+		if !errors.Is(err, fail.ErrMalformedStorage) {
+			t.Errorf("wrong error: want %v, got %v", fail.ErrMalformedStorage, err)
+		}
+	})
+}
@@ -0,0 +1,13 @@
+-- The schema as it used to be created by hand before migrations were introduced.
+-- Databases created that way are adopted as is, and so are the ones created from
+-- the later revisions of db/init.sql: migration 2 completes them first.
+
+CREATE TABLE IF NOT EXISTS lent_books (
+    id TEXT,
+    user_id TEXT,
+    book_id TEXT,
+    taken_at INTEGER,
+    return_deadline INTEGER,
+    returned BOOLEAN,
+    returned_at INTEGER
+);
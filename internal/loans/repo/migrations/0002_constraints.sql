@@ -0,0 +1,105 @@
+-- Adds primary keys, NOT NULL constraints and indexes, along with the columns
+-- and tables for renewals, holds, fines, copies and closed loan states.
+-- SQLite can't alter constraints in place, so the tables are rebuilt.
+-- The hand-made ones, with all the columns added over time, are filled in
+-- beforehand by completeLegacySchema, so their rows are kept here.
+
+CREATE TABLE lent_books_new (
+    id TEXT NOT NULL PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    book_id TEXT NOT NULL,
+    copy_id TEXT NOT NULL DEFAULT '',
+    taken_at INTEGER NOT NULL,
+    return_deadline INTEGER NOT NULL,
+    returned BOOLEAN NOT NULL DEFAULT FALSE,
+    returned_at INTEGER NOT NULL DEFAULT 0,
+    renewals INTEGER NOT NULL DEFAULT 0,
+    status TEXT NOT NULL DEFAULT 'open'
+);
+
+INSERT INTO lent_books_new
+SELECT
+    id,
+    user_id,
+    book_id,
+    coalesce(copy_id, ''),
+    taken_at,
+    return_deadline,
+    coalesce(returned, FALSE),
+    coalesce(returned_at, 0),
+    coalesce(renewals, 0),
+    coalesce(nullif(status, ''), CASE WHEN returned THEN 'returned' ELSE 'open' END)
+FROM lent_books;
+
+DROP TABLE lent_books;
+ALTER TABLE lent_books_new RENAME TO lent_books;
+
+CREATE INDEX lent_books_user_id ON lent_books (user_id);
+CREATE INDEX lent_books_book_id ON lent_books (book_id);
+CREATE INDEX lent_books_return_deadline ON lent_books (return_deadline);
+
+CREATE TABLE holds_new (
+    id TEXT NOT NULL PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    book_id TEXT NOT NULL,
+    placed_at INTEGER NOT NULL,
+    pickup_window INTEGER NOT NULL,
+    reserved_until INTEGER NOT NULL DEFAULT 0
+);
+
+INSERT INTO holds_new
+SELECT id, user_id, book_id, placed_at, pickup_window, coalesce(reserved_until, 0)
+FROM holds;
+
+DROP TABLE holds;
+ALTER TABLE holds_new RENAME TO holds;
+
+CREATE INDEX holds_user_id ON holds (user_id);
+CREATE INDEX holds_book_id ON holds (book_id);
+
+CREATE TABLE fines_new (
+    id TEXT NOT NULL PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    loan_id TEXT NOT NULL,
+    book_id TEXT NOT NULL,
+    reason TEXT NOT NULL DEFAULT 'late',
+    amount INTEGER NOT NULL,
+    issued_at INTEGER NOT NULL,
+    status TEXT NOT NULL,
+    resolved_at INTEGER NOT NULL DEFAULT 0
+);
+
+INSERT INTO fines_new
+SELECT
+    id,
+    user_id,
+    loan_id,
+    book_id,
+    coalesce(nullif(reason, ''), 'late'),
+    amount,
+    issued_at,
+    status,
+    coalesce(resolved_at, 0)
+FROM fines;
+
+DROP TABLE fines;
+ALTER TABLE fines_new RENAME TO fines;
+
+CREATE INDEX fines_user_id ON fines (user_id);
+
+CREATE TABLE copies_new (
+    id TEXT NOT NULL PRIMARY KEY,
+    book_id TEXT NOT NULL,
+    barcode TEXT NOT NULL UNIQUE,
+    condition TEXT NOT NULL,
+    shelf_location TEXT NOT NULL DEFAULT ''
+);
+
+INSERT INTO copies_new
+SELECT id, book_id, barcode, condition, coalesce(shelf_location, '')
+FROM copies;
+
+DROP TABLE copies;
+ALTER TABLE copies_new RENAME TO copies;
+
+CREATE INDEX copies_book_id ON copies (book_id);
@@ -0,0 +1,16 @@
+-- Switches all timestamps (and the hold pickup windows added to them)
+-- from Unix seconds to milliseconds. Unset timestamps stay 0.
+
+UPDATE lent_books SET
+    taken_at = taken_at * 1000,
+    return_deadline = return_deadline * 1000,
+    returned_at = returned_at * 1000;
+
+UPDATE holds SET
+    placed_at = placed_at * 1000,
+    pickup_window = pickup_window * 1000,
+    reserved_until = reserved_until * 1000;
+
+UPDATE fines SET
+    issued_at = issued_at * 1000,
+    resolved_at = resolved_at * 1000;
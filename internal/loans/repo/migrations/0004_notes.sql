@@ -0,0 +1,3 @@
+-- Adds free-form notes left when a book is taken.
+
+ALTER TABLE lent_books ADD COLUMN notes TEXT NOT NULL DEFAULT '';
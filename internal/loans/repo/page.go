@@ -0,0 +1,62 @@
+package repo
+
+import (
+	"cmp"
+	"slices"
+
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/loans"
+)
+
+// sortLoans orders the loans by the given sort key and then by ID, ascending or descending
+func sortLoans(books []loans.LentBook, key func(*loans.LentBook) uint64, descending bool) {
+	slices.SortFunc(books, func(a, b loans.LentBook) int {
+		result := cmp.Or(cmp.Compare(key(&a), key(&b)), cmp.Compare(a.ID, b.ID))
+		if descending {
+			return -result
+		}
+		return result
+	})
+}
+
+// isAfterCursor tells whether the loan comes after the cursor in a listing
+// ordered by the given sort key and then by ID, ascending or descending
+func isAfterCursor(book *loans.LentBook, cursor *loans.Cursor, key func(*loans.LentBook) uint64, descending bool) bool {
+	if cursor == nil {
+		return true
+	}
+	result := cmp.Or(cmp.Compare(key(book), cursor.Key), cmp.Compare(book.ID, cursor.ID))
+	if descending {
+		return result < 0
+	}
+	return result > 0
+}
+
+// cutLoanPage makes a page out of up to limit+1 loans that follow the cursor in a listing
+// of total loans. The extra loan, if present, only signals that there is a next page
+func cutLoanPage(books []loans.LentBook, limit uint, total uint, key func(*loans.LentBook) uint64) loans.LoanPage {
+	if uint(len(books)) <= limit {
+		return loans.LoanPage{
+			Loans:      books,
+			NextCursor: "",
+			Total:      total,
+		}
+	}
+
+	books = books[:limit]
+	last := &books[len(books)-1]
+	return loans.LoanPage{
+		Loans:      books,
+		NextCursor: loans.Cursor{Key: key(last), ID: last.ID}.Encode(),
+		Total:      total,
+	}
+}
+
+// takenAtKey is the sort key of listings ordered by the time the books were taken
+func takenAtKey(book *loans.LentBook) uint64 {
+	return book.TakenAt
+}
+
+// returnDeadlineKey is the sort key of listings ordered by the return deadlines
+func returnDeadlineKey(book *loans.LentBook) uint64 {
+	return book.ReturnDeadline
+}
@@ -3,6 +3,7 @@ package repo
 import (
 	"context"
 	"database/sql"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -24,6 +25,12 @@ func NewSqliteRepo(dsn string) (loans.Repo, error) {
 		return nil, err
 	}
 
+	err = migrate(context.Background(), db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
 	return &sqliteRepo{
 		mutex: sync.RWMutex{},
 		db:    db,
@@ -35,24 +42,37 @@ type sqliteRepo struct {
 	db    *sql.DB
 }
 
+// Close closes the database, waiting for the queries in progress
+func (s *sqliteRepo) Close() error {
+	return s.db.Close()
+}
+
 type sqliteLentBook struct {
 	ID             sql.NullString
 	UserID         sql.NullString
 	BookID         sql.NullString
+	CopyID         sql.NullString
 	TakenAt        sql.NullInt64
 	ReturnDeadline sql.NullInt64
 	Returned       sql.NullBool
 	ReturnedAt     sql.NullInt64
+	Renewals       sql.NullInt64
+	Status         sql.NullString
+	Notes          sql.NullString
 }
 
 func convertSqliteToReal(sqliteLentBook sqliteLentBook) (loans.LentBook, error) {
 	if !(sqliteLentBook.ID.Valid &&
 		sqliteLentBook.UserID.Valid &&
 		sqliteLentBook.BookID.Valid &&
+		sqliteLentBook.CopyID.Valid &&
 		sqliteLentBook.TakenAt.Valid &&
 		sqliteLentBook.ReturnDeadline.Valid &&
 		sqliteLentBook.Returned.Valid &&
-		sqliteLentBook.ReturnedAt.Valid) {
+		sqliteLentBook.ReturnedAt.Valid &&
+		sqliteLentBook.Renewals.Valid &&
+		sqliteLentBook.Status.Valid &&
+		sqliteLentBook.Notes.Valid) {
 		return loans.LentBook{}, fail.ErrMalformedStorage
 	}
 
@@ -60,19 +80,39 @@ func convertSqliteToReal(sqliteLentBook sqliteLentBook) (loans.LentBook, error)
 		ID:             sqliteLentBook.ID.String,
 		UserID:         sqliteLentBook.UserID.String,
 		BookID:         sqliteLentBook.BookID.String,
+		CopyID:         sqliteLentBook.CopyID.String,
 		TakenAt:        uint64(sqliteLentBook.TakenAt.Int64),
 		ReturnDeadline: uint64(sqliteLentBook.ReturnDeadline.Int64),
 		Returned:       sqliteLentBook.Returned.Bool,
 		ReturnedAt:     uint64(sqliteLentBook.ReturnedAt.Int64),
+		Renewals:       uint(sqliteLentBook.Renewals.Int64),
+		Status:         loans.LoanStatus(sqliteLentBook.Status.String),
+		Notes:          sqliteLentBook.Notes.String,
 	}, nil
 }
 
+// lentBookColumns lists the columns of lent_books in the order convertRowsToReal expects them
+const lentBookColumns = "id, user_id, book_id, copy_id, taken_at, return_deadline, returned, returned_at, renewals, status, notes"
+
 func convertRowsToReal(rows *sql.Rows) ([]loans.LentBook, error) {
 	result := make([]loans.LentBook, 0)
 
 	for rows.Next() {
 		var sqliteLentBook sqliteLentBook
-		if err := rows.Scan(&sqliteLentBook); err != nil {
+		err := rows.Scan(
+			&sqliteLentBook.ID,
+			&sqliteLentBook.UserID,
+			&sqliteLentBook.BookID,
+			&sqliteLentBook.CopyID,
+			&sqliteLentBook.TakenAt,
+			&sqliteLentBook.ReturnDeadline,
+			&sqliteLentBook.Returned,
+			&sqliteLentBook.ReturnedAt,
+			&sqliteLentBook.Renewals,
+			&sqliteLentBook.Status,
+			&sqliteLentBook.Notes,
+		)
+		if err != nil {
 			return nil, err
 		}
 
@@ -92,40 +132,268 @@ func convertRealToSqlite(realLentBook loans.LentBook) sqliteLentBook {
 		ID:             sql.NullString{String: realLentBook.ID, Valid: true},
 		UserID:         sql.NullString{String: realLentBook.UserID, Valid: true},
 		BookID:         sql.NullString{String: realLentBook.BookID, Valid: true},
+		CopyID:         sql.NullString{String: realLentBook.CopyID, Valid: true},
 		TakenAt:        sql.NullInt64{Int64: int64(realLentBook.TakenAt), Valid: true},
 		ReturnDeadline: sql.NullInt64{Int64: int64(realLentBook.ReturnDeadline), Valid: true},
 		Returned:       sql.NullBool{Bool: realLentBook.Returned, Valid: true},
 		ReturnedAt:     sql.NullInt64{Int64: int64(realLentBook.ReturnedAt), Valid: true},
+		Renewals:       sql.NullInt64{Int64: int64(realLentBook.Renewals), Valid: true},
+		Status:         sql.NullString{String: string(realLentBook.Status), Valid: true},
+		Notes:          sql.NullString{String: realLentBook.Notes, Valid: true},
+	}
+}
+
+func (s *sqliteRepo) FindLentBooks(ctx context.Context, at time.Time, page loans.Page) (loans.LoanPage, error) {
+	return s.findLoanPage(
+		ctx,
+		"taken_at <= ? AND NOT (returned AND returned_at <= ?)",
+		[]any{loans.ToTimestamp(at), loans.ToTimestamp(at)},
+		"taken_at", takenAtKey, false, page,
+	)
+}
+
+func (s *sqliteRepo) FindOverdueBooks(ctx context.Context, at time.Time, page loans.Page) (loans.LoanPage, error) {
+	return s.findLoanPage(
+		ctx,
+		"return_deadline <= ? AND NOT (returned AND returned_at <= ?)",
+		[]any{loans.ToTimestamp(at), loans.ToTimestamp(at)},
+		"return_deadline", returnDeadlineKey, false, page,
+	)
+}
+
+func (s *sqliteRepo) TakeBook(ctx context.Context, book *loans.LentBook, totalStock uint, limits loans.LoanLimits) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var existing uint
+	err = tx.QueryRowContext(ctx, "SELECT count(*) FROM lent_books WHERE id = ?", book.ID).Scan(&existing)
+	if err != nil {
+		return err
+	}
+	if existing != 0 {
+		return fail.ErrCollision
+	}
+
+	var userLoans, userBookLoans uint
+	err = tx.QueryRowContext(
+		ctx,
+		"SELECT count(*), coalesce(sum(book_id = ?), 0) FROM lent_books WHERE user_id = ? AND NOT returned",
+		book.BookID, book.UserID,
+	).Scan(&userLoans, &userBookLoans)
+	if err != nil {
+		return err
+	}
+
+	if err := limits.Check(userLoans, userBookLoans); err != nil {
+		return err
+	}
+
+	// The returned loans only matter for the stock if the book has not come back
+	rows, err := tx.QueryContext(
+		ctx,
+		"SELECT copy_id, returned, status FROM lent_books WHERE book_id = ? AND (NOT returned OR status IN (?, ?))",
+		book.BookID,
+		loans.LoanLost,
+		loans.LoanWrittenOff,
+	)
+	if err != nil {
+		return err
+	}
+	bookLoans := make([]loans.LentBook, 0)
+	for rows.Next() {
+		var bookLoan loans.LentBook
+		if err := rows.Scan(&bookLoan.CopyID, &bookLoan.Returned, &bookLoan.Status); err != nil {
+			rows.Close()
+			return err
+		}
+		bookLoans = append(bookLoans, bookLoan)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	copies, err := s.findCopies(ctx, tx, book.BookID)
+	if err != nil {
+		return err
+	}
+	stock := loans.ComputeStock(totalStock, copies, bookLoans)
+
+	queue, err := s.advanceHolds(ctx, tx, book.BookID, book.TakenAt, 0)
+	if err != nil {
+		return err
+	}
+	reservedForOthers, ownHold := countReservedFor(queue, book.UserID, book.TakenAt)
+
+	if stock.InStock-reservedForOthers <= 0 {
+		return fail.ErrNoStock
+	}
+
+	copyID, err := pickCopy(stock, copies, book.CopyID)
+	if err != nil {
+		return err
+	}
+	book.CopyID = copyID
+
+	_, err = tx.ExecContext(
+		ctx,
+		"INSERT INTO lent_books (id, user_id, book_id, copy_id, taken_at, return_deadline, returned, returned_at, renewals, status, notes) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		book.ID, book.UserID, book.BookID, book.CopyID, book.TakenAt, book.ReturnDeadline, false, 0, 0, loans.LoanOpen, book.Notes,
+	)
+	if err != nil {
+		return err
+	}
+
+	if ownHold != nil {
+		_, err = tx.ExecContext(ctx, "DELETE FROM holds WHERE id = ?", ownHold.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqliteRepo) ReturnBook(ctx context.Context, book *loans.LentBook, fines []loans.Fine) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(
+		ctx,
+		"UPDATE lent_books SET returned = TRUE, returned_at = ?, status = ? WHERE id = ? AND user_id = ? AND book_id = ? AND NOT returned",
+		book.ReturnedAt, book.Status, book.ID, book.UserID, book.BookID,
+	)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected != 1 {
+		return missingOrCollision(ctx, tx, "lent_books", book.ID)
+	}
+
+	for _, fine := range fines {
+		var existing uint
+		err = tx.QueryRowContext(ctx, "SELECT count(*) FROM fines WHERE id = ?", fine.ID).Scan(&existing)
+		if err != nil {
+			return err
+		}
+		if existing != 0 {
+			return fail.ErrCollision
+		}
+	}
+
+	for _, fine := range fines {
+		_, err = tx.ExecContext(
+			ctx,
+			"INSERT INTO fines (id, user_id, loan_id, book_id, reason, amount, issued_at, status, resolved_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			fine.ID, fine.UserID, fine.LoanID, fine.BookID, fine.Reason, fine.Amount, fine.IssuedAt, fine.Status, fine.ResolvedAt,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	if condition, damaged := closedCopyCondition(book.Status); damaged {
+		_, err = tx.ExecContext(ctx, "UPDATE copies SET condition = ? WHERE id = ?", condition, book.CopyID)
+		if err != nil {
+			return err
+		}
+	}
+	if returnFreesStock(book) {
+		_, err = s.advanceHolds(ctx, tx, book.BookID, book.ReturnedAt, 1)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqliteRepo) RenewLoan(ctx context.Context, book *loans.LentBook) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	result, err := s.db.ExecContext(
+		ctx,
+		"UPDATE lent_books SET return_deadline = ?, renewals = ? WHERE id = ? AND user_id = ? AND book_id = ? AND NOT returned AND renewals = ?",
+		book.ReturnDeadline, book.Renewals, book.ID, book.UserID, book.BookID, int64(book.Renewals)-1,
+	)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected != 1 {
+		// Someone else might have renewed or returned the loan concurrently
+		return missingOrCollision(ctx, s.db, "lent_books", book.ID)
 	}
+
+	return nil
 }
 
-func (s *sqliteRepo) FindLentBooks(ctx context.Context, at time.Time) ([]loans.LentBook, error) {
-	// TODO: Here and elsewhere, should I somehow respect context during mutex acquisition?
+func (s *sqliteRepo) CountOverdueLoansOf(ctx context.Context, userID string, at time.Time) (uint, error) {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 
-	rows, err := s.db.QueryContext(
+	var result uint
+	err := s.db.QueryRowContext(
 		ctx,
-		"SELECT * FROM lent_books WHERE taken_at <= ? AND NOT (returned AND returned_at <= ?)",
-		at.Unix(), at.Unix(),
-	)
+		"SELECT count(*) FROM lent_books WHERE user_id = ? AND NOT returned AND return_deadline <= ?",
+		userID, loans.ToTimestamp(at),
+	).Scan(&result)
 	if err != nil {
-		return nil, err
+		return 0, err
+	}
+
+	return result, nil
+}
+
+func (s *sqliteRepo) GetLoan(ctx context.Context, loanID string) (loans.LentBook, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	rows, err := s.db.QueryContext(ctx, "SELECT "+lentBookColumns+" FROM lent_books WHERE id = ?", loanID)
+	if err != nil {
+		return loans.LentBook{}, err
 	}
 	defer rows.Close()
 
 	result, err := convertRowsToReal(rows)
-	return result, err
+	if err != nil {
+		return loans.LentBook{}, err
+	}
+	if len(result) == 0 {
+		return loans.LentBook{}, fail.ErrNotFound
+	}
+
+	return result[0], nil
 }
 
-func (s *sqliteRepo) FindOverdueBooks(ctx context.Context, at time.Time) ([]loans.LentBook, error) {
+func (s *sqliteRepo) FindLoansOf(ctx context.Context, userID string, bookID string) ([]loans.LentBook, error) {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 
 	rows, err := s.db.QueryContext(
 		ctx,
-		"SELECT * FROM lent_books WHERE return_deadline <= ? AND NOT (returned AND returned_at <= ?)",
-		at.Unix(), at.Unix(),
+		"SELECT "+lentBookColumns+" FROM lent_books WHERE (? OR user_id = ?) AND (? OR book_id = ?) ORDER BY taken_at, id",
+		userID == "", userID, bookID == "", bookID,
 	)
 	if err != nil {
 		return nil, err
@@ -136,7 +404,133 @@ func (s *sqliteRepo) FindOverdueBooks(ctx context.Context, at time.Time) ([]loan
 	return result, err
 }
 
-func (s *sqliteRepo) TakeBook(ctx context.Context, book *loans.LentBook, totalStock uint) error {
+func (s *sqliteRepo) FindLoans(
+	ctx context.Context,
+	filter loans.LoanFilter,
+	order loans.LoanSort,
+	page loans.Page,
+) (loans.LoanPage, error) {
+	var where strings.Builder
+	where.WriteString("user_id = ? AND taken_at >= ?")
+	args := []any{filter.UserID, filter.TakenFrom}
+
+	if filter.BookID != "" {
+		where.WriteString(" AND book_id = ?")
+		args = append(args, filter.BookID)
+	}
+	if filter.TakenUntil != 0 {
+		where.WriteString(" AND taken_at < ?")
+		args = append(args, filter.TakenUntil)
+	}
+
+	switch filter.State {
+	case loans.LoanStateOpen:
+		where.WriteString(" AND NOT returned")
+	case loans.LoanStateReturned:
+		where.WriteString(" AND returned")
+	case loans.LoanStateOverdue:
+		where.WriteString(" AND NOT returned AND return_deadline <= ?")
+		args = append(args, filter.At)
+	}
+
+	return s.findLoanPage(ctx, where.String(), args, "taken_at", takenAtKey, order == loans.SortTakenDesc, page)
+}
+
+// findLoanPage lists the loans satisfying the WHERE condition, ordered by the given
+// sort key column (mirrored by key) and then by ID, a page at a time
+func (s *sqliteRepo) findLoanPage(
+	ctx context.Context,
+	where string,
+	args []any,
+	keyColumn string,
+	key func(*loans.LentBook) uint64,
+	descending bool,
+	page loans.Page,
+) (loans.LoanPage, error) {
+	cursor, err := loans.DecodeCursor(page.Cursor)
+	if err != nil {
+		return loans.LoanPage{}, err
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var total uint
+	err = s.db.QueryRowContext(ctx, "SELECT count(*) FROM lent_books WHERE "+where, args...).Scan(&total)
+	if err != nil {
+		return loans.LoanPage{}, err
+	}
+
+	comparison, direction := ">", "ASC"
+	if descending {
+		comparison, direction = "<", "DESC"
+	}
+
+	query := "SELECT " + lentBookColumns + " FROM lent_books WHERE " + where
+	args = slices.Clone(args)
+	if cursor != nil {
+		query += " AND (" + keyColumn + " " + comparison + " ? OR (" + keyColumn + " = ? AND id " + comparison + " ?))"
+		args = append(args, cursor.Key, cursor.Key, cursor.ID)
+	}
+	query += " ORDER BY " + keyColumn + " " + direction + ", id " + direction + " LIMIT ?"
+	args = append(args, page.Limit+1)
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return loans.LoanPage{}, err
+	}
+	defer rows.Close()
+
+	result, err := convertRowsToReal(rows)
+	if err != nil {
+		return loans.LoanPage{}, err
+	}
+
+	return cutLoanPage(result, page.Limit, total, key), nil
+}
+
+// rowQueryer is either a database or a transaction
+type rowQueryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// missingOrCollision explains why a guarded UPDATE of the row with the given ID matched nothing:
+// fail.ErrNotFound if there is no such row, fail.ErrCollision if it is in an unexpected state
+func missingOrCollision(ctx context.Context, q rowQueryer, table string, id string) error {
+	var existing uint
+	err := q.QueryRowContext(ctx, "SELECT count(*) FROM "+table+" WHERE id = ?", id).Scan(&existing)
+	if err != nil {
+		return err
+	}
+	if existing == 0 {
+		return fail.ErrNotFound
+	}
+	return fail.ErrCollision
+}
+
+func convertRowsToCopies(rows *sql.Rows) ([]loans.Copy, error) {
+	result := make([]loans.Copy, 0)
+
+	for rows.Next() {
+		var bookCopy loans.Copy
+		err := rows.Scan(
+			&bookCopy.ID,
+			&bookCopy.BookID,
+			&bookCopy.Barcode,
+			&bookCopy.Condition,
+			&bookCopy.ShelfLocation,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, bookCopy)
+	}
+
+	return result, rows.Err()
+}
+
+func (s *sqliteRepo) InsertCopy(ctx context.Context, bookCopy *loans.Copy) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
@@ -146,24 +540,39 @@ func (s *sqliteRepo) TakeBook(ctx context.Context, book *loans.LentBook, totalSt
 	}
 	defer tx.Rollback()
 
-	var lentStock uint
+	var existing uint
 	err = tx.QueryRowContext(
 		ctx,
-		"SELECT count(*) FROM lent_books WHERE book_id = ? AND NOT returned",
-		book.BookID,
-	).Scan(&lentStock)
+		"SELECT count(*) FROM copies WHERE id = ? OR barcode = ?",
+		bookCopy.ID, bookCopy.Barcode,
+	).Scan(&existing)
 	if err != nil {
 		return err
 	}
+	if existing != 0 {
+		return fail.ErrCollision
+	}
 
-	if lentStock >= totalStock {
-		return fail.ErrNoStock
+	_, err = tx.ExecContext(
+		ctx,
+		"INSERT INTO copies (id, book_id, barcode, condition, shelf_location) VALUES (?, ?, ?, ?, ?)",
+		bookCopy.ID, bookCopy.BookID, bookCopy.Barcode, bookCopy.Condition, bookCopy.ShelfLocation,
+	)
+	if err != nil {
+		return err
 	}
 
-	result, err := tx.ExecContext(
+	return tx.Commit()
+}
+
+func (s *sqliteRepo) UpdateCopy(ctx context.Context, bookCopy *loans.Copy) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	result, err := s.db.ExecContext(
 		ctx,
-		"INSERT INTO lent_books (id, user_id, book_id, taken_at, return_deadline, returned, returned_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
-		book.ID, book.UserID, book.BookID, book.TakenAt, book.ReturnDeadline, false, 0,
+		"UPDATE copies SET condition = ?, shelf_location = ? WHERE id = ? AND book_id = ? AND barcode = ?",
+		bookCopy.Condition, bookCopy.ShelfLocation, bookCopy.ID, bookCopy.BookID, bookCopy.Barcode,
 	)
 	if err != nil {
 		return err
@@ -173,22 +582,142 @@ func (s *sqliteRepo) TakeBook(ctx context.Context, book *loans.LentBook, totalSt
 		return err
 	}
 	if rowsAffected != 1 {
-		return fail.ErrCollision
+		return missingOrCollision(ctx, s.db, "copies", bookCopy.ID)
 	}
 
-	tx.Commit()
-
 	return nil
 }
 
-func (s *sqliteRepo) ReturnBook(ctx context.Context, book *loans.LentBook) error {
+func (s *sqliteRepo) LookupCopy(ctx context.Context, barcode string) (loans.Copy, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	rows, err := s.db.QueryContext(
+		ctx,
+		"SELECT id, book_id, barcode, condition, shelf_location FROM copies WHERE barcode = ?",
+		barcode,
+	)
+	if err != nil {
+		return loans.Copy{}, err
+	}
+	defer rows.Close()
+
+	result, err := convertRowsToCopies(rows)
+	if err != nil {
+		return loans.Copy{}, err
+	}
+	if len(result) == 0 {
+		return loans.Copy{}, fail.ErrNotFound
+	}
+
+	return result[0], nil
+}
+
+func (s *sqliteRepo) FindCopies(ctx context.Context, bookID string) ([]loans.Copy, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	return s.findCopies(ctx, tx, bookID)
+}
+
+// findCopies returns the copies of the given book ordered by barcode
+func (s *sqliteRepo) findCopies(ctx context.Context, tx *sql.Tx, bookID string) ([]loans.Copy, error) {
+	rows, err := tx.QueryContext(
+		ctx,
+		"SELECT id, book_id, barcode, condition, shelf_location FROM copies WHERE book_id = ? ORDER BY barcode",
+		bookID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return convertRowsToCopies(rows)
+}
+
+func convertRowsToFines(rows *sql.Rows) ([]loans.Fine, error) {
+	result := make([]loans.Fine, 0)
+
+	for rows.Next() {
+		var fine loans.Fine
+		err := rows.Scan(
+			&fine.ID,
+			&fine.UserID,
+			&fine.LoanID,
+			&fine.BookID,
+			&fine.Reason,
+			&fine.Amount,
+			&fine.IssuedAt,
+			&fine.Status,
+			&fine.ResolvedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, fine)
+	}
+
+	return result, rows.Err()
+}
+
+func (s *sqliteRepo) LookupFine(ctx context.Context, fineID string) (loans.Fine, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	rows, err := s.db.QueryContext(
+		ctx,
+		"SELECT id, user_id, loan_id, book_id, reason, amount, issued_at, status, resolved_at FROM fines WHERE id = ?",
+		fineID,
+	)
+	if err != nil {
+		return loans.Fine{}, err
+	}
+	defer rows.Close()
+
+	result, err := convertRowsToFines(rows)
+	if err != nil {
+		return loans.Fine{}, err
+	}
+	if len(result) == 0 {
+		return loans.Fine{}, fail.ErrNotFound
+	}
+
+	return result[0], nil
+}
+
+func (s *sqliteRepo) FindFines(ctx context.Context, userID string) ([]loans.Fine, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	rows, err := s.db.QueryContext(
+		ctx,
+		"SELECT id, user_id, loan_id, book_id, reason, amount, issued_at, status, resolved_at FROM fines WHERE user_id = ? ORDER BY issued_at, id",
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result, err := convertRowsToFines(rows)
+	return result, err
+}
+
+func (s *sqliteRepo) ResolveFine(ctx context.Context, fine *loans.Fine) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
 	result, err := s.db.ExecContext(
 		ctx,
-		"UPDATE lent_books SET returned = TRUE, returned_at = ? WHERE id = ? AND returned = FALSE",
-		book.ReturnedAt, book.ID,
+		"UPDATE fines SET status = ?, resolved_at = ? WHERE id = ? AND status = ?",
+		fine.Status, fine.ResolvedAt, fine.ID, loans.FineOutstanding,
 	)
 	if err != nil {
 		return err
@@ -198,26 +727,290 @@ func (s *sqliteRepo) ReturnBook(ctx context.Context, book *loans.LentBook) error
 		return err
 	}
 	if rowsAffected != 1 {
-		return fail.ErrCollision
+		return missingOrCollision(ctx, s.db, "fines", fine.ID)
 	}
 
 	return nil
 }
 
-func (s *sqliteRepo) FindLoansOf(ctx context.Context, userID string, bookID string) ([]loans.LentBook, error) {
+func convertRowsToHolds(rows *sql.Rows) ([]loans.Hold, error) {
+	result := make([]loans.Hold, 0)
+
+	for rows.Next() {
+		var hold loans.Hold
+		err := rows.Scan(
+			&hold.ID,
+			&hold.UserID,
+			&hold.BookID,
+			&hold.PlacedAt,
+			&hold.PickupWindow,
+			&hold.ReservedUntil,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, hold)
+	}
+
+	return result, rows.Err()
+}
+
+func (s *sqliteRepo) PlaceHold(ctx context.Context, hold *loans.Hold) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var existing uint
+	err = tx.QueryRowContext(
+		ctx,
+		"SELECT count(*) FROM holds WHERE id = ? OR (user_id = ? AND book_id = ?)",
+		hold.ID, hold.UserID, hold.BookID,
+	).Scan(&existing)
+	if err != nil {
+		return err
+	}
+	if existing != 0 {
+		return fail.ErrCollision
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		"INSERT INTO holds (id, user_id, book_id, placed_at, pickup_window, reserved_until) VALUES (?, ?, ?, ?, ?, ?)",
+		hold.ID, hold.UserID, hold.BookID, hold.PlacedAt, hold.PickupWindow, hold.ReservedUntil,
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqliteRepo) CancelHold(ctx context.Context, hold *loans.Hold, at time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	atTimestamp := loans.ToTimestamp(at)
+	queue, err := s.advanceHolds(ctx, tx, hold.BookID, atTimestamp, 0)
+	if err != nil {
+		return err
+	}
+
+	index := slices.IndexFunc(queue, func(other loans.Hold) bool {
+		return other.ID == hold.ID
+	})
+	if index == -1 {
+		// Might have also expired just now
+		return fail.ErrNotFound
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM holds WHERE id = ?", hold.ID)
+	if err != nil {
+		return err
+	}
+
+	if queue[index].ReservedUntil != 0 {
+		_, err = s.advanceHolds(ctx, tx, hold.BookID, atTimestamp, 1)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqliteRepo) FindHolds(ctx context.Context, userID string, bookID string, at time.Time) ([]loans.Hold, error) {
+	// Expired reservations are cleaned up along the way, so a write lock is needed
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(
+		ctx,
+		"SELECT DISTINCT book_id FROM holds WHERE (? OR book_id = ?) ORDER BY book_id",
+		bookID == "", bookID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	bookIDs := make([]string, 0)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		bookIDs = append(bookIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	atTimestamp := loans.ToTimestamp(at)
+	result := make([]loans.Hold, 0)
+	for _, id := range bookIDs {
+		queue, err := s.advanceHolds(ctx, tx, id, atTimestamp, 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, hold := range queue {
+			if userID == "" || hold.UserID == userID {
+				result = append(result, hold)
+			}
+		}
+	}
+
+	return result, tx.Commit()
+}
+
+// advanceHolds brings the queue of holds on the given book up to the given time,
+// reserving `freed` newly available copies. Returns the resulting queue.
+// Must be called with the write lock held
+func (s *sqliteRepo) advanceHolds(ctx context.Context, tx *sql.Tx, bookID string, at uint64, freed int) ([]loans.Hold, error) {
+	rows, err := tx.QueryContext(
+		ctx,
+		"SELECT id, user_id, book_id, placed_at, pickup_window, reserved_until FROM holds WHERE book_id = ?",
+		bookID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	queue, err := convertRowsToHolds(rows)
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+	sortHoldQueue(queue)
+
+	queue, dropped := advanceHoldQueue(queue, at, freed)
+	for _, hold := range dropped {
+		_, err = tx.ExecContext(ctx, "DELETE FROM holds WHERE id = ?", hold.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, hold := range queue {
+		_, err = tx.ExecContext(
+			ctx,
+			"UPDATE holds SET reserved_until = ? WHERE id = ?",
+			hold.ReservedUntil, hold.ID,
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return queue, nil
+}
+
+func (s *sqliteRepo) ReserveIdempotencyKey(ctx context.Context, record *loans.IdempotencyRecord, at time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE expires_at <= ?", loans.ToTimestamp(at))
+	if err != nil {
+		return err
+	}
+
+	var existing uint
+	err = tx.QueryRowContext(ctx, "SELECT count(*) FROM idempotency_keys WHERE key = ?", record.Key).Scan(&existing)
+	if err != nil {
+		return err
+	}
+	if existing != 0 {
+		return fail.ErrCollision
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		"INSERT INTO idempotency_keys (key, fingerprint, done, status, content_type, body, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		record.Key, record.Fingerprint, record.Done, record.Status, record.ContentType, record.Body, record.ExpiresAt,
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqliteRepo) LookupIdempotencyKey(ctx context.Context, key string, at time.Time) (loans.IdempotencyRecord, error) {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 
-	rows, err := s.db.QueryContext(
+	var record loans.IdempotencyRecord
+	err := s.db.QueryRowContext(
 		ctx,
-		"SELECT * FROM lent_books WHERE (? OR user_id = ?) AND (? OR book_id = ?)",
-		userID == "", userID, bookID == "", bookID,
+		"SELECT key, fingerprint, done, status, content_type, body, expires_at FROM idempotency_keys WHERE key = ? AND expires_at > ?",
+		key, loans.ToTimestamp(at),
+	).Scan(
+		&record.Key,
+		&record.Fingerprint,
+		&record.Done,
+		&record.Status,
+		&record.ContentType,
+		&record.Body,
+		&record.ExpiresAt,
 	)
+	if err == sql.ErrNoRows {
+		return loans.IdempotencyRecord{}, fail.ErrNotFound
+	}
 	if err != nil {
-		return nil, err
+		return loans.IdempotencyRecord{}, err
 	}
-	defer rows.Close()
 
-	result, err := convertRowsToReal(rows)
-	return result, err
+	return record, nil
+}
+
+func (s *sqliteRepo) CompleteIdempotencyKey(ctx context.Context, record *loans.IdempotencyRecord) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	result, err := s.db.ExecContext(
+		ctx,
+		"UPDATE idempotency_keys SET fingerprint = ?, done = ?, status = ?, content_type = ?, body = ?, expires_at = ? WHERE key = ?",
+		record.Fingerprint, record.Done, record.Status, record.ContentType, record.Body, record.ExpiresAt, record.Key,
+	)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected != 1 {
+		return fail.ErrNotFound
+	}
+
+	return nil
+}
+
+func (s *sqliteRepo) ReleaseIdempotencyKey(ctx context.Context, key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, err := s.db.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE key = ?", key)
+	return err
 }
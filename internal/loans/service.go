@@ -2,31 +2,51 @@ package loans
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"slices"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/mipt-kp-2024-go-beer/loan-service/internal/books"
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/clock"
 	"github.com/mipt-kp-2024-go-beer/loan-service/internal/fail"
 	"github.com/mipt-kp-2024-go-beer/loan-service/internal/users"
 )
 
-func NewService(repo Repo, users users.Connection, books books.Connection, returnDeadline time.Duration) Service {
+func NewService(
+	repo Repo,
+	users users.Connection,
+	books books.Connection,
+	policy Policy,
+	clock clock.Clock,
+) Service {
 	return &implService{
-		repo:           repo,
-		users:          users,
-		books:          books,
-		returnDeadline: returnDeadline,
+		repo:   repo,
+		users:  users,
+		books:  books,
+		policy: policy,
+		clock:  clock,
 	}
 }
 
 type implService struct {
-	repo           Repo
-	users          users.Connection
-	books          books.Connection
-	returnDeadline time.Duration
+	repo   Repo
+	users  users.Connection
+	books  books.Connection
+	policy Policy
+	clock  clock.Clock
 }
 
-func (s *implService) TakeBook(ctx context.Context, authToken string, userID string, bookID string) error {
+func (s *implService) TakeBook(
+	ctx context.Context,
+	authToken string,
+	userID string,
+	bookID string,
+	barcode string,
+	notes string,
+	overrides TakeOverrides,
+) error {
 	user, err := s.users.VerifyToken(ctx, authToken)
 	if err != nil {
 		return err
@@ -41,6 +61,46 @@ func (s *implService) TakeBook(ctx context.Context, authToken string, userID str
 		return fail.ErrForbidden
 	}
 
+	if overrides != (TakeOverrides{}) && !user.HasPerm(users.PermLoanBooks) {
+		return fmt.Errorf("%w: only librarians may override lending restrictions", fail.ErrForbidden)
+	}
+
+	limits := s.policy.Limits
+	if overrides.Limits {
+		limits = LoanLimits{}
+	}
+
+	now := s.clock.Now()
+
+	if !overrides.Overdue {
+		overdue, err := s.repo.CountOverdueLoansOf(ctx, userID, now.Add(-s.policy.OverdueGracePeriod))
+		if err != nil {
+			return err
+		}
+		if overdue > 0 {
+			return fail.WithDetails(
+				fmt.Errorf("%w: %d overdue", fail.ErrHasOverdue, overdue),
+				struct {
+					Overdue uint `json:"overdue"`
+				}{
+					Overdue: overdue,
+				},
+			)
+		}
+	}
+
+	copyID := ""
+	if barcode != "" {
+		bookCopy, err := s.repo.LookupCopy(ctx, barcode)
+		if err != nil {
+			return err
+		}
+		if bookCopy.BookID != bookID {
+			return fmt.Errorf("%w: no copy %q of this book", fail.ErrNotFound, barcode)
+		}
+		copyID = bookCopy.ID
+	}
+
 	book, err := s.books.LookupBook(ctx, bookID)
 	if err != nil {
 		return err
@@ -50,13 +110,17 @@ func (s *implService) TakeBook(ctx context.Context, authToken string, userID str
 		ID:             uuid.NewString(),
 		UserID:         userID,
 		BookID:         bookID,
-		TakenAt:        uint64(time.Now().Unix()),
-		ReturnDeadline: uint64(time.Now().Add(s.returnDeadline).Unix()),
+		CopyID:         copyID,
+		TakenAt:        ToTimestamp(now),
+		ReturnDeadline: ToTimestamp(now.Add(s.policy.ReturnDeadline)),
 		Returned:       false,
 		ReturnedAt:     0,
+		Renewals:       0,
+		Status:         LoanOpen,
+		Notes:          notes,
 	}
 
-	err = s.repo.TakeBook(ctx, &lentBook, book.TotalStock)
+	err = s.repo.TakeBook(ctx, &lentBook, book.TotalStock, limits)
 	return err
 }
 
@@ -75,13 +139,228 @@ func (s *implService) ReturnBook(ctx context.Context, authToken string, userID s
 		return fail.ErrForbidden
 	}
 
-	lentBooks, err := s.repo.FindLoansOf(ctx, userID, bookID)
+	oldestLentBook, err := s.findOldestLoan(ctx, userID, bookID)
+	if err != nil {
+		return err
+	}
+
+	return s.closeLoan(ctx, oldestLentBook, LoanReturned)
+}
+
+func (s *implService) ReturnLoan(ctx context.Context, authToken string, loanID string) error {
+	lentBook, err := s.GetLoan(ctx, authToken, loanID)
+	if err != nil {
+		return err
+	}
+
+	if lentBook.Returned {
+		return fmt.Errorf("%w: the loan is already closed", fail.ErrCollision)
+	}
+
+	return s.closeLoan(ctx, lentBook, LoanReturned)
+}
+
+func (s *implService) GetLoan(ctx context.Context, authToken string, loanID string) (LentBook, error) {
+	user, err := s.users.VerifyToken(ctx, authToken)
+	if err != nil {
+		return LentBook{}, err
+	}
+
+	lentBook, err := s.repo.GetLoan(ctx, loanID)
+	if err != nil {
+		return LentBook{}, err
+	}
+
+	allowed := user.HasPerm(users.PermLoanBooks) || user.ID == lentBook.UserID
+	if !allowed {
+		return LentBook{}, fail.ErrForbidden
+	}
+
+	return lentBook, nil
+}
+
+func (s *implService) ListUserLoans(
+	ctx context.Context,
+	authToken string,
+	userID string,
+	filter LoanFilter,
+	order LoanSort,
+	page Page,
+) (LoanPage, error) {
+	user, err := s.users.VerifyToken(ctx, authToken)
+	if err != nil {
+		return LoanPage{}, err
+	}
+
+	if userID == "" {
+		userID = user.ID
+	}
+
+	allowed := user.HasPerm(users.PermLoanBooks) || user.ID == userID
+	if !allowed {
+		return LoanPage{}, fail.ErrForbidden
+	}
+
+	if !filter.State.Valid() {
+		return LoanPage{}, fmt.Errorf("%w: unknown state %q", fail.ErrMissingParams, filter.State)
+	}
+	if order == "" {
+		order = SortTakenDesc
+	}
+	if !order.Valid() {
+		return LoanPage{}, fmt.Errorf("%w: unknown sort order %q", fail.ErrMissingParams, order)
+	}
+	page.Limit = normalizePageLimit(page.Limit)
+
+	filter.UserID = userID
+	filter.At = ToTimestamp(s.clock.Now())
+
+	result, err := s.repo.FindLoans(ctx, filter, order, page)
+	return result, err
+}
+
+// normalizePageLimit replaces an omitted page size with the default one and caps it
+func normalizePageLimit(limit uint) uint {
+	if limit == 0 {
+		return DefaultPageLimit
+	}
+	return min(limit, MaxPageLimit)
+}
+
+func (s *implService) ReturnCopy(ctx context.Context, authToken string, barcode string) error {
+	user, err := s.users.VerifyToken(ctx, authToken)
+	if err != nil {
+		return err
+	}
+
+	bookCopy, err := s.repo.LookupCopy(ctx, barcode)
+	if err != nil {
+		return err
+	}
+
+	lentBooks, err := s.repo.FindLoansOf(ctx, "", bookCopy.BookID)
+	if err != nil {
+		return err
+	}
+
+	index := slices.IndexFunc(lentBooks, func(book LentBook) bool {
+		return book.CopyID == bookCopy.ID && !book.Returned
+	})
+	if index == -1 {
+		return fmt.Errorf("%w: the copy is not lent out", fail.ErrNotFound)
+	}
+	lentBook := lentBooks[index]
+
+	allowed := user.HasPerm(users.PermLoanBooks) || user.ID == lentBook.UserID
+	if !allowed {
+		return fail.ErrForbidden
+	}
+
+	return s.closeLoan(ctx, lentBook, LoanReturned)
+}
+
+func (s *implService) CloseLoan(
+	ctx context.Context,
+	authToken string,
+	userID string,
+	bookID string,
+	status LoanStatus,
+) error {
+	user, err := s.users.VerifyToken(ctx, authToken)
+	if err != nil {
+		return err
+	}
+
+	if userID == "" {
+		userID = user.ID
+	}
+
+	allowed := user.HasPerm(users.PermLoanBooks)
+	if !allowed {
+		return fail.ErrForbidden
+	}
+
+	switch status {
+	case LoanLost, LoanDamaged, LoanWrittenOff:
+	default:
+		return fmt.Errorf("%w: unknown status %q", fail.ErrMissingParams, status)
+	}
+
+	oldestLentBook, err := s.findOldestLoan(ctx, userID, bookID)
+	if err != nil {
+		return err
+	}
+
+	return s.closeLoan(ctx, oldestLentBook, status)
+}
+
+// closeLoan registers the loan as closed in the given status at the current moment,
+// charging the fines the policy prescribes
+func (s *implService) closeLoan(ctx context.Context, lentBook LentBook, status LoanStatus) error {
+	lentBook.Returned = true
+	lentBook.ReturnedAt = ToTimestamp(s.clock.Now())
+	lentBook.Status = status
+
+	fines := s.policy.Fines.ComputeFor(&lentBook)
+
+	// Multiple DB operations without a common lock, but if a race condition
+	// occurs (unlikely here), it will be detected as an error.
+	err := s.repo.ReturnBook(ctx, &lentBook, fines)
+	return err
+}
+
+func (s *implService) RenewLoan(ctx context.Context, authToken string, userID string, bookID string) error {
+	user, err := s.users.VerifyToken(ctx, authToken)
+	if err != nil {
+		return err
+	}
+
+	if userID == "" {
+		userID = user.ID
+	}
+
+	allowed := user.HasPerm(users.PermLoanBooks) || user.ID == userID
+	if !allowed {
+		return fail.ErrForbidden
+	}
+
+	oldestLentBook, err := s.findOldestLoan(ctx, userID, bookID)
 	if err != nil {
 		return err
 	}
 
+	if oldestLentBook.Renewals >= s.policy.MaxRenewals {
+		return fail.ErrRenewalLimit
+	}
+
+	now := ToTimestamp(s.clock.Now())
+	newDeadlineBase := oldestLentBook.ReturnDeadline
+	if oldestLentBook.ReturnDeadline <= now {
+		if !user.HasPerm(users.PermLoanBooks) {
+			return fmt.Errorf("%w: the loan is overdue", fail.ErrForbidden)
+		}
+		// An overdue loan is renewed starting from the current moment,
+		// otherwise the new deadline could still be in the past
+		newDeadlineBase = now
+	}
+
+	oldestLentBook.ReturnDeadline = newDeadlineBase + ToMillis(s.policy.ReturnDeadline)
+	oldestLentBook.Renewals += 1
+
+	err = s.repo.RenewLoan(ctx, &oldestLentBook)
+	return err
+}
+
+// findOldestLoan returns the unreturned loan of the given book by the given user
+// that has the earliest return deadline
+func (s *implService) findOldestLoan(ctx context.Context, userID string, bookID string) (LentBook, error) {
+	lentBooks, err := s.repo.FindLoansOf(ctx, userID, bookID)
+	if err != nil {
+		return LentBook{}, err
+	}
+
 	if len(lentBooks) == 0 {
-		return fail.ErrNotFound
+		return LentBook{}, fail.ErrNotFound
 	}
 
 	oldestLentBook := lentBooks[0]
@@ -92,16 +371,10 @@ func (s *implService) ReturnBook(ctx context.Context, authToken string, userID s
 	}
 
 	if oldestLentBook.Returned {
-		return fail.ErrNotFound
+		return LentBook{}, fail.ErrNotFound
 	}
 
-	oldestLentBook.Returned = true
-	oldestLentBook.ReturnedAt = uint64(time.Now().Unix())
-
-	// Multiple DB operations without a common lock, but if a race condition
-	// occurs (unlikely here), it will be detected as an error.
-	err = s.repo.ReturnBook(ctx, &oldestLentBook)
-	return err
+	return oldestLentBook, nil
 }
 
 func (s *implService) CountAvailableBook(ctx context.Context, authToken string, bookID string) (uint, error) {
@@ -115,67 +388,463 @@ func (s *implService) CountAvailableBook(ctx context.Context, authToken string,
 		return 0, fail.ErrForbidden
 	}
 
-	lentBooks, err := s.repo.FindLoansOf(ctx, "", bookID)
+	book, err := s.books.LookupBook(ctx, bookID)
 	if err != nil {
 		return 0, err
 	}
 
-	book, err := s.books.LookupBook(ctx, bookID)
+	return s.countAvailable(ctx, "", book, s.clock.Now())
+}
+
+// countAvailable returns the number of copies of the book that can be taken by
+// the given user at the given time, i.e. neither lent out nor reserved for other users.
+// If userID is empty, all reserved copies are considered unavailable
+func (s *implService) countAvailable(ctx context.Context, userID string, book *books.Book, at time.Time) (uint, error) {
+	lentBooks, err := s.repo.FindLoansOf(ctx, "", book.ID)
 	if err != nil {
 		return 0, err
 	}
 
-	availableBooks := book.TotalStock
-	for _, book := range lentBooks {
-		if !book.Returned {
-			availableBooks -= 1
+	copies, err := s.repo.FindCopies(ctx, book.ID)
+	if err != nil {
+		return 0, err
+	}
+
+	holds, err := s.repo.FindHolds(ctx, "", book.ID, at)
+	if err != nil {
+		return 0, err
+	}
+
+	available := ComputeStock(book.TotalStock, copies, lentBooks).InStock
+	for _, hold := range holds {
+		if hold.ReservedUntil > ToTimestamp(at) && (userID == "" || hold.UserID != userID) {
+			available -= 1
 		}
 	}
 
-	return availableBooks, nil
+	if available <= 0 {
+		return 0, nil
+	}
+	return uint(available), nil
+}
+
+func (s *implService) RegisterCopy(
+	ctx context.Context,
+	authToken string,
+	bookID string,
+	barcode string,
+	condition CopyCondition,
+	shelfLocation string,
+) (Copy, error) {
+	user, err := s.users.VerifyToken(ctx, authToken)
+	if err != nil {
+		return Copy{}, err
+	}
+
+	allowed := user.HasPerm(users.PermChangeTotalStock)
+	if !allowed {
+		return Copy{}, fail.ErrForbidden
+	}
+
+	if condition == "" {
+		condition = CopyGood
+	}
+	if !condition.Valid() {
+		return Copy{}, fmt.Errorf("%w: unknown condition %q", fail.ErrMissingParams, condition)
+	}
+
+	// Make sure the book actually exists
+	_, err = s.books.LookupBook(ctx, bookID)
+	if err != nil {
+		return Copy{}, err
+	}
+
+	bookCopy := Copy{
+		ID:            uuid.NewString(),
+		BookID:        bookID,
+		Barcode:       barcode,
+		Condition:     condition,
+		ShelfLocation: shelfLocation,
+	}
+
+	err = s.repo.InsertCopy(ctx, &bookCopy)
+	if err != nil {
+		return Copy{}, err
+	}
+	return bookCopy, nil
+}
+
+func (s *implService) UpdateCopy(
+	ctx context.Context,
+	authToken string,
+	barcode string,
+	condition CopyCondition,
+	shelfLocation string,
+) (Copy, error) {
+	user, err := s.users.VerifyToken(ctx, authToken)
+	if err != nil {
+		return Copy{}, err
+	}
+
+	allowed := user.HasPerm(users.PermChangeTotalStock)
+	if !allowed {
+		return Copy{}, fail.ErrForbidden
+	}
+
+	if condition != "" && !condition.Valid() {
+		return Copy{}, fmt.Errorf("%w: unknown condition %q", fail.ErrMissingParams, condition)
+	}
+
+	bookCopy, err := s.repo.LookupCopy(ctx, barcode)
+	if err != nil {
+		return Copy{}, err
+	}
+
+	if condition != "" {
+		bookCopy.Condition = condition
+	}
+	if shelfLocation != "" {
+		bookCopy.ShelfLocation = shelfLocation
+	}
+
+	err = s.repo.UpdateCopy(ctx, &bookCopy)
+	if err != nil {
+		return Copy{}, err
+	}
+	return bookCopy, nil
 }
 
-func (s *implService) ListReservations(ctx context.Context, authToken string, at time.Time) ([]LentBook, error) {
+func (s *implService) ListCopies(ctx context.Context, authToken string, bookID string) ([]Copy, error) {
 	user, err := s.users.VerifyToken(ctx, authToken)
 	if err != nil {
 		return nil, err
 	}
 
-	allowed := user.HasPerm(users.PermQueryReservations)
+	allowed := user.HasPerm(users.PermQueryTotalStock)
 	if !allowed {
 		return nil, fail.ErrForbidden
 	}
 
-	reservations, err := s.repo.FindLentBooks(ctx, at)
-	return reservations, err
+	copies, err := s.repo.FindCopies(ctx, bookID)
+	return copies, err
+}
+
+func (s *implService) PlaceHold(ctx context.Context, authToken string, userID string, bookID string) error {
+	user, err := s.users.VerifyToken(ctx, authToken)
+	if err != nil {
+		return err
+	}
+
+	if userID == "" {
+		userID = user.ID
+	}
+
+	allowed := user.HasPerm(users.PermLoanBooks) || user.ID == userID
+	if !allowed {
+		return fail.ErrForbidden
+	}
+
+	book, err := s.books.LookupBook(ctx, bookID)
+	if err != nil {
+		return err
+	}
+
+	now := s.clock.Now()
+	available, err := s.countAvailable(ctx, userID, book, now)
+	if err != nil {
+		return err
+	}
+
+	if available > 0 {
+		return fmt.Errorf("%w: the book is in stock", fail.ErrCollision)
+	}
+
+	hold := Hold{
+		ID:            uuid.NewString(),
+		UserID:        userID,
+		BookID:        bookID,
+		PlacedAt:      ToTimestamp(now),
+		PickupWindow:  ToMillis(s.policy.HoldPickupWindow),
+		ReservedUntil: 0,
+	}
+
+	err = s.repo.PlaceHold(ctx, &hold)
+	return err
+}
+
+func (s *implService) CancelHold(ctx context.Context, authToken string, userID string, bookID string) error {
+	user, err := s.users.VerifyToken(ctx, authToken)
+	if err != nil {
+		return err
+	}
+
+	if userID == "" {
+		userID = user.ID
+	}
+
+	allowed := user.HasPerm(users.PermLoanBooks) || user.ID == userID
+	if !allowed {
+		return fail.ErrForbidden
+	}
+
+	now := s.clock.Now()
+	holds, err := s.repo.FindHolds(ctx, userID, bookID, now)
+	if err != nil {
+		return err
+	}
+
+	if len(holds) == 0 {
+		return fail.ErrNotFound
+	}
+
+	err = s.repo.CancelHold(ctx, &holds[0], now)
+	return err
 }
 
-func (s *implService) ListOverdue(ctx context.Context, authToken string, at time.Time) ([]LentBook, error) {
+func (s *implService) ListHolds(ctx context.Context, authToken string, userID string, bookID string) ([]Hold, error) {
 	user, err := s.users.VerifyToken(ctx, authToken)
 	if err != nil {
 		return nil, err
 	}
 
-	allowed := user.HasPerm(users.PermQueryReservations)
+	if userID == "" && !user.HasPerm(users.PermQueryReservations) {
+		userID = user.ID
+	}
+
+	allowed := user.HasPerm(users.PermQueryReservations) || user.ID == userID
 	if !allowed {
 		return nil, fail.ErrForbidden
 	}
 
-	overdue, err := s.repo.FindOverdueBooks(ctx, at)
+	holds, err := s.repo.FindHolds(ctx, userID, bookID, s.clock.Now())
+	return holds, err
+}
+
+func (s *implService) ListReservations(
+	ctx context.Context,
+	authToken string,
+	at time.Time,
+	page Page,
+) (LoanPage, error) {
+	user, err := s.users.VerifyToken(ctx, authToken)
+	if err != nil {
+		return LoanPage{}, err
+	}
+
+	allowed := user.HasPerm(users.PermQueryReservations)
+	if !allowed {
+		return LoanPage{}, fail.ErrForbidden
+	}
+
+	page.Limit = normalizePageLimit(page.Limit)
+	reservations, err := s.repo.FindLentBooks(ctx, at, page)
+	return reservations, err
+}
+
+func (s *implService) ListOverdue(ctx context.Context, authToken string, at time.Time, page Page) (LoanPage, error) {
+	user, err := s.users.VerifyToken(ctx, authToken)
+	if err != nil {
+		return LoanPage{}, err
+	}
+
+	allowed := user.HasPerm(users.PermQueryReservations)
+	if !allowed {
+		return LoanPage{}, fail.ErrForbidden
+	}
+
+	page.Limit = normalizePageLimit(page.Limit)
+	overdue, err := s.repo.FindOverdueBooks(ctx, at, page)
 	return overdue, err
 }
 
-func (s *implService) GetUserLoans(ctx context.Context, userID string) (uint, error) {
+func (s *implService) ListFines(ctx context.Context, authToken string, userID string) ([]Fine, error) {
+	user, err := s.users.VerifyToken(ctx, authToken)
+	if err != nil {
+		return nil, err
+	}
+
+	if userID == "" {
+		userID = user.ID
+	}
+
+	allowed := user.HasPerm(users.PermLoanBooks) || user.ID == userID
+	if !allowed {
+		return nil, fail.ErrForbidden
+	}
+
+	fines, err := s.repo.FindFines(ctx, userID)
+	return fines, err
+}
+
+func (s *implService) PayFine(ctx context.Context, authToken string, fineID string) error {
+	return s.resolveFine(ctx, authToken, fineID, FinePaid)
+}
+
+func (s *implService) WaiveFine(ctx context.Context, authToken string, fineID string) error {
+	return s.resolveFine(ctx, authToken, fineID, FineWaived)
+}
+
+// resolveFine moves an outstanding fine into the given status on behalf of a librarian
+func (s *implService) resolveFine(ctx context.Context, authToken string, fineID string, status FineStatus) error {
+	user, err := s.users.VerifyToken(ctx, authToken)
+	if err != nil {
+		return err
+	}
+
+	allowed := user.HasPerm(users.PermLoanBooks)
+	if !allowed {
+		return fail.ErrForbidden
+	}
+
+	fine, err := s.repo.LookupFine(ctx, fineID)
+	if err != nil {
+		return err
+	}
+
+	if fine.Status != FineOutstanding {
+		return fmt.Errorf("%w: the fine is already %s", fail.ErrCollision, fine.Status)
+	}
+
+	fine.Status = status
+	fine.ResolvedAt = ToTimestamp(s.clock.Now())
+
+	err = s.repo.ResolveFine(ctx, &fine)
+	return err
+}
+
+// isAdmin tells whether the user is an administrator, i.e. may grant any permissions to others
+func isAdmin(user *users.User) bool {
+	return user.HasPerm(users.PermGrantPermissions)
+}
+
+func (s *implService) GetClock(ctx context.Context, authToken string) (ClockState, error) {
+	user, err := s.users.VerifyToken(ctx, authToken)
+	if err != nil {
+		return ClockState{}, err
+	}
+
+	if !isAdmin(user) {
+		return ClockState{}, fail.ErrForbidden
+	}
+
+	return s.clockState(), nil
+}
+
+func (s *implService) TravelInTime(ctx context.Context, authToken string, offset time.Duration) (ClockState, error) {
+	user, err := s.users.VerifyToken(ctx, authToken)
+	if err != nil {
+		return ClockState{}, err
+	}
+
+	if !isAdmin(user) {
+		return ClockState{}, fail.ErrForbidden
+	}
+
+	traveler, ok := s.clock.(clock.Traveler)
+	if !ok {
+		return ClockState{}, fmt.Errorf("%w: time travel is disabled", fail.ErrForbidden)
+	}
+	traveler.SetOffset(offset)
+
+	return s.clockState(), nil
+}
+
+// clockState describes the current state of the service clock
+func (s *implService) clockState() ClockState {
+	result := ClockState{
+		Now:    ToTimestamp(s.clock.Now()),
+		Offset: 0,
+	}
+	if traveler, ok := s.clock.(clock.Traveler); ok {
+		result.Offset = traveler.Offset().Milliseconds()
+	}
+	return result
+}
+
+func (s *implService) GetUserLoans(ctx context.Context, userID string) (UserLoans, error) {
 	loans, err := s.repo.FindLoansOf(ctx, userID, "")
 	if err != nil {
-		return 0, err
+		return UserLoans{}, err
 	}
 
-	result := uint(0)
+	fines, err := s.repo.FindFines(ctx, userID)
+	if err != nil {
+		return UserLoans{}, err
+	}
+
+	result := UserLoans{}
 	for _, loan := range loans {
 		if !loan.Returned {
-			result += 1
+			result.Unreturned += 1
+		}
+	}
+	for _, fine := range fines {
+		if fine.Status == FineOutstanding {
+			result.OutstandingFines += fine.Amount
 		}
 	}
 	return result, nil
 }
+
+func (s *implService) InvalidateBook(ctx context.Context, bookID string) error {
+	if cache, ok := s.books.(books.Invalidator); ok {
+		cache.InvalidateBook(bookID)
+	}
+	return nil
+}
+
+func (s *implService) RevokeToken(ctx context.Context, authToken string) error {
+	if cache, ok := s.users.(users.Revoker); ok {
+		cache.RevokeToken(authToken)
+	}
+	return nil
+}
+
+// idempotencyLease is how long a key stays reserved for a request that is still being handled.
+// It outlasts the server's write timeout, so it only runs out if the service has crashed meanwhile
+const idempotencyLease = time.Minute
+
+func (s *implService) BeginIdempotentRequest(
+	ctx context.Context,
+	key string,
+	fingerprint string,
+) (*IdempotencyRecord, error) {
+	now := s.clock.Now()
+	record := IdempotencyRecord{
+		Key:         key,
+		Fingerprint: fingerprint,
+		Done:        false,
+		ExpiresAt:   ToTimestamp(now.Add(idempotencyLease)),
+	}
+
+	err := s.repo.ReserveIdempotencyKey(ctx, &record, now)
+	if err == nil {
+		return nil, nil
+	}
+	if !errors.Is(err, fail.ErrCollision) {
+		return nil, err
+	}
+
+	saved, err := s.repo.LookupIdempotencyKey(ctx, key, now)
+	if errors.Is(err, fail.ErrNotFound) {
+		// Released or expired since, which only happens while the original request is being handled
+		return &record, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if saved.Fingerprint != fingerprint {
+		return nil, fail.ErrIdempotencyMismatch
+	}
+	return &saved, nil
+}
+
+func (s *implService) FinishIdempotentRequest(ctx context.Context, record *IdempotencyRecord) error {
+	record.Done = true
+	record.ExpiresAt = ToTimestamp(s.clock.Now().Add(s.policy.IdempotencyKeyTTL))
+	return s.repo.CompleteIdempotencyKey(ctx, record)
+}
+
+func (s *implService) AbandonIdempotentRequest(ctx context.Context, key string) error {
+	return s.repo.ReleaseIdempotencyKey(ctx, key)
+}
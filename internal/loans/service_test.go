@@ -3,19 +3,33 @@ package loans_test
 import (
 	"context"
 	"errors"
+	"fmt"
 	"maps"
 	"slices"
 	"testing"
 	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/books"
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/clock"
 	"github.com/mipt-kp-2024-go-beer/loan-service/internal/fail"
 	"github.com/mipt-kp-2024-go-beer/loan-service/internal/loans"
 	"github.com/mipt-kp-2024-go-beer/loan-service/internal/loans/mock"
 	"github.com/mipt-kp-2024-go-beer/loan-service/internal/loans/repo"
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/users"
 )
 
-const bookReturnDeadline = 48 * time.Hour
+const (
+	bookReturnDeadline = 48 * time.Hour
+	maxRenewals        = 2
+	holdPickupWindow   = 24 * time.Hour
+	maxLoansPerUser    = 3
+	overdueGracePeriod = time.Hour
+	finePerDay         = 100
+	fineCap            = 250
+	replacementFee     = 1000
+	idempotencyKeyTTL  = 24 * time.Hour
+)
 
 func makeService(t *testing.T) (context.Context, loans.Service, repo.TestMemoryRepo) {
 	t.Helper()
@@ -27,17 +41,48 @@ func makeService(t *testing.T) (context.Context, loans.Service, repo.TestMemoryR
 
 	repo := repo.NewMemoryRepo("memory://")
 
-	service := loans.NewService(repo, userSvc, bookSvc, bookReturnDeadline)
+	service := loans.NewService(repo, userSvc, bookSvc, makePolicy(), clock.NewSystem())
 
 	return ctx, service, repo
 }
 
+// makeFakeClockService is makeService with the service clock stopped at a fixed moment,
+// so that the tests can expect exact timestamps
+func makeFakeClockService(t *testing.T) (context.Context, loans.Service, repo.TestMemoryRepo, *clock.Fake) {
+	t.Helper()
+
+	fakeClock := clock.NewFake(time.UnixMilli(1_700_000_000_000))
+	repo := repo.NewMemoryRepo("memory://")
+	service := loans.NewService(repo, mock.NewUsersConn(), mock.NewBooksConn(), makePolicy(), fakeClock)
+
+	return context.Background(), service, repo, fakeClock
+}
+
+func makePolicy() loans.Policy {
+	return loans.Policy{
+		ReturnDeadline:   bookReturnDeadline,
+		MaxRenewals:      maxRenewals,
+		HoldPickupWindow: holdPickupWindow,
+		Limits: loans.LoanLimits{
+			PerUser:        maxLoansPerUser,
+			PerBookPerUser: 0,
+		},
+		OverdueGracePeriod: overdueGracePeriod,
+		Fines: loans.FineRates{
+			PerDay:      finePerDay,
+			Cap:         fineCap,
+			Replacement: replacementFee,
+		},
+		IdempotencyKeyTTL: idempotencyKeyTTL,
+	}
+}
+
 func TestService_TakeBook(t *testing.T) {
 	t.Run("basic", func(t *testing.T) {
 		ctx, service, repo := makeService(t)
 		repo.ResetRawData(map[string]loans.LentBook{})
 
-		err := service.TakeBook(ctx, "token-regular-user", "vasya-pupkin", "multi-book")
+		err := service.TakeBook(ctx, "token-regular-user", "vasya-pupkin", "multi-book", "", "", loans.TakeOverrides{})
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
@@ -53,9 +98,10 @@ func TestService_TakeBook(t *testing.T) {
 			BookID:         "multi-book",
 			UserID:         "vasya-pupkin",
 			TakenAt:        got.TakenAt,
-			ReturnDeadline: got.TakenAt + uint64(bookReturnDeadline.Seconds()),
+			ReturnDeadline: got.TakenAt + uint64(bookReturnDeadline.Milliseconds()),
 			Returned:       false,
 			ReturnedAt:     got.ReturnedAt,
+			Status:         loans.LoanOpen,
 		}
 
 		if diff := cmp.Diff(want, got); diff != "" {
@@ -67,7 +113,7 @@ func TestService_TakeBook(t *testing.T) {
 		ctx, service, repo := makeService(t)
 		repo.ResetRawData(map[string]loans.LentBook{})
 
-		err := service.TakeBook(ctx, "token-regular-user", "", "multi-book")
+		err := service.TakeBook(ctx, "token-regular-user", "", "multi-book", "", "", loans.TakeOverrides{})
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
@@ -83,9 +129,10 @@ func TestService_TakeBook(t *testing.T) {
 			BookID:         "multi-book",
 			UserID:         "vasya-pupkin",
 			TakenAt:        got.TakenAt,
-			ReturnDeadline: got.TakenAt + uint64(bookReturnDeadline.Seconds()),
+			ReturnDeadline: got.TakenAt + uint64(bookReturnDeadline.Milliseconds()),
 			Returned:       false,
 			ReturnedAt:     got.ReturnedAt,
+			Status:         loans.LoanOpen,
 		}
 
 		if diff := cmp.Diff(want, got); diff != "" {
@@ -97,7 +144,7 @@ func TestService_TakeBook(t *testing.T) {
 		ctx, service, repo := makeService(t)
 		repo.ResetRawData(map[string]loans.LentBook{})
 
-		err := service.TakeBook(ctx, "token-librarian", "vasya-pupkin", "multi-book")
+		err := service.TakeBook(ctx, "token-librarian", "vasya-pupkin", "multi-book", "", "", loans.TakeOverrides{})
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
@@ -113,9 +160,10 @@ func TestService_TakeBook(t *testing.T) {
 			BookID:         "multi-book",
 			UserID:         "vasya-pupkin",
 			TakenAt:        got.TakenAt,
-			ReturnDeadline: got.TakenAt + uint64(bookReturnDeadline.Seconds()),
+			ReturnDeadline: got.TakenAt + uint64(bookReturnDeadline.Milliseconds()),
 			Returned:       false,
 			ReturnedAt:     got.ReturnedAt,
+			Status:         loans.LoanOpen,
 		}
 
 		if diff := cmp.Diff(want, got); diff != "" {
@@ -127,7 +175,7 @@ func TestService_TakeBook(t *testing.T) {
 		ctx, service, repo := makeService(t)
 		repo.ResetRawData(map[string]loans.LentBook{})
 
-		err := service.TakeBook(ctx, "token-regular-user", "yuuko-shirakawa", "multi-book")
+		err := service.TakeBook(ctx, "token-regular-user", "yuuko-shirakawa", "multi-book", "", "", loans.TakeOverrides{})
 		if !errors.Is(err, fail.ErrForbidden) {
 			t.Errorf("wrong error: want %v, got %v", fail.ErrForbidden, err)
 		}
@@ -137,7 +185,7 @@ func TestService_TakeBook(t *testing.T) {
 		ctx, service, repo := makeService(t)
 		repo.ResetRawData(map[string]loans.LentBook{})
 
-		err := service.TakeBook(ctx, "token-regular-user", "", "bad-id")
+		err := service.TakeBook(ctx, "token-regular-user", "", "bad-id", "", "", loans.TakeOverrides{})
 		if !errors.Is(err, fail.ErrBookService) {
 			t.Errorf("wrong error: want %v, got %v", fail.ErrBookService, err)
 		}
@@ -157,22 +205,170 @@ func TestService_TakeBook(t *testing.T) {
 			},
 		})
 
-		err := service.TakeBook(ctx, "token-regular-user", "", "single-book")
+		err := service.TakeBook(ctx, "token-regular-user", "", "single-book", "", "", loans.TakeOverrides{})
 		if !errors.Is(err, fail.ErrNoStock) {
 			t.Errorf("wrong error: want %v, got %v", fail.ErrNoStock, err)
 		}
 	})
 }
 
+func TestService_TakeBook_Limits(t *testing.T) {
+	makeLoans := func(count int) map[string]loans.LentBook {
+		now := uint64(time.Now().UnixMilli())
+		result := make(map[string]loans.LentBook)
+		for i := range count {
+			id := fmt.Sprintf("loan-%d", i)
+			result[id] = loans.LentBook{
+				ID:             id,
+				BookID:         "multi-book",
+				UserID:         "vasya-pupkin",
+				TakenAt:        now - 123,
+				ReturnDeadline: now + 123,
+				Returned:       false,
+				ReturnedAt:     0,
+			}
+		}
+		return result
+	}
+
+	t.Run("under limit", func(t *testing.T) {
+		ctx, service, repo := makeService(t)
+		repo.ResetRawData(makeLoans(maxLoansPerUser - 1))
+
+		err := service.TakeBook(ctx, "token-regular-user", "", "multi-book", "", "", loans.TakeOverrides{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("returned don't count", func(t *testing.T) {
+		ctx, service, repo := makeService(t)
+		data := makeLoans(maxLoansPerUser)
+		returned := data["loan-0"]
+		returned.Returned = true
+		returned.ReturnedAt = returned.TakenAt + 1
+		data["loan-0"] = returned
+		repo.ResetRawData(data)
+
+		err := service.TakeBook(ctx, "token-regular-user", "", "multi-book", "", "", loans.TakeOverrides{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("over limit", func(t *testing.T) {
+		ctx, service, repo := makeService(t)
+		repo.ResetRawData(makeLoans(maxLoansPerUser))
+
+		err := service.TakeBook(ctx, "token-regular-user", "", "multi-book", "", "", loans.TakeOverrides{})
+		if !errors.Is(err, fail.ErrLimitExceeded) {
+			t.Errorf("wrong error: want %v, got %v", fail.ErrLimitExceeded, err)
+		}
+	})
+
+	t.Run("override", func(t *testing.T) {
+		ctx, service, repo := makeService(t)
+		repo.ResetRawData(makeLoans(maxLoansPerUser))
+
+		err := service.TakeBook(ctx, "token-librarian", "vasya-pupkin", "multi-book", "", "", loans.TakeOverrides{Limits: true})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("override without permission", func(t *testing.T) {
+		ctx, service, repo := makeService(t)
+		repo.ResetRawData(makeLoans(maxLoansPerUser))
+
+		err := service.TakeBook(ctx, "token-regular-user", "", "multi-book", "", "", loans.TakeOverrides{Limits: true})
+		if !errors.Is(err, fail.ErrForbidden) {
+			t.Errorf("wrong error: want %v, got %v", fail.ErrForbidden, err)
+		}
+	})
+}
+
+func TestService_TakeBook_Overdue(t *testing.T) {
+	makeLoans := func(overdueBy time.Duration) map[string]loans.LentBook {
+		now := time.Now()
+		return map[string]loans.LentBook{
+			"blah-blah-blah": {
+				ID:             "blah-blah-blah",
+				BookID:         "single-book",
+				UserID:         "vasya-pupkin",
+				TakenAt:        uint64(now.Add(-bookReturnDeadline - overdueBy).UnixMilli()),
+				ReturnDeadline: uint64(now.Add(-overdueBy).UnixMilli()),
+				Returned:       false,
+				ReturnedAt:     0,
+			},
+		}
+	}
+
+	t.Run("within grace period", func(t *testing.T) {
+		ctx, service, repo := makeService(t)
+		repo.ResetRawData(makeLoans(overdueGracePeriod / 2))
+
+		err := service.TakeBook(ctx, "token-regular-user", "", "multi-book", "", "", loans.TakeOverrides{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("overdue", func(t *testing.T) {
+		ctx, service, repo := makeService(t)
+		repo.ResetRawData(makeLoans(overdueGracePeriod * 2))
+
+		err := service.TakeBook(ctx, "token-regular-user", "", "multi-book", "", "", loans.TakeOverrides{})
+		if !errors.Is(err, fail.ErrHasOverdue) {
+			t.Errorf("wrong error: want %v, got %v", fail.ErrHasOverdue, err)
+		}
+	})
+
+	t.Run("overdue returned", func(t *testing.T) {
+		ctx, service, repo := makeService(t)
+		data := makeLoans(overdueGracePeriod * 2)
+		loan := data["blah-blah-blah"]
+		loan.Returned = true
+		loan.ReturnedAt = uint64(time.Now().UnixMilli())
+		data["blah-blah-blah"] = loan
+		repo.ResetRawData(data)
+
+		err := service.TakeBook(ctx, "token-regular-user", "", "multi-book", "", "", loans.TakeOverrides{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("override", func(t *testing.T) {
+		ctx, service, repo := makeService(t)
+		repo.ResetRawData(makeLoans(overdueGracePeriod * 2))
+
+		err := service.TakeBook(ctx, "token-librarian", "vasya-pupkin", "multi-book", "", "", loans.TakeOverrides{Overdue: true})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("override without permission", func(t *testing.T) {
+		ctx, service, repo := makeService(t)
+		repo.ResetRawData(makeLoans(overdueGracePeriod * 2))
+
+		err := service.TakeBook(ctx, "token-regular-user", "", "multi-book", "", "", loans.TakeOverrides{Overdue: true})
+		if !errors.Is(err, fail.ErrForbidden) {
+			t.Errorf("wrong error: want %v, got %v", fail.ErrForbidden, err)
+		}
+	})
+}
+
 func TestService_ReturnBook(t *testing.T) {
 	t.Run("basic", func(t *testing.T) {
-		ctx, service, repo := makeService(t)
+		ctx, service, repo, fakeClock := makeFakeClockService(t)
+		now := loans.ToTimestamp(fakeClock.Now())
 		bookPre := loans.LentBook{
 			ID:             "blah-blah-blah",
 			BookID:         "single-book",
 			UserID:         "vasya-pupkin",
-			TakenAt:        uint64(time.Now().Unix()) - 123,
-			ReturnDeadline: uint64(time.Now().Unix()) + 123,
+			TakenAt:        now - 123,
+			ReturnDeadline: now + 123,
 			Returned:       false,
 			ReturnedAt:     0,
 		}
@@ -193,27 +389,23 @@ func TestService_ReturnBook(t *testing.T) {
 		got := lentBooks[0]
 		want := bookPre
 		want.Returned = true
-		want.ReturnedAt = got.ReturnedAt
+		want.ReturnedAt = now
+		want.Status = loans.LoanReturned
 
 		if diff := cmp.Diff(want, got); diff != "" {
 			t.Errorf("result mismatch (-want +got):\n%s", diff)
 		}
-
-		upperBound := uint64(time.Now().Unix())
-		lowerBound := upperBound - 5
-		if !(lowerBound <= got.ReturnedAt && got.ReturnedAt <= upperBound) {
-			t.Errorf("wrong returnedAt: want %d <= %d <= %d", lowerBound, got.ReturnedAt, upperBound)
-		}
 	})
 
 	t.Run("implicit user", func(t *testing.T) {
-		ctx, service, repo := makeService(t)
+		ctx, service, repo, fakeClock := makeFakeClockService(t)
+		now := loans.ToTimestamp(fakeClock.Now())
 		bookPre := loans.LentBook{
 			ID:             "blah-blah-blah",
 			BookID:         "single-book",
 			UserID:         "vasya-pupkin",
-			TakenAt:        uint64(time.Now().Unix()) - 123,
-			ReturnDeadline: uint64(time.Now().Unix()) + 123,
+			TakenAt:        now - 123,
+			ReturnDeadline: now + 123,
 			Returned:       false,
 			ReturnedAt:     0,
 		}
@@ -234,22 +426,17 @@ func TestService_ReturnBook(t *testing.T) {
 		got := lentBooks[0]
 		want := bookPre
 		want.Returned = true
-		want.ReturnedAt = got.ReturnedAt
+		want.ReturnedAt = now
+		want.Status = loans.LoanReturned
 
 		if diff := cmp.Diff(want, got); diff != "" {
 			t.Errorf("result mismatch (-want +got):\n%s", diff)
 		}
-
-		upperBound := uint64(time.Now().Unix())
-		lowerBound := upperBound - 5
-		if !(lowerBound <= got.ReturnedAt && got.ReturnedAt <= upperBound) {
-			t.Errorf("wrong returnedAt: want %d <= %d <= %d", lowerBound, got.ReturnedAt, upperBound)
-		}
 	})
 
 	t.Run("oldest lent", func(t *testing.T) {
-		ctx, service, repo := makeService(t)
-		now := uint64(time.Now().Unix())
+		ctx, service, repo, fakeClock := makeFakeClockService(t)
+		now := loans.ToTimestamp(fakeClock.Now())
 		booksPre := map[string]loans.LentBook{
 			"pi-pi-pi": { // Non-returned, but different user
 				ID:             "pi-pi-pi",
@@ -305,18 +492,13 @@ func TestService_ReturnBook(t *testing.T) {
 
 		target := want["blah-blah-blah"]
 		target.Returned = true
-		target.ReturnedAt = got["blah-blah-blah"].ReturnedAt
+		target.ReturnedAt = now
+		target.Status = loans.LoanReturned
 		want["blah-blah-blah"] = target
 
 		if diff := cmp.Diff(want, got); diff != "" {
 			t.Errorf("result mismatch (-want +got):\n%s", diff)
 		}
-
-		upperBound := uint64(time.Now().Unix())
-		lowerBound := upperBound - 5
-		if !(lowerBound <= target.ReturnedAt && target.ReturnedAt <= upperBound) {
-			t.Errorf("wrong returnedAt: want %d <= %d <= %d", lowerBound, target.ReturnedAt, upperBound)
-		}
 	})
 
 	t.Run("not lent", func(t *testing.T) {
@@ -335,8 +517,8 @@ func TestService_ReturnBook(t *testing.T) {
 			ID:             "blah-blah-blah",
 			BookID:         "single-book",
 			UserID:         "yuuko-shirakawa",
-			TakenAt:        uint64(time.Now().Unix()) - 123,
-			ReturnDeadline: uint64(time.Now().Unix()) + 123,
+			TakenAt:        uint64(time.Now().UnixMilli()) - 123,
+			ReturnDeadline: uint64(time.Now().UnixMilli()) + 123,
 			Returned:       false,
 			ReturnedAt:     0,
 		}
@@ -351,38 +533,1438 @@ func TestService_ReturnBook(t *testing.T) {
 	})
 }
 
-func TestService_CountAvailableBook(t *testing.T) {
-	ctx, service, repo := makeService(t)
+func TestService_ReturnLoan(t *testing.T) {
+	makeLoans := func() map[string]loans.LentBook {
+		now := uint64(time.Now().UnixMilli())
+		return map[string]loans.LentBook{
+			"pa-pa-pa": {
+				ID:             "pa-pa-pa",
+				BookID:         "multi-book",
+				UserID:         "vasya-pupkin",
+				TakenAt:        now - 100,
+				ReturnDeadline: now + 100,
+				Status:         loans.LoanOpen,
+			},
+			"pu-pu-pu": {
+				ID:             "pu-pu-pu",
+				BookID:         "multi-book",
+				UserID:         "vasya-pupkin",
+				TakenAt:        now - 100,
+				ReturnDeadline: now + 200,
+				Status:         loans.LoanOpen,
+			},
+			"pi-pi-pi": {
+				ID:             "pi-pi-pi",
+				BookID:         "multi-book",
+				UserID:         "yuuko-shirakawa",
+				TakenAt:        now - 100,
+				ReturnDeadline: now + 100,
+				Status:         loans.LoanOpen,
+			},
+		}
+	}
 
-	// TODO: Test serivce.CountAvailableBook
-	_ = ctx
-	_ = service
-	_ = repo
-}
+	t.Run("basic", func(t *testing.T) {
+		ctx, service, repo := makeService(t)
+		repo.ResetRawData(makeLoans())
 
-func TestService_ListReservations(t *testing.T) {
-	ctx, service, repo := makeService(t)
+		err := service.ReturnLoan(ctx, "token-regular-user", "pu-pu-pu")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
 
-	// TODO: Test serivce.ListReservations
-	_ = ctx
-	_ = service
-	_ = repo
+		lentBooks := repo.RawData()
+		if got := lentBooks["pu-pu-pu"]; !got.Returned || got.Status != loans.LoanReturned {
+			t.Errorf("expected the loan to be returned, got %+v", got)
+		}
+		if got := lentBooks["pa-pa-pa"]; got.Returned {
+			t.Errorf("expected the other loan to stay open, got %+v", got)
+		}
+
+		err = service.ReturnLoan(ctx, "token-regular-user", "pu-pu-pu")
+		if !errors.Is(err, fail.ErrCollision) {
+			t.Errorf("wrong error: want %v, got %v", fail.ErrCollision, err)
+		}
+	})
+
+	t.Run("librarian", func(t *testing.T) {
+		ctx, service, repo := makeService(t)
+		repo.ResetRawData(makeLoans())
+
+		err := service.ReturnLoan(ctx, "token-librarian", "pa-pa-pa")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if got := repo.RawData()["pa-pa-pa"]; !got.Returned {
+			t.Errorf("expected the loan to be returned, got %+v", got)
+		}
+	})
+
+	t.Run("bad permissions", func(t *testing.T) {
+		ctx, service, repo := makeService(t)
+		repo.ResetRawData(makeLoans())
+
+		err := service.ReturnLoan(ctx, "token-regular-user", "pi-pi-pi")
+		if !errors.Is(err, fail.ErrForbidden) {
+			t.Errorf("wrong error: want %v, got %v", fail.ErrForbidden, err)
+		}
+
+		_, err = service.GetLoan(ctx, "token-regular-user", "pi-pi-pi")
+		if !errors.Is(err, fail.ErrForbidden) {
+			t.Errorf("wrong error: want %v, got %v", fail.ErrForbidden, err)
+		}
+	})
+
+	t.Run("get", func(t *testing.T) {
+		ctx, service, repo := makeService(t)
+		repo.ResetRawData(makeLoans())
+
+		got, err := service.GetLoan(ctx, "token-regular-user", "pa-pa-pa")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if diff := cmp.Diff(makeLoans()["pa-pa-pa"], got); diff != "" {
+			t.Errorf("result mismatch (-want +got):\n%s", diff)
+		}
+
+		_, err = service.GetLoan(ctx, "token-librarian", "missing-loan")
+		if !errors.Is(err, fail.ErrNotFound) {
+			t.Errorf("wrong error: want %v, got %v", fail.ErrNotFound, err)
+		}
+	})
 }
 
-func TestService_ListOverdue(t *testing.T) {
-	ctx, service, repo := makeService(t)
+func TestService_ListUserLoans(t *testing.T) {
+	now := uint64(time.Now().UnixMilli())
+	makeLoans := func() map[string]loans.LentBook {
+		result := make(map[string]loans.LentBook)
+		for i, id := range []string{"loan-a", "loan-b", "loan-c", "loan-d", "loan-e"} {
+			result[id] = loans.LentBook{
+				ID:             id,
+				BookID:         "multi-book",
+				UserID:         "vasya-pupkin",
+				TakenAt:        now - 1000 + uint64(i/2)*100,
+				ReturnDeadline: now - 500 + uint64(i)*200,
+				Status:         loans.LoanOpen,
+			}
+		}
+		returned := result["loan-b"]
+		returned.BookID = "single-book"
+		returned.Returned = true
+		returned.ReturnedAt = now - 100
+		returned.Status = loans.LoanReturned
+		result["loan-b"] = returned
+		result["loan-other"] = loans.LentBook{
+			ID:             "loan-other",
+			BookID:         "multi-book",
+			UserID:         "yuuko-shirakawa",
+			TakenAt:        now - 1000,
+			ReturnDeadline: now + 1000,
+			Status:         loans.LoanOpen,
+		}
+		return result
+	}
 
-	// TODO: Test serivce.ListOverdue
-	_ = ctx
-	_ = service
-	_ = repo
+	listIDs := func(page loans.LoanPage) []string {
+		result := make([]string, 0)
+		for _, book := range page.Loans {
+			result = append(result, book.ID)
+		}
+		return result
+	}
+
+	for _, tc := range []struct {
+		name   string
+		filter loans.LoanFilter
+		order  loans.LoanSort
+		want   []string
+	}{
+		{name: "all", order: loans.SortTakenAsc, want: []string{"loan-a", "loan-b", "loan-c", "loan-d", "loan-e"}},
+		{name: "latest first", want: []string{"loan-e", "loan-d", "loan-c", "loan-b", "loan-a"}},
+		{name: "open", filter: loans.LoanFilter{State: loans.LoanStateOpen}, order: loans.SortTakenAsc, want: []string{"loan-a", "loan-c", "loan-d", "loan-e"}},
+		{name: "returned", filter: loans.LoanFilter{State: loans.LoanStateReturned}, want: []string{"loan-b"}},
+		{name: "overdue", filter: loans.LoanFilter{State: loans.LoanStateOverdue}, order: loans.SortTakenAsc, want: []string{"loan-a", "loan-c"}},
+		{name: "book", filter: loans.LoanFilter{BookID: "single-book"}, want: []string{"loan-b"}},
+		{
+			name:   "taken between",
+			filter: loans.LoanFilter{TakenFrom: now - 900, TakenUntil: now - 800},
+			order:  loans.SortTakenAsc,
+			want:   []string{"loan-c", "loan-d"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, service, repo := makeService(t)
+			repo.ResetRawData(makeLoans())
+
+			got, err := service.ListUserLoans(ctx, "token-regular-user", "", tc.filter, tc.order, loans.Page{})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if diff := cmp.Diff(tc.want, listIDs(got)); diff != "" {
+				t.Errorf("result mismatch (-want +got):\n%s", diff)
+			}
+			if got.NextCursor != "" {
+				t.Errorf("expected no next page, got cursor %q", got.NextCursor)
+			}
+		})
+	}
+
+	t.Run("pagination", func(t *testing.T) {
+		ctx, service, repo := makeService(t)
+		repo.ResetRawData(makeLoans())
+
+		for _, order := range []loans.LoanSort{loans.SortTakenAsc, loans.SortTakenDesc} {
+			want, err := service.ListUserLoans(ctx, "token-librarian", "vasya-pupkin", loans.LoanFilter{}, order, loans.Page{})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			got := make([]string, 0)
+			page := loans.Page{Limit: 2, Cursor: ""}
+			for pages := 0; ; pages++ {
+				if pages > 5 {
+					t.Fatalf("pagination doesn't terminate")
+				}
+
+				result, err := service.ListUserLoans(ctx, "token-librarian", "vasya-pupkin", loans.LoanFilter{}, order, page)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if len(result.Loans) > 2 {
+					t.Errorf("page too long: %d", len(result.Loans))
+				}
+
+				got = append(got, listIDs(result)...)
+				if result.NextCursor == "" {
+					break
+				}
+				page.Cursor = result.NextCursor
+			}
+
+			if diff := cmp.Diff(listIDs(want), got); diff != "" {
+				t.Errorf("result mismatch for %s (-want +got):\n%s", order, diff)
+			}
+		}
+	})
+
+	t.Run("bad params", func(t *testing.T) {
+		ctx, service, repo := makeService(t)
+		repo.ResetRawData(makeLoans())
+
+		_, err := service.ListUserLoans(ctx, "token-regular-user", "", loans.LoanFilter{State: "lost"}, "", loans.Page{})
+		if !errors.Is(err, fail.ErrMissingParams) {
+			t.Errorf("wrong error: want %v, got %v", fail.ErrMissingParams, err)
+		}
+
+		_, err = service.ListUserLoans(ctx, "token-regular-user", "", loans.LoanFilter{}, "random", loans.Page{})
+		if !errors.Is(err, fail.ErrMissingParams) {
+			t.Errorf("wrong error: want %v, got %v", fail.ErrMissingParams, err)
+		}
+
+		_, err = service.ListUserLoans(ctx, "token-regular-user", "", loans.LoanFilter{}, "", loans.Page{Cursor: "!!!"})
+		if !errors.Is(err, fail.ErrMissingParams) {
+			t.Errorf("wrong error: want %v, got %v", fail.ErrMissingParams, err)
+		}
+	})
+
+	t.Run("bad permissions", func(t *testing.T) {
+		ctx, service, repo := makeService(t)
+		repo.ResetRawData(makeLoans())
+
+		_, err := service.ListUserLoans(ctx, "token-regular-user", "yuuko-shirakawa", loans.LoanFilter{}, "", loans.Page{})
+		if !errors.Is(err, fail.ErrForbidden) {
+			t.Errorf("wrong error: want %v, got %v", fail.ErrForbidden, err)
+		}
+	})
 }
 
-func TestService_GetUserLoans(t *testing.T) {
-	ctx, service, repo := makeService(t)
+func TestService_CloseLoan(t *testing.T) {
+	makeLoans := func(overdueBy time.Duration, copyID string) map[string]loans.LentBook {
+		now := time.Now()
+		return map[string]loans.LentBook{
+			"blah-blah-blah": {
+				ID:             "blah-blah-blah",
+				BookID:         "single-book",
+				UserID:         "vasya-pupkin",
+				CopyID:         copyID,
+				TakenAt:        uint64(now.Add(-bookReturnDeadline - overdueBy).UnixMilli()),
+				ReturnDeadline: uint64(now.Add(-overdueBy).UnixMilli()),
+				Returned:       false,
+				ReturnedAt:     0,
+				Status:         loans.LoanOpen,
+			},
+		}
+	}
 
-	// TODO: Test serivce.GetUserLoans
-	_ = ctx
-	_ = service
-	_ = repo
+	for _, tc := range []struct {
+		name      string
+		status    loans.LoanStatus
+		overdueBy time.Duration
+		wantFines map[loans.FineReason]uint64
+		wantCopy  loans.CopyCondition
+	}{
+		{
+			name:      "lost",
+			status:    loans.LoanLost,
+			overdueBy: time.Hour,
+			wantFines: map[loans.FineReason]uint64{loans.FineReplacement: replacementFee},
+			wantCopy:  loans.CopyWithdrawn,
+		},
+		{
+			name:      "damaged",
+			status:    loans.LoanDamaged,
+			overdueBy: time.Hour,
+			wantFines: map[loans.FineReason]uint64{loans.FineLate: finePerDay, loans.FineReplacement: replacementFee},
+			wantCopy:  loans.CopyDamaged,
+		},
+		{
+			name:      "written off",
+			status:    loans.LoanWrittenOff,
+			overdueBy: 30 * 24 * time.Hour,
+			wantFines: map[loans.FineReason]uint64{},
+			wantCopy:  loans.CopyWithdrawn,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, service, repo := makeService(t)
+			repo.ResetRawData(makeLoans(tc.overdueBy, "copy-1"))
+			repo.ResetRawFines(map[string]loans.Fine{})
+			repo.ResetRawCopies(map[string]loans.Copy{
+				"copy-1": {ID: "copy-1", BookID: "single-book", Barcode: "0001", Condition: loans.CopyGood},
+			})
+
+			err := service.CloseLoan(ctx, "token-librarian", "vasya-pupkin", "single-book", tc.status)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			got := repo.RawData()["blah-blah-blah"]
+			if !got.Returned || got.Status != tc.status {
+				t.Errorf("wrong loan state: want closed as %q, got %+v", tc.status, got)
+			}
+
+			gotFines := make(map[loans.FineReason]uint64)
+			for _, fine := range repo.RawFines() {
+				gotFines[fine.Reason] += fine.Amount
+			}
+			if diff := cmp.Diff(tc.wantFines, gotFines); diff != "" {
+				t.Errorf("fines mismatch (-want +got):\n%s", diff)
+			}
+
+			if got := repo.RawCopies()["copy-1"].Condition; got != tc.wantCopy {
+				t.Errorf("wrong copy condition: want %q, got %q", tc.wantCopy, got)
+			}
+
+			overdue, err := service.ListOverdue(ctx, "token-librarian", time.Now(), loans.Page{})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if overdue.Total != 0 {
+				t.Errorf("expected no overdue loans, got %v", overdue.Loans)
+			}
+
+			userLoans, err := service.GetUserLoans(ctx, "vasya-pupkin")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if userLoans.Unreturned != 0 {
+				t.Errorf("wrong unreturned count: want %d, got %d", 0, userLoans.Unreturned)
+			}
+		})
+	}
+
+	for _, status := range []loans.LoanStatus{loans.LoanLost, loans.LoanWrittenOff} {
+		t.Run("keeps "+string(status)+" book out of stock without copies", func(t *testing.T) {
+			ctx, service, repo := makeService(t)
+			repo.ResetRawData(map[string]loans.LentBook{})
+			repo.ResetRawCopies(map[string]loans.Copy{})
+
+			err := service.TakeBook(ctx, "token-librarian", "vasya-pupkin", "single-book", "", "", loans.TakeOverrides{})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			err = service.CloseLoan(ctx, "token-librarian", "vasya-pupkin", "single-book", status)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			available, err := service.CountAvailableBook(ctx, "token-librarian", "single-book")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if available != 0 {
+				t.Errorf("wrong availability: want %d, got %d", 0, available)
+			}
+
+			err = service.TakeBook(ctx, "token-librarian", "", "single-book", "", "", loans.TakeOverrides{})
+			if !errors.Is(err, fail.ErrNoStock) {
+				t.Errorf("wrong error: want %v, got %v", fail.ErrNoStock, err)
+			}
+		})
+	}
+
+	t.Run("frees stock of damaged book without copies", func(t *testing.T) {
+		ctx, service, repo := makeService(t)
+		repo.ResetRawData(makeLoans(-time.Hour, ""))
+		repo.ResetRawCopies(map[string]loans.Copy{})
+
+		err := service.TakeBook(ctx, "token-librarian", "", "single-book", "", "", loans.TakeOverrides{})
+		if !errors.Is(err, fail.ErrNoStock) {
+			t.Fatalf("wrong error: want %v, got %v", fail.ErrNoStock, err)
+		}
+
+		err = service.CloseLoan(ctx, "token-librarian", "vasya-pupkin", "single-book", loans.LoanDamaged)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		err = service.TakeBook(ctx, "token-librarian", "", "single-book", "", "", loans.TakeOverrides{})
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("bad status", func(t *testing.T) {
+		ctx, service, repo := makeService(t)
+		repo.ResetRawData(makeLoans(-time.Hour, ""))
+
+		err := service.CloseLoan(ctx, "token-librarian", "vasya-pupkin", "single-book", loans.LoanReturned)
+		if !errors.Is(err, fail.ErrMissingParams) {
+			t.Errorf("wrong error: want %v, got %v", fail.ErrMissingParams, err)
+		}
+	})
+
+	t.Run("bad permissions", func(t *testing.T) {
+		ctx, service, repo := makeService(t)
+		repo.ResetRawData(makeLoans(-time.Hour, ""))
+
+		err := service.CloseLoan(ctx, "token-regular-user", "vasya-pupkin", "single-book", loans.LoanLost)
+		if !errors.Is(err, fail.ErrForbidden) {
+			t.Errorf("wrong error: want %v, got %v", fail.ErrForbidden, err)
+		}
+	})
+
+	t.Run("already closed", func(t *testing.T) {
+		ctx, service, repo := makeService(t)
+		repo.ResetRawData(makeLoans(-time.Hour, ""))
+
+		err := service.CloseLoan(ctx, "token-librarian", "vasya-pupkin", "single-book", loans.LoanLost)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		err = service.CloseLoan(ctx, "token-librarian", "vasya-pupkin", "single-book", loans.LoanWrittenOff)
+		if !errors.Is(err, fail.ErrNotFound) {
+			t.Errorf("wrong error: want %v, got %v", fail.ErrNotFound, err)
+		}
+	})
+}
+
+func TestService_RenewLoan(t *testing.T) {
+	t.Run("basic", func(t *testing.T) {
+		ctx, service, repo, fakeClock := makeFakeClockService(t)
+		now := loans.ToTimestamp(fakeClock.Now())
+		bookPre := loans.LentBook{
+			ID:             "blah-blah-blah",
+			BookID:         "single-book",
+			UserID:         "vasya-pupkin",
+			TakenAt:        now - 123,
+			ReturnDeadline: now + 123,
+			Returned:       false,
+			ReturnedAt:     0,
+			Renewals:       0,
+		}
+		repo.ResetRawData(map[string]loans.LentBook{
+			"blah-blah-blah": bookPre,
+		})
+
+		err := service.RenewLoan(ctx, "token-regular-user", "", "single-book")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		got := repo.RawData()["blah-blah-blah"]
+		want := bookPre
+		want.ReturnDeadline = bookPre.ReturnDeadline + uint64(bookReturnDeadline.Milliseconds())
+		want.Renewals = 1
+
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("result mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("renewal limit", func(t *testing.T) {
+		ctx, service, repo := makeService(t)
+		repo.ResetRawData(map[string]loans.LentBook{
+			"blah-blah-blah": {
+				ID:             "blah-blah-blah",
+				BookID:         "single-book",
+				UserID:         "vasya-pupkin",
+				TakenAt:        uint64(time.Now().UnixMilli()) - 123,
+				ReturnDeadline: uint64(time.Now().UnixMilli()) + 123,
+				Returned:       false,
+				ReturnedAt:     0,
+				Renewals:       maxRenewals,
+			},
+		})
+
+		err := service.RenewLoan(ctx, "token-regular-user", "", "single-book")
+		if !errors.Is(err, fail.ErrRenewalLimit) {
+			t.Fatalf("wrong error: want %v, got %v", fail.ErrRenewalLimit, err)
+		}
+	})
+
+	t.Run("overdue", func(t *testing.T) {
+		ctx, service, repo := makeService(t)
+		repo.ResetRawData(map[string]loans.LentBook{
+			"blah-blah-blah": {
+				ID:             "blah-blah-blah",
+				BookID:         "single-book",
+				UserID:         "vasya-pupkin",
+				TakenAt:        uint64(time.Now().UnixMilli()) - 123,
+				ReturnDeadline: uint64(time.Now().UnixMilli()) - 10,
+				Returned:       false,
+				ReturnedAt:     0,
+			},
+		})
+
+		err := service.RenewLoan(ctx, "token-regular-user", "", "single-book")
+		if !errors.Is(err, fail.ErrForbidden) {
+			t.Fatalf("wrong error: want %v, got %v", fail.ErrForbidden, err)
+		}
+	})
+
+	t.Run("overdue by librarian", func(t *testing.T) {
+		ctx, service, repo, fakeClock := makeFakeClockService(t)
+		now := loans.ToTimestamp(fakeClock.Now())
+		repo.ResetRawData(map[string]loans.LentBook{
+			"blah-blah-blah": {
+				ID:             "blah-blah-blah",
+				BookID:         "single-book",
+				UserID:         "vasya-pupkin",
+				TakenAt:        now - 123,
+				ReturnDeadline: now - 10,
+				Returned:       false,
+				ReturnedAt:     0,
+			},
+		})
+
+		err := service.RenewLoan(ctx, "token-librarian", "vasya-pupkin", "single-book")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		// An overdue loan is extended from now rather than from its missed deadline
+		got := repo.RawData()["blah-blah-blah"]
+		wantDeadline := now + uint64(bookReturnDeadline.Milliseconds())
+		if got.ReturnDeadline != wantDeadline {
+			t.Errorf("wrong returnDeadline: want %d, got %d", wantDeadline, got.ReturnDeadline)
+		}
+		if got.Renewals != 1 {
+			t.Errorf("wrong renewals: want %d, got %d", 1, got.Renewals)
+		}
+	})
+
+	t.Run("not lent", func(t *testing.T) {
+		ctx, service, repo := makeService(t)
+		repo.ResetRawData(map[string]loans.LentBook{})
+
+		err := service.RenewLoan(ctx, "token-regular-user", "", "multi-book")
+		if !errors.Is(err, fail.ErrNotFound) {
+			t.Fatalf("wrong error: want %v, got %v", fail.ErrNotFound, err)
+		}
+	})
+}
+
+func TestService_Holds(t *testing.T) {
+	t.Run("place", func(t *testing.T) {
+		ctx, service, repo := makeService(t)
+		repo.ResetRawData(map[string]loans.LentBook{
+			"blah-blah-blah": {
+				ID:             "blah-blah-blah",
+				BookID:         "single-book",
+				UserID:         "yuuko-shirakawa",
+				TakenAt:        uint64(time.Now().UnixMilli()) - 123,
+				ReturnDeadline: uint64(time.Now().UnixMilli()) + 123,
+				Returned:       false,
+				ReturnedAt:     0,
+			},
+		})
+		repo.ResetRawHolds(map[string]loans.Hold{})
+
+		err := service.PlaceHold(ctx, "token-regular-user", "", "single-book")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		holds, err := service.ListHolds(ctx, "token-regular-user", "", "")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(holds) != 1 {
+			t.Fatalf("expected 1 hold, got %d", len(holds))
+		}
+
+		got := holds[0]
+		want := loans.Hold{
+			ID:            got.ID,
+			UserID:        "vasya-pupkin",
+			BookID:        "single-book",
+			PlacedAt:      got.PlacedAt,
+			PickupWindow:  uint64(holdPickupWindow.Milliseconds()),
+			ReservedUntil: 0,
+		}
+
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("result mismatch (-want +got):\n%s", diff)
+		}
+
+		err = service.PlaceHold(ctx, "token-regular-user", "", "single-book")
+		if !errors.Is(err, fail.ErrCollision) {
+			t.Errorf("wrong error: want %v, got %v", fail.ErrCollision, err)
+		}
+	})
+
+	t.Run("in stock", func(t *testing.T) {
+		ctx, service, repo := makeService(t)
+		repo.ResetRawData(map[string]loans.LentBook{})
+		repo.ResetRawHolds(map[string]loans.Hold{})
+
+		err := service.PlaceHold(ctx, "token-regular-user", "", "single-book")
+		if !errors.Is(err, fail.ErrCollision) {
+			t.Errorf("wrong error: want %v, got %v", fail.ErrCollision, err)
+		}
+	})
+
+	t.Run("reserved on return", func(t *testing.T) {
+		ctx, service, repo, fakeClock := makeFakeClockService(t)
+		now := loans.ToTimestamp(fakeClock.Now())
+		repo.ResetRawData(map[string]loans.LentBook{
+			"blah-blah-blah": {
+				ID:             "blah-blah-blah",
+				BookID:         "single-book",
+				UserID:         "yuuko-shirakawa",
+				TakenAt:        now - 123,
+				ReturnDeadline: now + 123,
+				Returned:       false,
+				ReturnedAt:     0,
+			},
+		})
+		repo.ResetRawHolds(map[string]loans.Hold{
+			"hold-hold-hold": {
+				ID:            "hold-hold-hold",
+				UserID:        "vasya-pupkin",
+				BookID:        "single-book",
+				PlacedAt:      now - 100,
+				PickupWindow:  uint64(holdPickupWindow.Milliseconds()),
+				ReservedUntil: 0,
+			},
+		})
+
+		err := service.ReturnBook(ctx, "token-librarian", "", "single-book")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		hold := repo.RawHolds()["hold-hold-hold"]
+		wantReservedUntil := now + uint64(holdPickupWindow.Milliseconds())
+		if hold.ReservedUntil != wantReservedUntil {
+			t.Errorf("wrong reservedUntil: want %d, got %d", wantReservedUntil, hold.ReservedUntil)
+		}
+
+		err = service.TakeBook(ctx, "token-librarian", "", "single-book", "", "", loans.TakeOverrides{})
+		if !errors.Is(err, fail.ErrNoStock) {
+			t.Errorf("wrong error: want %v, got %v", fail.ErrNoStock, err)
+		}
+
+		err = service.TakeBook(ctx, "token-regular-user", "", "single-book", "", "", loans.TakeOverrides{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if holds := repo.RawHolds(); len(holds) != 0 {
+			t.Errorf("expected the hold to be fulfilled, got %v", holds)
+		}
+	})
+
+	t.Run("reservation expired", func(t *testing.T) {
+		ctx, service, repo := makeService(t)
+		now := uint64(time.Now().UnixMilli())
+		repo.ResetRawData(map[string]loans.LentBook{})
+		repo.ResetRawHolds(map[string]loans.Hold{
+			"hold-hold-hold": {
+				ID:            "hold-hold-hold",
+				UserID:        "vasya-pupkin",
+				BookID:        "single-book",
+				PlacedAt:      now - 1000,
+				PickupWindow:  100,
+				ReservedUntil: now - 10,
+			},
+		})
+
+		err := service.TakeBook(ctx, "token-librarian", "", "single-book", "", "", loans.TakeOverrides{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if holds := repo.RawHolds(); len(holds) != 0 {
+			t.Errorf("expected the hold to expire, got %v", holds)
+		}
+	})
+
+	t.Run("cancel passes reservation on", func(t *testing.T) {
+		ctx, service, repo := makeService(t)
+		now := uint64(time.Now().UnixMilli())
+		repo.ResetRawData(map[string]loans.LentBook{})
+		repo.ResetRawHolds(map[string]loans.Hold{
+			"hold-1": {
+				ID:            "hold-1",
+				UserID:        "vasya-pupkin",
+				BookID:        "single-book",
+				PlacedAt:      now - 100,
+				PickupWindow:  1000,
+				ReservedUntil: now + 10,
+			},
+			"hold-2": {
+				ID:            "hold-2",
+				UserID:        "yuuko-shirakawa",
+				BookID:        "single-book",
+				PlacedAt:      now - 50,
+				PickupWindow:  1000,
+				ReservedUntil: 0,
+			},
+		})
+
+		err := service.CancelHold(ctx, "token-regular-user", "", "single-book")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		holds := repo.RawHolds()
+		if _, ok := holds["hold-1"]; ok {
+			t.Errorf("expected hold-1 to be cancelled")
+		}
+		if holds["hold-2"].ReservedUntil < now+1000 {
+			t.Errorf("wrong reservedUntil: want >= %d, got %d", now+1000, holds["hold-2"].ReservedUntil)
+		}
+	})
+
+	t.Run("bad permissions", func(t *testing.T) {
+		ctx, service, repo := makeService(t)
+		repo.ResetRawHolds(map[string]loans.Hold{})
+
+		err := service.CancelHold(ctx, "token-regular-user", "yuuko-shirakawa", "single-book")
+		if !errors.Is(err, fail.ErrForbidden) {
+			t.Errorf("wrong error: want %v, got %v", fail.ErrForbidden, err)
+		}
+	})
+}
+
+func TestService_Fines(t *testing.T) {
+	makeLoans := func(overdueBy time.Duration) map[string]loans.LentBook {
+		now := time.Now()
+		return map[string]loans.LentBook{
+			"blah-blah-blah": {
+				ID:             "blah-blah-blah",
+				BookID:         "single-book",
+				UserID:         "vasya-pupkin",
+				TakenAt:        uint64(now.Add(-bookReturnDeadline - overdueBy).UnixMilli()),
+				ReturnDeadline: uint64(now.Add(-overdueBy).UnixMilli()),
+				Returned:       false,
+				ReturnedAt:     0,
+			},
+		}
+	}
+
+	for _, tc := range []struct {
+		name      string
+		overdueBy time.Duration
+		want      uint64
+	}{
+		{name: "on time", overdueBy: -time.Hour, want: 0},
+		{name: "started day", overdueBy: time.Hour, want: finePerDay},
+		{name: "two days", overdueBy: 36 * time.Hour, want: 2 * finePerDay},
+		{name: "capped", overdueBy: 30 * 24 * time.Hour, want: fineCap},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, service, repo := makeService(t)
+			repo.ResetRawData(makeLoans(tc.overdueBy))
+			repo.ResetRawFines(map[string]loans.Fine{})
+
+			err := service.ReturnBook(ctx, "token-regular-user", "", "single-book")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			fines, err := service.ListFines(ctx, "token-regular-user", "")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if tc.want == 0 {
+				if len(fines) != 0 {
+					t.Errorf("expected no fines, got %v", fines)
+				}
+				return
+			}
+
+			if len(fines) != 1 {
+				t.Fatalf("expected 1 fine, got %d", len(fines))
+			}
+
+			got := fines[0]
+			want := loans.Fine{
+				ID:         got.ID,
+				UserID:     "vasya-pupkin",
+				LoanID:     "blah-blah-blah",
+				BookID:     "single-book",
+				Reason:     loans.FineLate,
+				Amount:     tc.want,
+				IssuedAt:   got.IssuedAt,
+				Status:     loans.FineOutstanding,
+				ResolvedAt: 0,
+			}
+
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("result mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("pay and waive", func(t *testing.T) {
+		ctx, service, repo := makeService(t)
+		repo.ResetRawFines(map[string]loans.Fine{
+			"fine-1": {
+				ID:       "fine-1",
+				UserID:   "vasya-pupkin",
+				LoanID:   "loan-1",
+				BookID:   "single-book",
+				Amount:   100,
+				IssuedAt: 123,
+				Status:   loans.FineOutstanding,
+			},
+			"fine-2": {
+				ID:       "fine-2",
+				UserID:   "vasya-pupkin",
+				LoanID:   "loan-2",
+				BookID:   "single-book",
+				Amount:   200,
+				IssuedAt: 456,
+				Status:   loans.FineOutstanding,
+			},
+		})
+
+		err := service.PayFine(ctx, "token-regular-user", "fine-1")
+		if !errors.Is(err, fail.ErrForbidden) {
+			t.Errorf("wrong error: want %v, got %v", fail.ErrForbidden, err)
+		}
+
+		err = service.PayFine(ctx, "token-librarian", "fine-1")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		err = service.WaiveFine(ctx, "token-librarian", "fine-1")
+		if !errors.Is(err, fail.ErrCollision) {
+			t.Errorf("wrong error: want %v, got %v", fail.ErrCollision, err)
+		}
+
+		err = service.WaiveFine(ctx, "token-librarian", "missing-fine")
+		if !errors.Is(err, fail.ErrNotFound) {
+			t.Errorf("wrong error: want %v, got %v", fail.ErrNotFound, err)
+		}
+
+		userLoans, err := service.GetUserLoans(ctx, "vasya-pupkin")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if userLoans.OutstandingFines != 200 {
+			t.Errorf("wrong outstanding fines: want %d, got %d", 200, userLoans.OutstandingFines)
+		}
+
+		err = service.WaiveFine(ctx, "token-librarian", "fine-2")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		fines := repo.RawFines()
+		if fines["fine-1"].Status != loans.FinePaid {
+			t.Errorf("wrong status: want %q, got %q", loans.FinePaid, fines["fine-1"].Status)
+		}
+		if fines["fine-2"].Status != loans.FineWaived {
+			t.Errorf("wrong status: want %q, got %q", loans.FineWaived, fines["fine-2"].Status)
+		}
+	})
+
+	t.Run("bad permissions", func(t *testing.T) {
+		ctx, service, repo := makeService(t)
+		repo.ResetRawFines(map[string]loans.Fine{})
+
+		_, err := service.ListFines(ctx, "token-regular-user", "yuuko-shirakawa")
+		if !errors.Is(err, fail.ErrForbidden) {
+			t.Errorf("wrong error: want %v, got %v", fail.ErrForbidden, err)
+		}
+	})
+}
+
+func TestService_Copies(t *testing.T) {
+	registerCopies := func(t *testing.T, ctx context.Context, service loans.Service) {
+		t.Helper()
+
+		for _, barcode := range []string{"0002", "0001", "0003"} {
+			_, err := service.RegisterCopy(ctx, "token-librarian", "multi-book", barcode, "", "A-1")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+	}
+
+	t.Run("register", func(t *testing.T) {
+		ctx, service, repo := makeService(t)
+		repo.ResetRawCopies(map[string]loans.Copy{})
+
+		got, err := service.RegisterCopy(ctx, "token-librarian", "multi-book", "0001", loans.CopyWorn, "A-1")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		want := loans.Copy{
+			ID:            got.ID,
+			BookID:        "multi-book",
+			Barcode:       "0001",
+			Condition:     loans.CopyWorn,
+			ShelfLocation: "A-1",
+		}
+
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("result mismatch (-want +got):\n%s", diff)
+		}
+
+		_, err = service.RegisterCopy(ctx, "token-librarian", "single-book", "0001", "", "")
+		if !errors.Is(err, fail.ErrCollision) {
+			t.Errorf("wrong error: want %v, got %v", fail.ErrCollision, err)
+		}
+
+		_, err = service.RegisterCopy(ctx, "token-regular-user", "multi-book", "0002", "", "")
+		if !errors.Is(err, fail.ErrForbidden) {
+			t.Errorf("wrong error: want %v, got %v", fail.ErrForbidden, err)
+		}
+
+		_, err = service.RegisterCopy(ctx, "token-librarian", "multi-book", "0002", "shredded", "")
+		if !errors.Is(err, fail.ErrMissingParams) {
+			t.Errorf("wrong error: want %v, got %v", fail.ErrMissingParams, err)
+		}
+	})
+
+	t.Run("allocate", func(t *testing.T) {
+		ctx, service, repo := makeService(t)
+		repo.ResetRawData(map[string]loans.LentBook{})
+		repo.ResetRawCopies(map[string]loans.Copy{})
+		registerCopies(t, ctx, service)
+
+		available, err := service.CountAvailableBook(ctx, "token-regular-user", "multi-book")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if available != 3 {
+			t.Errorf("wrong availability: want %d, got %d", 3, available)
+		}
+
+		err = service.TakeBook(ctx, "token-regular-user", "", "multi-book", "", "", loans.TakeOverrides{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		lentBooks := slices.Collect(maps.Values(repo.RawData()))
+		if len(lentBooks) != 1 {
+			t.Fatalf("expected 1 lent book, got %d", len(lentBooks))
+		}
+		if got := repo.RawCopies()[lentBooks[0].CopyID].Barcode; got != "0001" {
+			t.Errorf("wrong copy lent: want %q, got %q", "0001", got)
+		}
+
+		available, err = service.CountAvailableBook(ctx, "token-regular-user", "multi-book")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if available != 2 {
+			t.Errorf("wrong availability: want %d, got %d", 2, available)
+		}
+	})
+
+	t.Run("scanned barcode", func(t *testing.T) {
+		ctx, service, repo := makeService(t)
+		repo.ResetRawData(map[string]loans.LentBook{})
+		repo.ResetRawCopies(map[string]loans.Copy{})
+		registerCopies(t, ctx, service)
+
+		err := service.TakeBook(ctx, "token-regular-user", "", "multi-book", "0003", "", loans.TakeOverrides{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		lentBooks := slices.Collect(maps.Values(repo.RawData()))
+		if got := repo.RawCopies()[lentBooks[0].CopyID].Barcode; got != "0003" {
+			t.Errorf("wrong copy lent: want %q, got %q", "0003", got)
+		}
+
+		err = service.TakeBook(ctx, "token-librarian", "", "multi-book", "0003", "", loans.TakeOverrides{})
+		if !errors.Is(err, fail.ErrCollision) {
+			t.Errorf("wrong error: want %v, got %v", fail.ErrCollision, err)
+		}
+
+		err = service.TakeBook(ctx, "token-librarian", "", "single-book", "0002", "", loans.TakeOverrides{})
+		if !errors.Is(err, fail.ErrNotFound) {
+			t.Errorf("wrong error: want %v, got %v", fail.ErrNotFound, err)
+		}
+	})
+
+	t.Run("not lendable", func(t *testing.T) {
+		ctx, service, repo := makeService(t)
+		repo.ResetRawData(map[string]loans.LentBook{})
+		repo.ResetRawCopies(map[string]loans.Copy{})
+		registerCopies(t, ctx, service)
+
+		for _, barcode := range []string{"0001", "0002"} {
+			_, err := service.UpdateCopy(ctx, "token-librarian", barcode, loans.CopyDamaged, "")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+
+		err := service.TakeBook(ctx, "token-regular-user", "", "multi-book", "0001", "", loans.TakeOverrides{})
+		if !errors.Is(err, fail.ErrCollision) {
+			t.Errorf("wrong error: want %v, got %v", fail.ErrCollision, err)
+		}
+
+		err = service.TakeBook(ctx, "token-regular-user", "", "multi-book", "", "", loans.TakeOverrides{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		err = service.TakeBook(ctx, "token-librarian", "", "multi-book", "", "", loans.TakeOverrides{})
+		if !errors.Is(err, fail.ErrNoStock) {
+			t.Errorf("wrong error: want %v, got %v", fail.ErrNoStock, err)
+		}
+	})
+
+	t.Run("return by barcode", func(t *testing.T) {
+		ctx, service, repo := makeService(t)
+		repo.ResetRawData(map[string]loans.LentBook{})
+		repo.ResetRawCopies(map[string]loans.Copy{})
+		registerCopies(t, ctx, service)
+
+		err := service.TakeBook(ctx, "token-regular-user", "", "multi-book", "0002", "", loans.TakeOverrides{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		err = service.ReturnCopy(ctx, "token-regular-user", "0001")
+		if !errors.Is(err, fail.ErrNotFound) {
+			t.Errorf("wrong error: want %v, got %v", fail.ErrNotFound, err)
+		}
+
+		err = service.ReturnCopy(ctx, "token-regular-user", "0002")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		lentBooks := slices.Collect(maps.Values(repo.RawData()))
+		if !lentBooks[0].Returned {
+			t.Errorf("expected the loan to be returned")
+		}
+	})
+}
+
+func TestService_CountAvailableBook(t *testing.T) {
+	ctx, service, repo := makeService(t)
+
+	// TODO: Test serivce.CountAvailableBook
+	_ = ctx
+	_ = service
+	_ = repo
+}
+
+// makeLoanHistory returns a set of loans, some of them returned and some overdue at the given time
+func makeLoanHistory(now uint64) map[string]loans.LentBook {
+	const second = 1000
+	result := make(map[string]loans.LentBook)
+	for i, id := range []string{"loan-a", "loan-b", "loan-c", "loan-d", "loan-e", "loan-f"} {
+		book := loans.LentBook{
+			ID:             id,
+			BookID:         "multi-book",
+			UserID:         "vasya-pupkin",
+			TakenAt:        now - (1000-uint64(i/2)*100)*second,
+			ReturnDeadline: now + 300*second - uint64(i)*100*second,
+			Status:         loans.LoanOpen,
+		}
+		if i%3 == 2 {
+			book.Returned = true
+			book.ReturnedAt = now - 50*second
+			book.Status = loans.LoanReturned
+		}
+		result[id] = book
+	}
+	return result
+}
+
+// collectPages walks through all pages of a listing, returning the IDs of the listed loans
+// and the total reported by the first page
+func collectPages(t *testing.T, list func(page loans.Page) (loans.LoanPage, error)) ([]string, uint) {
+	t.Helper()
+
+	result := make([]string, 0)
+	total := uint(0)
+	page := loans.Page{Limit: 2, Cursor: ""}
+	for pages := 0; ; pages++ {
+		if pages > 10 {
+			t.Fatalf("pagination doesn't terminate")
+		}
+
+		loanPage, err := list(page)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(loanPage.Loans) > 2 {
+			t.Errorf("page too long: %d", len(loanPage.Loans))
+		}
+		if pages == 0 {
+			total = loanPage.Total
+		}
+
+		for _, book := range loanPage.Loans {
+			result = append(result, book.ID)
+		}
+		if loanPage.NextCursor == "" {
+			return result, total
+		}
+		page.Cursor = loanPage.NextCursor
+	}
+}
+
+func TestService_ListReservations(t *testing.T) {
+	t.Run("pagination", func(t *testing.T) {
+		ctx, service, repo := makeService(t)
+		now := time.Now()
+		repo.ResetRawData(makeLoanHistory(uint64(now.UnixMilli())))
+
+		got, total := collectPages(t, func(page loans.Page) (loans.LoanPage, error) {
+			return service.ListReservations(ctx, "token-librarian", now, page)
+		})
+
+		want := []string{"loan-a", "loan-b", "loan-d", "loan-e"}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("result mismatch (-want +got):\n%s", diff)
+		}
+		if total != uint(len(want)) {
+			t.Errorf("wrong total: want %d, got %d", len(want), total)
+		}
+	})
+
+	t.Run("in the past", func(t *testing.T) {
+		ctx, service, repo := makeService(t)
+		now := time.Now()
+		repo.ResetRawData(makeLoanHistory(uint64(now.UnixMilli())))
+
+		got, total := collectPages(t, func(page loans.Page) (loans.LoanPage, error) {
+			return service.ListReservations(ctx, "token-librarian", now.Add(-850*time.Second), page)
+		})
+
+		want := []string{"loan-a", "loan-b", "loan-c", "loan-d"}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("result mismatch (-want +got):\n%s", diff)
+		}
+		if total != uint(len(want)) {
+			t.Errorf("wrong total: want %d, got %d", len(want), total)
+		}
+	})
+
+	t.Run("invalid token", func(t *testing.T) {
+		ctx, service, _ := makeService(t)
+
+		_, err := service.ListReservations(ctx, "token-invalid", time.Now(), loans.Page{})
+		if !errors.Is(err, fail.ErrUserService) {
+			t.Errorf("wrong error: want %v, got %v", fail.ErrUserService, err)
+		}
+	})
+}
+
+func TestService_ListOverdue(t *testing.T) {
+	t.Run("pagination", func(t *testing.T) {
+		ctx, service, repo := makeService(t)
+		now := time.Now()
+		repo.ResetRawData(makeLoanHistory(uint64(now.UnixMilli())))
+
+		got, total := collectPages(t, func(page loans.Page) (loans.LoanPage, error) {
+			return service.ListOverdue(ctx, "token-librarian", now.Add(250*time.Second), page)
+		})
+
+		// Ordered by the return deadline, the most overdue first
+		want := []string{"loan-e", "loan-d", "loan-b"}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("result mismatch (-want +got):\n%s", diff)
+		}
+		if total != uint(len(want)) {
+			t.Errorf("wrong total: want %d, got %d", len(want), total)
+		}
+	})
+
+	t.Run("bad cursor", func(t *testing.T) {
+		ctx, service, _ := makeService(t)
+
+		_, err := service.ListOverdue(ctx, "token-librarian", time.Now(), loans.Page{Limit: 2, Cursor: "%%%"})
+		if !errors.Is(err, fail.ErrMissingParams) {
+			t.Errorf("wrong error: want %v, got %v", fail.ErrMissingParams, err)
+		}
+	})
+}
+
+func TestService_GetUserLoans(t *testing.T) {
+	ctx, service, repo := makeService(t)
+
+	// TODO: Test serivce.GetUserLoans
+	_ = ctx
+	_ = service
+	_ = repo
+}
+
+func TestService_Clock(t *testing.T) {
+	makeTravelingService := func(t *testing.T) (context.Context, loans.Service, repo.TestMemoryRepo) {
+		t.Helper()
+
+		repo := repo.NewMemoryRepo("memory://")
+		serviceClock := clock.NewTraveler(clock.NewFake(time.Unix(1_000_000, 0)))
+		service := loans.NewService(repo, mock.NewUsersConn(), mock.NewBooksConn(), makePolicy(), serviceClock)
+
+		return context.Background(), service, repo
+	}
+
+	t.Run("travel", func(t *testing.T) {
+		ctx, service, repo := makeTravelingService(t)
+
+		state, err := service.GetClock(ctx, "token-librarian")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if diff := cmp.Diff(loans.ClockState{Now: 1_000_000_000, Offset: 0}, state); diff != "" {
+			t.Errorf("clock state mismatch (-want +got):\n%s", diff)
+		}
+
+		state, err = service.TravelInTime(ctx, "token-librarian", 72*time.Hour)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		want := loans.ClockState{Now: 1_000_000_000 + 72*60*60*1000, Offset: 72 * 60 * 60 * 1000}
+		if diff := cmp.Diff(want, state); diff != "" {
+			t.Errorf("clock state mismatch (-want +got):\n%s", diff)
+		}
+
+		err = service.TakeBook(ctx, "token-librarian", "vasya-pupkin", "multi-book", "", "", loans.TakeOverrides{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		for _, lentBook := range repo.RawData() {
+			if lentBook.TakenAt != want.Now {
+				t.Errorf("book taken at the wrong time: want %d, got %d", want.Now, lentBook.TakenAt)
+			}
+		}
+	})
+
+	t.Run("regular user", func(t *testing.T) {
+		ctx, service, _ := makeTravelingService(t)
+
+		_, err := service.GetClock(ctx, "token-regular-user")
+		if !errors.Is(err, fail.ErrForbidden) {
+			t.Errorf("wrong error: want %v, got %v", fail.ErrForbidden, err)
+		}
+
+		_, err = service.TravelInTime(ctx, "token-regular-user", time.Hour)
+		if !errors.Is(err, fail.ErrForbidden) {
+			t.Errorf("wrong error: want %v, got %v", fail.ErrForbidden, err)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		ctx, service, _ := makeService(t)
+
+		state, err := service.GetClock(ctx, "token-librarian")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if state.Offset != 0 {
+			t.Errorf("unexpected clock offset: %d", state.Offset)
+		}
+
+		_, err = service.TravelInTime(ctx, "token-librarian", time.Hour)
+		if !errors.Is(err, fail.ErrForbidden) {
+			t.Errorf("wrong error: want %v, got %v", fail.ErrForbidden, err)
+		}
+	})
+}
+
+func TestService_Idempotency(t *testing.T) {
+	makeIdempotentService := func(t *testing.T) (context.Context, loans.Service, *clock.Fake) {
+		t.Helper()
+
+		serviceClock := clock.NewFake(time.Unix(1_000_000, 0))
+		repo := repo.NewMemoryRepo("memory://")
+		service := loans.NewService(repo, mock.NewUsersConn(), mock.NewBooksConn(), makePolicy(), serviceClock)
+
+		return context.Background(), service, serviceClock
+	}
+
+	finish := func(t *testing.T, ctx context.Context, service loans.Service, key string, fingerprint string) {
+		t.Helper()
+
+		record, err := service.BeginIdempotentRequest(ctx, key, fingerprint)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if record != nil {
+			t.Fatalf("key %q is already used: %+v", key, record)
+		}
+
+		err = service.FinishIdempotentRequest(ctx, &loans.IdempotencyRecord{
+			Key:         key,
+			Fingerprint: fingerprint,
+			Status:      200,
+			ContentType: "application/json",
+			Body:        []byte(`{"success":true}`),
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	t.Run("replay", func(t *testing.T) {
+		ctx, service, serviceClock := makeIdempotentService(t)
+		finish(t, ctx, service, "key-1", "fingerprint-1")
+
+		serviceClock.Advance(idempotencyKeyTTL - time.Second)
+		record, err := service.BeginIdempotentRequest(ctx, "key-1", "fingerprint-1")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		want := &loans.IdempotencyRecord{
+			Key:         "key-1",
+			Fingerprint: "fingerprint-1",
+			Done:        true,
+			Status:      200,
+			ContentType: "application/json",
+			Body:        []byte(`{"success":true}`),
+			ExpiresAt:   loans.ToTimestamp(time.Unix(1_000_000, 0).Add(idempotencyKeyTTL)),
+		}
+		if diff := cmp.Diff(want, record); diff != "" {
+			t.Errorf("record mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("mismatch", func(t *testing.T) {
+		ctx, service, _ := makeIdempotentService(t)
+		finish(t, ctx, service, "key-1", "fingerprint-1")
+
+		_, err := service.BeginIdempotentRequest(ctx, "key-1", "fingerprint-2")
+		if !errors.Is(err, fail.ErrIdempotencyMismatch) {
+			t.Errorf("wrong error: want %v, got %v", fail.ErrIdempotencyMismatch, err)
+		}
+	})
+
+	t.Run("in progress", func(t *testing.T) {
+		ctx, service, serviceClock := makeIdempotentService(t)
+
+		_, err := service.BeginIdempotentRequest(ctx, "key-1", "fingerprint-1")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		record, err := service.BeginIdempotentRequest(ctx, "key-1", "fingerprint-1")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if record == nil || record.Done {
+			t.Errorf("request not in progress: %+v", record)
+		}
+
+		// A request that has hung up for too long doesn't hold the key forever
+		serviceClock.Advance(time.Hour)
+		finish(t, ctx, service, "key-1", "fingerprint-2")
+	})
+
+	t.Run("abandoned", func(t *testing.T) {
+		ctx, service, _ := makeIdempotentService(t)
+
+		_, err := service.BeginIdempotentRequest(ctx, "key-1", "fingerprint-1")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		err = service.AbandonIdempotentRequest(ctx, "key-1")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		finish(t, ctx, service, "key-1", "fingerprint-1")
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		ctx, service, serviceClock := makeIdempotentService(t)
+		finish(t, ctx, service, "key-1", "fingerprint-1")
+
+		serviceClock.Advance(idempotencyKeyTTL)
+		finish(t, ctx, service, "key-1", "fingerprint-2")
+	})
+}
+
+func TestService_InvalidateBook(t *testing.T) {
+	cache := booksCache{Connection: mock.NewBooksConn()}
+	service := loans.NewService(repo.NewMemoryRepo("memory://"), mock.NewUsersConn(), &cache, makePolicy(), clock.NewSystem())
+
+	err := service.InvalidateBook(context.Background(), "multi-book")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if diff := cmp.Diff([]string{"multi-book"}, cache.invalidated); diff != "" {
+		t.Errorf("invalidated books mismatch (-want +got):\n%s", diff)
+	}
+}
+
+// booksCache records the invalidations of the cached books
+type booksCache struct {
+	books.Connection
+	invalidated []string
+}
+
+func (c *booksCache) InvalidateBook(bookID string) {
+	c.invalidated = append(c.invalidated, bookID)
+}
+
+func (c *booksCache) InvalidateAll() {
+	c.invalidated = append(c.invalidated, "*")
+}
+
+func TestService_RevokeToken(t *testing.T) {
+	cache := usersCache{Connection: mock.NewUsersConn()}
+	service := loans.NewService(repo.NewMemoryRepo("memory://"), &cache, mock.NewBooksConn(), makePolicy(), clock.NewSystem())
+
+	err := service.RevokeToken(context.Background(), "token-regular-user")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if diff := cmp.Diff([]string{"token-regular-user"}, cache.revoked); diff != "" {
+		t.Errorf("revoked tokens mismatch (-want +got):\n%s", diff)
+	}
+}
+
+// usersCache records the revocations of the cached tokens
+type usersCache struct {
+	users.Connection
+	revoked []string
+}
+
+func (c *usersCache) RevokeToken(authToken string) {
+	c.revoked = append(c.revoked, authToken)
+}
+
+func (c *usersCache) RevokeAll() {
+	c.revoked = append(c.revoked, "*")
 }
@@ -0,0 +1,79 @@
+package loans
+
+// Valid returns true if the condition is one of the known ones
+func (c CopyCondition) Valid() bool {
+	switch c {
+	case CopyGood, CopyWorn, CopyDamaged, CopyWithdrawn:
+		return true
+	}
+	return false
+}
+
+// Lendable returns true if the copy may be lent out in its condition
+func (c *Copy) Lendable() bool {
+	return c.Condition == CopyGood || c.Condition == CopyWorn
+}
+
+// Stock describes which copies of a single book are in the library at the moment
+type Stock struct {
+	// InStock is the number of copies that are not lent out (can be negative if over-lent)
+	InStock int64
+	// FreeCopies lists the registered lendable copies that are not lent out, ordered as given
+	FreeCopies []Copy
+}
+
+// Missing returns true if the loan has ended without the book coming back to the library
+func (s LoanStatus) Missing() bool {
+	return s == LoanLost || s == LoanWrittenOff
+}
+
+// ComputeStock determines the stock of a book from its loans, which must include all open (unreturned)
+// ones and may include the closed ones. If the book has registered copies, only the lendable ones count
+// towards the stock, otherwise the book is assumed to have totalStock interchangeable copies,
+// some of which may be missing
+func ComputeStock(totalStock uint, copies []Copy, lentBooks []LentBook) Stock {
+	if len(copies) == 0 {
+		// The total stock comes from the book service, which doesn't know about the lost books
+		occupied := 0
+		for _, loan := range lentBooks {
+			if !loan.Returned || loan.Status.Missing() {
+				occupied += 1
+			}
+		}
+		return Stock{
+			InStock:    int64(totalStock) - int64(occupied),
+			FreeCopies: []Copy{},
+		}
+	}
+
+	// A missing registered copy is withdrawn, so only the open loans matter
+	lentCopies := make(map[string]int)
+	for _, loan := range lentBooks {
+		if !loan.Returned {
+			lentCopies[loan.CopyID] += 1
+		}
+	}
+
+	result := Stock{
+		InStock:    0,
+		FreeCopies: make([]Copy, 0),
+	}
+	for _, bookCopy := range copies {
+		if lentCopies[bookCopy.ID] > 0 {
+			lentCopies[bookCopy.ID] -= 1
+			continue
+		}
+		if bookCopy.Lendable() {
+			result.InStock += 1
+			result.FreeCopies = append(result.FreeCopies, bookCopy)
+		}
+	}
+
+	// The loans that remain either date back to when the book had no registered copies,
+	// or reference copies since removed from the inventory. Either way, they occupy a copy
+	for _, count := range lentCopies {
+		result.InStock -= int64(count)
+	}
+
+	return result
+}
@@ -0,0 +1,200 @@
+package loans
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Timestamps are stored as the number of milliseconds since the Unix epoch (UTC),
+// so that loans taken within the same second are still ordered
+
+// ToTimestamp returns the timestamp of the given moment
+func ToTimestamp(t time.Time) uint64 {
+	return uint64(t.UnixMilli())
+}
+
+// FromTimestamp returns the moment of the given timestamp
+func FromTimestamp(timestamp uint64) time.Time {
+	return time.UnixMilli(int64(timestamp)).UTC()
+}
+
+// ToMillis returns the length of the time span in milliseconds, as stored along with timestamps
+func ToMillis(d time.Duration) uint64 {
+	return uint64(d.Milliseconds())
+}
+
+// TimeFormat is the representation of timestamps in API responses
+type TimeFormat string
+
+const (
+	// TimeUnix represents timestamps as integer Unix seconds, the original form of the API
+	TimeUnix TimeFormat = "unix"
+	// TimeRFC3339 represents timestamps as RFC 3339 strings in UTC with millisecond precision
+	TimeRFC3339 TimeFormat = "rfc3339"
+)
+
+// rfc3339Millis is the layout of RFC 3339 timestamps in responses
+const rfc3339Millis = "2006-01-02T15:04:05.000Z07:00"
+
+// negotiateTimeFormat picks the time format requested by the "time" parameter
+// of the Accept header, e.g. "application/json; time=rfc3339", or the given default
+func negotiateTimeFormat(r *http.Request, fallback TimeFormat) TimeFormat {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, mediaRange := range strings.Split(accept, ",") {
+			_, params, err := mime.ParseMediaType(mediaRange)
+			if err != nil {
+				continue
+			}
+			switch format := TimeFormat(params["time"]); format {
+			case TimeUnix, TimeRFC3339:
+				return format
+			}
+		}
+	}
+	return fallback
+}
+
+// parseTime parses a timestamp given either as integer Unix seconds or as an RFC 3339 string
+func parseTime(value string) (uint64, error) {
+	seconds, err := strconv.ParseUint(value, 10, 64)
+	if err == nil {
+		return seconds * 1000, nil
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil || t.Before(time.Unix(0, 0)) {
+		return 0, fmt.Errorf("expected Unix seconds or an RFC 3339 timestamp, got %q", value)
+	}
+	return ToTimestamp(t), nil
+}
+
+// parseOptionalTime parses a timestamp form value, which is 0 if omitted
+func parseOptionalTime(value string) (uint64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	return parseTime(value)
+}
+
+// formatTime renders the timestamp in the format. Unset (zero) timestamps stay 0 as Unix seconds
+// and become null as RFC 3339
+func (f TimeFormat) formatTime(timestamp uint64) any {
+	if f == TimeRFC3339 {
+		if timestamp == 0 {
+			return nil
+		}
+		return FromTimestamp(timestamp).Format(rfc3339Millis)
+	}
+	return timestamp / 1000
+}
+
+// The views mirror the JSON form of the API entities with timestamps in the requested format.
+// Time spans are always given in seconds
+
+type lentBookView struct {
+	ID             string     `json:"id"`
+	UserID         string     `json:"user_id"`
+	BookID         string     `json:"book_id"`
+	CopyID         string     `json:"copy_id"`
+	TakenAt        any        `json:"taken_at"`
+	ReturnDeadline any        `json:"return_deadline"`
+	Returned       bool       `json:"returned"`
+	ReturnedAt     any        `json:"returned_at"`
+	Renewals       uint       `json:"renewals"`
+	Status         LoanStatus `json:"status"`
+	Notes          string     `json:"notes,omitempty"`
+}
+
+func (f TimeFormat) lentBooks(books []LentBook) []lentBookView {
+	result := make([]lentBookView, 0, len(books))
+	for i := range books {
+		result = append(result, f.lentBook(&books[i]))
+	}
+	return result
+}
+
+func (f TimeFormat) lentBook(book *LentBook) lentBookView {
+	return lentBookView{
+		ID:             book.ID,
+		UserID:         book.UserID,
+		BookID:         book.BookID,
+		CopyID:         book.CopyID,
+		TakenAt:        f.formatTime(book.TakenAt),
+		ReturnDeadline: f.formatTime(book.ReturnDeadline),
+		Returned:       book.Returned,
+		ReturnedAt:     f.formatTime(book.ReturnedAt),
+		Renewals:       book.Renewals,
+		Status:         book.Status,
+		Notes:          book.Notes,
+	}
+}
+
+type holdView struct {
+	ID            string `json:"id"`
+	UserID        string `json:"user_id"`
+	BookID        string `json:"book_id"`
+	PlacedAt      any    `json:"placed_at"`
+	PickupWindow  uint64 `json:"pickup_window"`
+	ReservedUntil any    `json:"reserved_until"`
+}
+
+func (f TimeFormat) holds(holds []Hold) []holdView {
+	result := make([]holdView, 0, len(holds))
+	for _, hold := range holds {
+		result = append(result, holdView{
+			ID:            hold.ID,
+			UserID:        hold.UserID,
+			BookID:        hold.BookID,
+			PlacedAt:      f.formatTime(hold.PlacedAt),
+			PickupWindow:  hold.PickupWindow / 1000,
+			ReservedUntil: f.formatTime(hold.ReservedUntil),
+		})
+	}
+	return result
+}
+
+type fineView struct {
+	ID         string     `json:"id"`
+	UserID     string     `json:"user_id"`
+	LoanID     string     `json:"loan_id"`
+	BookID     string     `json:"book_id"`
+	Reason     FineReason `json:"reason"`
+	Amount     uint64     `json:"amount"`
+	IssuedAt   any        `json:"issued_at"`
+	Status     FineStatus `json:"status"`
+	ResolvedAt any        `json:"resolved_at"`
+}
+
+func (f TimeFormat) fines(fines []Fine) []fineView {
+	result := make([]fineView, 0, len(fines))
+	for _, fine := range fines {
+		result = append(result, fineView{
+			ID:         fine.ID,
+			UserID:     fine.UserID,
+			LoanID:     fine.LoanID,
+			BookID:     fine.BookID,
+			Reason:     fine.Reason,
+			Amount:     fine.Amount,
+			IssuedAt:   f.formatTime(fine.IssuedAt),
+			Status:     fine.Status,
+			ResolvedAt: f.formatTime(fine.ResolvedAt),
+		})
+	}
+	return result
+}
+
+type clockStateView struct {
+	Now    any   `json:"now"`
+	Offset int64 `json:"offset"`
+}
+
+func (f TimeFormat) clockState(state ClockState) clockStateView {
+	return clockStateView{
+		Now:    f.formatTime(state.Now),
+		Offset: state.Offset / 1000,
+	}
+}
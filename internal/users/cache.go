@@ -0,0 +1,74 @@
+package users
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/cache"
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/clock"
+)
+
+// Revoker is implemented by the connections that cache the verified tokens
+type Revoker interface {
+	// RevokeToken drops the cached user of the token, so that the next verification asks the user service
+	RevokeToken(authToken string)
+
+	// RevokeAll drops all cached users
+	RevokeAll()
+}
+
+// CacheOptions configures the caching connection
+type CacheOptions struct {
+	// TTL is the time span that the user of a verified token is cached for.
+	// It bounds how long a revoked token or permission is still accepted, unless revoked explicitly
+	TTL time.Duration
+	// MaxEntries is the maximum number of cached tokens, or 0 for no limit.
+	// The least recently used ones are dropped first
+	MaxEntries int
+}
+
+// NewCachedConn returns a connection that caches the users of the tokens verified through conn.
+// Only valid tokens are cached. Concurrent verifications of the same token share
+// a single request to the user service
+func NewCachedConn(conn Connection, options CacheOptions, clock clock.Clock) *CachedConn {
+	return &CachedConn{
+		conn: conn,
+		users: cache.NewLoader[User](cache.LoaderOptions{
+			TTL:        options.TTL,
+			MaxEntries: options.MaxEntries,
+		}, clock),
+	}
+}
+
+// CachedConn is a caching decorator of Connection
+type CachedConn struct {
+	conn  Connection
+	users *cache.Loader[User]
+}
+
+func (c *CachedConn) VerifyToken(ctx context.Context, authToken string) (*User, error) {
+	return c.users.Get(ctx, tokenKey(authToken), func(ctx context.Context) (*User, error) {
+		return c.conn.VerifyToken(ctx, authToken)
+	})
+}
+
+func (c *CachedConn) RevokeToken(authToken string) {
+	c.users.Invalidate(tokenKey(authToken))
+}
+
+func (c *CachedConn) RevokeAll() {
+	c.users.InvalidateAll()
+}
+
+// Len returns the number of cached tokens, including the expired ones not dropped yet
+func (c *CachedConn) Len() int {
+	return c.users.Len()
+}
+
+// tokenKey returns the cache key of the token, so that the tokens themselves aren't kept around
+func tokenKey(authToken string) string {
+	hash := sha256.Sum256([]byte(authToken))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,216 @@
+package users_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/clock"
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/fail"
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/users"
+)
+
+// countingConn pretends to be the user service, counting the verifications of every token
+type countingConn struct {
+	mutex         sync.Mutex
+	verifications map[string]int
+	permissions   users.Permission
+	// release, if set, holds the verifications until it is closed
+	release chan struct{}
+}
+
+func newCountingConn() *countingConn {
+	return &countingConn{
+		verifications: make(map[string]int),
+		permissions:   users.PermLoanBooks,
+	}
+}
+
+func (c *countingConn) VerifyToken(ctx context.Context, authToken string) (*users.User, error) {
+	c.mutex.Lock()
+	c.verifications[authToken] += 1
+	permissions, release := c.permissions, c.release
+	c.mutex.Unlock()
+
+	if release != nil {
+		<-release
+	}
+
+	if authToken == "token-invalid" {
+		return nil, fmt.Errorf("%w: 401 Unauthorized", fail.ErrUserService)
+	}
+	return &users.User{ID: "user-of-" + authToken, Permissions: permissions}, nil
+}
+
+func (c *countingConn) count(authToken string) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.verifications[authToken]
+}
+
+func (c *countingConn) setPermissions(permissions users.Permission) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.permissions = permissions
+}
+
+func verify(t *testing.T, conn users.Connection, authToken string, wantPermissions users.Permission) {
+	t.Helper()
+
+	user, err := conn.VerifyToken(context.Background(), authToken)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := &users.User{ID: "user-of-" + authToken, Permissions: wantPermissions}
+	if diff := cmp.Diff(want, user); diff != "" {
+		t.Errorf("user mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func expectVerifications(t *testing.T, conn *countingConn, authToken string, want int) {
+	t.Helper()
+
+	if got := conn.count(authToken); got != want {
+		t.Errorf("wrong number of verifications of %q: want %d, got %d", authToken, want, got)
+	}
+}
+
+func TestCachedConn(t *testing.T) {
+	options := users.CacheOptions{
+		TTL:        30 * time.Second,
+		MaxEntries: 2,
+	}
+
+	t.Run("ttl", func(t *testing.T) {
+		conn := newCountingConn()
+		fakeClock := clock.NewFake(time.Unix(1_000_000, 0))
+		cache := users.NewCachedConn(conn, options, fakeClock)
+
+		verify(t, cache, "token-1", users.PermLoanBooks)
+		conn.setPermissions(users.PermQueryUsers)
+		fakeClock.Advance(29 * time.Second)
+		verify(t, cache, "token-1", users.PermLoanBooks)
+		expectVerifications(t, conn, "token-1", 1)
+
+		fakeClock.Advance(time.Second)
+		verify(t, cache, "token-1", users.PermQueryUsers)
+		expectVerifications(t, conn, "token-1", 2)
+	})
+
+	t.Run("copies", func(t *testing.T) {
+		conn := newCountingConn()
+		cache := users.NewCachedConn(conn, options, clock.NewFake(time.Unix(1_000_000, 0)))
+
+		user, err := cache.VerifyToken(context.Background(), "token-1")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		user.Permissions = users.Permission(0xffffffffffffffff)
+		verify(t, cache, "token-1", users.PermLoanBooks)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		conn := newCountingConn()
+		cache := users.NewCachedConn(conn, options, clock.NewFake(time.Unix(1_000_000, 0)))
+
+		for range 2 {
+			_, err := cache.VerifyToken(context.Background(), "token-invalid")
+			if !errors.Is(err, fail.ErrUserService) {
+				t.Errorf("wrong error: want %v, got %v", fail.ErrUserService, err)
+			}
+		}
+		expectVerifications(t, conn, "token-invalid", 2)
+	})
+
+	t.Run("size", func(t *testing.T) {
+		conn := newCountingConn()
+		cache := users.NewCachedConn(conn, options, clock.NewFake(time.Unix(1_000_000, 0)))
+
+		verify(t, cache, "token-1", users.PermLoanBooks)
+		verify(t, cache, "token-2", users.PermLoanBooks)
+		verify(t, cache, "token-1", users.PermLoanBooks)
+		// token-2 is the least recently used one
+		verify(t, cache, "token-3", users.PermLoanBooks)
+		if cache.Len() != 2 {
+			t.Errorf("wrong cache size: want %d, got %d", 2, cache.Len())
+		}
+
+		verify(t, cache, "token-1", users.PermLoanBooks)
+		verify(t, cache, "token-2", users.PermLoanBooks)
+		expectVerifications(t, conn, "token-1", 1)
+		expectVerifications(t, conn, "token-2", 2)
+	})
+
+	t.Run("revoke", func(t *testing.T) {
+		conn := newCountingConn()
+		cache := users.NewCachedConn(conn, options, clock.NewFake(time.Unix(1_000_000, 0)))
+
+		verify(t, cache, "token-1", users.PermLoanBooks)
+		verify(t, cache, "token-2", users.PermLoanBooks)
+		conn.setPermissions(users.PermQueryUsers)
+		cache.RevokeToken("token-1")
+		verify(t, cache, "token-1", users.PermQueryUsers)
+		verify(t, cache, "token-2", users.PermLoanBooks)
+
+		conn.setPermissions(users.PermManageUsers)
+		cache.RevokeAll()
+		verify(t, cache, "token-1", users.PermManageUsers)
+		verify(t, cache, "token-2", users.PermManageUsers)
+	})
+
+	t.Run("coalescing", func(t *testing.T) {
+		conn := newCountingConn()
+		conn.release = make(chan struct{})
+		cache := users.NewCachedConn(conn, options, clock.NewFake(time.Unix(1_000_000, 0)))
+
+		var wg sync.WaitGroup
+		for range 10 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				verify(t, cache, "token-1", users.PermLoanBooks)
+			}()
+		}
+		// Let the verifications pile up behind the first one
+		time.Sleep(50 * time.Millisecond)
+		close(conn.release)
+		wg.Wait()
+
+		expectVerifications(t, conn, "token-1", 1)
+	})
+
+	t.Run("revoked while verifying", func(t *testing.T) {
+		conn := newCountingConn()
+		conn.release = make(chan struct{})
+		cache := users.NewCachedConn(conn, options, clock.NewFake(time.Unix(1_000_000, 0)))
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			verify(t, cache, "token-1", users.PermLoanBooks)
+		}()
+		for conn.count("token-1") == 0 {
+			time.Sleep(time.Millisecond)
+		}
+
+		cache.RevokeToken("token-1")
+		conn.mutex.Lock()
+		release := conn.release
+		conn.permissions, conn.release = users.PermQueryUsers, nil
+		conn.mutex.Unlock()
+
+		// The verification started after the revocation doesn't wait for the stale one
+		verify(t, cache, "token-1", users.PermQueryUsers)
+		close(release)
+		<-done
+
+		verify(t, cache, "token-1", users.PermQueryUsers)
+		expectVerifications(t, conn, "token-1", 2)
+	})
+}
@@ -8,68 +8,95 @@ import (
 	"io"
 	"net/http"
 	"strconv"
-	"time"
 
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/clock"
 	"github.com/mipt-kp-2024-go-beer/loan-service/internal/fail"
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/httpclient"
+	"golang.org/x/sync/errgroup"
 )
 
-func NewConn(url string) Connection {
+func NewConn(url string, options httpclient.Options) Connection {
 	return &implConn{
-		url: url,
-		client: http.Client{
-			Timeout: 30 * time.Second,
-		},
+		url:    url,
+		client: httpclient.New(fail.ErrUserService, options, clock.NewSystem()),
 	}
 }
 
 type implConn struct {
 	url    string
-	client http.Client
+	client *httpclient.Client
 }
 
 func (c *implConn) VerifyToken(ctx context.Context, authToken string) (*User, error) {
-	responseID, err := c.makeRequest(ctx, "/user/id", authToken)
+	// The user service has separate endpoints for the ID and the permissions, which are asked in parallel
+	var userID string
+	var permissions Permission
+	group, groupCtx := errgroup.WithContext(ctx)
+	group.Go(func() error {
+		var err error
+		userID, err = c.fetchID(groupCtx, authToken)
+		return err
+	})
+	group.Go(func() error {
+		var err error
+		permissions, err = c.fetchPermissions(groupCtx, authToken)
+		return err
+	})
+	err := group.Wait()
 	if err != nil {
 		return nil, err
 	}
-	defer responseID.Body.Close()
 
-	var resultID struct {
+	return &User{
+		ID: userID,
+		// TODO: Populate if the user service starts providing these
+		Login:       "",
+		Name:        "",
+		Surname:     "",
+		Permissions: permissions,
+	}, nil
+}
+
+func (c *implConn) fetchID(ctx context.Context, authToken string) (string, error) {
+	response, err := c.makeRequest(ctx, "/user/id", authToken)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	var result struct {
 		ID string `json:"ID"`
 	}
-	err = json.NewDecoder(responseID.Body).Decode(&resultID)
+	err = json.NewDecoder(response.Body).Decode(&result)
 	if err != nil {
-		return nil, err
+		return "", fmt.Errorf("%w: failed to parse user ID: %w", fail.ErrUserService, err)
 	}
 
-	responsePermissions, err := c.makeRequest(ctx, "/user/permissions", authToken)
+	return result.ID, nil
+}
+
+func (c *implConn) fetchPermissions(ctx context.Context, authToken string) (Permission, error) {
+	response, err := c.makeRequest(ctx, "/user/permissions", authToken)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
-	defer responsePermissions.Body.Close()
+	defer response.Body.Close()
 
-	var resultPermissions struct {
+	var result struct {
 		// Yes, the typo is on their side, unfortunately...
 		Permissions string `json:"permissios"`
 	}
-	err = json.NewDecoder(responsePermissions.Body).Decode(&resultPermissions)
+	err = json.NewDecoder(response.Body).Decode(&result)
 	if err != nil {
-		return nil, err
+		return 0, fmt.Errorf("%w: failed to parse permissions: %w", fail.ErrUserService, err)
 	}
 
-	permissions, err := strconv.ParseUint(resultPermissions.Permissions, 10, 64)
+	permissions, err := strconv.ParseUint(result.Permissions, 10, 64)
 	if err != nil {
-		return nil, err
+		return 0, fmt.Errorf("%w: failed to parse permissions: %w", fail.ErrUserService, err)
 	}
 
-	return &User{
-		ID: resultID.ID,
-		// TODO: Populate if the user service starts providing these
-		Login:       "",
-		Name:        "",
-		Surname:     "",
-		Permissions: Permission(permissions),
-	}, nil
+	return Permission(permissions), nil
 }
 
 func (c *implConn) makeRequest(ctx context.Context, endpoint string, authToken string) (*http.Response, error) {
@@ -92,7 +119,8 @@ func (c *implConn) makeRequest(ctx context.Context, endpoint string, authToken s
 		return nil, err
 	}
 
-	response, err := c.client.Do(request)
+	// The endpoints only query the user, so they are safe to retry despite being POSTs
+	response, err := c.client.DoIdempotent(request)
 	if err != nil {
 		return nil, err
 	}
@@ -100,13 +128,18 @@ func (c *implConn) makeRequest(ctx context.Context, endpoint string, authToken s
 	if response.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(response.Body)
 		response.Body.Close()
-		return nil, fmt.Errorf(
-			"%w: %d %s %q",
-			fail.ErrUserService,
-			response.StatusCode,
-			response.Status,
-			string(body),
-		)
+
+		// A rejected token is the client's fault, not a failure of the user service
+		var sentinel error
+		switch response.StatusCode {
+		case http.StatusUnauthorized:
+			sentinel = fail.ErrUnauthorized
+		case http.StatusForbidden:
+			sentinel = fail.ErrForbidden
+		default:
+			sentinel = fail.UpstreamStatusError(fail.ErrUserService, response.StatusCode)
+		}
+		return nil, fmt.Errorf("%w: %s %q", sentinel, response.Status, string(body))
 	}
 
 	return response, nil
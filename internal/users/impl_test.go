@@ -0,0 +1,82 @@
+package users_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/fail"
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/httpclient"
+	"github.com/mipt-kp-2024-go-beer/loan-service/internal/users"
+)
+
+func TestConnVerifyToken(t *testing.T) {
+	// Both endpoints wait for each other, so the test only passes if they are called in parallel
+	var arrived sync.WaitGroup
+	arrived.Add(2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Token string `json:"token"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil || r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if request.Token == "token-parallel" {
+			arrived.Done()
+			waited := make(chan struct{})
+			go func() {
+				arrived.Wait()
+				close(waited)
+			}()
+			select {
+			case <-waited:
+			case <-time.After(5 * time.Second):
+				w.WriteHeader(http.StatusGatewayTimeout)
+				return
+			}
+		}
+		if request.Token == "token-invalid" && r.URL.Path == "/user/permissions" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/user/id":
+			_, _ = w.Write([]byte(`{"ID":"user-1"}`))
+		case "/user/permissions":
+			_, _ = w.Write([]byte(`{"permissios":"64"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	conn := users.NewConn(strings.TrimPrefix(server.URL, "http://"), httpclient.Options{Timeout: 10 * time.Second})
+
+	t.Run("parallel", func(t *testing.T) {
+		user, err := conn.VerifyToken(context.Background(), "token-parallel")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if diff := cmp.Diff(&users.User{ID: "user-1", Permissions: users.PermLoanBooks}, user); diff != "" {
+			t.Errorf("user mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := conn.VerifyToken(context.Background(), "token-invalid")
+		if !errors.Is(err, fail.ErrUnauthorized) || errors.Is(err, fail.ErrUserService) {
+			t.Errorf("wrong error: want %v, got %v", fail.ErrUnauthorized, err)
+		}
+	})
+}
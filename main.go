@@ -3,6 +3,8 @@ package main
 import (
 	"context"
 	"log"
+	"os"
+	"os/signal"
 
 	"github.com/mipt-kp-2024-go-beer/loan-service/internal/app"
 )
@@ -24,7 +26,14 @@ func main() {
 		log.Fatal(err)
 	}
 
-	if err = app.Start(); err != nil {
+	// The interrupt signal shuts the servers down gracefully, a second one kills the process
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	if err = app.Start(ctx); err != nil {
 		log.Fatal(err)
 	}
 }